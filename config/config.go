@@ -44,11 +44,12 @@ type PropertyConfig struct {
 		Expiration      int
 	}
 	Retry struct {
-		Enabled      bool
-		MaxAttempts  int
-		Strategy     string
-		InitialDelay int
-		MaxDelay     int
+		Enabled       bool
+		MaxAttempts   int
+		Strategy      string
+		InitialDelay  int
+		MaxDelay      int
+		JitterPercent int
 	}
 	TaskQueue struct {
 		ConcurrentTaskRun int
@@ -56,6 +57,66 @@ type PropertyConfig struct {
 		Delay             int
 		Expiration        int
 		Retention         int
+		UserConcurrency   int
+		BackfillAfterDays int
+	}
+	FileStore struct {
+		Backend     string
+		LocalDir    string
+		S3Endpoint  string
+		S3Region    string
+		S3Bucket    string
+		S3AccessKey string
+		S3SecretKey string
+		S3UseSSL    bool
+
+		DownloadSecret    string
+		DownloadURLExpiry int
+	}
+	RecordRetention struct {
+		PurgeAfterDays int
+	}
+	BulkImport struct {
+		MaxFiles            int
+		MaxFileSizeMB       int
+		MaxTotalSizeMB      int
+		MaxCompressionRatio int
+	}
+	DataExport struct {
+		LinkExpiryHours int
+	}
+	Erasure struct {
+		GracePeriodDays   int
+		CertificateSecret string
+	}
+	CriticalAlert struct {
+		ReescalateMinutes int
+		MaxEscalations    int
+		MaxResultAgeHours int
+	}
+	TrendAnalytics struct {
+		WindowDays           string
+		MovingAveragePoints  int
+		DriftMinPoints       int
+		DriftMinShiftPercent int
+	}
+	DigitizationReview struct {
+		Enabled              bool
+		MinConfidencePercent int
+	}
+	AliasSuggestion struct {
+		MinScorePercent int
+		MaxCandidates   int
+	}
+	Encryption struct {
+		MasterKey          string
+		MasterKeyVersion   int
+		PreviousMasterKeys string
+	}
+	AIMock struct {
+		Enabled    bool
+		Addr       string
+		FixtureDir string
 	}
 	SystemVaribale struct {
 		Score      int
@@ -114,6 +175,11 @@ func LoadConfigFromEnv() *PropertyConfig {
 	cfg.SystemVaribale.Status = getEnv("SYSTEM_REPORT_STATUS")
 	cfg.SystemVaribale.GeminiCall = getEnvAsBool("SYSTEM_GEMINI_CALL", true)
 
+	// Mock AI server Config
+	cfg.AIMock.Enabled = getEnvAsBool("AI_MOCK_ENABLED", false)
+	cfg.AIMock.Addr = getEnv("AI_MOCK_ADDR")
+	cfg.AIMock.FixtureDir = getEnv("AI_MOCK_FIXTURE_DIR")
+
 	cfg.Database.Host = getEnv("DB_HOST")
 	cfg.Database.Port = getEnv("DB_PORT")
 	cfg.Database.DBName = getEnv("DB_NAME")
@@ -136,6 +202,7 @@ func LoadConfigFromEnv() *PropertyConfig {
 	cfg.Retry.Strategy = getEnv("RETRY_BACKOFF_STRATEGY")
 	cfg.Retry.InitialDelay = getEnvAsInt("RETRY_INITIAL_DELAY_SECONDS", 5)
 	cfg.Retry.MaxDelay = getEnvAsInt("RETRY_MAX_DELAY_SECONDS", 300)
+	cfg.Retry.JitterPercent = getEnvAsInt("RETRY_JITTER_PERCENT", 20)
 
 	// TaskQueue Config
 	cfg.TaskQueue.ConcurrentTaskRun = getEnvAsInt("TASK_CONCURRENT_RUN_COUNT", 50)
@@ -143,6 +210,44 @@ func LoadConfigFromEnv() *PropertyConfig {
 	cfg.TaskQueue.Delay = getEnvAsInt("TASK_PROCESS_DELAY_SECONDS", 5)
 	cfg.TaskQueue.Expiration = getEnvAsInt("TASK_QUEUE_EXPIRATION", 0)
 	cfg.TaskQueue.Retention = getEnvAsInt("TASK_QUEUE_RETENTION", 86400)
+	cfg.TaskQueue.UserConcurrency = getEnvAsInt("TASK_USER_CONCURRENCY", 3)
+	cfg.TaskQueue.BackfillAfterDays = getEnvAsInt("TASK_BACKFILL_AFTER_DAYS", 30)
+
+	// File store Config
+	cfg.FileStore.Backend = getEnv("FILE_STORE_BACKEND")
+	cfg.FileStore.LocalDir = getEnv("FILE_STORE_LOCAL_DIR")
+	cfg.FileStore.S3Endpoint = getEnv("FILE_STORE_S3_ENDPOINT")
+	cfg.FileStore.S3Region = getEnv("FILE_STORE_S3_REGION")
+	cfg.FileStore.S3Bucket = getEnv("FILE_STORE_S3_BUCKET")
+	cfg.FileStore.S3AccessKey = getEnv("FILE_STORE_S3_ACCESS_KEY")
+	cfg.FileStore.S3SecretKey = getEnv("FILE_STORE_S3_SECRET_KEY")
+	cfg.FileStore.S3UseSSL = getEnvAsBool("FILE_STORE_S3_USE_SSL", true)
+	cfg.FileStore.DownloadSecret = getEnv("FILE_DOWNLOAD_SECRET")
+	cfg.FileStore.DownloadURLExpiry = getEnvAsInt("FILE_DOWNLOAD_URL_EXPIRY_SECONDS", 900)
+	cfg.RecordRetention.PurgeAfterDays = getEnvAsInt("DELETED_RECORD_RETENTION_DAYS", 30)
+	cfg.BulkImport.MaxFiles = getEnvAsInt("ZIP_IMPORT_MAX_FILES", 200)
+	cfg.BulkImport.MaxFileSizeMB = getEnvAsInt("ZIP_IMPORT_MAX_FILE_SIZE_MB", 25)
+	cfg.BulkImport.MaxTotalSizeMB = getEnvAsInt("ZIP_IMPORT_MAX_TOTAL_SIZE_MB", 500)
+	cfg.BulkImport.MaxCompressionRatio = getEnvAsInt("ZIP_IMPORT_MAX_COMPRESSION_RATIO", 100)
+	cfg.DataExport.LinkExpiryHours = getEnvAsInt("DATA_EXPORT_LINK_EXPIRY_HOURS", 72)
+	cfg.Erasure.GracePeriodDays = getEnvAsInt("ERASURE_GRACE_PERIOD_DAYS", 30)
+	cfg.Erasure.CertificateSecret = getEnv("ERASURE_CERTIFICATE_SECRET")
+	cfg.CriticalAlert.ReescalateMinutes = getEnvAsInt("CRITICAL_ALERT_REESCALATE_MINUTES", 15)
+	cfg.CriticalAlert.MaxEscalations = getEnvAsInt("CRITICAL_ALERT_MAX_ESCALATIONS", 3)
+	cfg.CriticalAlert.MaxResultAgeHours = getEnvAsInt("CRITICAL_ALERT_MAX_RESULT_AGE_HOURS", 168)
+	cfg.TrendAnalytics.WindowDays = getEnv("TREND_WINDOW_DAYS")
+	cfg.TrendAnalytics.MovingAveragePoints = getEnvAsInt("TREND_MOVING_AVERAGE_POINTS", 3)
+	cfg.TrendAnalytics.DriftMinPoints = getEnvAsInt("TREND_DRIFT_MIN_POINTS", 3)
+	cfg.TrendAnalytics.DriftMinShiftPercent = getEnvAsInt("TREND_DRIFT_MIN_SHIFT_PERCENT", 20)
+	cfg.DigitizationReview.Enabled = getEnvAsBool("DIGITIZATION_REVIEW_ENABLED", true)
+	cfg.DigitizationReview.MinConfidencePercent = getEnvAsInt("DIGITIZATION_REVIEW_MIN_CONFIDENCE_PERCENT", 80)
+	cfg.AliasSuggestion.MinScorePercent = getEnvAsInt("ALIAS_SUGGESTION_MIN_SCORE_PERCENT", 60)
+	cfg.AliasSuggestion.MaxCandidates = getEnvAsInt("ALIAS_SUGGESTION_MAX_CANDIDATES", 3)
+
+	// Record encryption Config
+	cfg.Encryption.MasterKey = getEnv("RECORD_MASTER_KEY")
+	cfg.Encryption.MasterKeyVersion = getEnvAsInt("RECORD_MASTER_KEY_VERSION", 1)
+	cfg.Encryption.PreviousMasterKeys = getEnv("RECORD_PREVIOUS_MASTER_KEYS")
 
 	// API Endpoints URLS
 	cfg.ApiURL.RedisURL = getEnv("REDIS_ADDR")
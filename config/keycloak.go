@@ -12,8 +12,9 @@ import (
 )
 
 var (
-	AsynqClient *asynq.Client
-	RedisClient *redis.Client
+	AsynqClient    *asynq.Client
+	AsynqInspector *asynq.Inspector
+	RedisClient    *redis.Client
 )
 
 var (
@@ -30,6 +31,10 @@ func InitRedisAndAsynq() {
 	AsynqClient = asynq.NewClient(asynq.RedisClientOpt{
 		Addr: os.Getenv("REDIS_ADDR"),
 	})
+
+	AsynqInspector = asynq.NewInspector(asynq.RedisClientOpt{
+		Addr: os.Getenv("REDIS_ADDR"),
+	})
 }
 
 var (
@@ -108,6 +108,13 @@ const (
 	DiagnosticComponents                 = "/diagnostic-components"
 	DiagnosticComponent                  = "/diagnostic-component"
 	SingleDiagnosticComponent            = "/diagnostic-component/:diagnosticComponentId"
+	DiagnosticComponentUnits             = "/diagnostic-component/:diagnosticComponentId/units"
+	DeleteDiagnosticComponentUnit        = "/diagnostic-component-unit/:component_unit_id"
+	DiagnosticCriticalThreshold          = "/diagnostic-component/:diagnosticComponentId/critical-threshold"
+	ComponentAliasSuggestions            = "/diagnostic-component/alias-suggestions"
+	AcceptComponentAliasSuggestions      = "/diagnostic-component/alias-suggestions/accept"
+	LoincCodes                           = "/loinc-codes"
+	LoincCode                            = "/loinc-code/:loinc_code"
 	DiagnosticTestComponentMappings      = "/diagnostic-test-component-mappings"
 	DiagnosticTestComponentMapping       = "/diagnostic-test-component-mapping"
 	DeleteDiagnosticTestComponentMapping = "/delete-diagnostic-test-component-mapping"
@@ -179,6 +186,7 @@ const (
 	ViewRefRange      = "/view-range/:test_reference_range_id"
 	ViewAllRefRange   = "/view-all-range"
 	ViewAuditRefRange = "/view-audit-range"
+	ReflagRefRange    = "/reflag-range"
 
 	SubscriptionEnabledStatus = "/api/subscription/status"
 	UpdateSubscriptionStatus  = "/subscription/update-status"
@@ -246,6 +254,38 @@ const (
 	ABDMVerifyOTP           = "/abha/verify-otp"
 	ABDMVerifyUser          = "/abha/verify-user"
 	ABDMUserAddress         = "/abha/abha-address"
+	RecordDownload          = "/record/download/:record_id"
+	RecordThumbnail         = "/record/thumbnail/:record_id"
+	RecordVersions          = "/record/versions/:record_id"
+	RecordSearch            = "/record/search"
+	ImportRecordsZip        = "/record/import-zip"
+	StartDataExport         = "/record/export"
+	DataExportInfo          = "/record/export/:export_id"
+	DataExportDownload      = "/record/export/download/:export_id"
+	RestoreRecord           = "/record/restore/:record_id"
+	PurgeRecord             = "/record/purge/:record_id"
+	MigrateRecordURL        = "/migrate-record-url"
+	RewrapRecordKeys        = "/rewrap-record-keys"
+	ErasurePreview          = "/account/erasure/preview"
+	RequestErasure          = "/account/erasure"
+	ErasureRequestByID      = "/account/erasure/:erasure_id"
+	VerifyErasureChain      = "/account/erasure-certificates/verify"
+	CriticalAlerts          = "/critical-alerts"
+	AcknowledgeCritical     = "/critical-alerts/:alert_id/acknowledge"
+	ReportResults           = "/report/:report_id/results"
+	ReportResult            = "/report/result/:result_id"
+	ReportResultAudit       = "/report/result/:result_id/audit"
+	ReviewQueue             = "/report/review-queue"
+	ApproveReviewItem       = "/report/review-queue/:review_id/approve"
+	RejectReviewItem        = "/report/review-queue/:review_id/reject"
+	CompareReports          = "/report/compare"
+	ExportReportComparison  = "/report/compare/export"
+	DeadLetters             = "/digitization/dead-letters"
+	ReplayDeadLetters       = "/digitization/dead-letters/replay"
+	DiscardDeadLetters      = "/digitization/dead-letters/discard"
+	ScrubDeadLetters        = "/digitization/dead-letters/scrub"
+	RetryDigitization       = "/record/retry-digitization/:record_id"
+	DigitizationQueueStatus = "/digitization/queue-status"
 )
 
 const (
@@ -258,6 +298,110 @@ const (
 	DELETE              = "Delete"
 	SUBSCRIPTIONENABLED = "subscription_enabled"
 	Running             = "running"
+	Expired             = "expired"
+)
+
+// Where the reference range applied to a result came from, and the flag it gives the result.
+const (
+	RangeSourcePatientOverride = "patient_override"
+	RangeSourceMaster          = "master"
+	RangeSourceNone            = "none"
+	RangeFlagLow               = "low"
+	RangeFlagNormal            = "normal"
+	RangeFlagHigh              = "high"
+	RangeFlagAbnormal          = "abnormal"
+)
+
+// Critical result alert states.
+const (
+	CriticalAlertOpen         = "open"
+	CriticalAlertAcknowledged = "acknowledged"
+	CriticalAlertResolved     = "resolved"
+)
+
+// Where a stored result value came from.
+const (
+	ResultSourceAI     = "ai"
+	ResultSourceManual = "manual"
+	ResultSourceDevice = "device"
+	ResultSourceABDM   = "abdm"
+)
+
+// Why an extracted result was parked for review, and the states of a review item.
+const (
+	ReviewReasonUnmapped      = "unmapped"
+	ReviewReasonLowConfidence = "low_confidence"
+	ReviewPending             = "pending"
+	ReviewApproved            = "approved"
+	ReviewRejected            = "rejected"
+)
+
+// Directions of a sustained drift toward the reference range bounds.
+const (
+	TrendDriftTowardHigh = "toward_high"
+	TrendDriftTowardLow  = "toward_low"
+)
+
+// Asynq task types of the digitization worker.
+const (
+	TaskDigitizeRecord  = "digitize:record"
+	TaskCheckDocType    = "check:doctype"
+	TaskBuildDataExport = "export:patient"
+)
+
+// Asynq queues. Digitization is split by priority and paused while the AI service is down. Doc
+// type checks stay on the default queue with previews, since an upload waits on their answer.
+const (
+	QueueDigitizationHigh   = "digitization_high"
+	QueueDigitizationMedium = "digitization_medium"
+	QueueDigitizationLow    = "digitization_low"
+	QueueDefault            = "default"
+)
+
+// Digitization priorities: manual uploads are high, app syncs medium and historical backfill
+// (zip imports and synced mail older than TASK_BACKFILL_AFTER_DAYS) low.
+const (
+	PriorityHigh   = "high"
+	PriorityMedium = "medium"
+	PriorityLow    = "low"
+)
+
+// Retry backoff strategies and the classes a task error falls in. Permanent errors are not
+// retried.
+const (
+	RetryExponential = "exponential"
+	RetryLinear      = "linear"
+	RetryFixed       = "fixed"
+
+	ErrorClassTransient = "transient"
+	ErrorClassPermanent = "permanent"
+)
+
+// States of a dead-letter entry. A retrying entry still has asynq attempts left; a dead one
+// has none and waits for a replay or a discard.
+const (
+	DeadLetterRetrying  = "retrying"
+	DeadLetterDead      = "dead"
+	DeadLetterReplayed  = "replayed"
+	DeadLetterResolved  = "resolved"
+	DeadLetterDiscarded = "discarded"
+)
+
+// How a component changed between two compared reports.
+const (
+	ComparisonNew       = "new"
+	ComparisonMissing   = "missing"
+	ComparisonChanged   = "changed"
+	ComparisonUnchanged = "unchanged"
+)
+
+// Right-to-erasure request states and the action taken on each table.
+const (
+	ErasureScheduled = "scheduled"
+	ErasureCancelled = "cancelled"
+	ErasureCompleted = "completed"
+	ErasureDelete    = "delete"
+	ErasureAnonymize = "anonymize"
 )
 
 const (
@@ -294,6 +438,19 @@ const (
 	SCANS            RecordCategory = "scans"
 )
 
+const (
+	UploadDestinationLocal      = "LocalServer"
+	UploadDestinationS3         = "S3"
+	UploadDestinationDigiLocker = "DigiLocker"
+)
+
+// Preview statuses of a record thumbnail: rendered from the file itself, or a generated
+// placeholder page for PDFs without an image to show.
+const (
+	PreviewRendered    = "rendered"
+	PreviewPlaceholder = "placeholder"
+)
+
 type RecordSubCategory string
 
 const (
@@ -365,6 +522,11 @@ const (
 	CallAIService              ProcessStep = "call_ai_service"
 	MatchingReport             ProcessStep = "matching_report_name_with_self_or_relative_name"
 	CheckReportDuplication     ProcessStep = "checking_report_duplication_by_collection_date_and_test_component"
+	ProcessRewrapDataKeys      ProcessStep = "rewrap_data_keys"
+	CheckContentDuplication    ProcessStep = "checking_record_content_duplication"
+	ExtractZipArchive          ProcessStep = "extract_zip_archive"
+	CollectExportData          ProcessStep = "collect_export_data"
+	BuildExportArchive         ProcessStep = "build_export_archive"
 )
 
 type ProcessStepStatusMessage string
@@ -404,6 +566,17 @@ const (
 	CheckReportDuplicationMsg         ProcessStepStatusMessage = "Checking for report duplication based on collection date and test component name to determine if it already exists in a previous report"
 	ReportDuplicationSuccess          ProcessStepStatusMessage = "Report duplication check success"
 	ManualRecordUploadDigitizationMsg ProcessStepStatusMessage = "Manual record upload  and digitization process start"
+	DuplicateRecordLinked             ProcessStepStatusMessage = "Same document already exists for this patient, linked to the existing record instead of digitizing again"
+	RewrapDataKeysMsg                 ProcessStepStatusMessage = "Re-wrapping record data keys with the current master key"
+	RewrapDataKeysSuccess             ProcessStepStatusMessage = "Record data keys re-wrapped successfully"
+	RewrapDataKeysFailed              ProcessStepStatusMessage = "Failed to re-wrap record data keys"
+	ExtractZipArchiveMsg              ProcessStepStatusMessage = "Extracting files from the uploaded archive"
+	ZipImportCompleted                ProcessStepStatusMessage = "Archive import completed"
+	ZipImportFailed                   ProcessStepStatusMessage = "Archive import failed"
+	CollectExportDataMsg              ProcessStepStatusMessage = "Collecting profile, prescriptions, diagnostic results and records for export"
+	BuildExportArchiveMsg             ProcessStepStatusMessage = "Building the export archive"
+	DataExportReady                   ProcessStepStatusMessage = "Your data export is ready to download"
+	DataExportFailed                  ProcessStepStatusMessage = "Failed to export patient data"
 )
 
 type ProcessType string
@@ -412,12 +585,16 @@ const (
 	GmailSync          ProcessType = "gmail_sync"
 	DocsDigitization   ProcessType = "docs_digitization"
 	ManualRecordUpload ProcessType = "manual_record_upload"
+	RecordKeyRewrap    ProcessType = "record_key_rewrap"
+	BulkRecordImport   ProcessType = "bulk_record_import"
+	PatientDataExport  ProcessType = "patient_data_export"
 )
 
 type EntityType string
 
 const (
-	MedicalRecordEntity EntityType = "tbl_medical_record"
+	MedicalRecordEntity     EntityType = "tbl_medical_record"
+	PatientDataExportEntity EntityType = "tbl_patient_data_export"
 )
 
 type UserRole string
@@ -5,6 +5,7 @@ import (
 	"biostat/models"
 	"biostat/service"
 	"biostat/utils"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -14,41 +15,44 @@ import (
 )
 
 type MasterController struct {
-	allergyService      service.AllergyService
-	diseaseService      service.DiseaseService
-	causeService        service.CauseService
-	symptomService      service.SymptomService
-	medicationService   service.MedicationService
-	dietService         service.DietService
-	exerciseService     service.ExerciseService
-	diagnosticService   service.DiagnosticService
-	roleService         service.RoleService
-	supportGroupService service.SupportGroupService
-	hospitalService     service.HospitalService
-	userService         service.UserService
-	subscriptionService service.SubscriptionService
-	notificationService service.NotificationService
+	allergyService       service.AllergyService
+	diseaseService       service.DiseaseService
+	causeService         service.CauseService
+	symptomService       service.SymptomService
+	medicationService    service.MedicationService
+	dietService          service.DietService
+	exerciseService      service.ExerciseService
+	diagnosticService    service.DiagnosticService
+	roleService          service.RoleService
+	supportGroupService  service.SupportGroupService
+	hospitalService      service.HospitalService
+	userService          service.UserService
+	subscriptionService  service.SubscriptionService
+	notificationService  service.NotificationService
+	criticalAlertService service.CriticalAlertService
 }
 
 func NewMasterController(allergyService service.AllergyService, diseaseService service.DiseaseService,
 	causeService service.CauseService, symptomService service.SymptomService, medicationService service.MedicationService,
 	dietService service.DietService, exerciseService service.ExerciseService, diagnosticService service.DiagnosticService,
 	roleService service.RoleService, supportGroupService service.SupportGroupService, hospitalService service.HospitalService,
-	userService service.UserService, subscriptionService service.SubscriptionService, notificationService service.NotificationService) *MasterController {
+	userService service.UserService, subscriptionService service.SubscriptionService, notificationService service.NotificationService,
+	criticalAlertService service.CriticalAlertService) *MasterController {
 	return &MasterController{allergyService: allergyService,
-		diseaseService:      diseaseService,
-		causeService:        causeService,
-		symptomService:      symptomService,
-		medicationService:   medicationService,
-		dietService:         dietService,
-		exerciseService:     exerciseService,
-		diagnosticService:   diagnosticService,
-		roleService:         roleService,
-		supportGroupService: supportGroupService,
-		hospitalService:     hospitalService,
-		userService:         userService,
-		subscriptionService: subscriptionService,
-		notificationService: notificationService,
+		diseaseService:       diseaseService,
+		causeService:         causeService,
+		symptomService:       symptomService,
+		medicationService:    medicationService,
+		dietService:          dietService,
+		exerciseService:      exerciseService,
+		diagnosticService:    diagnosticService,
+		roleService:          roleService,
+		supportGroupService:  supportGroupService,
+		hospitalService:      hospitalService,
+		userService:          userService,
+		subscriptionService:  subscriptionService,
+		notificationService:  notificationService,
+		criticalAlertService: criticalAlertService,
 	}
 }
 
@@ -1521,6 +1525,148 @@ func (mc *MasterController) GetSingleDiagnosticComponent(c *gin.Context) {
 	models.SuccessResponse(c, constant.Success, http.StatusOK, "Diagnostic component retrieved successfully", diagnosticComponent, nil, nil)
 }
 
+func (mc *MasterController) GetDiagnosticComponentUnits(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	diagnosticComponentId := utils.GetParamAsInt(c, "diagnosticComponentId")
+	if diagnosticComponentId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "DiagnosticComponentId is required", nil, nil)
+		return
+	}
+	units, err := mc.diagnosticService.GetComponentUnits(uint64(diagnosticComponentId))
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to retrieve component units", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Component units retrieved successfully", units, nil, nil)
+}
+
+func (mc *MasterController) SaveDiagnosticComponentUnit(c *gin.Context) {
+	authUserId, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	diagnosticComponentId := utils.GetParamAsInt(c, "diagnosticComponentId")
+	if diagnosticComponentId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "DiagnosticComponentId is required", nil, nil)
+		return
+	}
+	var unit models.DiagnosticTestComponentUnit
+	if err := c.ShouldBindJSON(&unit); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	unit.ComponentUnitId = 0
+	unit.DiagnosticTestComponentId = uint64(diagnosticComponentId)
+	unit.CreatedBy = authUserId
+	if err := mc.diagnosticService.SaveComponentUnit(&unit); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Failed to save component unit", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Component unit saved successfully", unit, nil, nil)
+}
+
+func (mc *MasterController) DeleteDiagnosticComponentUnit(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	componentUnitId := utils.GetParamAsInt(c, "component_unit_id")
+	if componentUnitId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Component unit id is required", nil, nil)
+		return
+	}
+	if err := mc.diagnosticService.DeleteComponentUnit(uint64(componentUnitId)); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusNotFound, "Failed to delete component unit", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Component unit deleted successfully", nil, nil, nil)
+}
+
+func (mc *MasterController) GetCriticalThreshold(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	diagnosticComponentId := utils.GetParamAsInt(c, "diagnosticComponentId")
+	if diagnosticComponentId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "DiagnosticComponentId is required", nil, nil)
+		return
+	}
+	threshold, err := mc.criticalAlertService.GetCriticalThreshold(uint64(diagnosticComponentId))
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusNotFound, "Critical threshold not found", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Critical threshold retrieved successfully", threshold, nil, nil)
+}
+
+func (mc *MasterController) SaveCriticalThreshold(c *gin.Context) {
+	authUserId, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	diagnosticComponentId := utils.GetParamAsInt(c, "diagnosticComponentId")
+	if diagnosticComponentId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "DiagnosticComponentId is required", nil, nil)
+		return
+	}
+	threshold := models.DiagnosticCriticalThreshold{IsActive: true}
+	if err := c.ShouldBindJSON(&threshold); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	threshold.ThresholdId = 0
+	threshold.DiagnosticTestComponentId = uint64(diagnosticComponentId)
+	threshold.CreatedBy = authUserId
+	if err := mc.criticalAlertService.SaveCriticalThreshold(&threshold); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Failed to save critical threshold", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Critical threshold saved successfully", threshold, nil, nil)
+}
+
+func (mc *MasterController) DeleteCriticalThreshold(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	diagnosticComponentId := utils.GetParamAsInt(c, "diagnosticComponentId")
+	if diagnosticComponentId == 0 {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "DiagnosticComponentId is required", nil, nil)
+		return
+	}
+	if err := mc.criticalAlertService.DeleteCriticalThreshold(uint64(diagnosticComponentId)); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusNotFound, "Failed to delete critical threshold", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Critical threshold deleted successfully", nil, nil, nil)
+}
+
 func (mc *MasterController) GetAllDiagnosticTestComponentMappings(c *gin.Context) {
 	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
 	if err != nil {
@@ -2350,6 +2496,41 @@ func (mc *MasterController) DeleteTestReferenceRange(c *gin.Context) {
 	models.SuccessResponse(c, constant.Success, http.StatusOK, "Reference range deleted successfully.", nil, nil, nil)
 }
 
+func (mc *MasterController) ReflagTestResults(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	var componentId, patientId *uint64
+	if value := c.Query("diagnostic_test_component_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Invalid diagnostic_test_component_id", nil, err)
+			return
+		}
+		componentId = &id
+	}
+	if value := c.Query("patient_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Invalid patient_id", nil, err)
+			return
+		}
+		patientId = &id
+	}
+	changed, err := mc.diagnosticService.ReflagResults(componentId, patientId)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Error re-flagging results", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Results re-flagged successfully.", map[string]interface{}{"updated_results": changed}, nil, nil)
+}
+
 func (mc *MasterController) ViewTestReferenceRange(c *gin.Context) {
 	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
 	if err != nil {
@@ -2536,3 +2717,79 @@ func (mc *MasterController) CreateUsersOnMail(ctx *gin.Context) {
 	}
 	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "success", nil, nil, nil)
 }
+
+func (mc *MasterController) GetComponentAliasSuggestions(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	suggestions, err := mc.diagnosticService.GetComponentAliasSuggestions()
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to retrieve alias suggestions", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Alias suggestions retrieved successfully", suggestions, nil, nil)
+}
+
+func (mc *MasterController) AcceptComponentAliasSuggestions(c *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(c, string(constant.Admin)) {
+		models.ErrorResponse(c, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	reqUserID, err := mc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	var req models.AcceptAliasSuggestionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	results, err := mc.diagnosticService.AcceptComponentAliasSuggestions(reqUserID, req.Suggestions)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to accept alias suggestions", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "Alias suggestions processed", results, nil, nil)
+}
+
+func (mc *MasterController) SearchLoincCodes(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	page, limit, offset := utils.GetPaginationParams(c)
+	codes, totalRecords, err := mc.diagnosticService.SearchLoincCodes(c.Query("search"), limit, offset)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to search LOINC codes", nil, err)
+		return
+	}
+	pagination := utils.GetPagination(limit, page, offset, totalRecords)
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "LOINC codes retrieved successfully", codes, pagination, nil)
+}
+
+func (mc *MasterController) GetLoincCode(c *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(c, mc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	code, err := mc.diagnosticService.GetLoincCodeDetail(c.Param("loinc_code"))
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusNotFound, "LOINC code not found", nil, err)
+		return
+	}
+	models.SuccessResponse(c, constant.Success, http.StatusOK, "LOINC code retrieved successfully", code, nil, nil)
+}
@@ -54,6 +54,11 @@ type PatientController struct {
 	processStatusService service.ProcessStatusService
 	gmailSyncService     service.GmailSyncService
 	abdmService          service.ABDMService
+	patientExportService service.PatientExportService
+	erasureService       service.ErasureService
+	criticalAlertService service.CriticalAlertService
+	deadLetterService    service.DeadLetterService
+	taskQueueService     service.TaskQueueService
 }
 
 func NewPatientController(patientService service.PatientService, dietService service.DietService,
@@ -63,7 +68,9 @@ func NewPatientController(patientService service.PatientService, dietService ser
 	apiService service.ApiService, diseaseService service.DiseaseService, smsService service.SmsService,
 	emailService service.EmailService, orderService service.OrderService, notificationService service.NotificationService,
 	authService auth.AuthService, roleService service.RoleService, permissionService service.PermissionService,
-	subscriptionService service.SubscriptionService, processStatusService service.ProcessStatusService, gmailSyncService service.GmailSyncService, abdmService service.ABDMService) *PatientController {
+	subscriptionService service.SubscriptionService, processStatusService service.ProcessStatusService, gmailSyncService service.GmailSyncService, abdmService service.ABDMService,
+	patientExportService service.PatientExportService, erasureService service.ErasureService, criticalAlertService service.CriticalAlertService,
+	deadLetterService service.DeadLetterService, taskQueueService service.TaskQueueService) *PatientController {
 	return &PatientController{patientService: patientService, dietService: dietService,
 		allergyService: allergyService, medicalRecordService: medicalRecordService,
 		medicationService: medicationService, appointmentService: appointmentService,
@@ -82,6 +89,11 @@ func NewPatientController(patientService service.PatientService, dietService ser
 		processStatusService: processStatusService,
 		gmailSyncService:     gmailSyncService,
 		abdmService:          abdmService,
+		patientExportService: patientExportService,
+		erasureService:       erasureService,
+		criticalAlertService: criticalAlertService,
+		deadLetterService:    deadLetterService,
+		taskQueueService:     taskQueueService,
 	}
 }
 
@@ -302,7 +314,12 @@ func (pc *PatientController) GetDiagnosticResults(c *gin.Context) {
 }
 
 func (pc *PatientController) GetPatientDiagnosticReportResult(c *gin.Context) {
-	_, user_id, _, err := utils.GetUserIDFromContext(c, pc.userService.GetUserIdBySUB)
+	sub, user_id, _, err := utils.GetUserIDFromContext(c, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
 	if err != nil {
 		models.ErrorResponse(c, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
 		return
@@ -319,7 +336,7 @@ func (pc *PatientController) GetPatientDiagnosticReportResult(c *gin.Context) {
 		// return
 	}
 	page, limit, offset := utils.GetPaginationParams(c)
-	results, totalRecords, err := pc.patientService.GetPatientDiagnosticReportResult(user.UserId, filter, limit, offset)
+	results, totalRecords, err := pc.patientService.GetPatientDiagnosticReportResult(user.UserId, reqUserID, filter, limit, offset)
 	if err != nil {
 		models.ErrorResponse(c, constant.Failure, http.StatusNotFound, "Failed to fetch diagnostic results", nil, err)
 		return
@@ -388,7 +405,7 @@ func (pc *PatientController) ExportDiagnosticResultsExcel(c *gin.Context) {
 		// return
 	}
 
-	data, _, err := pc.patientService.GetPatientDiagnosticReportResult(user.UserId, filter, 1000, 0)
+	data, _, err := pc.patientService.GetPatientDiagnosticReportResult(user.UserId, user.UserId, filter, 1000, 0)
 	if err != nil {
 		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to generate report data", nil, err)
 		return
@@ -1024,12 +1041,12 @@ func (c *PatientController) GetAllMedicalRecord(ctx *gin.Context) {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
 		return
 	}
+	reqUserID, err := c.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
 	if isDelegate {
-		reqUserID, err := c.userService.GetUserIdBySUB(sub)
-		if err != nil {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
-			return
-		}
 		err = c.patientService.CanContinue(patientId, reqUserID, constant.PermissionViewHealth)
 		if err != nil {
 			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionViewMedicalRecord), nil, err)
@@ -1043,97 +1060,793 @@ func (c *PatientController) GetAllMedicalRecord(ctx *gin.Context) {
 	if queryParamErr != nil {
 		isDeleted = 0
 	}
-	var data []models.MedicalRecordResponseRes
-	var total int64
-	var counts map[string]int64
-	var fetchErr error
-	if category == string(constant.MEDICATION) {
-		data, total, counts, fetchErr = c.medicalRecordService.GetPrecription(patientId, category, tag, limit, offset, isDeleted)
-		if fetchErr != nil {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, fetchErr)
-			return
-		}
-	} else {
-		data, total, counts, fetchErr = c.medicalRecordService.GetMedicalRecords(patientId, category, tag, limit, offset, isDeleted)
-		if fetchErr != nil {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, fetchErr)
-			return
-		}
+	var data []models.MedicalRecordResponseRes
+	var total int64
+	var counts map[string]int64
+	var fetchErr error
+	if category == string(constant.MEDICATION) {
+		data, total, counts, fetchErr = c.medicalRecordService.GetPrecription(patientId, reqUserID, category, tag, limit, offset, isDeleted)
+		if fetchErr != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, fetchErr)
+			return
+		}
+	} else {
+		data, total, counts, fetchErr = c.medicalRecordService.GetMedicalRecords(patientId, reqUserID, category, tag, limit, offset, isDeleted)
+		if fetchErr != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, fetchErr)
+			return
+		}
+	}
+	pagination := utils.GetPagination(limit, page, offset, total)
+	message := "Data not found"
+	if len(data) > 0 {
+		message = "Data retrieved successfully"
+	}
+	responseData := map[string]interface{}{
+		"records": data,
+		"counts":  counts,
+		"total":   total,
+		"hasMore": (int64(offset+limit) < total),
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, responseData, pagination, nil)
+}
+
+func (c *PatientController) GetDiagnosticLabReportName(ctx *gin.Context) {
+	_, patientId, _, err := utils.GetUserIDFromContext(ctx, c.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	data, err := c.diagnosticService.GetDiagnosticLabReportName(patientId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Lab report name fetched.", data, nil, nil)
+}
+
+func (pc *PatientController) CreateTblMedicalRecord(ctx *gin.Context) {
+	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if isDelegate {
+		reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+			return
+		}
+		err = pc.patientService.CanContinue(userId, reqUserID, constant.PermissionUploadReport)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, err)
+			return
+		}
+	} else {
+		canAccess := pc.patientService.CanAccessAPI(userId, []string{string(constant.MappingTypeR), string(constant.MappingTypeHOF), string(constant.MappingTypeS)})
+		if !canAccess {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, errors.New("You need subscription for uploading own records"))
+			return
+		}
+	}
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, "Please provid file to save", nil, errors.New("Error while uploading document"))
+		return
+	}
+	form, _ := ctx.MultipartForm()
+	attachments := form.File["attachments"]
+	uploadSource := ctx.PostForm("upload_source")
+	description := ctx.PostForm("description")
+	recordCategory := ctx.PostForm("record_category")
+	recordSubCategory := ctx.PostForm("record_sub_category")
+	tags := ctx.PostForm("tags")
+	data, err := pc.medicalRecordService.CreateTblMedicalRecord(userId, authUserId, file, header, uploadSource, description, recordCategory, recordSubCategory, attachments, tags)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to create record", nil, err)
+		return
+	}
+	message := "Your record has been created successfully. Digitization is in progress and should complete within 4–5 minutes."
+	if recordCategory == string(constant.OTHER) || recordCategory == string(constant.INSURANCE) || recordCategory == string(constant.VACCINATION) || recordCategory == string(constant.DISCHARGESUMMARY) || recordCategory == string(constant.INVOICE) || recordCategory == string(constant.NONMEDICAL) || recordCategory == string(constant.SCANS) {
+		message = "Record saved successfully"
+	}
+	if data.IsDuplicate {
+		message = "This document was already uploaded, linked to the existing record"
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, data, nil, nil)
+}
+
+func (pc *PatientController) ImportMedicalRecordsZip(ctx *gin.Context) {
+	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if isDelegate {
+		reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+			return
+		}
+		err = pc.patientService.CanContinue(userId, reqUserID, constant.PermissionUploadReport)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, err)
+			return
+		}
+	} else {
+		canAccess := pc.patientService.CanAccessAPI(userId, []string{string(constant.MappingTypeR), string(constant.MappingTypeHOF), string(constant.MappingTypeS)})
+		if !canAccess {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, errors.New("You need subscription for uploading own records"))
+			return
+		}
+	}
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Please provide a zip file to import", nil, err)
+		return
+	}
+	defer file.Close()
+	if !strings.EqualFold(filepath.Ext(header.Filename), ".zip") {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Only .zip archives can be imported", nil, errors.New("invalid archive type"))
+		return
+	}
+	processID, err := pc.medicalRecordService.ImportMedicalRecordsZip(userId, authUserId, file, header, ctx.PostForm("upload_source"), ctx.PostForm("description"),
+		ctx.PostForm("record_category"), ctx.PostForm("record_sub_category"), ctx.PostForm("tags"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to import archive", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusAccepted, "Archive import started", map[string]interface{}{"process_id": processID}, nil, nil)
+}
+
+func (pc *PatientController) StartPatientDataExport(ctx *gin.Context) {
+	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	if isDelegate {
+		err = pc.patientService.CanContinue(userId, reqUserID, constant.PermissionViewHealth)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionViewMedicalRecord), nil, err)
+			return
+		}
+	}
+	export, err := pc.patientExportService.StartPatientDataExport(userId, reqUserID)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to start data export", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusAccepted, "Data export started, you will be notified when it is ready",
+		map[string]interface{}{"process_id": export.ExportId, "export_id": export.ExportId}, nil, nil)
+}
+
+func (pc *PatientController) GetPatientDataExport(ctx *gin.Context) {
+	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	exportId, err := uuid.Parse(ctx.Param("export_id"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid export id", nil, err)
+		return
+	}
+	if isDelegate {
+		reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+			return
+		}
+		err = pc.patientService.CanContinue(userId, reqUserID, constant.PermissionViewHealth)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionViewMedicalRecord), nil, err)
+			return
+		}
+	}
+	export, err := pc.patientExportService.GetPatientDataExport(exportId, userId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusNotFound, "Data export not found", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Data export fetched successfully", export, nil, nil)
+}
+
+// erasureSubject returns the account an erasure endpoint acts on: the caller's own account,
+// or for admins the user_id they pass. Delegates cannot erase the patient they act for.
+func (pc *PatientController) erasureSubject(ctx *gin.Context, targetUserId *uint64) (uint64, uint64, error) {
+	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		return 0, 0, err
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
+	if err != nil {
+		return 0, 0, err
+	}
+	if targetUserId != nil && *targetUserId != reqUserID {
+		if !utils.HasRole(ctx, string(constant.Admin)) {
+			return 0, 0, errors.New("only admins can erase another account")
+		}
+		return *targetUserId, reqUserID, nil
+	}
+	if isDelegate {
+		return 0, 0, errors.New("erasure must be requested by the account owner")
+	}
+	return userId, reqUserID, nil
+}
+
+func (pc *PatientController) PreviewErasure(ctx *gin.Context) {
+	var targetUserId *uint64
+	if ctx.Query("user_id") != "" {
+		id, err := strconv.ParseUint(ctx.Query("user_id"), 10, 64)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid user id", nil, err)
+			return
+		}
+		targetUserId = &id
+	}
+	subjectId, _, err := pc.erasureSubject(ctx, targetUserId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, err.Error(), nil, err)
+		return
+	}
+	report, err := pc.erasureService.PreviewErasure(subjectId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to prepare erasure report", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Erasure dry run completed", report, nil, nil)
+}
+
+func (pc *PatientController) RequestErasure(ctx *gin.Context) {
+	var input models.ErasureRequestInput
+	if err := ctx.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	subjectId, reqUserID, err := pc.erasureSubject(ctx, input.UserID)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, err.Error(), nil, err)
+		return
+	}
+	request, err := pc.erasureService.RequestErasure(subjectId, reqUserID, input.Reason)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to schedule erasure", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusAccepted, "Erasure scheduled, it can be cancelled until the grace period ends", request, nil, nil)
+}
+
+func (pc *PatientController) GetErasureRequest(ctx *gin.Context) {
+	_, reqUserID, err := pc.erasureSubject(ctx, nil)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, err.Error(), nil, err)
+		return
+	}
+	erasureId, err := uuid.Parse(ctx.Param("erasure_id"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid erasure id", nil, err)
+		return
+	}
+	request, err := pc.erasureService.GetErasureRequest(erasureId, reqUserID)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusNotFound, "Erasure request not found", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Erasure request fetched successfully", request, nil, nil)
+}
+
+func (pc *PatientController) CancelErasure(ctx *gin.Context) {
+	_, reqUserID, err := pc.erasureSubject(ctx, nil)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, err.Error(), nil, err)
+		return
+	}
+	erasureId, err := uuid.Parse(ctx.Param("erasure_id"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid erasure id", nil, err)
+		return
+	}
+	if err := pc.erasureService.CancelErasure(erasureId, reqUserID); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to cancel erasure", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Erasure cancelled", nil, nil, nil)
+}
+
+func (pc *PatientController) VerifyErasureCertificates(ctx *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	result, err := pc.erasureService.VerifyErasureCertificates()
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to verify erasure certificates", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Erasure certificates verified", result, nil, nil)
+}
+
+func (pc *PatientController) GetCriticalAlerts(ctx *gin.Context) {
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if isDelegate {
+		reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+			return
+		}
+		if err := pc.patientService.CanContinue(patientId, reqUserID, constant.PermissionViewHealth); err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, err)
+			return
+		}
+	}
+	page, limit, offset := utils.GetPaginationParams(ctx)
+	alerts, totalRecords, err := pc.criticalAlertService.GetCriticalAlerts(patientId, ctx.Query("status"), limit, offset)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to fetch critical alerts", nil, err)
+		return
+	}
+	pagination := utils.GetPagination(limit, page, offset, totalRecords)
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Critical alerts fetched successfully", alerts, pagination, nil)
+}
+
+func (pc *PatientController) AcknowledgeCriticalAlert(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	alertId, err := uuid.Parse(ctx.Param("alert_id"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid alert id", nil, err)
+		return
+	}
+	var input models.AcknowledgeAlertRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	alert, err := pc.criticalAlertService.AcknowledgeAlert(alertId, reqUserID, input.Note)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to acknowledge critical alert", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Critical alert acknowledged", alert, nil, nil)
+}
+
+func (pc *PatientController) AddReportResult(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	reportId := utils.GetParamAsUInt(ctx, "report_id")
+	if reportId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid report id", nil, nil)
+		return
+	}
+	var input models.ManualResultRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	result, err := pc.diagnosticService.AddResultValue(reportId, reqUserID, input)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to add result", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusCreated, "Result added successfully", result, nil, nil)
+}
+
+func (pc *PatientController) UpdateReportResult(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	resultId := utils.GetParamAsInt(ctx, "result_id")
+	if resultId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid result id", nil, nil)
+		return
+	}
+	var input models.ManualResultRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	result, err := pc.diagnosticService.UpdateResultValue(resultId, reqUserID, input)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to update result", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Result updated successfully", result, nil, nil)
+}
+
+func (pc *PatientController) DeleteReportResult(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	resultId := utils.GetParamAsInt(ctx, "result_id")
+	if resultId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid result id", nil, nil)
+		return
+	}
+	if err := pc.diagnosticService.DeleteResultValue(resultId, reqUserID, ctx.Query("reason")); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to delete result", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Result deleted successfully", nil, nil, nil)
+}
+
+func (pc *PatientController) GetReportResultAudit(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	resultId := utils.GetParamAsInt(ctx, "result_id")
+	if resultId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid result id", nil, nil)
+		return
+	}
+	audits, err := pc.diagnosticService.GetResultValueAudit(resultId, reqUserID)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to fetch result audit", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, constant.AuditSuccessMessage, audits, nil, nil)
+}
+
+func (pc *PatientController) GetReviewQueue(ctx *gin.Context) {
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	filter := models.ReviewQueueFilter{Status: ctx.DefaultQuery("status", constant.ReviewPending), Reason: ctx.Query("reason")}
+	if filter.Status == "all" {
+		filter.Status = ""
+	}
+	if reportId, err := strconv.ParseUint(ctx.Query("report_id"), 10, 64); err == nil {
+		filter.ReportId = &reportId
+	}
+	if !(ctx.Query("all") == "true" && utils.HasRole(ctx, string(constant.Admin))) {
+		if isDelegate {
+			reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+			if err != nil {
+				models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+				return
+			}
+			if err := pc.patientService.CanContinue(patientId, reqUserID, constant.PermissionViewHealth); err != nil {
+				models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, err)
+				return
+			}
+		}
+		filter.PatientId = &patientId
+	}
+	page, limit, offset := utils.GetPaginationParams(ctx)
+	items, totalRecords, err := pc.diagnosticService.GetReviewQueue(filter, limit, offset)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to fetch review queue", nil, err)
+		return
+	}
+	pagination := utils.GetPagination(limit, page, offset, totalRecords)
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Review queue loaded successfully", items, pagination, nil)
+}
+
+func (pc *PatientController) ApproveReviewItem(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	reviewId := utils.GetParamAsUInt(ctx, "review_id")
+	if reviewId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid review id", nil, nil)
+		return
+	}
+	var input models.ReviewDecisionRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	item, err := pc.diagnosticService.ApproveReviewItem(reviewId, reqUserID, utils.HasRole(ctx, string(constant.Admin)), input)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to approve review item", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Review item approved", item, nil, nil)
+}
+
+func (pc *PatientController) RejectReviewItem(ctx *gin.Context) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	reviewId := utils.GetParamAsUInt(ctx, "review_id")
+	if reviewId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid review id", nil, nil)
+		return
+	}
+	var input models.ReviewDecisionRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	item, err := pc.diagnosticService.RejectReviewItem(reviewId, reqUserID, utils.HasRole(ctx, string(constant.Admin)), input.Note)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to reject review item", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Review item rejected", item, nil, nil)
+}
+
+// reportComparisonPatient resolves the patient whose reports are compared, checking the
+// delegate's permission to view health data.
+func (pc *PatientController) reportComparisonPatient(ctx *gin.Context) (uint64, models.ReportComparisonRequest, bool) {
+	var input models.ReportComparisonRequest
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return 0, input, false
+	}
+	if isDelegate {
+		reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+			return 0, input, false
+		}
+		if err := pc.patientService.CanContinue(patientId, reqUserID, constant.PermissionViewHealth); err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, err)
+			return 0, input, false
+		}
+	}
+	for param, target := range map[string]**uint64{"report_a": &input.ReportIdA, "report_b": &input.ReportIdB} {
+		if value := ctx.Query(param); value != "" {
+			reportId, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid "+param, nil, err)
+				return 0, input, false
+			}
+			*target = &reportId
+		}
+	}
+	for param, target := range map[string]**time.Time{"date_a": &input.DateA, "date_b": &input.DateB} {
+		if value := ctx.Query(param); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid "+param+", expected YYYY-MM-DD", nil, err)
+				return 0, input, false
+			}
+			*target = &date
+		}
+	}
+	return patientId, input, true
+}
+
+func (pc *PatientController) CompareReports(ctx *gin.Context) {
+	patientId, input, ok := pc.reportComparisonPatient(ctx)
+	if !ok {
+		return
+	}
+	comparison, err := pc.patientService.CompareReports(patientId, input)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to compare reports", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Reports compared successfully", comparison, nil, nil)
+}
+
+func (pc *PatientController) ExportReportComparison(ctx *gin.Context) {
+	patientId, input, ok := pc.reportComparisonPatient(ctx)
+	if !ok {
+		return
+	}
+	format := ctx.DefaultQuery("format", "pdf")
+	fileBytes, err := pc.patientService.ExportReportComparison(patientId, input, format)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to export report comparison", nil, err)
+		return
+	}
+	contentType, fileName := "application/pdf", "report_comparison.pdf"
+	if format == "excel" {
+		contentType, fileName = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "report_comparison.xlsx"
+	}
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	ctx.Header("File-Name", fileName)
+	ctx.Header("Access-Control-Expose-Headers", "File-Name")
+	ctx.Data(http.StatusOK, contentType, fileBytes)
+}
+
+func (pc *PatientController) GetDeadLetters(ctx *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	filter := models.DeadLetterFilter{Status: ctx.DefaultQuery("status", constant.DeadLetterDead), TaskType: ctx.Query("task_type"), QueueName: ctx.Query("queue_name")}
+	if filter.Status == "all" {
+		filter.Status = ""
+	}
+	if recordId, err := strconv.ParseUint(ctx.Query("record_id"), 10, 64); err == nil {
+		filter.RecordId = &recordId
+	}
+	if patientId, err := strconv.ParseUint(ctx.Query("patient_id"), 10, 64); err == nil {
+		filter.PatientId = &patientId
+	}
+	if from, err := time.Parse("2006-01-02", ctx.Query("from")); err == nil {
+		filter.From = &from
+	}
+	if to, err := time.Parse("2006-01-02", ctx.Query("to")); err == nil {
+		to = to.AddDate(0, 0, 1)
+		filter.To = &to
+	}
+	page, limit, offset := utils.GetPaginationParams(ctx)
+	entries, totalRecords, err := pc.deadLetterService.GetDeadLetters(filter, limit, offset)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to fetch dead letters", nil, err)
+		return
+	}
+	pagination := utils.GetPagination(limit, page, offset, totalRecords)
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Dead letters loaded successfully", entries, pagination, nil)
+}
+
+func (pc *PatientController) ReplayDeadLetters(ctx *gin.Context) {
+	pc.deadLetterAction(ctx, func(input models.DeadLetterActionRequest, userId uint64) []models.DeadLetterActionResult {
+		return pc.deadLetterService.ReplayDeadLetters(input.DeadLetterIds, userId)
+	}, "Dead letters replayed")
+}
+
+func (pc *PatientController) DiscardDeadLetters(ctx *gin.Context) {
+	pc.deadLetterAction(ctx, func(input models.DeadLetterActionRequest, userId uint64) []models.DeadLetterActionResult {
+		return pc.deadLetterService.DiscardDeadLetters(input.DeadLetterIds, userId, input.Note)
+	}, "Dead letters discarded")
+}
+
+func (pc *PatientController) ScrubDeadLetters(ctx *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
 	}
-	pagination := utils.GetPagination(limit, page, offset, total)
-	message := "Data not found"
-	if len(data) > 0 {
-		message = "Data retrieved successfully"
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
 	}
-	responseData := map[string]interface{}{
-		"records": data,
-		"counts":  counts,
-		"total":   total,
-		"hasMore": (int64(offset+limit) < total),
+	scrubbed, err := pc.deadLetterService.ScrubStoredPayloads()
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to scrub dead letters", nil, err)
+		return
 	}
-	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, responseData, pagination, nil)
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Dead letters scrubbed", map[string]interface{}{"scrubbed": scrubbed}, nil, nil)
 }
 
-func (c *PatientController) GetDiagnosticLabReportName(ctx *gin.Context) {
-	_, patientId, _, err := utils.GetUserIDFromContext(ctx, c.userService.GetUserIdBySUB)
+func (pc *PatientController) deadLetterAction(ctx *gin.Context, action func(input models.DeadLetterActionRequest, userId uint64) []models.DeadLetterActionResult, message string) {
+	sub, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
 	if err != nil {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
 		return
 	}
-	data, err := c.diagnosticService.GetDiagnosticLabReportName(patientId)
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
 	if err != nil {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to retrieve records", nil, err)
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
 		return
 	}
-	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Lab report name fetched.", data, nil, nil)
+	var input models.DeadLetterActionRequest
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, action(input, reqUserID), nil, nil)
 }
 
-func (pc *PatientController) CreateTblMedicalRecord(ctx *gin.Context) {
-	authUserId, userId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+func (pc *PatientController) RetryDigitization(ctx *gin.Context) {
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
 	if err != nil {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
 		return
 	}
+	reqUserID, err := pc.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
 	if isDelegate {
-		reqUserID, err := pc.userService.GetUserIdBySUB(authUserId)
-		if err != nil {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
-			return
-		}
-		err = pc.patientService.CanContinue(userId, reqUserID, constant.PermissionUploadReport)
-		if err != nil {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, err)
-			return
-		}
-	} else {
-		canAccess := pc.patientService.CanAccessAPI(userId, []string{string(constant.MappingTypeR), string(constant.MappingTypeHOF), string(constant.MappingTypeS)})
-		if !canAccess {
-			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, string(constant.PermissionUploadMedicalRecord), nil, errors.New("You need subscription for uploading own records"))
+		if err := pc.patientService.CanContinue(patientId, reqUserID, constant.PermissionUploadReport); err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, err)
 			return
 		}
 	}
-	file, header, err := ctx.Request.FormFile("file")
+	recordId := utils.GetParamAsUInt(ctx, "record_id")
+	if recordId == 0 {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record Id", nil, nil)
+		return
+	}
+	entry, err := pc.deadLetterService.RetryRecordDigitization(recordId, patientId, reqUserID)
 	if err != nil {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, "Please provid file to save", nil, errors.New("Error while uploading document"))
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to retry digitization", nil, err)
 		return
 	}
-	form, _ := ctx.MultipartForm()
-	attachments := form.File["attachments"]
-	uploadSource := ctx.PostForm("upload_source")
-	description := ctx.PostForm("description")
-	recordCategory := ctx.PostForm("record_category")
-	recordSubCategory := ctx.PostForm("record_sub_category")
-	tags := ctx.PostForm("tags")
-	data, err := pc.medicalRecordService.CreateTblMedicalRecord(userId, authUserId, file, header, uploadSource, description, recordCategory, recordSubCategory, attachments, tags)
+	models.SuccessResponse(ctx, constant.Success, http.StatusAccepted, "Digitization queued again", entry, nil, nil)
+}
+
+func (pc *PatientController) GetDigitizationQueueStatus(ctx *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
 	if err != nil {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to create record", nil, err)
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
 		return
 	}
-	message := "Your record has been created successfully. Digitization is in progress and should complete within 4–5 minutes."
-	if recordCategory == string(constant.OTHER) || recordCategory == string(constant.INSURANCE) || recordCategory == string(constant.VACCINATION) || recordCategory == string(constant.DISCHARGESUMMARY) || recordCategory == string(constant.INVOICE) || recordCategory == string(constant.NONMEDICAL) || recordCategory == string(constant.SCANS) {
-		message = "Record saved successfully"
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
 	}
-	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, data, nil, nil)
+	overview, err := pc.taskQueueService.GetQueueStatus()
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to fetch queue status", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Queue status loaded successfully", overview, nil, nil)
 }
 
 func (pc *PatientController) SaveReport(ctx *gin.Context) {
@@ -1164,24 +1877,12 @@ func (pc *PatientController) SaveReport(ctx *gin.Context) {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "No file found for this record", nil, nil)
 		return
 	}
-	resp, err := http.Get(record.RecordUrl)
-	if err != nil {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to fetch file from URL", nil, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "File not accessible or missing", nil, nil)
-		return
-	}
-
-	fileBuf := new(bytes.Buffer)
-	_, err = io.Copy(fileBuf, resp.Body)
+	fileData, err := pc.medicalRecordService.ReadRecordFile(record)
 	if err != nil {
-		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Error reading file content", nil, err)
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "File not accessible or missing", nil, err)
 		return
 	}
+	fileBuf := bytes.NewBuffer(fileData)
 
 	_, updateErr := pc.medicalRecordService.UpdateTblMedicalRecord(patientId, &models.TblMedicalRecord{RecordId: recordId, Status: constant.StatusRetrying})
 	if updateErr != nil {
@@ -1241,15 +1942,40 @@ func (c *PatientController) GetMedicalRecordByRecordId(ctx *gin.Context) {
 	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Record retrieved successfully", data, nil, nil)
 }
 
+// recordPatient resolves the patient whose records a request acts on. A delegate needs the
+// given permission on that patient.
+func (c *PatientController) recordPatient(ctx *gin.Context, permission string) (uint64, bool) {
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, c.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return 0, false
+	}
+	reqUserID, err := c.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return 0, false
+	}
+	if isDelegate {
+		if err := c.patientService.CanContinue(patientId, reqUserID, permission); err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, err)
+			return 0, false
+		}
+	}
+	return patientId, true
+}
+
 func (c *PatientController) DeleteTblMedicalRecord(ctx *gin.Context) {
+	userId, ok := c.recordPatient(ctx, constant.PermissionUploadReport)
+	if !ok {
+		return
+	}
 	id := utils.GetParamAsInt(ctx, "id")
 	if id == 0 {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Param id is required", nil, nil)
 		return
 	}
 
-	updatedBy := ctx.GetString("user")
-	err := c.medicalRecordService.DeleteTblMedicalRecord(id, updatedBy)
+	err := c.medicalRecordService.DeleteTblMedicalRecord(userId, uint64(id))
 	if err != nil {
 		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to delete record", nil, err)
 		return
@@ -1257,6 +1983,111 @@ func (c *PatientController) DeleteTblMedicalRecord(ctx *gin.Context) {
 	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Record deleted successfully", nil, nil, nil)
 }
 
+func (c *PatientController) SearchMedicalRecords(ctx *gin.Context) {
+	sub, patientId, isDelegate, err := utils.GetUserIDFromContext(ctx, c.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	query := strings.TrimSpace(ctx.Query("q"))
+	if query == "" {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Search query is required", nil, errors.New("missing q"))
+		return
+	}
+	reqUserID, err := c.userService.GetUserIdBySUB(sub)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, err.Error(), nil, err)
+		return
+	}
+	var scopePatientId *uint64
+	if isDelegate {
+		scopePatientId = &patientId
+	} else if ctx.Query("patient_id") != "" {
+		id, err := strconv.ParseUint(ctx.Query("patient_id"), 10, 64)
+		if err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid patient id", nil, err)
+			return
+		}
+		scopePatientId = &id
+	}
+	page, limit, offset := utils.GetPaginationParams(ctx)
+	results, total, err := c.medicalRecordService.SearchMedicalRecords(reqUserID, scopePatientId, query, limit, offset)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to search records", nil, err)
+		return
+	}
+	pagination := utils.GetPagination(limit, page, offset, total)
+	message := "Data not found"
+	if len(results) > 0 {
+		message = "Data retrieved successfully"
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, results, pagination, nil)
+}
+
+func (c *PatientController) GetRecordVersions(ctx *gin.Context) {
+	userId, ok := c.recordPatient(ctx, constant.PermissionViewHealth)
+	if !ok {
+		return
+	}
+	recordId, err := strconv.ParseUint(ctx.Param("record_id"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record Id", nil, err)
+		return
+	}
+	versions, err := c.medicalRecordService.GetRecordVersions(userId, recordId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to load record versions", nil, err)
+		return
+	}
+	message := "Data not found"
+	if len(versions) > 0 {
+		message = "Record versions retrieved successfully"
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, message, versions, nil, nil)
+}
+
+func (c *PatientController) RestoreMedicalRecord(ctx *gin.Context) {
+	userId, ok := c.recordPatient(ctx, constant.PermissionUploadReport)
+	if !ok {
+		return
+	}
+	recordId, err := strconv.ParseUint(ctx.Param("record_id"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record Id", nil, err)
+		return
+	}
+	var req models.RestoreRecordRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid request body", nil, err)
+			return
+		}
+	}
+	record, err := c.medicalRecordService.RestoreMedicalRecord(userId, recordId, req.VersionId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to restore record", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Record restored successfully", record, nil, nil)
+}
+
+func (c *PatientController) PurgeMedicalRecord(ctx *gin.Context) {
+	userId, ok := c.recordPatient(ctx, constant.PermissionUploadReport)
+	if !ok {
+		return
+	}
+	recordId, err := strconv.ParseUint(ctx.Param("record_id"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record Id", nil, err)
+		return
+	}
+	if err := c.medicalRecordService.PurgeMedicalRecord(userId, recordId); err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to purge record", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Record purged permanently", nil, nil, nil)
+}
+
 func (pc *PatientController) GetUserProfile(ctx *gin.Context) {
 	sub, user_id, isDelegate, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
 	if err != nil {
@@ -1978,6 +2809,123 @@ func (pc *PatientController) ReadUserUploadedMedicalFile(ctx *gin.Context) {
 	}
 }
 
+func (pc *PatientController) DownloadMedicalRecord(ctx *gin.Context) {
+	recordID, err := strconv.ParseUint(ctx.Param("record_id"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record id", nil, err)
+		return
+	}
+	userID, err := strconv.ParseUint(ctx.Query("uid"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	expiresAt, err := strconv.ParseInt(ctx.Query("exp"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	file, fileName, err := pc.medicalRecordService.ReadSignedMedicalRecord(recordID, userID, expiresAt, ctx.Query("sig"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, string(constant.PermissionViewMedicalRecord), nil, err)
+		return
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", fileName))
+	ctx.Header("Cache-Control", "private, no-store")
+	ctx.Data(http.StatusOK, file.ContentType, file.Data)
+}
+
+func (pc *PatientController) GetRecordThumbnail(ctx *gin.Context) {
+	recordID, err := strconv.ParseUint(ctx.Param("record_id"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid record id", nil, err)
+		return
+	}
+	userID, err := strconv.ParseUint(ctx.Query("uid"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	expiresAt, err := strconv.ParseInt(ctx.Query("exp"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	file, err := pc.medicalRecordService.ReadSignedRecordThumbnail(recordID, userID, expiresAt, ctx.Query("sig"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, string(constant.PermissionViewMedicalRecord), nil, err)
+		return
+	}
+	ctx.Header("Cache-Control", "private, no-store")
+	ctx.Data(http.StatusOK, file.ContentType, file.Data)
+}
+
+func (pc *PatientController) DownloadPatientDataExport(ctx *gin.Context) {
+	exportId, err := uuid.Parse(ctx.Param("export_id"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid export id", nil, err)
+		return
+	}
+	userID, err := strconv.ParseUint(ctx.Query("uid"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	expiresAt, err := strconv.ParseInt(ctx.Query("exp"), 10, 64)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Invalid download link", nil, err)
+		return
+	}
+	reader, size, err := pc.patientExportService.OpenSignedPatientDataExport(exportId, userID, expiresAt, ctx.Query("sig"))
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Unable to download data export", nil, err)
+		return
+	}
+	defer reader.Close()
+	fileName := fmt.Sprintf("biostack_export_%s.zip", exportId)
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	ctx.Header("File-Name", fileName)
+	ctx.Header("Access-Control-Expose-Headers", "File-Name")
+	ctx.Header("Cache-Control", "private, no-store")
+	ctx.DataFromReader(http.StatusOK, size, "application/zip", reader, nil)
+}
+
+func (pc *PatientController) MigrateLegacyRecordUrls(ctx *gin.Context) {
+	_, _, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	updated, err := pc.medicalRecordService.MigrateLegacyRecordUrls()
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusInternalServerError, "Failed to migrate record urls", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusOK, "Record urls migrated", map[string]interface{}{"updated": updated}, nil, nil)
+}
+
+func (pc *PatientController) RewrapRecordDataKeys(ctx *gin.Context) {
+	_, userId, _, err := utils.GetUserIDFromContext(ctx, pc.userService.GetUserIdBySUB)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusUnauthorized, err.Error(), nil, err)
+		return
+	}
+	if !utils.HasRole(ctx, string(constant.Admin)) {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusForbidden, "Access denied", nil, errors.New("admin role required"))
+		return
+	}
+	processID, err := pc.medicalRecordService.RewrapRecordDataKeys(userId)
+	if err != nil {
+		models.ErrorResponse(ctx, constant.Failure, http.StatusBadRequest, "Failed to start key rotation", nil, err)
+		return
+	}
+	models.SuccessResponse(ctx, constant.Success, http.StatusAccepted, "Record key re-wrap started", map[string]interface{}{"process_id": processID}, nil, nil)
+}
+
 func (pc *PatientController) AddMappingToMergeTestComponent(c *gin.Context) {
 	authUserId, _, _, err := utils.GetUserIDFromContext(c, pc.userService.GetUserIdBySUB)
 	if err != nil {
@@ -2066,8 +3014,13 @@ func (pc *PatientController) ArchivePatientDiagnosticReport(c *gin.Context) {
 		return
 	}
 
-	err = pc.diagnosticService.ArchivePatientDiagnosticReport(reportID, isDeleted)
-	if err != nil {
+	tx := database.DB.Begin()
+	if err := pc.diagnosticService.ArchivePatientDiagnosticReport(tx, reportID, isDeleted); err != nil {
+		tx.Rollback()
+		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to archive patient diagnostic report", nil, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
 		models.ErrorResponse(c, constant.Failure, http.StatusInternalServerError, "Failed to archive patient diagnostic report", nil, err)
 		return
 	}
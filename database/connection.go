@@ -52,11 +52,71 @@ func InitDB() *gorm.DB {
 	}
 
 	log.Println("db.26 Database connection established successfully")
-	database.AutoMigrate(&models.ProcessStepRecordLog{})
+	err = database.AutoMigrate(&models.ProcessStepRecordLog{}, &models.TblMedicalRecordVersion{}, &models.PatientDataExport{},
+		&models.PatientErasureRequest{}, &models.ErasureCertificate{}, &models.DiagnosticTestComponentUnit{},
+		&models.DiagnosticCriticalThreshold{}, &models.CriticalResultAlert{}, &models.CriticalAlertEscalation{},
+		&models.TrendDriftNotice{}, &models.PatientDiagnosticResultAudit{}, &models.DigitizationReviewItem{},
+		&models.LoincCode{}, &models.DigitizationDeadLetter{})
+	if err != nil {
+		log.Fatal("db.28 AutoMigrate failed: ", err)
+	}
+	for _, statement := range schemaChanges {
+		if err := database.Exec(statement).Error; err != nil {
+			log.Fatalf("db.32 schema change failed: %s: %v", statement, err)
+		}
+	}
+	createSearchIndexes(database)
 	DB = database
 	return DB
 }
 
+// schemaChanges add the columns and indexes of tables AutoMigrate does not manage. Each is
+// idempotent and runs on every start; startup stops if one fails.
+var schemaChanges = []string{
+	"ALTER TABLE tbl_medical_record ADD COLUMN IF NOT EXISTS data_key text, ADD COLUMN IF NOT EXISTS key_version integer DEFAULT 0, ADD COLUMN IF NOT EXISTS content_hash varchar(64), ADD COLUMN IF NOT EXISTS deleted_at timestamp, ADD COLUMN IF NOT EXISTS thumbnail_url text, ADD COLUMN IF NOT EXISTS page_count integer DEFAULT 0, ADD COLUMN IF NOT EXISTS sealed_pdf_password text, ADD COLUMN IF NOT EXISTS preview_status varchar(20), ADD COLUMN IF NOT EXISTS owner_id bigint",
+	"CREATE INDEX IF NOT EXISTS idx_tbl_medical_record_content_hash ON tbl_medical_record (content_hash)",
+	// Older records take their mapped user as owner; only the oldest live copy of a file per
+	// user does, so the unique index below can be built over existing duplicates.
+	`UPDATE tbl_medical_record AS mr SET owner_id = mrum.user_id
+		FROM tbl_medical_record_user_mapping AS mrum
+		WHERE mrum.record_id = mr.record_id AND mr.owner_id IS NULL AND mr.is_deleted = 0 AND mr.content_hash <> ''
+		AND mr.record_id = (SELECT MIN(r.record_id) FROM tbl_medical_record AS r
+			JOIN tbl_medical_record_user_mapping AS m ON m.record_id = r.record_id
+			WHERE m.user_id = mrum.user_id AND r.content_hash = mr.content_hash AND r.is_deleted = 0)
+		AND NOT EXISTS (SELECT 1 FROM tbl_medical_record AS o
+			WHERE o.owner_id = mrum.user_id AND o.content_hash = mr.content_hash AND o.is_deleted = 0)`,
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_tbl_medical_record_owner_content_hash ON tbl_medical_record (owner_id, content_hash) WHERE " + OwnedContentPredicate,
+	"ALTER TABLE tbl_patient_diagnostic_test_result_value ADD COLUMN IF NOT EXISTS result_unit varchar(50), ADD COLUMN IF NOT EXISTS original_result_value double precision, ADD COLUMN IF NOT EXISTS original_unit varchar(50)",
+	"ALTER TABLE tbl_patient_diagnostic_test_result_value ADD COLUMN IF NOT EXISTS applied_range_source varchar(20), ADD COLUMN IF NOT EXISTS applied_range_id bigint, ADD COLUMN IF NOT EXISTS applied_normal_min double precision, ADD COLUMN IF NOT EXISTS applied_normal_max double precision, ADD COLUMN IF NOT EXISTS applied_range_units varchar(50), ADD COLUMN IF NOT EXISTS applied_range_reason text, ADD COLUMN IF NOT EXISTS range_flag varchar(10)",
+	"ALTER TABLE tbl_patient_diagnostic_test_result_value ADD COLUMN IF NOT EXISTS is_derived boolean DEFAULT false, ADD COLUMN IF NOT EXISTS derived_formula text, ADD COLUMN IF NOT EXISTS derived_inputs jsonb",
+	"ALTER TABLE tbl_patient_diagnostic_test_result_value ADD COLUMN IF NOT EXISTS source varchar(20) DEFAULT 'ai', ADD COLUMN IF NOT EXISTS verified_by bigint, ADD COLUMN IF NOT EXISTS verified_at timestamp",
+}
+
+// OwnedContentPredicate is the predicate of the per-owner content hash unique index, which
+// an ON CONFLICT target has to repeat for the index to be used.
+const OwnedContentPredicate = "is_deleted = 0 AND owner_id IS NOT NULL AND content_hash <> ''"
+
+// searchVectors are the generated tsvector columns used by record search, per table.
+var searchVectors = map[string]string{
+	"tbl_medical_record": "setweight(to_tsvector('english', coalesce(record_name, '')), 'A') || " +
+		"setweight(to_tsvector('english', coalesce(description, '')), 'B') || " +
+		"setweight(jsonb_to_tsvector('english', coalesce(metadata::jsonb -> 'ai', '{}'::jsonb), '[\"string\"]'), 'C')",
+	"tbl_patient_diagnostic_report":                        "to_tsvector('english', coalesce(report_name, '') || ' ' || coalesce(observation, '') || ' ' || coalesce(comments, ''))",
+	"tbl_diagnostic_lab":                                   "to_tsvector('english', coalesce(lab_name, ''))",
+	"tbl_disease_profile_diagnostic_test_component_master": "to_tsvector('english', coalesce(test_component_name, ''))",
+	"tbl_user_tag":                                         "to_tsvector('english', coalesce(tag_name, ''))",
+}
+
+func createSearchIndexes(database *gorm.DB) {
+	for table, expr := range searchVectors {
+		if err := database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (%s) STORED", table, expr)).Error; err != nil {
+			log.Printf("db search_vector on %s: %v", table, err)
+			continue
+		}
+		database.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_fts ON %s USING GIN (search_vector)", table, table))
+	}
+}
+
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	if err := sqlDB.Ping(); err != nil {
 		http.Error(w, "Database connection unhealthy", http.StatusServiceUnavailable)
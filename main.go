@@ -4,6 +4,7 @@ import (
 	"biostat/config"
 	"biostat/database"
 	"biostat/router"
+	"biostat/service"
 	"log"
 	"os"
 	"os/signal"
@@ -36,6 +37,11 @@ func main() {
 	defer config.Log.Sync()
 	config.Log.Info("Biostack Application Started.....")
 	config.Log.Info("ENV profile active", zap.String("env", env))
+	if config.PropConfig.AIMock.Enabled {
+		if err := service.StartMockAIServer(); err != nil {
+			log.Fatalf("Error starting mock AI server: %v", err)
+		}
+	}
 	config.InitKeycloak()
 	database.InitDB()
 	config.InitRedisAndAsynq()
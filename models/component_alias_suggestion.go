@@ -0,0 +1,43 @@
+package models
+
+// ComponentAliasSuggestion is a component name the digitizer could not map, with the master
+// components it most likely stands for, best first.
+type ComponentAliasSuggestion struct {
+	AliasName        string                    `json:"alias_name"`
+	Occurrences      int                       `json:"occurrences"`
+	Units            string                    `json:"units,omitempty"`
+	ReferenceMin     *float64                  `json:"reference_min,omitempty"`
+	ReferenceMax     *float64                  `json:"reference_max,omitempty"`
+	PendingReviewIds []uint64                  `json:"pending_review_ids"`
+	Candidates       []ComponentMatchCandidate `json:"candidates"`
+}
+
+// ComponentMatchCandidate scores a master component against an unmapped name. Score weighs the
+// name similarity with how well the units and reference ranges agree.
+type ComponentMatchCandidate struct {
+	DiagnosticTestComponentId uint64  `json:"diagnostic_test_component_id"`
+	TestComponentName         string  `json:"test_component_name"`
+	Units                     string  `json:"units"`
+	Score                     float64 `json:"score"`
+	NameScore                 float64 `json:"name_score"`
+	UnitScore                 float64 `json:"unit_score"`
+	RangeScore                float64 `json:"range_score"`
+}
+
+type AcceptAliasSuggestion struct {
+	AliasName                 string `json:"alias_name" binding:"required"`
+	DiagnosticTestComponentId uint64 `json:"diagnostic_test_component_id" binding:"required"`
+}
+
+type AcceptAliasSuggestionsRequest struct {
+	Suggestions []AcceptAliasSuggestion `json:"suggestions" binding:"required,min=1,dive"`
+}
+
+// AliasSuggestionResult reports one accepted suggestion and the parked results that were
+// saved under the component because of it.
+type AliasSuggestionResult struct {
+	AliasName                 string `json:"alias_name"`
+	DiagnosticTestComponentId uint64 `json:"diagnostic_test_component_id"`
+	ApprovedReviewItems       int    `json:"approved_review_items"`
+	Error                     string `json:"error,omitempty"`
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DiagnosticCriticalThreshold holds the panic values of a test component. A result at or
+// below CriticalLow, or at or above CriticalHigh, is escalated immediately.
+type DiagnosticCriticalThreshold struct {
+	ThresholdId               uint64    `gorm:"column:threshold_id;primaryKey;autoIncrement" json:"threshold_id"`
+	DiagnosticTestComponentId uint64    `gorm:"column:diagnostic_test_component_id;not null;uniqueIndex" json:"diagnostic_test_component_id"`
+	CriticalLow               *float64  `gorm:"column:critical_low" json:"critical_low"`
+	CriticalHigh              *float64  `gorm:"column:critical_high" json:"critical_high"`
+	Units                     string    `gorm:"column:units;size:50" json:"units"`
+	IsActive                  bool      `gorm:"column:is_active;default:true" json:"is_active"`
+	CreatedBy                 string    `gorm:"column:created_by" json:"created_by"`
+	CreatedAt                 time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt                 time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (DiagnosticCriticalThreshold) TableName() string {
+	return "tbl_diagnostic_critical_threshold"
+}
+
+// CriticalResultAlert is one critical result and the state of its escalation. It stays open,
+// and is re-escalated, until someone acknowledges it or the result is corrected or deleted.
+type CriticalResultAlert struct {
+	AlertId                   uuid.UUID  `gorm:"column:alert_id;type:uuid;default:gen_random_uuid();primaryKey" json:"alert_id"`
+	PatientId                 uint64     `gorm:"column:patient_id;not null;index" json:"patient_id"`
+	TestResultValueId         int        `gorm:"column:test_result_value_id;not null;uniqueIndex" json:"test_result_value_id"`
+	PatientDiagnosticReportId uint64     `gorm:"column:patient_diagnostic_report_id" json:"patient_diagnostic_report_id"`
+	DiagnosticTestComponentId uint64     `gorm:"column:diagnostic_test_component_id" json:"diagnostic_test_component_id"`
+	TestComponentName         string     `gorm:"column:test_component_name" json:"test_component_name"`
+	ResultValue               float64    `gorm:"column:result_value" json:"result_value"`
+	ResultUnit                string     `gorm:"column:result_unit" json:"result_unit"`
+	ResultDate                time.Time  `gorm:"column:result_date" json:"result_date"`
+	Breach                    string     `gorm:"column:breach;size:10" json:"breach"`
+	ThresholdValue            float64    `gorm:"column:threshold_value" json:"threshold_value"`
+	Status                    string     `gorm:"column:status;size:20;not null;index" json:"status"`
+	EscalationCount           int        `gorm:"column:escalation_count;default:0" json:"escalation_count"`
+	LastEscalatedAt           *time.Time `gorm:"column:last_escalated_at" json:"last_escalated_at,omitempty"`
+	NextEscalationAt          *time.Time `gorm:"column:next_escalation_at;index" json:"next_escalation_at,omitempty"`
+	AcknowledgedBy            *uint64    `gorm:"column:acknowledged_by" json:"acknowledged_by,omitempty"`
+	AcknowledgedAt            *time.Time `gorm:"column:acknowledged_at" json:"acknowledged_at,omitempty"`
+	AcknowledgeNote           string     `gorm:"column:acknowledge_note" json:"acknowledge_note,omitempty"`
+	CreatedAt                 time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+}
+
+func (CriticalResultAlert) TableName() string {
+	return "tbl_critical_result_alert"
+}
+
+// CriticalAlertEscalation records who was notified on each escalation attempt.
+type CriticalAlertEscalation struct {
+	EscalationId    uint64    `gorm:"column:escalation_id;primaryKey;autoIncrement" json:"escalation_id"`
+	AlertId         uuid.UUID `gorm:"column:alert_id;type:uuid;not null;index" json:"alert_id"`
+	Attempt         int       `gorm:"column:attempt" json:"attempt"`
+	RecipientUserId uint64    `gorm:"column:recipient_user_id" json:"recipient_user_id"`
+	MappingType     string    `gorm:"column:mapping_type;size:10" json:"mapping_type"`
+	Error           string    `gorm:"column:error" json:"error,omitempty"`
+	SentAt          time.Time `gorm:"column:sent_at;autoCreateTime" json:"sent_at"`
+}
+
+func (CriticalAlertEscalation) TableName() string {
+	return "tbl_critical_alert_escalation"
+}
+
+// CriticalCandidate is a stored result joined with the critical threshold of its component.
+type CriticalCandidate struct {
+	TestResultValueId         int
+	PatientId                 uint64
+	PatientDiagnosticReportId uint64
+	DiagnosticTestComponentId uint64
+	TestComponentName         string
+	ResultValue               float64
+	ResultUnit                string
+	ResultDate                time.Time
+	CriticalLow               *float64
+	CriticalHigh              *float64
+	ThresholdUnits            string
+}
+
+type CriticalAlertRecipient struct {
+	UserId      uint64
+	MappingType string
+}
+
+type AcknowledgeAlertRequest struct {
+	Note string `json:"note"`
+}
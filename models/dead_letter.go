@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// DigitizationDeadLetter is a digitize:record or check:doctype task that failed. One entry is
+// kept per task and record (or attachment for doc type checks) while it is open, and every
+// failed attempt is appended to Attempts. Payload is the task payload as enqueued, less the
+// PDF password and temp file path of digitization tasks, so the task can be replayed; it is
+// never sent to clients. ProcessLog is the process status as it stood after the last failure.
+type DigitizationDeadLetter struct {
+	DeadLetterId uint64         `gorm:"column:dead_letter_id;primaryKey;autoIncrement" json:"dead_letter_id"`
+	TaskType     string         `gorm:"column:task_type;size:50;not null;index:idx_dead_letter_task" json:"task_type"`
+	TaskKey      string         `gorm:"column:task_key;not null;index:idx_dead_letter_task" json:"task_key"`
+	QueueName    string         `gorm:"column:queue_name" json:"queue_name"`
+	RecordId     *uint64        `gorm:"column:record_id;index" json:"record_id,omitempty"`
+	PatientId    *uint64        `gorm:"column:patient_id;index" json:"patient_id,omitempty"`
+	ProcessId    string         `gorm:"column:process_id" json:"process_id"`
+	Payload      datatypes.JSON `gorm:"column:payload" json:"-"`
+	ErrorMessage string         `gorm:"column:error_message" json:"error_message"`
+	AttemptCount int            `gorm:"column:attempt_count" json:"attempt_count"`
+	Attempts     datatypes.JSON `gorm:"column:attempts" json:"attempts"`
+	ProcessLog   datatypes.JSON `gorm:"column:process_log" json:"process_log,omitempty"`
+	Status       string         `gorm:"column:status;size:20;index" json:"status"`
+	ReplayCount  int            `gorm:"column:replay_count" json:"replay_count"`
+	ReplayedBy   *uint64        `gorm:"column:replayed_by" json:"replayed_by,omitempty"`
+	ReplayedAt   *time.Time     `gorm:"column:replayed_at" json:"replayed_at,omitempty"`
+	DiscardedBy  *uint64        `gorm:"column:discarded_by" json:"discarded_by,omitempty"`
+	DiscardedAt  *time.Time     `gorm:"column:discarded_at" json:"discarded_at,omitempty"`
+	Note         string         `gorm:"column:note" json:"note,omitempty"`
+	CreatedAt    time.Time      `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time      `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (DigitizationDeadLetter) TableName() string {
+	return "tbl_digitization_dead_letter"
+}
+
+// DeadLetterAttempt is one failed run of a dead-lettered task. Replay is the number of replays
+// that preceded it, so attempts of different replays can be told apart.
+type DeadLetterAttempt struct {
+	Attempt  int       `json:"attempt"`
+	Replay   int       `json:"replay"`
+	Error    string    `json:"error"`
+	Class    string    `json:"class,omitempty"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type DeadLetterFilter struct {
+	Status    string
+	TaskType  string
+	QueueName string
+	RecordId  *uint64
+	PatientId *uint64
+	From      *time.Time
+	To        *time.Time
+}
+
+type DeadLetterActionRequest struct {
+	DeadLetterIds []uint64 `json:"dead_letter_ids" binding:"required,min=1"`
+	Note          string   `json:"note"`
+}
+
+// DeadLetterActionResult reports the outcome of a replay or discard of one entry of a bulk
+// request; a failure of one entry does not stop the others.
+type DeadLetterActionResult struct {
+	DeadLetterId uint64 `json:"dead_letter_id"`
+	Status       string `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// DigitizationReviewItem is an extracted result that was not written to the report because its
+// component is unmapped or the extraction confidence was low. Component holds the extracted
+// LabReportComponent as it came from the AI.
+type DigitizationReviewItem struct {
+	ReviewId                  uint64         `gorm:"column:review_id;primaryKey;autoIncrement" json:"review_id"`
+	PatientId                 uint64         `gorm:"column:patient_id;not null;index" json:"patient_id"`
+	PatientDiagnosticReportId uint64         `gorm:"column:patient_diagnostic_report_id;not null;index" json:"patient_diagnostic_report_id"`
+	RecordId                  *uint64        `gorm:"column:record_id" json:"record_id,omitempty"`
+	DiagnosticTestId          uint64         `gorm:"column:diagnostic_test_id" json:"diagnostic_test_id"`
+	TestName                  string         `gorm:"column:test_name" json:"test_name"`
+	TestComponentName         string         `gorm:"column:test_component_name" json:"test_component_name"`
+	ResultValue               string         `gorm:"column:result_value" json:"result_value"`
+	Units                     string         `gorm:"column:units" json:"units"`
+	ResultDate                time.Time      `gorm:"column:result_date" json:"result_date"`
+	Confidence                *float64       `gorm:"column:confidence" json:"confidence,omitempty"`
+	Component                 datatypes.JSON `gorm:"column:component" json:"component"`
+	Reason                    string         `gorm:"column:reason;size:20;index" json:"reason"`
+	Status                    string         `gorm:"column:status;size:20;index" json:"status"`
+	ReviewedBy                *uint64        `gorm:"column:reviewed_by" json:"reviewed_by,omitempty"`
+	ReviewedAt                *time.Time     `gorm:"column:reviewed_at" json:"reviewed_at,omitempty"`
+	ReviewNote                string         `gorm:"column:review_note" json:"review_note,omitempty"`
+	CreatedAt                 time.Time      `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt                 time.Time      `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (DigitizationReviewItem) TableName() string {
+	return "tbl_digitization_review_item"
+}
+
+// ReviewDecisionRequest approves a review item, optionally correcting it first. Non-admins
+// must map it to an existing component. Mapping it with SaveAsAlias also records the
+// extracted name as an alias of that component, which only admins may do.
+type ReviewDecisionRequest struct {
+	TestComponentName         *string `json:"test_component_name,omitempty"`
+	ResultValue               *string `json:"result_value,omitempty"`
+	Units                     *string `json:"units,omitempty"`
+	DiagnosticTestComponentId *uint64 `json:"diagnostic_test_component_id,omitempty"`
+	SaveAsAlias               bool    `json:"save_as_alias"`
+	Note                      string  `json:"note"`
+}
+
+type ReviewQueueFilter struct {
+	PatientId *uint64
+	ReportId  *uint64
+	Status    string
+	Reason    string
+}
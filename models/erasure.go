@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// PatientErasureRequest is a right-to-erasure request. It is executed once ScheduledFor has
+// passed unless it is cancelled during the grace period.
+type PatientErasureRequest struct {
+	ErasureId     uuid.UUID      `gorm:"column:erasure_id;type:uuid;default:gen_random_uuid();primaryKey" json:"erasure_id"`
+	UserID        uint64         `gorm:"column:user_id;not null;index" json:"user_id"`
+	RequestedBy   uint64         `gorm:"column:requested_by;not null" json:"requested_by"`
+	Reason        string         `gorm:"column:reason" json:"reason"`
+	Status        string         `gorm:"column:status;size:20;not null" json:"status"`
+	DryRunReport  datatypes.JSON `gorm:"column:dry_run_report" json:"dry_run_report"`
+	ScheduledFor  time.Time      `gorm:"column:scheduled_for;not null" json:"scheduled_for"`
+	CreatedAt     time.Time      `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	CancelledAt   *time.Time     `gorm:"column:cancelled_at" json:"cancelled_at,omitempty"`
+	ExecutedAt    *time.Time     `gorm:"column:executed_at" json:"executed_at,omitempty"`
+	FailureReason string         `gorm:"column:failure_reason" json:"failure_reason,omitempty"`
+	CertificateId *uint64        `gorm:"column:certificate_id" json:"certificate_id,omitempty"`
+}
+
+func (PatientErasureRequest) TableName() string {
+	return "tbl_patient_erasure_request"
+}
+
+// ErasureTableCount is the number of rows of one table an erasure deletes or anonymizes.
+type ErasureTableCount struct {
+	Table  string `json:"table"`
+	Action string `json:"action"`
+	Rows   int64  `json:"rows"`
+}
+
+// ErasureReport is the dry-run result: what an erasure of UserID would remove.
+type ErasureReport struct {
+	UserID          uint64              `json:"user_id"`
+	Tables          []ErasureTableCount `json:"tables"`
+	TotalRows       int64               `json:"total_rows"`
+	StoredFiles     int                 `json:"stored_files"`
+	GracePeriodDays int                 `json:"grace_period_days"`
+	PendingRequest  *uuid.UUID          `json:"pending_request,omitempty"`
+}
+
+// ErasureSummary is what an executed erasure removed, as recorded on its certificate.
+type ErasureSummary struct {
+	Tables          []ErasureTableCount `json:"tables"`
+	TotalRows       int64               `json:"total_rows"`
+	StoredFiles     int                 `json:"stored_files"`
+	KeycloakRevoked bool                `json:"keycloak_revoked"`
+}
+
+type ErasureRequestInput struct {
+	UserID *uint64 `json:"user_id"`
+	Reason string  `json:"reason"`
+}
+
+// ErasureCertificate is the audit log entry proving an erasure ran. Entries form a hash chain:
+// Hash signs the entry together with the previous entry's hash, so editing or removing any
+// certificate breaks verification of every later one. Summary is stored as text, not jsonb,
+// so the signed bytes come back unchanged.
+type ErasureCertificate struct {
+	CertificateId uint64         `gorm:"column:certificate_id;primaryKey;autoIncrement" json:"certificate_id"`
+	ErasureId     uuid.UUID      `gorm:"column:erasure_id;type:uuid;not null;uniqueIndex" json:"erasure_id"`
+	SubjectHash   string         `gorm:"column:subject_hash;size:64;not null" json:"subject_hash"`
+	RequestedBy   uint64         `gorm:"column:requested_by" json:"requested_by"`
+	Summary       datatypes.JSON `gorm:"column:summary;type:text" json:"summary"`
+	ExecutedAt    time.Time      `gorm:"column:executed_at;type:timestamptz;not null" json:"executed_at"`
+	PrevHash      string         `gorm:"column:prev_hash" json:"prev_hash"`
+	Hash          string         `gorm:"column:hash;not null" json:"hash"`
+}
+
+func (ErasureCertificate) TableName() string {
+	return "tbl_erasure_certificate_audit"
+}
+
+type ErasureCertificateVerification struct {
+	Checked             int     `json:"checked"`
+	Valid               bool    `json:"valid"`
+	BrokenCertificateId *uint64 `json:"broken_certificate_id,omitempty"`
+}
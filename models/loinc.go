@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// LoincCode is an entry of the LOINC subset imported by admins. Tests and components refer to
+// it through their test_loinc_code and test_component_loinc_code columns.
+type LoincCode struct {
+	LoincNum       string    `gorm:"column:loinc_num;primaryKey;size:10" json:"loinc_num"`
+	LongCommonName string    `gorm:"column:long_common_name" json:"long_common_name"`
+	ShortName      string    `gorm:"column:short_name" json:"short_name"`
+	Component      string    `gorm:"column:component" json:"component"`
+	Property       string    `gorm:"column:property" json:"property"`
+	TimeAspect     string    `gorm:"column:time_aspect" json:"time_aspect"`
+	System         string    `gorm:"column:system" json:"system"`
+	ScaleType      string    `gorm:"column:scale_type" json:"scale_type"`
+	Class          string    `gorm:"column:class" json:"class"`
+	ExampleUnits   string    `gorm:"column:example_units" json:"example_units"`
+	Status         string    `gorm:"column:status;size:20" json:"status"`
+	CreatedBy      string    `gorm:"column:created_by" json:"created_by"`
+	CreatedAt      time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (LoincCode) TableName() string {
+	return "tbl_loinc_code"
+}
+
+// LoincCodeDetail is a LOINC code with the master tests and components mapped to it.
+type LoincCodeDetail struct {
+	LoincCode
+	Tests      []DiagnosticTest          `json:"tests"`
+	Components []DiagnosticTestComponent `json:"components"`
+}
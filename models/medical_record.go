@@ -30,7 +30,17 @@ type TblMedicalRecord struct {
 	Metadata                datatypes.JSON `gorm:"column:metadata;" json:"metadata"`
 	DocTypeResponseMetaData datatypes.JSON `gorm:"column:doctype_response_meta_data;" json:"doctype_response_meta_data"`
 	IsDeleted               int            `gorm:"column:is_deleted;default:0" json:"is_deleted"`
+	DeletedAt               *time.Time     `gorm:"column:deleted_at" json:"deleted_at,omitempty"`
 	DigitizeFlag            int            `gorm:"column:digitize_flag;default:0" json:"digitize_flag"`
+	DataKey                 string         `gorm:"column:data_key;type:text" json:"-"`
+	KeyVersion              int            `gorm:"column:key_version;default:0" json:"key_version"`
+	ContentHash             string         `gorm:"column:content_hash;type:varchar(64)" json:"content_hash"`
+	OwnerId                 *uint64        `gorm:"column:owner_id" json:"-"`
+	SourceDocumentId        string         `gorm:"-" json:"-"`
+	ThumbnailUrl            string         `gorm:"column:thumbnail_url" json:"-"`
+	PreviewStatus           string         `gorm:"column:preview_status;type:varchar(20)" json:"preview_status"`
+	PageCount               int            `gorm:"column:page_count;default:0" json:"page_count"`
+	SealedPDFPassword       string         `gorm:"column:sealed_pdf_password;type:text" json:"-"`
 
 	Status              constant.JobStatus `gorm:"type:status_enum" json:"status"`
 	RetryCount          int                `gorm:"column:retry_count;default:0" json:"retry_count"`
@@ -49,13 +59,104 @@ type TblMedicalRecord struct {
 	PDFPassword               string   `gorm:"-" json:"pdf_password,omitempty"`
 	PatientName               string   `gorm:"-" json:"patient_name,omitempty"`
 	PatientDiagnosticReportId *uint64  `gorm:"-" json:"patient_diagnostic_report_id,omitempty"`
+	DigitizationPriority      string   `gorm:"-" json:"-"`
 	Tags                      []string `gorm:"-" json:"tags"`
+	IsDuplicate               bool     `gorm:"-" json:"is_duplicate,omitempty"`
 }
 
 func (TblMedicalRecord) TableName() string {
 	return "tbl_medical_record"
 }
 
+type TblMedicalRecordVersion struct {
+	VersionId       uint64    `gorm:"column:version_id;primaryKey;autoIncrement" json:"version_id"`
+	RecordId        uint64    `gorm:"column:record_id;not null;index" json:"record_id"`
+	Action          string    `gorm:"column:action;size:20;not null" json:"action"`
+	ChangedBy       uint64    `gorm:"column:changed_by;not null" json:"changed_by"`
+	ChangeTimestamp time.Time `gorm:"column:change_timestamp;autoCreateTime" json:"change_timestamp"`
+
+	RecordName        string         `gorm:"column:record_name" json:"record_name"`
+	RecordSize        int64          `gorm:"column:record_size" json:"record_size"`
+	FileType          string         `gorm:"column:file_type" json:"file_type"`
+	UploadSource      string         `gorm:"column:upload_source" json:"upload_source"`
+	UploadDestination string         `gorm:"column:upload_destination" json:"upload_destination"`
+	SourceAccount     string         `gorm:"column:source_account" json:"source_account"`
+	RecordCategory    string         `gorm:"column:record_category" json:"record_category"`
+	RecordSubCategory string         `gorm:"column:record_sub_category" json:"record_sub_category"`
+	Description       string         `gorm:"column:description" json:"description"`
+	RecordUrl         string         `gorm:"column:record_url" json:"-"`
+	FileData          []byte         `gorm:"column:file_data" json:"-"`
+	DataKey           string         `gorm:"column:data_key;type:text" json:"-"`
+	KeyVersion        int            `gorm:"column:key_version" json:"-"`
+	ContentHash       string         `gorm:"column:content_hash;type:varchar(64)" json:"content_hash"`
+	Metadata          datatypes.JSON `gorm:"column:metadata" json:"metadata"`
+	Status            string         `gorm:"column:status" json:"status"`
+	IsVerified        bool           `gorm:"column:is_verified" json:"is_verified"`
+	IsDeleted         int            `gorm:"column:is_deleted" json:"is_deleted"`
+	CreatedAt         time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt         time.Time      `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (TblMedicalRecordVersion) TableName() string {
+	return "tbl_medical_record_version"
+}
+
+// PatientDataExport is a generated archive of everything held for a patient. ExportId is
+// the id of the process that built it.
+type PatientDataExport struct {
+	ExportId          uuid.UUID  `gorm:"column:export_id;type:uuid;primaryKey" json:"export_id"`
+	UserID            uint64     `gorm:"column:user_id;not null;index" json:"user_id"`
+	RequestedBy       uint64     `gorm:"column:requested_by;not null" json:"requested_by"`
+	Status            string     `gorm:"column:status;size:20;not null" json:"status"`
+	FileUrl           string     `gorm:"column:file_url" json:"-"`
+	UploadDestination string     `gorm:"column:upload_destination" json:"-"`
+	DataKey           string     `gorm:"column:data_key;type:text" json:"-"`
+	KeyVersion        int        `gorm:"column:key_version" json:"-"`
+	FileSize          int64      `gorm:"column:file_size" json:"file_size"`
+	ExpiresAt         *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	CreatedAt         time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	CompletedAt       *time.Time `gorm:"column:completed_at" json:"completed_at"`
+	DownloadURL       string     `gorm:"-" json:"download_url,omitempty"`
+}
+
+func (PatientDataExport) TableName() string {
+	return "tbl_patient_data_export"
+}
+
+type PatientDataExportPayload struct {
+	ExportId uuid.UUID `json:"export_id"`
+}
+
+// PatientDataBundle is the machine readable part of a patient data export.
+type PatientDataBundle struct {
+	ExportedAt        time.Time                   `json:"exported_at"`
+	Profile           *SystemUser_                `json:"profile"`
+	Prescriptions     []PatientPrescription       `json:"prescriptions"`
+	DiagnosticReports []map[string]interface{}    `json:"diagnostic_reports"`
+	Allergies         []PatientAllergyRestriction `json:"allergies"`
+	DiseaseProfiles   []PatientDiseaseProfile     `json:"disease_profiles"`
+	Reminders         []UserReminder              `json:"reminders"`
+	Records           []ExportedRecord            `json:"records"`
+}
+
+// ExportedRecord lists a record file in the export and where it sits in the archive.
+type ExportedRecord struct {
+	RecordId          uint64    `json:"record_id"`
+	RecordName        string    `json:"record_name"`
+	RecordCategory    string    `json:"record_category"`
+	RecordSubCategory string    `json:"record_sub_category"`
+	FileType          string    `json:"file_type"`
+	UploadSource      string    `json:"upload_source"`
+	ContentHash       string    `json:"content_hash"`
+	CreatedAt         time.Time `json:"created_at"`
+	FilePath          string    `json:"file_path,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+type RestoreRecordRequest struct {
+	VersionId uint64 `json:"version_id"`
+}
+
 type TblMedicalRecordUserMapping struct {
 	MedicalRecordUserMappingId uint64 `gorm:"primaryKey;autoIncrement" json:"medical_record_user_mapping_id"`
 	UserID                     uint64 `gorm:"column:user_id;not null" json:"user_id"`
@@ -134,6 +235,9 @@ type MedicalRecordResponseRes struct {
 	RecordName                string                     `json:"record_name"`
 	RecordSize                int64                      `json:"record_size"`
 	RecordURL                 string                     `json:"record_url"`
+	ThumbnailURL              string                     `json:"thumbnail_url"`
+	PreviewStatus             string                     `json:"preview_status"`
+	PageCount                 int                        `json:"page_count"`
 	RecordDescription         string                     `json:"record_description"`
 	IsVerified                bool                       `json:"is_verified"`
 	SourceAccount             string                     `json:"source_account"`
@@ -155,11 +259,12 @@ type DigitizationPayload struct {
 	Category                  string    `json:"category"`
 	FileName                  string    `json:"file_name"`
 	RecordURL                 string    `json:"record_url"`
+	UploadDestination         string    `json:"upload_destination"`
 	AttachmentId              *string   `json:"attachment_id"`
 	ProcessID                 uuid.UUID `json:"process_id"`
 	IsPasswordProtected       *bool     `json:"is_password_protected"`
-	PDFPassword               *string   `json:"pdf_password,omitempty"`
 	PatientDiagnosticReportId *uint64   `json:"patient_diagnostic_report_id,omitempty"`
+	Priority                  string    `json:"priority,omitempty"`
 }
 
 type DocTypeCheckPayload struct {
@@ -169,6 +274,25 @@ type DocTypeCheckPayload struct {
 	ProcessID    uuid.UUID `json:"process_id"`
 }
 
+type RecordSearchResult struct {
+	RecordID                  uint64    `gorm:"column:record_id" json:"record_id"`
+	PatientID                 uint64    `gorm:"column:patient_id" json:"patient_id"`
+	PatientDiagnosticReportID *uint64   `gorm:"column:patient_diagnostic_report_id" json:"patient_diagnostic_report_id,omitempty"`
+	RecordName                string    `gorm:"column:record_name" json:"record_name"`
+	RecordCategory            string    `gorm:"column:record_category" json:"record_category"`
+	ReportName                string    `gorm:"column:report_name" json:"report_name,omitempty"`
+	LabName                   string    `gorm:"column:lab_name" json:"lab_name,omitempty"`
+	CreatedAt                 time.Time `gorm:"column:created_at" json:"created_at"`
+	Rank                      float64   `gorm:"column:rank" json:"rank"`
+	Snippet                   string    `gorm:"column:snippet" json:"snippet"`
+	RecordURL                 string    `gorm:"-" json:"record_url"`
+	Total                     int64     `gorm:"column:total" json:"-"`
+}
+
+type RecordPreviewPayload struct {
+	RecordID uint64 `json:"record_id"`
+}
+
 type AddTagRequest struct {
 	UserId                    uint64   `json:"user_id"`
 	RecordId                  *uint64  `json:"record_id,omitempty"`
@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"time"
+
+	"gorm.io/datatypes"
 )
 
 type DiagnosticLab struct {
@@ -132,27 +134,106 @@ func (PatientReportAttachment) TableName() string {
 }
 
 type PatientDiagnosticTestResultValue struct {
-	TestResultValueId         int       `gorm:"column:test_result_value_id;primaryKey;autoIncrement" json:"test_result_value_id"`
-	PatientDiagnosticReportId uint64    `gorm:"column:patient_diagnostic_report_id" json:"patient_diagnostic_report_id"`
-	DiagnosticTestId          uint64    `gorm:"column:diagnostic_test_id" json:"diagnostic_test_id"`
-	PatientId                 uint64    `gorm:"column:patient_id" json:"patient_id"`
-	DiagnosticTestComponentId uint64    `gorm:"column:diagnostic_test_component_id" json:"diagnostic_test_component_id"`
-	ResultValue               float64   `gorm:"column:result_value" json:"result_value"`
-	ResultStatus              string    `gorm:"column:result_status" json:"result_status"`
-	ResultDate                time.Time `gorm:"column:result_date" json:"result_date"`
-	ResultComment             string    `gorm:"column:result_comment" json:"result_comment"`
-	CreatedAt                 time.Time `gorm:"column:created_at" json:"created_at"`
-	UpdatedAt                 time.Time `gorm:"column:updated_at" json:"updated_at"`
-	UDF1                      string    `gorm:"column:udf1" json:"udf1"`
-	UDF2                      string    `gorm:"column:udf2" json:"udf2"`
-	UDF3                      string    `gorm:"column:udf3" json:"udf3"`
-	UDF4                      string    `gorm:"column:udf4" json:"udf4"`
+	TestResultValueId         int            `gorm:"column:test_result_value_id;primaryKey;autoIncrement" json:"test_result_value_id"`
+	PatientDiagnosticReportId uint64         `gorm:"column:patient_diagnostic_report_id" json:"patient_diagnostic_report_id"`
+	DiagnosticTestId          uint64         `gorm:"column:diagnostic_test_id" json:"diagnostic_test_id"`
+	PatientId                 uint64         `gorm:"column:patient_id" json:"patient_id"`
+	DiagnosticTestComponentId uint64         `gorm:"column:diagnostic_test_component_id" json:"diagnostic_test_component_id"`
+	ResultValue               float64        `gorm:"column:result_value" json:"result_value"`
+	ResultUnit                string         `gorm:"column:result_unit" json:"result_unit"`
+	OriginalValue             *float64       `gorm:"column:original_result_value" json:"original_result_value,omitempty"`
+	OriginalUnit              string         `gorm:"column:original_unit" json:"original_unit,omitempty"`
+	AppliedRangeSource        string         `gorm:"column:applied_range_source" json:"applied_range_source,omitempty"`
+	AppliedRangeId            *uint64        `gorm:"column:applied_range_id" json:"applied_range_id,omitempty"`
+	AppliedNormalMin          *float64       `gorm:"column:applied_normal_min" json:"applied_normal_min,omitempty"`
+	AppliedNormalMax          *float64       `gorm:"column:applied_normal_max" json:"applied_normal_max,omitempty"`
+	AppliedRangeUnits         string         `gorm:"column:applied_range_units" json:"applied_range_units,omitempty"`
+	AppliedRangeReason        string         `gorm:"column:applied_range_reason" json:"applied_range_reason,omitempty"`
+	RangeFlag                 string         `gorm:"column:range_flag" json:"range_flag,omitempty"`
+	IsDerived                 bool           `gorm:"column:is_derived;default:false" json:"is_derived"`
+	DerivedFormula            string         `gorm:"column:derived_formula" json:"derived_formula,omitempty"`
+	DerivedInputs             datatypes.JSON `gorm:"column:derived_inputs" json:"derived_inputs,omitempty"`
+	Source                    string         `gorm:"column:source;default:ai" json:"source"`
+	VerifiedBy                *uint64        `gorm:"column:verified_by" json:"verified_by,omitempty"`
+	VerifiedAt                *time.Time     `gorm:"column:verified_at" json:"verified_at,omitempty"`
+	ResultStatus              string         `gorm:"column:result_status" json:"result_status"`
+	ResultDate                time.Time      `gorm:"column:result_date" json:"result_date"`
+	ResultComment             string         `gorm:"column:result_comment" json:"result_comment"`
+	CreatedAt                 time.Time      `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt                 time.Time      `gorm:"column:updated_at" json:"updated_at"`
+	UDF1                      string         `gorm:"column:udf1" json:"udf1"`
+	UDF2                      string         `gorm:"column:udf2" json:"udf2"`
+	UDF3                      string         `gorm:"column:udf3" json:"udf3"`
+	UDF4                      string         `gorm:"column:udf4" json:"udf4"`
 }
 
 func (PatientDiagnosticTestResultValue) TableName() string {
 	return "tbl_patient_diagnostic_test_result_value"
 }
 
+// ManualResultRequest adds a result to a report by hand or corrects an existing one. The
+// component of an existing result cannot be changed; delete it and add another instead.
+type ManualResultRequest struct {
+	DiagnosticTestComponentId uint64     `json:"diagnostic_test_component_id"`
+	DiagnosticTestId          uint64     `json:"diagnostic_test_id,omitempty"`
+	ResultValue               *float64   `json:"result_value" binding:"required"`
+	ResultUnit                string     `json:"result_unit"`
+	Qualifier                 string     `json:"qualifier"`
+	ResultComment             string     `json:"result_comment"`
+	ResultDate                *time.Time `json:"result_date,omitempty"`
+	Source                    string     `json:"source"`
+	Reason                    string     `json:"reason"`
+}
+
+// PatientDiagnosticResultAudit is one change made to a stored result. AiResultValue keeps the
+// value the AI originally extracted, so it survives any number of corrections.
+type PatientDiagnosticResultAudit struct {
+	ResultAuditId             uint64    `gorm:"column:result_audit_id;primaryKey;autoIncrement" json:"result_audit_id"`
+	TestResultValueId         int       `gorm:"column:test_result_value_id;not null;index" json:"test_result_value_id"`
+	PatientDiagnosticReportId uint64    `gorm:"column:patient_diagnostic_report_id;not null" json:"patient_diagnostic_report_id"`
+	PatientId                 uint64    `gorm:"column:patient_id;not null;index" json:"patient_id"`
+	DiagnosticTestComponentId uint64    `gorm:"column:diagnostic_test_component_id" json:"diagnostic_test_component_id"`
+	OperationType             string    `gorm:"column:operation_type;size:20" json:"operation_type"`
+	PreviousValue             *float64  `gorm:"column:previous_value" json:"previous_value,omitempty"`
+	PreviousUnit              string    `gorm:"column:previous_unit" json:"previous_unit,omitempty"`
+	PreviousSource            string    `gorm:"column:previous_source;size:20" json:"previous_source,omitempty"`
+	NewValue                  *float64  `gorm:"column:new_value" json:"new_value,omitempty"`
+	NewUnit                   string    `gorm:"column:new_unit" json:"new_unit,omitempty"`
+	NewSource                 string    `gorm:"column:new_source;size:20" json:"new_source,omitempty"`
+	AiResultValue             *float64  `gorm:"column:ai_result_value" json:"ai_result_value,omitempty"`
+	AiResultUnit              string    `gorm:"column:ai_result_unit" json:"ai_result_unit,omitempty"`
+	Reason                    string    `gorm:"column:reason" json:"reason,omitempty"`
+	ChangedBy                 uint64    `gorm:"column:changed_by;not null" json:"changed_by"`
+	CreatedAt                 time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+}
+
+func (PatientDiagnosticResultAudit) TableName() string {
+	return "tbl_patient_diagnostic_result_audit"
+}
+
+// DerivedMetricInput is one value a derived result was calculated from: a stored result, or a
+// patient attribute such as age, sex or weight.
+type DerivedMetricInput struct {
+	Name                      string  `json:"name"`
+	DiagnosticTestComponentId uint64  `json:"diagnostic_test_component_id,omitempty"`
+	TestResultValueId         int     `json:"test_result_value_id,omitempty"`
+	Value                     float64 `json:"value"`
+	Unit                      string  `json:"unit,omitempty"`
+	Text                      string  `json:"text,omitempty"`
+}
+
+// DerivationSource is a stored result that can feed a derived metric.
+type DerivationSource struct {
+	TestResultValueId         int
+	PatientDiagnosticReportId uint64
+	DiagnosticTestComponentId uint64
+	TestComponentName         string
+	LoincCode                 string
+	ResultValue               float64
+	ResultUnit                string
+	ResultDate                time.Time
+}
+
 type Diagnostic_Test_Component_ReferenceRange struct {
 	TestName          string `json:"test_name"`
 	TestComponentName string `json:"test_component_name"`
@@ -180,6 +261,24 @@ func (DiagnosticTestReferenceRange) TableName() string {
 	return "tbl_diagnostic_test_reference_range"
 }
 
+// DiagnosticTestComponentUnit registers a unit a component may be reported in. A value v in
+// Unit equals v*Factor + Offset in the component's canonical unit, the row with IsCanonical.
+type DiagnosticTestComponentUnit struct {
+	ComponentUnitId           uint64    `gorm:"column:component_unit_id;primaryKey;autoIncrement" json:"component_unit_id"`
+	DiagnosticTestComponentId uint64    `gorm:"column:diagnostic_test_component_id;not null;uniqueIndex:idx_component_unit" json:"diagnostic_test_component_id"`
+	Unit                      string    `gorm:"column:unit;size:50;not null;uniqueIndex:idx_component_unit" json:"unit"`
+	IsCanonical               bool      `gorm:"column:is_canonical;default:false" json:"is_canonical"`
+	Factor                    float64   `gorm:"column:factor;not null;default:1" json:"factor"`
+	Offset                    float64   `gorm:"column:unit_offset;not null;default:0" json:"offset"`
+	CreatedBy                 string    `gorm:"column:created_by" json:"created_by"`
+	CreatedAt                 time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt                 time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (DiagnosticTestComponentUnit) TableName() string {
+	return "tbl_diagnostic_test_component_unit"
+}
+
 type DiagnosticTestReferenceRangeAudit struct {
 	TestReferenceRangeAuditId uint64    `json:"test_reference_range_audit_id" gorm:"primaryKey;autoIncrement"`
 	TestReferenceRangeId      uint64    `json:"test_reference_range_id"`
@@ -231,6 +330,8 @@ type DiagnosticResultRequest struct {
 	ResultDateStart           *time.Time `json:"result_date_start,omitempty"`
 	ResultDateEnd             *time.Time `json:"result_date_end,omitempty"`
 	IsPinned                  *bool      `json:"is_pinned,omitempty"`
+	DisplayUnit               *string    `json:"display_unit,omitempty"`
+	TrendWindowDays           []int      `json:"trend_window_days,omitempty"`
 }
 
 type ResultSummary struct {
@@ -314,24 +415,30 @@ type LabReport struct {
 		LabContactNumber string  `json:"lab_contact_number"`
 	} `json:"report_details"`
 	Tests []struct {
-		TestName       string `json:"test_name"`
-		Interpretation string `json:"interpretation"`
-		Components     []struct {
-			TestComponentName              string  `json:"test_component_name"`
-			ResultValue                    string  `json:"result_value"`
-			Status                         string  `json:"status"`
-			Units                          string  `json:"units"`
-			Qualifier                      *string `json:"qualifier,omitempty"`
-			BiologicalReferenceDescription *string `json:"biological_reference_description"`
-			ReferenceRange                 struct {
-				Min string `json:"min"`
-				Max string `json:"max"`
-			} `json:"reference_range"`
-		} `json:"components"`
+		TestName       string               `json:"test_name"`
+		Interpretation string               `json:"interpretation"`
+		Components     []LabReportComponent `json:"components"`
 	} `json:"tests"`
 	RawText string `json:"raw_text"`
 }
 
+// LabReportComponent is one extracted result. Confidence is the extractor's overall confidence
+// between 0 and 1, and FieldConfidence the confidence per field, keyed by its json name.
+type LabReportComponent struct {
+	TestComponentName              string  `json:"test_component_name"`
+	ResultValue                    string  `json:"result_value"`
+	Status                         string  `json:"status"`
+	Units                          string  `json:"units"`
+	Qualifier                      *string `json:"qualifier,omitempty"`
+	BiologicalReferenceDescription *string `json:"biological_reference_description"`
+	ReferenceRange                 struct {
+		Min string `json:"min"`
+		Max string `json:"max"`
+	} `json:"reference_range"`
+	Confidence      *float64           `json:"confidence,omitempty"`
+	FieldConfidence map[string]float64 `json:"field_confidence,omitempty"`
+}
+
 type PatientData struct {
 	Patient PatientBasicInfo `json:"patient"`
 }
@@ -426,6 +533,7 @@ type DiagnosticReportResponse struct {
 	DiagnosticTestComponentID uint64  `json:"diagnostic_test_component_id"`
 	TestComponentName         string  `json:"test_component_name"`
 	ResultValue               string  `json:"result_value"`
+	ResultUnit                string  `json:"result_unit"`
 	NormalMin                 float64 `json:"normal_min"`
 	NormalMax                 float64 `json:"normal_max"`
 	Units                     string  `json:"units"`
@@ -454,6 +562,7 @@ type DiagnosticReportFilter struct {
 	ReportDate        *string `json:"report_date,omitempty"`
 	OrderBy           *string `json:"order_by,omitempty"`
 	OrderDir          *string `json:"order_dir,omitempty"`
+	DisplayUnit       *string `json:"display_unit,omitempty"`
 }
 
 type PatientTestComponentDisplayConfig struct {
@@ -649,6 +758,7 @@ type ReportRow struct {
 	// Test result value fields
 	// ResultValue       interface{}
 	ResultValue     string
+	ResultUnit      string
 	ResultStatus    string
 	ResultDate      string
 	ResultComment   string
@@ -678,6 +788,7 @@ type ReportRow struct {
 type ComponentKey struct {
 	ComponentID uint64
 	Name        string
+	LoincCode   string
 	Units       string
 	RefRange    string
 	ReportName  string
@@ -107,9 +107,11 @@ type LabInfoData struct {
 // TestResult represents a single test component's result
 type TestResult struct {
 	TestComponentName string
+	LoincCode         string
 	Unit              string
 	RefRange          string
 	TrendValues       []Cell
+	Analytics         *TrendAnalytics
 }
 
 // CellData represents a single trend value with its date
@@ -121,6 +123,7 @@ type Cell struct {
 
 // ReportData combines all data needed for the PDF report
 type ReportData struct {
+	Title       string
 	Patient     PatientInfoData
 	Lab         LabInfoData
 	TestResults []TestResult
@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// ReportComparisonRequest picks the two sides of a comparison, either by report id or by
+// report date (YYYY-MM-DD). All reports of a date are compared together.
+type ReportComparisonRequest struct {
+	ReportIdA *uint64
+	ReportIdB *uint64
+	DateA     *time.Time
+	DateB     *time.Time
+}
+
+// ComparisonResultRow is one result of a compared report, with merged alias components
+// reported under the component they were merged into.
+type ComparisonResultRow struct {
+	ReportId                  uint64
+	ReportDate                time.Time
+	DiagnosticTestComponentId uint64
+	TestComponentName         string
+	LoincCode                 string
+	TestName                  string
+	ResultValue               float64
+	ResultUnit                string
+	ResultStatus              string
+	Qualifier                 string
+	NormalMin                 *float64
+	NormalMax                 *float64
+	RangeFlag                 string
+	ResultDate                time.Time
+}
+
+// ReportComparisonSide describes the reports on one side of a comparison.
+type ReportComparisonSide struct {
+	ReportIds  []uint64  `json:"report_ids"`
+	ReportName string    `json:"report_name"`
+	ReportDate time.Time `json:"report_date"`
+	Label      string    `json:"label"`
+}
+
+// ComparedValue is the result of a component on one side of a comparison.
+type ComparedValue struct {
+	ReportId   uint64    `json:"patient_diagnostic_report_id"`
+	Value      string    `json:"value"`
+	Numeric    *float64  `json:"numeric_value,omitempty"`
+	Unit       string    `json:"unit"`
+	NormalMin  *float64  `json:"normal_min,omitempty"`
+	NormalMax  *float64  `json:"normal_max,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ResultDate time.Time `json:"result_date"`
+}
+
+// ComponentComparison aligns one component across the two sides. Change is new, missing,
+// changed or unchanged; Transition names a status change such as normal_to_high, or
+// normal_to_abnormal for a qualitative result that turned positive.
+type ComponentComparison struct {
+	DiagnosticTestComponentId uint64         `json:"diagnostic_test_component_id"`
+	TestComponentName         string         `json:"test_component_name"`
+	TestName                  string         `json:"test_name"`
+	LoincCode                 string         `json:"loinc_code,omitempty"`
+	Before                    *ComparedValue `json:"before,omitempty"`
+	After                     *ComparedValue `json:"after,omitempty"`
+	Delta                     *float64       `json:"delta,omitempty"`
+	PercentChange             *float64       `json:"percent_change,omitempty"`
+	Change                    string         `json:"change"`
+	Transition                string         `json:"transition,omitempty"`
+}
+
+type ReportComparison struct {
+	Before       ReportComparisonSide  `json:"before"`
+	After        ReportComparisonSide  `json:"after"`
+	Components   []ComponentComparison `json:"components"`
+	NewTests     []string              `json:"new_tests"`
+	MissingTests []string              `json:"missing_tests"`
+	Summary      map[string]int        `json:"summary"`
+}
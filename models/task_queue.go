@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// TaskQueueStatus is the backlog of one asynq queue. BacklogAgeSeconds is how long the oldest
+// pending task has been waiting.
+type TaskQueueStatus struct {
+	Queue             string  `json:"queue"`
+	Paused            bool    `json:"paused"`
+	Size              int     `json:"size"`
+	Pending           int     `json:"pending"`
+	Active            int     `json:"active"`
+	Scheduled         int     `json:"scheduled"`
+	Retry             int     `json:"retry"`
+	Archived          int     `json:"archived"`
+	Completed         int     `json:"completed"`
+	ProcessedToday    int     `json:"processed_today"`
+	FailedToday       int     `json:"failed_today"`
+	BacklogAgeSeconds float64 `json:"backlog_age_seconds"`
+}
+
+type TaskQueueOverview struct {
+	AIServiceUp bool              `json:"ai_service_up"`
+	Queues      []TaskQueueStatus `json:"queues"`
+	CheckedAt   time.Time         `json:"checked_at"`
+}
@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+// TrendAnalytics summarises the history of one test component.
+type TrendAnalytics struct {
+	Points              int                 `json:"points"`
+	LatestValue         float64             `json:"latest_value"`
+	LatestDate          time.Time           `json:"latest_date"`
+	PreviousValue       *float64            `json:"previous_value,omitempty"`
+	PercentChange       *float64            `json:"percent_change,omitempty"`
+	RateOfChangePerDay  *float64            `json:"rate_of_change_per_day,omitempty"`
+	Windows             []TrendWindow       `json:"windows"`
+	MovingAverageWindow int                 `json:"moving_average_window"`
+	MovingAverage       []TrendAveragePoint `json:"moving_average,omitempty"`
+	Drift               *TrendDrift         `json:"drift,omitempty"`
+}
+
+// TrendWindow is the least-squares slope of the results taken in the last Days days.
+type TrendWindow struct {
+	Days        int      `json:"days"`
+	Points      int      `json:"points"`
+	SlopePerDay *float64 `json:"slope_per_day,omitempty"`
+	Change      *float64 `json:"change,omitempty"`
+}
+
+type TrendAveragePoint struct {
+	ResultDate time.Time `json:"result_date"`
+	Value      float64   `json:"value"`
+}
+
+// TrendDrift describes consecutive results moving steadily toward one bound of the reference
+// range.
+type TrendDrift struct {
+	Direction    string  `json:"direction"`
+	Bound        float64 `json:"bound"`
+	Points       int     `json:"points"`
+	ShiftPercent float64 `json:"shift_percent"`
+	InRange      bool    `json:"in_range"`
+	Reason       string  `json:"reason"`
+}
+
+// TrendAnalyticsPoint is one result fed into the analytics.
+type TrendAnalyticsPoint struct {
+	TestResultValueId int
+	ReportId          uint64
+	ResultDate        time.Time
+	Value             float64
+	NormalMin         *float64
+	NormalMax         *float64
+}
+
+// TrendDriftNotice remembers the result a drift notification was sent for, so the same drift
+// is not announced twice.
+type TrendDriftNotice struct {
+	NoticeId                  uint64    `gorm:"column:notice_id;primaryKey;autoIncrement" json:"notice_id"`
+	PatientId                 uint64    `gorm:"column:patient_id;not null;index" json:"patient_id"`
+	DiagnosticTestComponentId uint64    `gorm:"column:diagnostic_test_component_id;not null" json:"diagnostic_test_component_id"`
+	TestResultValueId         int       `gorm:"column:test_result_value_id;not null;uniqueIndex" json:"test_result_value_id"`
+	Direction                 string    `gorm:"column:direction;size:20" json:"direction"`
+	CreatedAt                 time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+}
+
+func (TrendDriftNotice) TableName() string {
+	return "tbl_trend_drift_notice"
+}
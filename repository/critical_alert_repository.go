@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CriticalAlertRepository interface {
+	GetCriticalThreshold(componentId uint64) (*models.DiagnosticCriticalThreshold, error)
+	SaveCriticalThreshold(threshold *models.DiagnosticCriticalThreshold) error
+	DeleteCriticalThreshold(componentId uint64) error
+	GetCriticalCandidates(reportId uint64) ([]models.CriticalCandidate, error)
+	CreateCriticalAlert(alert *models.CriticalResultAlert) (bool, error)
+	GetCriticalAlert(alertId uuid.UUID) (*models.CriticalResultAlert, error)
+	GetCriticalAlerts(patientId uint64, status string, limit, offset int) ([]models.CriticalResultAlert, int64, error)
+	ClaimDueEscalations(now time.Time, maxEscalations int, claimUntil time.Time) ([]models.CriticalResultAlert, error)
+	UpdateCriticalAlert(alertId uuid.UUID, updates map[string]interface{}) error
+	AcknowledgeCriticalAlert(alertId uuid.UUID, userId uint64, note string) (bool, error)
+	ResolveResultAlert(tx *gorm.DB, testResultValueId int, userId uint64, note string) error
+	SaveEscalations(escalations []models.CriticalAlertEscalation) error
+	GetEscalationRecipients(patientId uint64, mappingTypes []string) ([]models.CriticalAlertRecipient, error)
+}
+
+type CriticalAlertRepositoryImpl struct {
+	db *gorm.DB
+}
+
+func NewCriticalAlertRepository(db *gorm.DB) CriticalAlertRepository {
+	return &CriticalAlertRepositoryImpl{db: db}
+}
+
+func (r *CriticalAlertRepositoryImpl) GetCriticalThreshold(componentId uint64) (*models.DiagnosticCriticalThreshold, error) {
+	var threshold models.DiagnosticCriticalThreshold
+	if err := r.db.Where("diagnostic_test_component_id = ?", componentId).First(&threshold).Error; err != nil {
+		return nil, err
+	}
+	return &threshold, nil
+}
+
+func (r *CriticalAlertRepositoryImpl) SaveCriticalThreshold(threshold *models.DiagnosticCriticalThreshold) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "diagnostic_test_component_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"critical_low", "critical_high", "units", "is_active", "updated_at"}),
+	}).Create(threshold).Error
+}
+
+func (r *CriticalAlertRepositoryImpl) DeleteCriticalThreshold(componentId uint64) error {
+	result := r.db.Where("diagnostic_test_component_id = ?", componentId).Delete(&models.DiagnosticCriticalThreshold{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetCriticalCandidates returns the numeric results of a report whose component has an active
+// critical threshold and that have not raised an alert yet.
+func (r *CriticalAlertRepositoryImpl) GetCriticalCandidates(reportId uint64) ([]models.CriticalCandidate, error) {
+	var candidates []models.CriticalCandidate
+	err := r.db.Raw(`
+		SELECT pdtrv.test_result_value_id, pdtrv.patient_id, pdtrv.patient_diagnostic_report_id,
+			pdtrv.diagnostic_test_component_id, COALESCE(comp.test_component_name, '') AS test_component_name,
+			pdtrv.result_value, COALESCE(pdtrv.result_unit, '') AS result_unit, pdtrv.result_date,
+			t.critical_low, t.critical_high, COALESCE(t.units, '') AS threshold_units
+		FROM tbl_patient_diagnostic_test_result_value pdtrv
+		INNER JOIN tbl_diagnostic_critical_threshold t
+			ON t.diagnostic_test_component_id = pdtrv.diagnostic_test_component_id AND t.is_active = TRUE
+		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master comp
+			ON comp.diagnostic_test_component_id = pdtrv.diagnostic_test_component_id
+		LEFT JOIN tbl_critical_result_alert a
+			ON a.test_result_value_id = pdtrv.test_result_value_id
+		WHERE pdtrv.patient_diagnostic_report_id = ? AND pdtrv.result_value <> 0 AND a.alert_id IS NULL`, reportId).
+		Scan(&candidates).Error
+	return candidates, err
+}
+
+// CreateCriticalAlert stores the alert unless one already exists for the result, and reports
+// whether it was created. The alert of a result that was corrected is raised again with the
+// corrected value.
+func (r *CriticalAlertRepositoryImpl) CreateCriticalAlert(alert *models.CriticalResultAlert) (bool, error) {
+	result := r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "test_result_value_id"}},
+		Where:   clause.Where{Exprs: []clause.Expression{clause.Eq{Column: clause.Column{Table: "tbl_critical_result_alert", Name: "status"}, Value: constant.CriticalAlertResolved}}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"result_value":       alert.ResultValue,
+			"result_unit":        alert.ResultUnit,
+			"result_date":        alert.ResultDate,
+			"breach":             alert.Breach,
+			"threshold_value":    alert.ThresholdValue,
+			"status":             constant.CriticalAlertOpen,
+			"escalation_count":   0,
+			"last_escalated_at":  nil,
+			"next_escalation_at": nil,
+			"acknowledged_by":    nil,
+			"acknowledged_at":    nil,
+			"acknowledge_note":   "",
+		}),
+	}).Create(alert)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *CriticalAlertRepositoryImpl) GetCriticalAlert(alertId uuid.UUID) (*models.CriticalResultAlert, error) {
+	var alert models.CriticalResultAlert
+	if err := r.db.Where("alert_id = ?", alertId).First(&alert).Error; err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+func (r *CriticalAlertRepositoryImpl) GetCriticalAlerts(patientId uint64, status string, limit, offset int) ([]models.CriticalResultAlert, int64, error) {
+	var alerts []models.CriticalResultAlert
+	var total int64
+	query := r.db.Model(&models.CriticalResultAlert{}).Where("patient_id = ?", patientId)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&alerts).Error
+	return alerts, total, err
+}
+
+// ClaimDueEscalations returns the open alerts due for escalation and moves their next
+// escalation to claimUntil in the same statement, so each alert is picked up by one replica
+// only. An alert whose escalation never completes is due again after claimUntil.
+func (r *CriticalAlertRepositoryImpl) ClaimDueEscalations(now time.Time, maxEscalations int, claimUntil time.Time) ([]models.CriticalResultAlert, error) {
+	var alerts []models.CriticalResultAlert
+	err := r.db.Raw(`
+		UPDATE tbl_critical_result_alert
+		SET next_escalation_at = ?
+		WHERE alert_id IN (
+			SELECT alert_id FROM tbl_critical_result_alert
+			WHERE status = ? AND next_escalation_at <= ? AND escalation_count < ?
+			ORDER BY next_escalation_at
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`, claimUntil, constant.CriticalAlertOpen, now, maxEscalations).
+		Scan(&alerts).Error
+	return alerts, err
+}
+
+func (r *CriticalAlertRepositoryImpl) UpdateCriticalAlert(alertId uuid.UUID, updates map[string]interface{}) error {
+	return r.db.Model(&models.CriticalResultAlert{}).Where("alert_id = ?", alertId).Updates(updates).Error
+}
+
+// AcknowledgeCriticalAlert closes an open alert and reports whether it was still open.
+func (r *CriticalAlertRepositoryImpl) AcknowledgeCriticalAlert(alertId uuid.UUID, userId uint64, note string) (bool, error) {
+	result := r.db.Model(&models.CriticalResultAlert{}).
+		Where("alert_id = ? AND status = ?", alertId, constant.CriticalAlertOpen).
+		Updates(map[string]interface{}{
+			"status":             constant.CriticalAlertAcknowledged,
+			"acknowledged_by":    userId,
+			"acknowledged_at":    time.Now(),
+			"acknowledge_note":   note,
+			"next_escalation_at": nil,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// ResolveResultAlert closes the open alert of a result that was corrected or deleted, so it is
+// no longer re-escalated. The user and note are kept in the acknowledgement fields.
+func (r *CriticalAlertRepositoryImpl) ResolveResultAlert(tx *gorm.DB, testResultValueId int, userId uint64, note string) error {
+	return tx.Model(&models.CriticalResultAlert{}).
+		Where("test_result_value_id = ? AND status = ?", testResultValueId, constant.CriticalAlertOpen).
+		Updates(map[string]interface{}{
+			"status":             constant.CriticalAlertResolved,
+			"acknowledged_by":    userId,
+			"acknowledged_at":    time.Now(),
+			"acknowledge_note":   note,
+			"next_escalation_at": nil,
+		}).Error
+}
+
+func (r *CriticalAlertRepositoryImpl) SaveEscalations(escalations []models.CriticalAlertEscalation) error {
+	if len(escalations) == 0 {
+		return nil
+	}
+	return r.db.Create(&escalations).Error
+}
+
+func (r *CriticalAlertRepositoryImpl) GetEscalationRecipients(patientId uint64, mappingTypes []string) ([]models.CriticalAlertRecipient, error) {
+	var recipients []models.CriticalAlertRecipient
+	err := r.db.Table("tbl_system_user_role_mapping").
+		Select("DISTINCT user_id, mapping_type").
+		Where("patient_id = ? AND mapping_type IN ? AND is_self = ? AND is_deleted = 0", patientId, mappingTypes, false).
+		Scan(&recipients).Error
+	return recipients, err
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type DeadLetterRepository interface {
+	GetOpenDeadLetter(taskType, taskKey string) (*models.DigitizationDeadLetter, error)
+	CreateDeadLetter(entry *models.DigitizationDeadLetter) error
+	UpdateDeadLetter(deadLetterId uint64, updates map[string]interface{}) error
+	GetDeadLetter(deadLetterId uint64) (*models.DigitizationDeadLetter, error)
+	GetDeadLetters(filter models.DeadLetterFilter, limit, offset int) ([]models.DigitizationDeadLetter, int64, error)
+	ResolveDeadLetters(taskType, taskKey string) error
+	CloseDeadLetter(deadLetterId uint64, fromStatuses []string, updates map[string]interface{}) (bool, error)
+	ScrubDeadLetterPayloads(taskType string, fields []string) (int64, error)
+}
+
+type DeadLetterRepositoryImpl struct {
+	db *gorm.DB
+}
+
+func NewDeadLetterRepository(db *gorm.DB) DeadLetterRepository {
+	return &DeadLetterRepositoryImpl{db: db}
+}
+
+// openDeadLetterStatuses are the states in which a task can still fail again and add to its
+// entry rather than start a new one.
+var openDeadLetterStatuses = []string{constant.DeadLetterRetrying, constant.DeadLetterDead, constant.DeadLetterReplayed}
+
+func (r *DeadLetterRepositoryImpl) GetOpenDeadLetter(taskType, taskKey string) (*models.DigitizationDeadLetter, error) {
+	var entry models.DigitizationDeadLetter
+	err := r.db.Where("task_type = ? AND task_key = ? AND status IN ?", taskType, taskKey, openDeadLetterStatuses).
+		Order("dead_letter_id DESC").First(&entry).Error
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *DeadLetterRepositoryImpl) CreateDeadLetter(entry *models.DigitizationDeadLetter) error {
+	return r.db.Create(entry).Error
+}
+
+func (r *DeadLetterRepositoryImpl) UpdateDeadLetter(deadLetterId uint64, updates map[string]interface{}) error {
+	return r.db.Model(&models.DigitizationDeadLetter{}).Where("dead_letter_id = ?", deadLetterId).Updates(updates).Error
+}
+
+func (r *DeadLetterRepositoryImpl) GetDeadLetter(deadLetterId uint64) (*models.DigitizationDeadLetter, error) {
+	var entry models.DigitizationDeadLetter
+	if err := r.db.Where("dead_letter_id = ?", deadLetterId).First(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetDeadLetters lists entries newest first. The payload is left out; it can hold the whole
+// file of a doc type check and is only needed to replay.
+func (r *DeadLetterRepositoryImpl) GetDeadLetters(filter models.DeadLetterFilter, limit, offset int) ([]models.DigitizationDeadLetter, int64, error) {
+	var entries []models.DigitizationDeadLetter
+	var total int64
+	query := r.db.Model(&models.DigitizationDeadLetter{})
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.TaskType != "" {
+		query = query.Where("task_type = ?", filter.TaskType)
+	}
+	if filter.QueueName != "" {
+		query = query.Where("queue_name = ?", filter.QueueName)
+	}
+	if filter.RecordId != nil {
+		query = query.Where("record_id = ?", *filter.RecordId)
+	}
+	if filter.PatientId != nil {
+		query = query.Where("patient_id = ?", *filter.PatientId)
+	}
+	if filter.From != nil {
+		query = query.Where("updated_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("updated_at < ?", *filter.To)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Omit("payload").Order("updated_at DESC, dead_letter_id DESC").Limit(limit).Offset(offset).Find(&entries).Error
+	return entries, total, err
+}
+
+// ResolveDeadLetters closes the open entries of a task once it has succeeded.
+func (r *DeadLetterRepositoryImpl) ResolveDeadLetters(taskType, taskKey string) error {
+	return r.db.Model(&models.DigitizationDeadLetter{}).
+		Where("task_type = ? AND task_key = ? AND status IN ?", taskType, taskKey, openDeadLetterStatuses).
+		Update("status", constant.DeadLetterResolved).Error
+}
+
+// CloseDeadLetter moves an entry on from one of fromStatuses and reports whether it was still
+// in one of them, so two admins acting on the same entry do not both replay it.
+func (r *DeadLetterRepositoryImpl) CloseDeadLetter(deadLetterId uint64, fromStatuses []string, updates map[string]interface{}) (bool, error) {
+	result := r.db.Model(&models.DigitizationDeadLetter{}).
+		Where("dead_letter_id = ? AND status IN ?", deadLetterId, fromStatuses).
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// ScrubDeadLetterPayloads removes fields from the stored payloads of taskType and returns how
+// many entries held any of them.
+func (r *DeadLetterRepositoryImpl) ScrubDeadLetterPayloads(taskType string, fields []string) (int64, error) {
+	keys := strings.Join(fields, ",")
+	result := r.db.Model(&models.DigitizationDeadLetter{}).
+		Where("task_type = ? AND jsonb_exists_any(payload::jsonb, string_to_array(?, ','))", taskType, keys).
+		Update("payload", gorm.Expr("payload::jsonb - string_to_array(?, ',')", keys))
+	return result.RowsAffected, result.Error
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DiagnosticRepository interface {
@@ -58,6 +59,33 @@ type DiagnosticRepository interface {
 	GetAllDiagnosticReferenceRange() (map[string]models.DiagnosticTestReferenceRange, error)
 	GetTestReferenceRangeAuditRecord(testReferenceRangeId, auditId uint64, limit, offset int) ([]models.Diagnostic_Test_Component_ReferenceRange, int64, error)
 	LoadDiagnosticTestMasterData() (map[string]uint64, map[string]uint64)
+	GetComponentUnits(componentIds []uint64) ([]models.DiagnosticTestComponentUnit, error)
+	SaveComponentUnit(unit *models.DiagnosticTestComponentUnit) error
+	DeleteComponentUnit(componentUnitId uint64) error
+	GetReferenceRanges(componentIds []uint64) ([]models.DiagnosticTestReferenceRange, error)
+	GetTestReferenceRange(testReferenceRangeId uint64) (*models.DiagnosticTestReferenceRange, error)
+	GetPatientTestReferenceRanges(patientId uint64) ([]models.PatientTestReferenceRange, error)
+	GetResultValuesAfter(componentId, patientId *uint64, afterId, limit int) ([]models.PatientDiagnosticTestResultValue, error)
+	UpdateResultValueRange(result *models.PatientDiagnosticTestResultValue) error
+	GetDerivationSources(patientId, reportId uint64) ([]models.DerivationSource, error)
+	DeleteDerivedResults(tx *gorm.DB, reportId, derivedTestId uint64) error
+	GetResultValue(resultId int) (*models.PatientDiagnosticTestResultValue, error)
+	GetComponentTestId(componentId uint64) (uint64, error)
+	EnsurePatientDiagnosticTest(tx *gorm.DB, test *models.PatientDiagnosticTest) error
+	UpdateResultValue(tx *gorm.DB, result *models.PatientDiagnosticTestResultValue) error
+	DeleteResultValue(tx *gorm.DB, resultId int) error
+	SaveResultAudit(tx *gorm.DB, audit *models.PatientDiagnosticResultAudit) error
+	GetResultAudits(resultId int) ([]models.PatientDiagnosticResultAudit, error)
+	LoadComponentAliasNames() (map[string]uint64, error)
+	CreateComponentAlias(tx *gorm.DB, alias *models.DiagnosticTestComponentAliasMapping) error
+	CreateReviewItem(tx *gorm.DB, item *models.DigitizationReviewItem) error
+	GetReviewItem(reviewId uint64) (*models.DigitizationReviewItem, error)
+	GetReviewItems(filter models.ReviewQueueFilter, limit, offset int) ([]models.DigitizationReviewItem, int64, error)
+	CloseReviewItem(tx *gorm.DB, reviewId uint64, updates map[string]interface{}) (bool, error)
+	GetMergeableComponents() ([]models.DiagnosticTestComponent, error)
+	SearchLoincCodes(search string, limit, offset int) ([]models.LoincCode, int64, error)
+	GetLoincCode(loincCode string) (*models.LoincCode, error)
+	GetLoincMappings(loincCode string) ([]models.DiagnosticTest, []models.DiagnosticTestComponent, error)
 	LoadDiagnosticLabData() map[string]uint64
 	GeneratePatientDiagnosticReport(tx *gorm.DB, patientDiagnoReport *models.PatientDiagnosticReport) (*models.PatientDiagnosticReport, error)
 	UpdatePatientDiagnosticReport(tx *gorm.DB, reportId uint64, updates map[string]interface{}) (*models.PatientDiagnosticReport, error)
@@ -65,7 +93,7 @@ type DiagnosticRepository interface {
 	SavePatientReportResultValue(tx *gorm.DB, resultValues *models.PatientDiagnosticTestResultValue) (*models.PatientDiagnosticTestResultValue, error)
 	SavePatientReportAttachmentMapping(tx *gorm.DB, recordMapping *models.PatientReportAttachment) error
 	GetAbnormalValue(patientId uint64) ([]models.TestResultAlert, error)
-	ArchivePatientDiagnosticReport(reportID uint64, isDeleted int) error
+	ArchivePatientDiagnosticReport(tx *gorm.DB, reportID uint64, isDeleted int) error
 	AddMappingToMergeTestComponent(mapping []models.DiagnosticTestComponentAliasMapping) error
 	FetchSources(limit, offset int) ([]models.HealthVitalSourceType, int64, error)
 	GetDiagnosticLabReportName(patientId uint64) ([]models.DiagnosticReport, error)
@@ -782,6 +810,317 @@ func (s *DiagnosticRepositoryImpl) LoadDiagnosticTestMasterData() (map[string]ui
 	return testNameCache, componentNameCache
 }
 
+// GetComponentUnits returns the unit registry of the given components, or of every component
+// when componentIds is empty.
+func (r *DiagnosticRepositoryImpl) GetComponentUnits(componentIds []uint64) ([]models.DiagnosticTestComponentUnit, error) {
+	var units []models.DiagnosticTestComponentUnit
+	query := r.db.Model(&models.DiagnosticTestComponentUnit{})
+	if len(componentIds) > 0 {
+		query = query.Where("diagnostic_test_component_id IN ?", componentIds)
+	}
+	err := query.Order("diagnostic_test_component_id, is_canonical DESC, unit").Find(&units).Error
+	return units, err
+}
+
+// SaveComponentUnit adds or updates a unit of a component. Marking a unit canonical demotes the
+// previous canonical unit of that component.
+func (r *DiagnosticRepositoryImpl) SaveComponentUnit(unit *models.DiagnosticTestComponentUnit) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if unit.IsCanonical {
+			if err := tx.Model(&models.DiagnosticTestComponentUnit{}).
+				Where("diagnostic_test_component_id = ? AND unit <> ?", unit.DiagnosticTestComponentId, unit.Unit).
+				Update("is_canonical", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "diagnostic_test_component_id"}, {Name: "unit"}},
+			DoUpdates: clause.AssignmentColumns([]string{"is_canonical", "factor", "unit_offset", "updated_at"}),
+		}).Create(unit).Error
+	})
+}
+
+func (r *DiagnosticRepositoryImpl) DeleteComponentUnit(componentUnitId uint64) error {
+	result := r.db.Where("component_unit_id = ?", componentUnitId).Delete(&models.DiagnosticTestComponentUnit{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetReferenceRanges returns the active master ranges of the given components, or of every
+// component when componentIds is empty.
+func (r *DiagnosticRepositoryImpl) GetReferenceRanges(componentIds []uint64) ([]models.DiagnosticTestReferenceRange, error) {
+	var ranges []models.DiagnosticTestReferenceRange
+	query := r.db.Where("is_deleted = 0")
+	if len(componentIds) > 0 {
+		query = query.Where("diagnostic_test_component_id IN ?", componentIds)
+	}
+	err := query.Find(&ranges).Error
+	return ranges, err
+}
+
+func (r *DiagnosticRepositoryImpl) GetTestReferenceRange(testReferenceRangeId uint64) (*models.DiagnosticTestReferenceRange, error) {
+	var ref models.DiagnosticTestReferenceRange
+	if err := r.db.Where("test_reference_range_id = ?", testReferenceRangeId).First(&ref).Error; err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (r *DiagnosticRepositoryImpl) GetPatientTestReferenceRanges(patientId uint64) ([]models.PatientTestReferenceRange, error) {
+	var ranges []models.PatientTestReferenceRange
+	err := r.db.Where("patient_id = ? AND is_deleted = 0", patientId).Order("created_at").Find(&ranges).Error
+	return ranges, err
+}
+
+// GetResultValuesAfter pages through result values by id, optionally for one component or patient.
+func (r *DiagnosticRepositoryImpl) GetResultValuesAfter(componentId, patientId *uint64, afterId, limit int) ([]models.PatientDiagnosticTestResultValue, error) {
+	var results []models.PatientDiagnosticTestResultValue
+	query := r.db.Where("test_result_value_id > ?", afterId)
+	if componentId != nil {
+		query = query.Where("diagnostic_test_component_id = ?", *componentId)
+	}
+	if patientId != nil {
+		query = query.Where("patient_id = ?", *patientId)
+	}
+	err := query.Order("test_result_value_id").Limit(limit).Find(&results).Error
+	return results, err
+}
+
+func (r *DiagnosticRepositoryImpl) UpdateResultValueRange(result *models.PatientDiagnosticTestResultValue) error {
+	return r.db.Model(&models.PatientDiagnosticTestResultValue{}).
+		Where("test_result_value_id = ?", result.TestResultValueId).
+		Updates(map[string]interface{}{
+			"applied_range_source": result.AppliedRangeSource,
+			"applied_range_id":     result.AppliedRangeId,
+			"applied_normal_min":   result.AppliedNormalMin,
+			"applied_normal_max":   result.AppliedNormalMax,
+			"applied_range_units":  result.AppliedRangeUnits,
+			"applied_range_reason": result.AppliedRangeReason,
+			"range_flag":           result.RangeFlag,
+		}).Error
+}
+
+// GetDerivationSources returns the measured numeric results of the report followed by those
+// the patient had taken on the same day in other reports, newest first.
+func (r *DiagnosticRepositoryImpl) GetDerivationSources(patientId, reportId uint64) ([]models.DerivationSource, error) {
+	var sources []models.DerivationSource
+	err := r.db.Raw(`
+		SELECT pdtrv.test_result_value_id, pdtrv.patient_diagnostic_report_id, pdtrv.diagnostic_test_component_id,
+			COALESCE(comp.test_component_name, '') AS test_component_name,
+			COALESCE(comp.test_component_loinc_code, '') AS loinc_code,
+			pdtrv.result_value, COALESCE(pdtrv.result_unit, '') AS result_unit, pdtrv.result_date
+		FROM tbl_patient_diagnostic_test_result_value pdtrv
+		INNER JOIN tbl_patient_diagnostic_report pdr
+			ON pdr.patient_diagnostic_report_id = pdtrv.patient_diagnostic_report_id AND pdr.is_deleted = 0
+		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master comp
+			ON comp.diagnostic_test_component_id = pdtrv.diagnostic_test_component_id
+		WHERE pdtrv.patient_id = ? AND pdtrv.result_value <> 0 AND COALESCE(pdtrv.is_derived, FALSE) = FALSE
+			AND (pdtrv.patient_diagnostic_report_id = ? OR pdtrv.result_date::date IN (
+				SELECT result_date::date FROM tbl_patient_diagnostic_test_result_value WHERE patient_diagnostic_report_id = ?))
+		ORDER BY (pdtrv.patient_diagnostic_report_id = ?) DESC, pdtrv.result_date DESC, pdtrv.test_result_value_id DESC`,
+		patientId, reportId, reportId, reportId).Scan(&sources).Error
+	return sources, err
+}
+
+// DeleteDerivedResults removes the derived results of a report, and the test entry that groups
+// them, so they can be calculated again.
+func (r *DiagnosticRepositoryImpl) DeleteDerivedResults(tx *gorm.DB, reportId, derivedTestId uint64) error {
+	if err := tx.Where("patient_diagnostic_report_id = ? AND is_derived = ?", reportId, true).
+		Delete(&models.PatientDiagnosticTestResultValue{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("patient_diagnostic_report_id = ? AND diagnostic_test_id = ?", reportId, derivedTestId).
+		Delete(&models.PatientDiagnosticTest{}).Error
+}
+
+func (r *DiagnosticRepositoryImpl) GetResultValue(resultId int) (*models.PatientDiagnosticTestResultValue, error) {
+	var result models.PatientDiagnosticTestResultValue
+	if err := r.db.Where("test_result_value_id = ?", resultId).First(&result).Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetComponentTestId returns the test a component is mapped to, the first one when it belongs
+// to several.
+func (r *DiagnosticRepositoryImpl) GetComponentTestId(componentId uint64) (uint64, error) {
+	var mapping models.DiagnosticTestComponentMapping
+	err := r.db.Where("diagnostic_test_component_id = ?", componentId).
+		Order("diagnostic_test_component_mapping_id").First(&mapping).Error
+	return mapping.DiagnosticTestId, err
+}
+
+// EnsurePatientDiagnosticTest loads the test entry of the report, creating it when the report
+// has no result of that test yet.
+func (r *DiagnosticRepositoryImpl) EnsurePatientDiagnosticTest(tx *gorm.DB, test *models.PatientDiagnosticTest) error {
+	return tx.Where("patient_diagnostic_report_id = ? AND diagnostic_test_id = ?", test.PatientDiagnosticReportId, test.DiagnosticTestId).
+		FirstOrCreate(test).Error
+}
+
+func (r *DiagnosticRepositoryImpl) UpdateResultValue(tx *gorm.DB, result *models.PatientDiagnosticTestResultValue) error {
+	return tx.Model(&models.PatientDiagnosticTestResultValue{}).
+		Where("test_result_value_id = ?", result.TestResultValueId).
+		Updates(map[string]interface{}{
+			"result_value":          result.ResultValue,
+			"result_unit":           result.ResultUnit,
+			"original_result_value": result.OriginalValue,
+			"original_unit":         result.OriginalUnit,
+			"applied_range_source":  result.AppliedRangeSource,
+			"applied_range_id":      result.AppliedRangeId,
+			"applied_normal_min":    result.AppliedNormalMin,
+			"applied_normal_max":    result.AppliedNormalMax,
+			"applied_range_units":   result.AppliedRangeUnits,
+			"applied_range_reason":  result.AppliedRangeReason,
+			"range_flag":            result.RangeFlag,
+			"result_date":           result.ResultDate,
+			"result_comment":        result.ResultComment,
+			"udf1":                  result.UDF1,
+			"source":                result.Source,
+			"verified_by":           result.VerifiedBy,
+			"verified_at":           result.VerifiedAt,
+			"updated_at":            time.Now(),
+		}).Error
+}
+
+func (r *DiagnosticRepositoryImpl) DeleteResultValue(tx *gorm.DB, resultId int) error {
+	return tx.Where("test_result_value_id = ?", resultId).Delete(&models.PatientDiagnosticTestResultValue{}).Error
+}
+
+func (r *DiagnosticRepositoryImpl) SaveResultAudit(tx *gorm.DB, audit *models.PatientDiagnosticResultAudit) error {
+	return tx.Create(audit).Error
+}
+
+func (r *DiagnosticRepositoryImpl) GetResultAudits(resultId int) ([]models.PatientDiagnosticResultAudit, error) {
+	var audits []models.PatientDiagnosticResultAudit
+	err := r.db.Where("test_result_value_id = ?", resultId).Order("result_audit_id").Find(&audits).Error
+	return audits, err
+}
+
+// LoadComponentAliasNames maps the lower-cased name of every merged alias component to the
+// component it was merged into.
+func (r *DiagnosticRepositoryImpl) LoadComponentAliasNames() (map[string]uint64, error) {
+	var rows []struct {
+		TestComponentName         string
+		DiagnosticTestComponentId uint64
+	}
+	err := r.db.Table("tbl_diagnostic_test_component_alias_mapping am").
+		Select("comp.test_component_name, am.diagnostic_test_component_id").
+		Joins("INNER JOIN tbl_disease_profile_diagnostic_test_component_master comp ON comp.diagnostic_test_component_id = am.alias_test_component_id").
+		Where("am.is_deleted = 0 AND am.diagnostic_test_component_id <> am.alias_test_component_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	aliases := make(map[string]uint64, len(rows))
+	for _, row := range rows {
+		aliases[strings.ToLower(strings.TrimSpace(row.TestComponentName))] = row.DiagnosticTestComponentId
+	}
+	return aliases, nil
+}
+
+func (r *DiagnosticRepositoryImpl) CreateComponentAlias(tx *gorm.DB, alias *models.DiagnosticTestComponentAliasMapping) error {
+	return tx.Create(alias).Error
+}
+
+func (r *DiagnosticRepositoryImpl) CreateReviewItem(tx *gorm.DB, item *models.DigitizationReviewItem) error {
+	return tx.Create(item).Error
+}
+
+func (r *DiagnosticRepositoryImpl) GetReviewItem(reviewId uint64) (*models.DigitizationReviewItem, error) {
+	var item models.DigitizationReviewItem
+	if err := r.db.Where("review_id = ?", reviewId).First(&item).Error; err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (r *DiagnosticRepositoryImpl) GetReviewItems(filter models.ReviewQueueFilter, limit, offset int) ([]models.DigitizationReviewItem, int64, error) {
+	var items []models.DigitizationReviewItem
+	var total int64
+	query := r.db.Model(&models.DigitizationReviewItem{})
+	if filter.PatientId != nil {
+		query = query.Where("patient_id = ?", *filter.PatientId)
+	}
+	if filter.ReportId != nil {
+		query = query.Where("patient_diagnostic_report_id = ?", *filter.ReportId)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Reason != "" {
+		query = query.Where("reason = ?", filter.Reason)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("created_at DESC, review_id DESC").Limit(limit).Offset(offset).Find(&items).Error
+	return items, total, err
+}
+
+// CloseReviewItem approves or rejects a pending item and reports whether it was still pending.
+func (r *DiagnosticRepositoryImpl) CloseReviewItem(tx *gorm.DB, reviewId uint64, updates map[string]interface{}) (bool, error) {
+	result := tx.Model(&models.DigitizationReviewItem{}).
+		Where("review_id = ? AND status = ?", reviewId, constant.ReviewPending).
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetMergeableComponents returns the live master components that are not themselves merged
+// into another component.
+func (r *DiagnosticRepositoryImpl) GetMergeableComponents() ([]models.DiagnosticTestComponent, error) {
+	subQuery := r.db.
+		Table("tbl_diagnostic_test_component_alias_mapping").
+		Select("alias_test_component_id").
+		Where("diagnostic_test_component_id != alias_test_component_id").
+		Where("is_deleted = 0")
+	var components []models.DiagnosticTestComponent
+	err := r.db.Where("is_deleted = 0 AND diagnostic_test_component_id NOT IN (?)", subQuery).
+		Order("diagnostic_test_component_id").Find(&components).Error
+	return components, err
+}
+
+// SearchLoincCodes matches the code itself by prefix and the names and component by text.
+func (r *DiagnosticRepositoryImpl) SearchLoincCodes(search string, limit, offset int) ([]models.LoincCode, int64, error) {
+	var codes []models.LoincCode
+	var total int64
+	query := r.db.Model(&models.LoincCode{})
+	if search = strings.TrimSpace(search); search != "" {
+		like := "%" + search + "%"
+		query = query.Where("loinc_num LIKE ? OR long_common_name ILIKE ? OR short_name ILIKE ? OR component ILIKE ?", search+"%", like, like, like)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("loinc_num").Limit(limit).Offset(offset).Find(&codes).Error
+	return codes, total, err
+}
+
+func (r *DiagnosticRepositoryImpl) GetLoincCode(loincCode string) (*models.LoincCode, error) {
+	var code models.LoincCode
+	if err := r.db.Where("loinc_num = ?", loincCode).First(&code).Error; err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// GetLoincMappings returns the live master tests and components carrying the code.
+func (r *DiagnosticRepositoryImpl) GetLoincMappings(loincCode string) ([]models.DiagnosticTest, []models.DiagnosticTestComponent, error) {
+	tests := []models.DiagnosticTest{}
+	if err := r.db.Where("test_loinc_code = ? AND is_deleted = 0", loincCode).Order("diagnostic_test_id").Find(&tests).Error; err != nil {
+		return nil, nil, err
+	}
+	components := []models.DiagnosticTestComponent{}
+	if err := r.db.Where("test_component_loinc_code = ? AND is_deleted = 0", loincCode).Order("diagnostic_test_component_id").Find(&components).Error; err != nil {
+		return nil, nil, err
+	}
+	return tests, components, nil
+}
+
 func (r *DiagnosticRepositoryImpl) GeneratePatientDiagnosticReport(tx *gorm.DB, report *models.PatientDiagnosticReport) (*models.PatientDiagnosticReport, error) {
 	if err := tx.Create(report).Error; err != nil {
 		return nil, err
@@ -871,16 +1210,18 @@ func (ds *DiagnosticRepositoryImpl) GetAbnormalValue(patientId uint64) ([]models
 	return alerts, nil
 }
 
-func (dr *DiagnosticRepositoryImpl) ArchivePatientDiagnosticReport(recordId uint64, isDeleted int) error {
-	tx := dr.db.Begin()
-	if tx.Error != nil {
-		return tx.Error
+// ArchivePatientDiagnosticReport marks the record and the report and prescriptions read from
+// it deleted or restored in tx; the caller commits.
+func (dr *DiagnosticRepositoryImpl) ArchivePatientDiagnosticReport(tx *gorm.DB, recordId uint64, isDeleted int) error {
+	var deletedAt *time.Time
+	if isDeleted == 1 {
+		now := time.Now()
+		deletedAt = &now
 	}
 	err := tx.Model(&models.TblMedicalRecord{}).
 		Where("record_id = ?", recordId).
-		Update("is_deleted", isDeleted).Error
+		Updates(map[string]interface{}{"is_deleted": isDeleted, "deleted_at": deletedAt}).Error
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
@@ -890,7 +1231,6 @@ func (dr *DiagnosticRepositoryImpl) ArchivePatientDiagnosticReport(recordId uint
 		Where("record_id = ?", recordId).
 		Scan(&reportId).Error
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
@@ -898,18 +1238,11 @@ func (dr *DiagnosticRepositoryImpl) ArchivePatientDiagnosticReport(recordId uint
 		Where("patient_diagnostic_report_id = ?", reportId).
 		Update("is_deleted", isDeleted).Error
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	err1 := tx.Model(&models.PatientPrescription{}).
+	return tx.Model(&models.PatientPrescription{}).
 		Where("record_id = ?", recordId).
 		Update("is_deleted", isDeleted).Error
-	if err1 != nil {
-		tx.Rollback()
-		return err1
-	}
-
-	return tx.Commit().Error
 }
 
 func (r *DiagnosticRepositoryImpl) AddMappingToMergeTestComponent(mapping []models.DiagnosticTestComponentAliasMapping) error {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DiseaseRepository interface {
@@ -28,6 +29,9 @@ type DiseaseRepository interface {
 	InsertMedicationType(medicationType *[]models.MedicationType) error
 
 	BulkInsert(data interface{}) error
+	UpsertLoincCodes(codes []models.LoincCode) error
+	AssignTestLoincCode(testName, loincCode string) (int64, error)
+	AssignComponentLoincCode(componentName, loincCode string) (int64, error)
 	AddPatientReportNote(reportId string, patientId uint64, comment string) error
 	AddReportCommentLog(reportID string, comment string) error
 }
@@ -318,6 +322,29 @@ func (r *DiseaseRepositoryImpl) BulkInsert(data interface{}) error {
 	return r.db.Create(data).Error
 }
 
+// UpsertLoincCodes adds the codes, refreshing the descriptions of codes imported before.
+func (r *DiseaseRepositoryImpl) UpsertLoincCodes(codes []models.LoincCode) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "loinc_num"}},
+		DoUpdates: clause.AssignmentColumns([]string{"long_common_name", "short_name", "component", "property", "time_aspect",
+			"system", "scale_type", "class", "example_units", "status", "updated_at"}),
+	}).CreateInBatches(codes, 500).Error
+}
+
+func (r *DiseaseRepositoryImpl) AssignTestLoincCode(testName, loincCode string) (int64, error) {
+	result := r.db.Model(&models.DiagnosticTest{}).
+		Where("LOWER(TRIM(test_name)) = LOWER(TRIM(?)) AND is_deleted = 0", testName).
+		Update("test_loinc_code", loincCode)
+	return result.RowsAffected, result.Error
+}
+
+func (r *DiseaseRepositoryImpl) AssignComponentLoincCode(componentName, loincCode string) (int64, error) {
+	result := r.db.Model(&models.DiagnosticTestComponent{}).
+		Where("LOWER(TRIM(test_component_name)) = LOWER(TRIM(?)) AND is_deleted = 0", componentName).
+		Update("test_component_loinc_code", loincCode)
+	return result.RowsAffected, result.Error
+}
+
 // InsertMedication implements DiseaseRepository.
 func (repo *DiseaseRepositoryImpl) InsertMedication(medication *models.Medication) error {
 	return repo.db.Create(medication).Error
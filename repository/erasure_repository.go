@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ErasureRepository interface {
+	CreateErasureRequest(request *models.PatientErasureRequest) error
+	GetErasureRequest(erasureId uuid.UUID) (*models.PatientErasureRequest, error)
+	GetPendingErasureRequest(userId uint64) (*models.PatientErasureRequest, error)
+	GetDueErasureRequests(now time.Time) ([]models.PatientErasureRequest, error)
+	UpdateErasureRequest(erasureId uuid.UUID, updates map[string]interface{}) error
+
+	CountErasureTargets(userId uint64) ([]models.ErasureTableCount, error)
+	GetErasureFiles(userId uint64) ([]models.TblMedicalRecord, []models.TblMedicalRecordVersion, []models.PatientDataExport, error)
+	ExecuteErasure(request *models.PatientErasureRequest, certify func(tables []models.ErasureTableCount, prevHash string) (*models.ErasureCertificate, error)) (*models.ErasureCertificate, error)
+	GetErasureCertificates() ([]models.ErasureCertificate, error)
+}
+
+type ErasureRepositoryImpl struct {
+	db *gorm.DB
+}
+
+func NewErasureRepository(db *gorm.DB) ErasureRepository {
+	return &ErasureRepositoryImpl{db}
+}
+
+// erasureTarget is one step of an erasure. Every ? in where is bound to the user id. Steps
+// run in order, children before the rows their filters select through.
+type erasureTarget struct {
+	table  string
+	action string
+	where  string
+	set    string
+}
+
+const (
+	erasureReports      = "SELECT patient_diagnostic_report_id FROM tbl_patient_diagnostic_report WHERE patient_id = ?"
+	erasureProcesses    = "SELECT process_status_id FROM tbl_process_status WHERE user_id = ?"
+	erasureOwnedRecords = "SELECT record_id FROM tbl_medical_record_user_mapping WHERE user_id = ? " +
+		"EXCEPT SELECT record_id FROM tbl_medical_record_user_mapping WHERE user_id <> ?"
+)
+
+// erasedUserFields keeps the tbl_system_user_ row, which audit and master tables point at
+// through created_by, but strips everything that identifies the person.
+const erasedUserFields = "first_name = 'Erased', middle_name = '', last_name = 'User', username = 'erased_' || user_id, " +
+	"password = '', auth_user_id = NULL, email = NULL, mobile_no = NULL, address = '', date_of_birth = NULL, " +
+	"notify_id = NULL, biomail_id = NULL, emergency_contact = NULL, abha_number = NULL, passport_number = NULL, " +
+	"last_login_ip = '', user_state = 'erased', activation_flag = false, account_locked = true, updated_at = now()"
+
+var erasurePlan = []erasureTarget{
+	{table: "tbl_critical_alert_escalation", action: constant.ErasureDelete, where: "alert_id IN (SELECT alert_id FROM tbl_critical_result_alert WHERE patient_id = ?)"},
+	{table: "tbl_critical_result_alert", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_trend_drift_notice", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diagnostic_result_audit", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_digitization_review_item", action: constant.ErasureDelete, where: "patient_id = ? OR record_id IN (" + erasureOwnedRecords + ")"},
+	{table: "tbl_digitization_dead_letter", action: constant.ErasureDelete, where: "patient_id = ? OR record_id IN (" + erasureOwnedRecords + ")"},
+	{table: "tbl_patient_diagnostic_test_result_value", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diagnostic_test", action: constant.ErasureDelete, where: "patient_diagnostic_report_id IN (" + erasureReports + ")"},
+	{table: "tbl_patient_report_comment", action: constant.ErasureDelete, where: "patient_diagnostic_report_id IN (SELECT patient_diagnostic_report_id::text FROM tbl_patient_diagnostic_report WHERE patient_id = ?)"},
+	{table: "tbl_patient_report_attachment", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diagnostic_report", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_test_reference_range", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_test_component_display_config", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diagnostic_lab_mapping", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_dp_custom_range", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diagnostic_test_group_component_mapping", action: constant.ErasureDelete, where: "group_id IN (SELECT group_id FROM tbl_patient_diagnostic_test_group_master WHERE patient_id = ?)"},
+	{table: "tbl_patient_diagnostic_test_group_master", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_prescription_dose_schedule", action: constant.ErasureDelete, where: "prescription_detail_id IN (SELECT d.prescription_detail_id FROM tbl_prescription_detail d JOIN tbl_patient_prescription p ON p.prescription_id = d.prescription_id WHERE p.patient_id = ?)"},
+	{table: "tbl_prescription_detail", action: constant.ErasureDelete, where: "prescription_id IN (SELECT prescription_id FROM tbl_patient_prescription WHERE patient_id = ?)"},
+	{table: "tbl_patient_prescription", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_allergy_restriction", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_disease_profile", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_health_profile", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_patient_diet_plan", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_appointment_audit", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_appointment_master", action: constant.ErasureDelete, where: "patient_id = ?"},
+	{table: "tbl_user_tag", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_medical_record_version", action: constant.ErasureDelete, where: "record_id IN (" + erasureOwnedRecords + ")"},
+	{table: "tbl_medical_record", action: constant.ErasureDelete, where: "record_id IN (" + erasureOwnedRecords + ")"},
+	{table: "tbl_medical_record_user_mapping", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_process_step_record_log", action: constant.ErasureDelete, where: "process_step_log_id IN (SELECT process_step_log_id FROM tbl_process_step_log WHERE process_status_id IN (" + erasureProcesses + "))"},
+	{table: "tbl_process_step_log", action: constant.ErasureDelete, where: "process_status_id IN (" + erasureProcesses + ")"},
+	{table: "tbl_process_status", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_patient_data_export", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_user_notification_mapping", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_user_relative_permission_mappings", action: constant.ErasureDelete, where: "user_id = ? OR relative_id = ?"},
+	{table: "tbl_system_user_role_mapping", action: constant.ErasureDelete, where: "user_id = ? OR patient_id = ?"},
+	{table: "tbl_support_group_member", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_user_order_mapping", action: constant.ErasureAnonymize, where: "user_id = ?", set: "user_id = 0"},
+	{table: "tbl_user_token", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_system_user_address_mapping", action: constant.ErasureDelete, where: "user_id = ?"},
+	{table: "tbl_system_user_", action: constant.ErasureAnonymize, where: "user_id = ?", set: erasedUserFields},
+}
+
+func (t erasureTarget) args(userId uint64) []interface{} {
+	args := make([]interface{}, strings.Count(t.where, "?"))
+	for i := range args {
+		args[i] = userId
+	}
+	return args
+}
+
+func (r *ErasureRepositoryImpl) CreateErasureRequest(request *models.PatientErasureRequest) error {
+	return r.db.Create(request).Error
+}
+
+func (r *ErasureRepositoryImpl) GetErasureRequest(erasureId uuid.UUID) (*models.PatientErasureRequest, error) {
+	var request models.PatientErasureRequest
+	if err := r.db.Where("erasure_id = ?", erasureId).First(&request).Error; err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (r *ErasureRepositoryImpl) GetPendingErasureRequest(userId uint64) (*models.PatientErasureRequest, error) {
+	var request models.PatientErasureRequest
+	err := r.db.Where("user_id = ? AND status = ?", userId, constant.ErasureScheduled).First(&request).Error
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (r *ErasureRepositoryImpl) GetDueErasureRequests(now time.Time) ([]models.PatientErasureRequest, error) {
+	var requests []models.PatientErasureRequest
+	err := r.db.Where("status = ? AND scheduled_for <= ?", constant.ErasureScheduled, now).Order("scheduled_for").Find(&requests).Error
+	return requests, err
+}
+
+func (r *ErasureRepositoryImpl) UpdateErasureRequest(erasureId uuid.UUID, updates map[string]interface{}) error {
+	return r.db.Model(&models.PatientErasureRequest{}).Where("erasure_id = ?", erasureId).Updates(updates).Error
+}
+
+func (r *ErasureRepositoryImpl) CountErasureTargets(userId uint64) ([]models.ErasureTableCount, error) {
+	counts := make([]models.ErasureTableCount, 0, len(erasurePlan))
+	for _, target := range erasurePlan {
+		var rows int64
+		if err := r.db.Table(target.table).Where(target.where, target.args(userId)...).Count(&rows).Error; err != nil {
+			return nil, fmt.Errorf("count %s: %w", target.table, err)
+		}
+		counts = append(counts, models.ErasureTableCount{Table: target.table, Action: target.action, Rows: rows})
+	}
+	return counts, nil
+}
+
+// GetErasureFiles returns the records, record versions and exports whose stored blobs go
+// with the user.
+func (r *ErasureRepositoryImpl) GetErasureFiles(userId uint64) ([]models.TblMedicalRecord, []models.TblMedicalRecordVersion, []models.PatientDataExport, error) {
+	var records []models.TblMedicalRecord
+	if err := r.db.Where("record_id IN ("+erasureOwnedRecords+")", userId, userId).Find(&records).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	var versions []models.TblMedicalRecordVersion
+	if err := r.db.Where("record_id IN ("+erasureOwnedRecords+")", userId, userId).Find(&versions).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	var exports []models.PatientDataExport
+	if err := r.db.Where("user_id = ? AND file_url <> ''", userId).Find(&exports).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	return records, versions, exports, nil
+}
+
+// ExecuteErasure runs the erasure plan and appends its certificate to the audit chain in a
+// single transaction. The certificate table is locked so concurrent erasures chain in order.
+func (r *ErasureRepositoryImpl) ExecuteErasure(request *models.PatientErasureRequest,
+	certify func(tables []models.ErasureTableCount, prevHash string) (*models.ErasureCertificate, error)) (*models.ErasureCertificate, error) {
+	var certificate *models.ErasureCertificate
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE tbl_erasure_certificate_audit IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		tables := make([]models.ErasureTableCount, 0, len(erasurePlan))
+		for _, target := range erasurePlan {
+			query := fmt.Sprintf("DELETE FROM %s WHERE %s", target.table, target.where)
+			if target.action == constant.ErasureAnonymize {
+				query = fmt.Sprintf("UPDATE %s SET %s WHERE %s", target.table, target.set, target.where)
+			}
+			result := tx.Exec(query, target.args(request.UserID)...)
+			if result.Error != nil {
+				return fmt.Errorf("%s %s: %w", target.action, target.table, result.Error)
+			}
+			tables = append(tables, models.ErasureTableCount{Table: target.table, Action: target.action, Rows: result.RowsAffected})
+		}
+		var prevHash string
+		err := tx.Model(&models.ErasureCertificate{}).Select("hash").Order("certificate_id DESC").Limit(1).Scan(&prevHash).Error
+		if err != nil {
+			return err
+		}
+		certificate, err = certify(tables, prevHash)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(certificate).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PatientErasureRequest{}).Where("erasure_id = ?", request.ErasureId).Updates(map[string]interface{}{
+			"status":         constant.ErasureCompleted,
+			"executed_at":    certificate.ExecutedAt,
+			"certificate_id": certificate.CertificateId,
+		}).Error
+	})
+	return certificate, err
+}
+
+func (r *ErasureRepositoryImpl) GetErasureCertificates() ([]models.ErasureCertificate, error) {
+	var certificates []models.ErasureCertificate
+	err := r.db.Order("certificate_id").Find(&certificates).Error
+	return certificates, err
+}
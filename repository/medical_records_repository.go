@@ -3,6 +3,7 @@ package repository
 import (
 	"biostat/config"
 	"biostat/constant"
+	"biostat/database"
 	"biostat/models"
 	"encoding/json"
 	"errors"
@@ -12,8 +13,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type TblMedicalRecordRepository interface {
@@ -22,11 +25,37 @@ type TblMedicalRecordRepository interface {
 	GetMedicalRecordsByUserID(userID uint64, recordIdsMap map[uint64]uint64) ([]models.TblMedicalRecord, error)
 	CreateTblMedicalRecord(tx *gorm.DB, data *models.TblMedicalRecord) (*models.TblMedicalRecord, error)
 	CreateMultipleTblMedicalRecords(tx *gorm.DB, data []*models.TblMedicalRecord) error
+	CreateOwnedTblMedicalRecord(tx *gorm.DB, data *models.TblMedicalRecord) (bool, error)
 	UpdateTblMedicalRecord(data *models.TblMedicalRecord) (*models.TblMedicalRecord, error)
+	UpdateTblMedicalRecordWithVersion(data *models.TblMedicalRecord, changedBy uint64) (*models.TblMedicalRecord, error)
+	SetRecordNextRetryAt(recordId uint64, nextRetryAt *time.Time) error
+	SetRecordPDFPassword(recordId uint64, sealedPassword string) error
 	GetMedicalRecordByRecordId(RecordId uint64) (*models.TblMedicalRecord, error)
 	DeleteTblMedicalRecord(id int, updatedBy string) error
 	IsRecordBelongsToUser(userID uint64, recordID uint64) (bool, error)
 	ExistsRecordForUser(userId uint64, source, url string) (bool, error)
+	IsSourceDocumentSynced(userId uint64, sourceDocumentId string) (bool, error)
+	AddRecordSourceDocument(recordId uint64, sourceDocumentId string) error
+	MigrateLegacyLocalRecordUrls(prefix string) (int64, error)
+	GetRecordsForKeyRewrap(currentKeyVersion int, afterRecordId uint64, limit int) ([]models.TblMedicalRecord, error)
+	UpdateRecordDataKey(recordId uint64, dataKey string, keyVersion int) error
+	GetRecordVersionsForKeyRewrap(currentKeyVersion int, afterVersionId uint64, limit int) ([]models.TblMedicalRecordVersion, error)
+	UpdateRecordVersionDataKey(versionId uint64, dataKey string, keyVersion int) error
+	UpdateRecordPreview(recordId uint64, thumbnailUrl, previewStatus string, pageCount int) error
+	GetRecordByContentHash(userId uint64, contentHash string) (*models.TblMedicalRecord, error)
+
+	CreateRecordVersionSnapshot(tx *gorm.DB, record *models.TblMedicalRecord, action string, changedBy uint64) error
+	GetRecordVersions(recordId uint64) ([]models.TblMedicalRecordVersion, error)
+	SearchMedicalRecords(patientIds []uint64, query string, limit, offset int) ([]models.RecordSearchResult, int64, error)
+	GetRecordVersion(recordId, versionId uint64) (*models.TblMedicalRecordVersion, error)
+	RestoreRecordFromVersion(tx *gorm.DB, version *models.TblMedicalRecordVersion) error
+	GetPurgeableRecords(deletedBefore time.Time) ([]models.TblMedicalRecord, error)
+	PurgeMedicalRecord(recordId uint64) error
+	GetRecordsForExport(userId uint64) ([]models.TblMedicalRecord, error)
+	CreatePatientDataExport(export *models.PatientDataExport) error
+	UpdatePatientDataExport(exportId uuid.UUID, updates map[string]interface{}) error
+	GetPatientDataExport(exportId uuid.UUID) (*models.PatientDataExport, error)
+	GetExpiredPatientDataExports(now time.Time) ([]models.PatientDataExport, error)
 
 	CreateMedicalRecordMappings(tx *gorm.DB, mappings *[]models.TblMedicalRecordUserMapping) error
 	UpdateMedicalRecordMappingByRecordId(tx *gorm.DB, RecordId *uint64, mapping map[string]interface{}) error
@@ -421,6 +450,24 @@ func (r *tblMedicalRecordRepositoryImpl) CreateTblMedicalRecord(tx *gorm.DB, dat
 	return data, nil
 }
 
+// CreateOwnedTblMedicalRecord inserts a record unless its owner already has a live record
+// with the same content hash, in which case nothing is written and false is returned. The
+// check and the insert are one statement, so concurrent uploads of a file cannot both land.
+func (r *tblMedicalRecordRepositoryImpl) CreateOwnedTblMedicalRecord(tx *gorm.DB, data *models.TblMedicalRecord) (bool, error) {
+	if tx == nil {
+		return false, fmt.Errorf("transaction is nil")
+	}
+	result := tx.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "owner_id"}, {Name: "content_hash"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: database.OwnedContentPredicate}}},
+		DoNothing:   true,
+	}).Create(data)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
 func (r *tblMedicalRecordRepositoryImpl) CreateMultipleTblMedicalRecords(tx *gorm.DB, records []*models.TblMedicalRecord) error {
 	if tx == nil {
 		return fmt.Errorf("transaction is nil")
@@ -435,10 +482,31 @@ func (r *tblMedicalRecordRepositoryImpl) CreateMultipleTblMedicalRecords(tx *gor
 }
 
 func (r *tblMedicalRecordRepositoryImpl) UpdateTblMedicalRecord(data *models.TblMedicalRecord) (*models.TblMedicalRecord, error) {
+	return r.updateTblMedicalRecord(data, nil)
+}
+
+// UpdateTblMedicalRecordWithVersion keeps the record as it stood before the update as a
+// version, in the same transaction as the update.
+func (r *tblMedicalRecordRepositoryImpl) UpdateTblMedicalRecordWithVersion(data *models.TblMedicalRecord, changedBy uint64) (*models.TblMedicalRecord, error) {
+	return r.updateTblMedicalRecord(data, &changedBy)
+}
+
+func (r *tblMedicalRecordRepositoryImpl) updateTblMedicalRecord(data *models.TblMedicalRecord, versionBy *uint64) (*models.TblMedicalRecord, error) {
 	tx := r.db.Begin()
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
+	if versionBy != nil {
+		var existing models.TblMedicalRecord
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("record_id = ?", data.RecordId).First(&existing).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := r.CreateRecordVersionSnapshot(tx, &existing, "updated", *versionBy); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
 
 	updateFields := map[string]interface{}{}
 	if data.RecordName != "" {
@@ -489,6 +557,10 @@ func (r *tblMedicalRecordRepositoryImpl) UpdateTblMedicalRecord(data *models.Tbl
 	if data.FileData != nil {
 		updateFields["file_data"] = data.FileData
 	}
+	if data.DataKey != "" {
+		updateFields["data_key"] = data.DataKey
+		updateFields["key_version"] = data.KeyVersion
+	}
 	if data.DigitizeFlag > 0 {
 		updateFields["digitize_flag"] = data.DigitizeFlag
 	}
@@ -555,6 +627,18 @@ func (r *tblMedicalRecordRepositoryImpl) UpdateTblMedicalRecord(data *models.Tbl
 	return &updatedRecord, nil
 }
 
+// SetRecordNextRetryAt records when digitization of the record runs again. Unlike
+// UpdateTblMedicalRecord it clears the time when nextRetryAt is nil.
+func (r *tblMedicalRecordRepositoryImpl) SetRecordNextRetryAt(recordId uint64, nextRetryAt *time.Time) error {
+	return r.db.Model(&models.TblMedicalRecord{}).Where("record_id = ?", recordId).Update("next_retry_at", nextRetryAt).Error
+}
+
+// SetRecordPDFPassword keeps the password of a protected PDF, sealed with the record's data
+// key, for workers that have to read the record from the file store.
+func (r *tblMedicalRecordRepositoryImpl) SetRecordPDFPassword(recordId uint64, sealedPassword string) error {
+	return r.db.Model(&models.TblMedicalRecord{}).Where("record_id = ?", recordId).Update("sealed_pdf_password", sealedPassword).Error
+}
+
 func (r *tblMedicalRecordRepositoryImpl) GetMedicalRecordByRecordId(RecordId uint64) (*models.TblMedicalRecord, error) {
 	var obj models.TblMedicalRecord
 	err := r.db.First(&obj, RecordId).Error
@@ -646,6 +730,227 @@ func (r *tblMedicalRecordRepositoryImpl) ExistsRecordForUser(userId uint64, sour
 	return count > 0, err
 }
 
+// IsSourceDocumentSynced reports whether a synced source document, such as a Gmail
+// attachment, was already saved for the user, either as its own record or as a duplicate
+// linked to one.
+func (r *tblMedicalRecordRepositoryImpl) IsSourceDocumentSynced(userId uint64, sourceDocumentId string) (bool, error) {
+	var count int64
+	err := r.db.
+		Table("tbl_medical_record").
+		Joins("INNER JOIN tbl_medical_record_user_mapping ON tbl_medical_record.record_id = tbl_medical_record_user_mapping.record_id").
+		Where("tbl_medical_record_user_mapping.user_id = ?", userId).
+		Where("jsonb_exists(COALESCE(tbl_medical_record.metadata::jsonb -> 'source_document_ids', '[]'::jsonb), ?)", sourceDocumentId).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// AddRecordSourceDocument records that a source document was saved as the given record.
+func (r *tblMedicalRecordRepositoryImpl) AddRecordSourceDocument(recordId uint64, sourceDocumentId string) error {
+	return r.db.Exec(`UPDATE tbl_medical_record
+		SET metadata = jsonb_set(COALESCE(metadata::jsonb, '{}'::jsonb), '{source_document_ids}',
+			COALESCE(metadata::jsonb -> 'source_document_ids', '[]'::jsonb) || to_jsonb(?::text))
+		WHERE record_id = ?`, sourceDocumentId, recordId).Error
+}
+
+// MigrateLegacyLocalRecordUrls rewrites public "<host>/uploads/<key>" record urls of
+// local records to the "<prefix><key>" store reference.
+func (r *tblMedicalRecordRepositoryImpl) MigrateLegacyLocalRecordUrls(prefix string) (int64, error) {
+	result := r.db.Exec(`UPDATE tbl_medical_record
+		SET record_url = ? || regexp_replace(record_url, '^.*/uploads/', ''), updated_at = NOW()
+		WHERE upload_destination = ? AND record_url LIKE '%://%/uploads/%'`, prefix, constant.UploadDestinationLocal)
+	return result.RowsAffected, result.Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetRecordsForKeyRewrap(currentKeyVersion int, afterRecordId uint64, limit int) ([]models.TblMedicalRecord, error) {
+	var records []models.TblMedicalRecord
+	err := r.db.Select("record_id, data_key, key_version").
+		Where("data_key IS NOT NULL AND data_key <> '' AND key_version <> ? AND record_id > ?", currentKeyVersion, afterRecordId).
+		Order("record_id ASC").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+func (r *tblMedicalRecordRepositoryImpl) UpdateRecordDataKey(recordId uint64, dataKey string, keyVersion int) error {
+	return r.db.Model(&models.TblMedicalRecord{}).Where("record_id = ?", recordId).
+		Updates(map[string]interface{}{"data_key": dataKey, "key_version": keyVersion}).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetRecordVersionsForKeyRewrap(currentKeyVersion int, afterVersionId uint64, limit int) ([]models.TblMedicalRecordVersion, error) {
+	var versions []models.TblMedicalRecordVersion
+	err := r.db.Select("version_id, record_id, data_key, key_version").
+		Where("data_key IS NOT NULL AND data_key <> '' AND key_version <> ? AND version_id > ?", currentKeyVersion, afterVersionId).
+		Order("version_id ASC").Limit(limit).Find(&versions).Error
+	return versions, err
+}
+
+func (r *tblMedicalRecordRepositoryImpl) UpdateRecordVersionDataKey(versionId uint64, dataKey string, keyVersion int) error {
+	return r.db.Model(&models.TblMedicalRecordVersion{}).Where("version_id = ?", versionId).
+		Updates(map[string]interface{}{"data_key": dataKey, "key_version": keyVersion}).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) UpdateRecordPreview(recordId uint64, thumbnailUrl, previewStatus string, pageCount int) error {
+	return r.db.Model(&models.TblMedicalRecord{}).Where("record_id = ?", recordId).
+		Updates(map[string]interface{}{"thumbnail_url": thumbnailUrl, "preview_status": previewStatus, "page_count": pageCount}).Error
+}
+
+// GetRecordByContentHash returns the oldest live record of the user with the given content
+// hash, with its diagnostic report id when it is attached to one. Returns nil when none.
+func (r *tblMedicalRecordRepositoryImpl) GetRecordByContentHash(userId uint64, contentHash string) (*models.TblMedicalRecord, error) {
+	var record models.TblMedicalRecord
+	err := r.db.Table("tbl_medical_record AS mr").
+		Select("mr.*").
+		Joins("JOIN tbl_medical_record_user_mapping AS mrum ON mrum.record_id = mr.record_id").
+		Where("mrum.user_id = ? AND mr.content_hash = ? AND mr.is_deleted = 0", userId, contentHash).
+		Order("mr.record_id ASC").
+		First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var attachment models.PatientReportAttachment
+	err = r.db.Where("record_id = ?", record.RecordId).First(&attachment).Error
+	if err == nil {
+		record.PatientDiagnosticReportId = &attachment.PatientDiagnosticReportId
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (r *tblMedicalRecordRepositoryImpl) CreateRecordVersionSnapshot(tx *gorm.DB, record *models.TblMedicalRecord, action string, changedBy uint64) error {
+	version := &models.TblMedicalRecordVersion{
+		RecordId:        record.RecordId,
+		Action:          action,
+		ChangedBy:       changedBy,
+		ChangeTimestamp: time.Now(),
+
+		RecordName:        record.RecordName,
+		RecordSize:        record.RecordSize,
+		FileType:          record.FileType,
+		UploadSource:      record.UploadSource,
+		UploadDestination: record.UploadDestination,
+		SourceAccount:     record.SourceAccount,
+		RecordCategory:    record.RecordCategory,
+		RecordSubCategory: record.RecordSubCategory,
+		Description:       record.Description,
+		RecordUrl:         record.RecordUrl,
+		FileData:          record.FileData,
+		DataKey:           record.DataKey,
+		KeyVersion:        record.KeyVersion,
+		ContentHash:       record.ContentHash,
+		Metadata:          record.Metadata,
+		Status:            string(record.Status),
+		IsVerified:        record.IsVerified,
+		IsDeleted:         record.IsDeleted,
+		CreatedAt:         record.CreatedAt,
+		UpdatedAt:         record.UpdatedAt,
+	}
+	return tx.Create(version).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetRecordVersions(recordId uint64) ([]models.TblMedicalRecordVersion, error) {
+	var versions []models.TblMedicalRecordVersion
+	err := r.db.Omit("file_data").Where("record_id = ?", recordId).Order("change_timestamp DESC").Find(&versions).Error
+	return versions, err
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetRecordVersion(recordId, versionId uint64) (*models.TblMedicalRecordVersion, error) {
+	var version models.TblMedicalRecordVersion
+	err := r.db.Where("record_id = ? AND version_id = ?", recordId, versionId).First(&version).Error
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (r *tblMedicalRecordRepositoryImpl) RestoreRecordFromVersion(tx *gorm.DB, version *models.TblMedicalRecordVersion) error {
+	updateFields := map[string]interface{}{
+		"record_name":         version.RecordName,
+		"record_size":         version.RecordSize,
+		"file_type":           version.FileType,
+		"upload_source":       version.UploadSource,
+		"upload_destination":  version.UploadDestination,
+		"source_account":      version.SourceAccount,
+		"record_category":     version.RecordCategory,
+		"record_sub_category": version.RecordSubCategory,
+		"description":         version.Description,
+		"record_url":          version.RecordUrl,
+		"data_key":            version.DataKey,
+		"key_version":         version.KeyVersion,
+		"content_hash":        version.ContentHash,
+		"metadata":            version.Metadata,
+		"status":              version.Status,
+		"is_verified":         version.IsVerified,
+		"updated_at":          time.Now(),
+	}
+	if len(version.FileData) > 0 {
+		updateFields["file_data"] = version.FileData
+	}
+	return tx.Model(&models.TblMedicalRecord{}).Where("record_id = ?", version.RecordId).Updates(updateFields).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetPurgeableRecords(deletedBefore time.Time) ([]models.TblMedicalRecord, error) {
+	var records []models.TblMedicalRecord
+	// Records deleted before deleted_at existed only have updated_at to go by.
+	err := r.db.Where("is_deleted = 1 AND COALESCE(deleted_at, updated_at) < ?", deletedBefore).Find(&records).Error
+	return records, err
+}
+
+// purgeTarget is one table cleared by a record purge. Every ? in where is bound to the record
+// id. Steps run in order, children before the rows their filters select through.
+type purgeTarget struct {
+	table string
+	where string
+}
+
+const (
+	purgeReports       = "SELECT patient_diagnostic_report_id FROM tbl_patient_report_attachment WHERE record_id = ?"
+	purgeResultValues  = "SELECT test_result_value_id FROM tbl_patient_diagnostic_test_result_value WHERE patient_diagnostic_report_id IN (" + purgeReports + ")"
+	purgePrescriptions = "SELECT prescription_id FROM tbl_patient_prescription WHERE record_id = ?"
+)
+
+// recordPurgePlan removes a record with the report and prescriptions digitized from it, their
+// results and everything hanging off those results, as erasurePlan does for a whole patient.
+var recordPurgePlan = []purgeTarget{
+	{table: "tbl_critical_alert_escalation", where: "alert_id IN (SELECT alert_id FROM tbl_critical_result_alert WHERE test_result_value_id IN (" + purgeResultValues + "))"},
+	{table: "tbl_critical_result_alert", where: "test_result_value_id IN (" + purgeResultValues + ")"},
+	{table: "tbl_trend_drift_notice", where: "test_result_value_id IN (" + purgeResultValues + ")"},
+	{table: "tbl_patient_diagnostic_result_audit", where: "patient_diagnostic_report_id IN (" + purgeReports + ")"},
+	{table: "tbl_digitization_review_item", where: "record_id = ? OR patient_diagnostic_report_id IN (" + purgeReports + ")"},
+	{table: "tbl_digitization_dead_letter", where: "record_id = ?"},
+	{table: "tbl_patient_diagnostic_test_result_value", where: "patient_diagnostic_report_id IN (" + purgeReports + ")"},
+	{table: "tbl_patient_diagnostic_test", where: "patient_diagnostic_report_id IN (" + purgeReports + ")"},
+	{table: "tbl_patient_report_comment", where: "patient_diagnostic_report_id IN (SELECT patient_diagnostic_report_id::text FROM tbl_patient_report_attachment WHERE record_id = ?)"},
+	{table: "tbl_patient_diagnostic_report", where: "patient_diagnostic_report_id IN (" + purgeReports + ")"},
+	{table: "tbl_patient_report_attachment", where: "record_id = ?"},
+	{table: "tbl_prescription_dose_schedule", where: "prescription_detail_id IN (SELECT prescription_detail_id FROM tbl_prescription_detail WHERE prescription_id IN (" + purgePrescriptions + "))"},
+	{table: "tbl_prescription_detail", where: "prescription_id IN (" + purgePrescriptions + ")"},
+	{table: "tbl_patient_prescription", where: "record_id = ?"},
+	{table: "tbl_medical_record_version", where: "record_id = ?"},
+	{table: "tbl_user_tag", where: "record_id = ?"},
+	{table: "tbl_medical_record_user_mapping", where: "record_id = ?"},
+	{table: "tbl_medical_record", where: "record_id = ?"},
+}
+
+// PurgeMedicalRecord permanently removes a record row together with its mappings, tags,
+// version history and the report and prescriptions read from it, in one transaction.
+func (r *tblMedicalRecordRepositoryImpl) PurgeMedicalRecord(recordId uint64) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, target := range recordPurgePlan {
+			args := make([]interface{}, strings.Count(target.where, "?"))
+			for i := range args {
+				args[i] = recordId
+			}
+			if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", target.table, target.where), args...).Error; err != nil {
+				return fmt.Errorf("purge %s: %w", target.table, err)
+			}
+		}
+		return nil
+	})
+}
+
 func (r *tblMedicalRecordRepositoryImpl) IsRecordBelongsToUser(userID uint64, recordID uint64) (bool, error) {
 	var mapping models.TblMedicalRecordUserMapping
 	err := r.db.Where("user_id = ? AND record_id = ?", userID, recordID).First(&mapping).Error
@@ -663,6 +968,9 @@ func (r *tblMedicalRecordRepositoryImpl) MovePatientRecord(patientId, targetPati
 		if err := r.UpdateMedicalRecordMappingByRecordId(tx, &recordId, map[string]interface{}{"user_id": targetPatientId}); err != nil {
 			return fmt.Errorf("record mapping move failed: %w", err)
 		}
+		if err := tx.Model(&models.TblMedicalRecord{}).Where("record_id = ?", recordId).Update("owner_id", targetPatientId).Error; err != nil {
+			return fmt.Errorf("record owner move failed: %w", err)
+		}
 		if err := r.UpdatePatientDiagnosticReports(tx, patientId, targetPatientId, reportId); err != nil {
 			return fmt.Errorf("report move failed: %w", err)
 		}
@@ -808,3 +1116,120 @@ func (r *tblMedicalRecordRepositoryImpl) GetAllReportTag(userId uint64, limit, o
 
 	return tags, total, nil
 }
+
+// recordSearchQuery matches the query against the indexed search_vector of records, their
+// reports, labs, test components and tags, ranks the matching records and highlights the
+// matched words in a snippet built from the same fields and the digitized document text.
+const recordSearchQuery = `
+WITH q AS (SELECT websearch_to_tsquery('english', @query) AS query),
+accessible AS (
+	SELECT mr.record_id, mrum.user_id AS patient_id, pra.patient_diagnostic_report_id
+	FROM tbl_medical_record mr
+	JOIN tbl_medical_record_user_mapping mrum ON mrum.record_id = mr.record_id
+	LEFT JOIN tbl_patient_report_attachment pra ON pra.record_id = mr.record_id
+	WHERE mrum.user_id IN @patients AND mr.is_deleted = 0
+),
+hits AS (
+	SELECT a.record_id FROM accessible a JOIN tbl_medical_record mr ON mr.record_id = a.record_id, q
+	WHERE mr.search_vector @@ q.query
+	UNION
+	SELECT a.record_id FROM accessible a JOIN tbl_patient_diagnostic_report r ON r.patient_diagnostic_report_id = a.patient_diagnostic_report_id, q
+	WHERE r.search_vector @@ q.query
+	UNION
+	SELECT a.record_id FROM accessible a
+	JOIN tbl_patient_diagnostic_report r ON r.patient_diagnostic_report_id = a.patient_diagnostic_report_id
+	JOIN tbl_diagnostic_lab l ON l.diagnostic_lab_id = r.diagnostic_lab_id, q
+	WHERE l.search_vector @@ q.query
+	UNION
+	SELECT a.record_id FROM accessible a
+	JOIN tbl_patient_diagnostic_test_result_value rv ON rv.patient_diagnostic_report_id = a.patient_diagnostic_report_id
+	JOIN tbl_disease_profile_diagnostic_test_component_master c ON c.diagnostic_test_component_id = rv.diagnostic_test_component_id, q
+	WHERE c.search_vector @@ q.query
+	UNION
+	SELECT a.record_id FROM accessible a
+	JOIN tbl_user_tag t ON t.record_id = a.record_id OR t.patient_diagnostic_report_id = a.patient_diagnostic_report_id, q
+	WHERE t.search_vector @@ q.query
+),
+docs AS (
+	SELECT DISTINCT ON (a.record_id) a.record_id, a.patient_id, a.patient_diagnostic_report_id,
+		mr.record_name, mr.record_category, mr.created_at, mr.search_vector,
+		coalesce(r.report_name, '') AS report_name, coalesce(l.lab_name, '') AS lab_name,
+		concat_ws(' ', r.report_name, l.lab_name,
+			(SELECT string_agg(DISTINCT c.test_component_name, ', ')
+				FROM tbl_patient_diagnostic_test_result_value rv
+				JOIN tbl_disease_profile_diagnostic_test_component_master c ON c.diagnostic_test_component_id = rv.diagnostic_test_component_id
+				WHERE rv.patient_diagnostic_report_id = a.patient_diagnostic_report_id),
+			(SELECT string_agg(DISTINCT t.tag_name, ', ') FROM tbl_user_tag t
+				WHERE t.record_id = a.record_id OR t.patient_diagnostic_report_id = a.patient_diagnostic_report_id)) AS related_text,
+		concat_ws(' ', mr.metadata::jsonb -> 'ai' ->> 'summary', mr.metadata::jsonb -> 'ai' ->> 'raw_text') AS document_text,
+		mr.description
+	FROM hits h
+	JOIN accessible a ON a.record_id = h.record_id
+	JOIN tbl_medical_record mr ON mr.record_id = a.record_id
+	LEFT JOIN tbl_patient_diagnostic_report r ON r.patient_diagnostic_report_id = a.patient_diagnostic_report_id
+	LEFT JOIN tbl_diagnostic_lab l ON l.diagnostic_lab_id = r.diagnostic_lab_id
+	ORDER BY a.record_id
+),
+ranked AS (
+	SELECT d.*, ts_rank(d.search_vector || setweight(to_tsvector('english', d.related_text), 'B'), q.query) AS rank,
+		count(*) OVER () AS total
+	FROM docs d, q
+	ORDER BY rank DESC, d.created_at DESC
+	LIMIT @limit OFFSET @offset
+)
+SELECT rk.record_id, rk.patient_id, rk.patient_diagnostic_report_id, rk.record_name, rk.record_category,
+	rk.report_name, rk.lab_name, rk.created_at, rk.rank, rk.total,
+	ts_headline('english', concat_ws(' | ', rk.record_name, rk.description, rk.related_text, rk.document_text), q.query,
+		'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=" ... "') AS snippet
+FROM ranked rk, q
+ORDER BY rk.rank DESC, rk.created_at DESC`
+
+func (r *tblMedicalRecordRepositoryImpl) SearchMedicalRecords(patientIds []uint64, query string, limit, offset int) ([]models.RecordSearchResult, int64, error) {
+	var results []models.RecordSearchResult
+	err := r.db.Raw(recordSearchQuery, map[string]interface{}{
+		"query":    query,
+		"patients": patientIds,
+		"limit":    limit,
+		"offset":   offset,
+	}).Scan(&results).Error
+	if err != nil || len(results) == 0 {
+		return results, 0, err
+	}
+	return results, results[0].Total, nil
+}
+
+// GetRecordsForExport returns every live record mapped to the user, oldest first.
+func (r *tblMedicalRecordRepositoryImpl) GetRecordsForExport(userId uint64) ([]models.TblMedicalRecord, error) {
+	var records []models.TblMedicalRecord
+	err := r.db.Table("tbl_medical_record AS mr").
+		Select("mr.*").
+		Joins("JOIN tbl_medical_record_user_mapping AS mrum ON mr.record_id = mrum.record_id").
+		Where("mrum.user_id = ? AND mr.is_deleted = 0", userId).
+		Order("mr.record_id").
+		Find(&records).Error
+	return records, err
+}
+
+func (r *tblMedicalRecordRepositoryImpl) CreatePatientDataExport(export *models.PatientDataExport) error {
+	return r.db.Create(export).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) UpdatePatientDataExport(exportId uuid.UUID, updates map[string]interface{}) error {
+	return r.db.Model(&models.PatientDataExport{}).Where("export_id = ?", exportId).Updates(updates).Error
+}
+
+func (r *tblMedicalRecordRepositoryImpl) GetPatientDataExport(exportId uuid.UUID) (*models.PatientDataExport, error) {
+	var export models.PatientDataExport
+	if err := r.db.Where("export_id = ?", exportId).First(&export).Error; err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// GetExpiredPatientDataExports returns the exports whose link has expired but whose archive
+// is still stored.
+func (r *tblMedicalRecordRepositoryImpl) GetExpiredPatientDataExports(now time.Time) ([]models.PatientDataExport, error) {
+	var exports []models.PatientDataExport
+	err := r.db.Where("status = ? AND expires_at < ? AND file_url <> ''", constant.Success, now).Find(&exports).Error
+	return exports, err
+}
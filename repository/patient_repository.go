@@ -6,6 +6,7 @@ import (
 	"biostat/database"
 	"biostat/models"
 	"biostat/utils"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PatientRepository interface {
@@ -65,6 +67,9 @@ type PatientRepository interface {
 	ExistsByUserIdAndRoleId(userId uint64, roleId uint64) (bool, error)
 	FetchPatientDiagnosticTrendValue(input models.DiagnosticResultRequest) ([]map[string]interface{}, error)
 	ParseDiagnosticTrendData(rawData []map[string]interface{}) ([]map[string]interface{}, error)
+	CreateTrendDriftNotice(notice *models.TrendDriftNotice) (bool, error)
+	GetComparisonReports(patientId uint64, reportId *uint64, reportDate *time.Time) ([]models.PatientDiagnosticReport, error)
+	GetComparisonResults(patientId uint64, reportIds []uint64) ([]models.ComparisonResultRow, error)
 	GetUserSUBByID(ID uint64) (string, error)
 	NoOfUpcomingAppointments(patientID uint64) (int64, error)
 	NoOfMedicationsForDashboard(patientID uint64) (int64, error)
@@ -83,6 +88,7 @@ type PatientRepository interface {
 	AddTestComponentDisplayConfig(config *models.PatientTestComponentDisplayConfig) error
 	GetPinnedComponentCount(patientId uint64) (int64, error)
 	HasRelation(patientId uint64, userId uint64) (bool, error)
+	GetPatientIdsWithPermission(userId uint64, permissionCode string) ([]uint64, error)
 	UserHasAnyOfRole(userId uint64, roles []string) bool
 }
 
@@ -1240,13 +1246,25 @@ func (pr *PatientRepositoryImpl) FetchPatientDiagnosticTrendValue(input models.D
 		format_datetime(pdt.test_date) AS test_date,
 		pdtrv.diagnostic_test_id,
 		pdtrv.diagnostic_test_component_id,
+		pdtrv.test_result_value_id,
 		tdpdtcm.test_component_name,
 		pdtrv.result_value,
-		dtrr.normal_min,
-		dtrr.normal_max,
-		dtrr.units,
+		pdtrv.result_unit,
+		pdtrv.original_result_value,
+		pdtrv.original_unit,
+		COALESCE(pdtrv.applied_normal_min, dtrr.normal_min) AS normal_min,
+		COALESCE(pdtrv.applied_normal_max, dtrr.normal_max) AS normal_max,
+		COALESCE(NULLIF(pdtrv.applied_range_units, ''), dtrr.units) AS units,
+		pdtrv.range_flag,
+		pdtrv.applied_range_reason,
+		COALESCE(pdtrv.is_derived, FALSE) AS is_derived,
+		pdtrv.derived_formula,
+		pdtrv.derived_inputs,
+		COALESCE(pdtrv.source, 'ai') AS source,
+		pdtrv.verified_at,
 		pdtrv.result_status,
 		format_datetime(pdtrv.result_date) AS result_date,
+		pdtrv.result_date AS result_at,
 		pdtrv.result_comment,
 		pdtrv.udf1 AS qualifier,
 		dc.is_pinned,
@@ -1265,7 +1283,8 @@ func (pr *PatientRepositoryImpl) FetchPatientDiagnosticTrendValue(input models.D
 			ON pdt.diagnostic_test_id = pdtrv.diagnostic_test_id 
 			AND pdt.patient_diagnostic_report_id = pdtrv.patient_diagnostic_report_id
 		LEFT JOIN tbl_diagnostic_test_reference_range dtrr 
-			ON pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id
+			ON (pdtrv.applied_range_source IS NULL AND pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id)
+			OR dtrr.test_reference_range_id = pdtrv.applied_range_id
 		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master tdpdtcm 
 			ON tdpdtcm.diagnostic_test_component_id = pdtrv.diagnostic_test_component_id
 		LEFT JOIN tbl_patient_test_component_display_config dc 
@@ -1356,6 +1375,7 @@ func (p *PatientRepositoryImpl) ParseDiagnosticTrendData(rawData []map[string]in
 				"normal_min":                   row["normal_min"],
 				"normal_max":                   row["normal_max"],
 				"is_pinned":                    row["is_pinned"],
+				"is_derived":                   row["is_derived"],
 				"diagnostic_test_id":           row["diagnostic_test_id"],
 				"patient_id":                   row["patient_id"],
 				"diagnostic_lab_id":            row["diagnostic_lab_id"],
@@ -1373,6 +1393,18 @@ func (p *PatientRepositoryImpl) ParseDiagnosticTrendData(rawData []map[string]in
 			"report_status":                row["report_status"],
 			"result_status":                row["result_status"],
 			"result_value":                 row["result_value"],
+			"result_unit":                  row["result_unit"],
+			"original_result_value":        row["original_result_value"],
+			"original_unit":                row["original_unit"],
+			"normal_min":                   row["normal_min"],
+			"normal_max":                   row["normal_max"],
+			"range_flag":                   row["range_flag"],
+			"applied_range_reason":         row["applied_range_reason"],
+			"derived_formula":              row["derived_formula"],
+			"derived_inputs":               derivedInputsJSON(row["derived_inputs"]),
+			"test_result_value_id":         row["test_result_value_id"],
+			"source":                       row["source"],
+			"verified_at":                  row["verified_at"],
 			"qualifier":                    row["qualifier"],
 			"result_comment":               row["result_comment"],
 			"test_note":                    row["test_note"],
@@ -1391,6 +1423,86 @@ func (p *PatientRepositoryImpl) ParseDiagnosticTrendData(rawData []map[string]in
 	return result, nil
 }
 
+// CreateTrendDriftNotice records a drift notification unless one was already sent for the
+// result, and reports whether it was recorded.
+func (p *PatientRepositoryImpl) CreateTrendDriftNotice(notice *models.TrendDriftNotice) (bool, error) {
+	result := p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "test_result_value_id"}},
+		DoNothing: true,
+	}).Create(notice)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetComparisonReports returns the live report of the patient with the id, or all of the
+// patient's reports dated reportDate.
+func (p *PatientRepositoryImpl) GetComparisonReports(patientId uint64, reportId *uint64, reportDate *time.Time) ([]models.PatientDiagnosticReport, error) {
+	var reports []models.PatientDiagnosticReport
+	query := p.db.Where("patient_id = ? AND is_deleted = 0", patientId)
+	if reportId != nil {
+		query = query.Where("patient_diagnostic_report_id = ?", *reportId)
+	}
+	if reportDate != nil {
+		query = query.Where("DATE(report_date) = ?", reportDate.Format("2006-01-02"))
+	}
+	err := query.Order("report_date, patient_diagnostic_report_id").Find(&reports).Error
+	return reports, err
+}
+
+// GetComparisonResults returns the results of the reports. Results of a merged alias component
+// are reported under the component it was merged into, and results stored before reference
+// ranges were applied fall back to the first master range of the component.
+func (p *PatientRepositoryImpl) GetComparisonResults(patientId uint64, reportIds []uint64) ([]models.ComparisonResultRow, error) {
+	var rows []models.ComparisonResultRow
+	err := p.db.Raw(`
+		SELECT
+			pdtrv.patient_diagnostic_report_id AS report_id,
+			pdr.report_date,
+			COALESCE(tcam.diagnostic_test_component_id, pdtrv.diagnostic_test_component_id) AS diagnostic_test_component_id,
+			COALESCE(orig_comp.test_component_name, tdpdtcm.test_component_name) AS test_component_name,
+			COALESCE(NULLIF(orig_comp.test_component_loinc_code, ''), tdpdtcm.test_component_loinc_code, '') AS loinc_code,
+			COALESCE(pdtm.test_name, '') AS test_name,
+			pdtrv.result_value,
+			COALESCE(pdtrv.result_unit, '') AS result_unit,
+			COALESCE(pdtrv.result_status, '') AS result_status,
+			COALESCE(pdtrv.udf1, '') AS qualifier,
+			COALESCE(pdtrv.applied_normal_min, dtrr.normal_min) AS normal_min,
+			COALESCE(pdtrv.applied_normal_max, dtrr.normal_max) AS normal_max,
+			COALESCE(pdtrv.range_flag, '') AS range_flag,
+			pdtrv.result_date
+		FROM tbl_patient_diagnostic_test_result_value pdtrv
+		INNER JOIN tbl_patient_diagnostic_report pdr
+			ON pdtrv.patient_diagnostic_report_id = pdr.patient_diagnostic_report_id
+		LEFT JOIN LATERAL (
+			SELECT r.normal_min, r.normal_max
+			FROM tbl_diagnostic_test_reference_range r
+			WHERE r.diagnostic_test_component_id = pdtrv.diagnostic_test_component_id AND r.is_deleted = 0
+			ORDER BY r.test_reference_range_id
+			LIMIT 1
+		) dtrr ON pdtrv.applied_range_source IS NULL
+		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master tdpdtcm
+			ON pdtrv.diagnostic_test_component_id = tdpdtcm.diagnostic_test_component_id
+		LEFT JOIN tbl_diagnostic_test_component_alias_mapping tcam
+			ON tcam.alias_test_component_id = pdtrv.diagnostic_test_component_id
+			AND tcam.diagnostic_test_component_id <> tcam.alias_test_component_id
+			AND tcam.is_deleted = 0
+		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master orig_comp
+			ON orig_comp.diagnostic_test_component_id = tcam.diagnostic_test_component_id
+		LEFT JOIN tbl_disease_profile_diagnostic_test_master pdtm
+			ON pdtrv.diagnostic_test_id = pdtm.diagnostic_test_id
+		WHERE pdr.patient_id = ? AND pdr.is_deleted = 0 AND pdtrv.patient_diagnostic_report_id IN ?
+		ORDER BY pdtrv.result_date, pdtrv.test_result_value_id`, patientId, reportIds).Scan(&rows).Error
+	return rows, err
+}
+
+// derivedInputsJSON returns the stored inputs of a derived result as raw JSON, so they are not
+// rendered as an escaped string.
+func derivedInputsJSON(value interface{}) interface{} {
+	if inputs, ok := value.(string); ok && inputs != "" {
+		return json.RawMessage(inputs)
+	}
+	return nil
+}
+
 func (p *PatientRepositoryImpl) GetRelationNameById(ids []uint64) ([]models.RelationMaster, error) {
 	uniqueIds := make(map[uint64]struct{})
 	for _, id := range ids {
@@ -1545,9 +1657,10 @@ func (p *PatientRepositoryImpl) FetchPatientDiagnosticReports(patientId uint64,
 			pdtrv.diagnostic_test_component_id,
 			tdpdtcm.test_component_name,
 			pdtrv.result_value,
-			dtrr.normal_min,
-			dtrr.normal_max,
-			dtrr.units,
+			COALESCE(pdtrv.result_unit, '') AS result_unit,
+			COALESCE(pdtrv.applied_normal_min, dtrr.normal_min) AS normal_min,
+			COALESCE(pdtrv.applied_normal_max, dtrr.normal_max) AS normal_max,
+			COALESCE(NULLIF(pdtrv.applied_range_units, ''), dtrr.units) AS units,
 			pdtrv.result_status,
 			pdtrv.result_date,
 			pdtrv.result_comment,
@@ -1562,7 +1675,8 @@ func (p *PatientRepositoryImpl) FetchPatientDiagnosticReports(patientId uint64,
 		LEFT JOIN tbl_patient_diagnostic_report pdr
 			ON pdtrv.patient_diagnostic_report_id = pdr.patient_diagnostic_report_id
 		LEFT JOIN tbl_diagnostic_test_reference_range dtrr
-			ON pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id
+			ON (pdtrv.applied_range_source IS NULL AND pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id)
+			OR dtrr.test_reference_range_id = pdtrv.applied_range_id
 		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master tdpdtcm
 			ON pdtrv.diagnostic_test_component_id = tdpdtcm.diagnostic_test_component_id
 		LEFT JOIN tbl_diagnostic_lab dl
@@ -1656,7 +1770,6 @@ func (p *PatientRepositoryImpl) GetPatientDiagnosticReportResult(patientId uint6
 			pdr.patient_diagnostic_report_id,
 			pdr.patient_id,
 			pra.record_id,
-			mr.record_url,
 			format_datetime(pdr.collected_date) AS collected_date,
 			format_datetime(pdr.report_date) AS report_date,
 			pdr.report_status,
@@ -1668,11 +1781,14 @@ func (p *PatientRepositoryImpl) GetPatientDiagnosticReportResult(patientId uint6
 			pdtrv.diagnostic_test_component_id,
 			COALESCE(orig_comp.test_component_name, tdpdtcm.test_component_name) AS test_component_name,
 			COALESCE(orig_comp.units, tdpdtcm.units) AS component_unit,
+			COALESCE(NULLIF(orig_comp.test_component_loinc_code, ''), tdpdtcm.test_component_loinc_code, '') AS test_component_loinc_code,
+			COALESCE(pdtm.test_loinc_code, '') AS test_loinc_code,
 			pdtrv.result_value,
-			dtrr.normal_min,
-			dtrr.normal_max,
+			COALESCE(pdtrv.result_unit, '') AS result_unit,
+			COALESCE(pdtrv.applied_normal_min, dtrr.normal_min) AS normal_min,
+			COALESCE(pdtrv.applied_normal_max, dtrr.normal_max) AS normal_max,
 			dtrr.biological_reference_description,
-			dtrr.units AS ref_units,
+			COALESCE(NULLIF(pdtrv.applied_range_units, ''), dtrr.units) AS ref_units,
 			pdtrv.result_status,
 			format_datetime(pdtrv.result_date) AS result_date,
 			pdtrv.result_comment,
@@ -1687,7 +1803,8 @@ func (p *PatientRepositoryImpl) GetPatientDiagnosticReportResult(patientId uint6
 		LEFT JOIN tbl_patient_diagnostic_report pdr 
 			ON pdtrv.patient_diagnostic_report_id = pdr.patient_diagnostic_report_id
 		LEFT JOIN tbl_diagnostic_test_reference_range dtrr 
-			ON pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id
+			ON (pdtrv.applied_range_source IS NULL AND pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id)
+			OR dtrr.test_reference_range_id = pdtrv.applied_range_id
 		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master tdpdtcm 
 			ON pdtrv.diagnostic_test_component_id = tdpdtcm.diagnostic_test_component_id
 		LEFT JOIN tbl_diagnostic_test_component_alias_mapping tcam 
@@ -1884,11 +2001,14 @@ func (p *PatientRepositoryImpl) GetPatientDiagnosticHealthVital(patientId uint64
 			pdtrv.diagnostic_test_component_id,
 			COALESCE(orig_comp.test_component_name, tdpdtcm.test_component_name) AS test_component_name,
 			COALESCE(orig_comp.units, tdpdtcm.units) AS component_unit,
+			COALESCE(NULLIF(orig_comp.test_component_loinc_code, ''), tdpdtcm.test_component_loinc_code, '') AS test_component_loinc_code,
+			COALESCE(pdtm.test_loinc_code, '') AS test_loinc_code,
 			pdtrv.result_value,
-			dtrr.normal_min,
-			dtrr.normal_max,
+			COALESCE(pdtrv.result_unit, '') AS result_unit,
+			COALESCE(pdtrv.applied_normal_min, dtrr.normal_min) AS normal_min,
+			COALESCE(pdtrv.applied_normal_max, dtrr.normal_max) AS normal_max,
 			dtrr.biological_reference_description,
-			dtrr.units AS ref_units,
+			COALESCE(NULLIF(pdtrv.applied_range_units, ''), dtrr.units) AS ref_units,
 			pdtrv.result_status,
 			format_datetime(pdtrv.result_date) AS result_date,
 			pdtrv.result_comment,
@@ -1903,7 +2023,8 @@ func (p *PatientRepositoryImpl) GetPatientDiagnosticHealthVital(patientId uint64
 			ON pdtrv.patient_diagnostic_report_id = pdr.patient_diagnostic_report_id
 			AND pdr.is_health_vital = true
 		LEFT JOIN tbl_diagnostic_test_reference_range dtrr 
-			ON pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id
+			ON (pdtrv.applied_range_source IS NULL AND pdtrv.diagnostic_test_component_id = dtrr.diagnostic_test_component_id)
+			OR dtrr.test_reference_range_id = pdtrv.applied_range_id
 		LEFT JOIN tbl_disease_profile_diagnostic_test_component_master tdpdtcm 
 			ON pdtrv.diagnostic_test_component_id = tdpdtcm.diagnostic_test_component_id
 		LEFT JOIN tbl_diagnostic_test_component_alias_mapping tcam 
@@ -1983,6 +2104,7 @@ func (p *PatientRepositoryImpl) ProcessReportGridData(rows []models.ReportRow, u
 		key := models.ComponentKey{
 			ComponentID: row.DiagnosticTestComponentID,
 			Name:        row.TestComponentName,
+			LoincCode:   row.TestComponentLoincCode,
 			Units:       row.ComponentUnit,
 			RefRange:    rangeStr,
 			IsPinned:    row.IsPinned,
@@ -2016,6 +2138,7 @@ func (p *PatientRepositoryImpl) ProcessReportGridData(rows []models.ReportRow, u
 		row := map[string]interface{}{
 			"diagnostic_test_component_id": key.ComponentID,
 			"test_component_name":          key.Name,
+			"loinc_code":                   key.LoincCode,
 			"ref_unit":                     key.Units,
 			"ref_range":                    key.RefRange,
 			"is_pinned":                    key.IsPinned,
@@ -2075,6 +2198,7 @@ func (p *PatientRepositoryImpl) RestructureDiagnosticReports(flatData []models.D
 					"diagnostic_test_id":           item.DiagnosticTestID,
 					"diagnostic_test_component_id": item.DiagnosticTestComponentID,
 					"result_value":                 item.ResultValue,
+					"result_unit":                  item.ResultUnit,
 					"result_status":                item.ResultStatus,
 					"result_date":                  item.ResultDate,
 					"result_comment":               item.ResultComment,
@@ -2242,6 +2366,19 @@ func (p *PatientRepositoryImpl) HasRelation(patientId uint64, userId uint64) (bo
 	return count > 0, nil
 }
 
+// GetPatientIdsWithPermission returns the patients related to userId that granted userId the
+// permission, i.e. every patient for which CanContinue(patient, userId, code) passes.
+func (p *PatientRepositoryImpl) GetPatientIdsWithPermission(userId uint64, permissionCode string) ([]uint64, error) {
+	var patientIds []uint64
+	err := p.db.Table("tbl_system_user_role_mapping AS m").
+		Distinct("m.patient_id").
+		Joins("JOIN tbl_user_relative_permission_mappings AS pm ON pm.user_id = m.patient_id AND pm.relative_id = m.user_id AND pm.granted = true").
+		Joins("JOIN tbl_permissions_master AS p ON p.permission_id = pm.permission_id").
+		Where("m.user_id = ? AND m.patient_id <> m.user_id AND p.code = ?", userId, permissionCode).
+		Pluck("m.patient_id", &patientIds).Error
+	return patientIds, err
+}
+
 func (r *PatientRepositoryImpl) UpdateSystemUserRoleMapping(userId uint64, patientData *models.Patient) error {
 	log.Println("PatientRepositoryImpl UpdateSystemUserRoleMapping :: ", patientData)
 	updateData := map[string]interface{}{}
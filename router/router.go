@@ -56,15 +56,27 @@ func InitializeRoutes(apiGroup *gin.RouterGroup, db *gorm.DB) {
 	var permissionRepo = repository.NewPermissionRepository(db)
 	var permissionService = service.NewPermissionService(permissionRepo, roleRepo)
 
-	var patientService = service.NewPatientService(patientRepo, apiService, allergyService, medicalRecordsRepo, roleRepo, notificationService, permissionRepo, userRepo)
+	var diagnosticRepo = repository.NewDiagnosticRepository(db)
+	var patientService = service.NewPatientService(patientRepo, apiService, allergyService, medicalRecordsRepo, roleRepo, notificationService, permissionRepo, userRepo, diagnosticRepo)
 
 	var subscriptionRepo = repository.NewSubscriptionRepository(db)
 	var subscriptionService = service.NewSubscriptionService(subscriptionRepo, roleRepo)
 	var roleService = service.NewRoleService(roleRepo, patientService, userRepo, subscriptionRepo)
 
-	var diagnosticRepo = repository.NewDiagnosticRepository(db)
-	var diagnosticService = service.NewDiagnosticService(diagnosticRepo, emailService, patientService, medicalRecordsRepo, processStatusService)
-	var medicalRecordService = service.NewTblMedicalRecordService(medicalRecordsRepo, apiService, diagnosticService, patientService, userService, config.AsynqClient, config.RedisClient, processStatusService, patientRepo)
+	var criticalAlertRepo = repository.NewCriticalAlertRepository(db)
+	var criticalAlertService = service.NewCriticalAlertService(criticalAlertRepo, diagnosticRepo, userRepo, patientService, notificationService)
+	var diagnosticService = service.NewDiagnosticService(diagnosticRepo, emailService, patientService, medicalRecordsRepo, processStatusService, criticalAlertService)
+	var recordEncryptionService = service.NewRecordEncryptionService()
+	var fileStoreService = service.NewFileStoreService(recordEncryptionService)
+	var medicalRecordService = service.NewTblMedicalRecordService(medicalRecordsRepo, apiService, diagnosticService, patientService, userService, config.AsynqClient, config.RedisClient, processStatusService, patientRepo, fileStoreService, recordEncryptionService)
+
+	var patientExportService = service.NewPatientExportService(medicalRecordsRepo, patientService, allergyService, notificationService, processStatusService, fileStoreService, recordEncryptionService, config.AsynqClient)
+
+	var deadLetterRepo = repository.NewDeadLetterRepository(db)
+	var deadLetterService = service.NewDeadLetterService(deadLetterRepo, medicalRecordsRepo, processStatusService, config.AsynqClient, config.RedisClient)
+
+	var erasureRepo = repository.NewErasureRepository(db)
+	var erasureService = service.NewErasureService(erasureRepo, userRepo, fileStoreService)
 
 	var smsService = service.NewSmsService()
 
@@ -88,8 +100,10 @@ func InitializeRoutes(apiGroup *gin.RouterGroup, db *gorm.DB) {
 		time.Duration(config.PropConfig.HealthCheck.TimeoutSeconds)*time.Second,
 	)
 
-	var gmailSyncService = service.NewGmailSyncService(processStatusService, medicalRecordService, userService, diagnosticRepo, apiService, patientService, medicalRecordsRepo, db)
-	var outlookService = service.NewOutLookService(userService, apiService, processStatusService, gmailSyncService, diagnosticRepo)
+	var taskQueueService = service.NewTaskQueueService(config.AsynqInspector, healthService)
+
+	var gmailSyncService = service.NewGmailSyncService(processStatusService, medicalRecordService, userService, diagnosticRepo, apiService, patientService, medicalRecordsRepo, db, fileStoreService)
+	var outlookService = service.NewOutLookService(userService, apiService, processStatusService, gmailSyncService, diagnosticRepo, fileStoreService)
 	var yahooService = service.NewYahooService(userService, apiService, processStatusService, gmailSyncService, diagnosticRepo)
 
 	var gmailRecordsController = controller.NewGmailSyncController(gmailSyncService, medicalRecordService, userService, healthService, outlookService, yahooService)
@@ -100,10 +114,12 @@ func InitializeRoutes(apiGroup *gin.RouterGroup, db *gorm.DB) {
 
 	var patientController = controller.NewPatientController(patientService, dietService, allergyService, medicalRecordService,
 		medicationService, appointmentService, diagnosticService, userService, apiService, diseaseService, smsService, emailService,
-		orderService, notificationService, authService, roleService, permissionService, subscriptionService, processStatusService, gmailSyncService, abdmService)
+		orderService, notificationService, authService, roleService, permissionService, subscriptionService, processStatusService, gmailSyncService, abdmService,
+		patientExportService, erasureService, criticalAlertService, deadLetterService, taskQueueService)
 
 	var masterController = controller.NewMasterController(allergyService, diseaseService, causeService, symptomService,
-		medicationService, dietService, exerciseService, diagnosticService, roleService, supportGrpService, hospitalService, userService, subscriptionService, notificationService)
+		medicationService, dietService, exerciseService, diagnosticService, roleService, supportGrpService, hospitalService, userService, subscriptionService, notificationService,
+		criticalAlertService)
 	MasterRoutes(apiGroup, masterController, patientController)
 	PatientRoutes(apiGroup, patientController)
 
@@ -115,7 +131,11 @@ func InitializeRoutes(apiGroup *gin.RouterGroup, db *gorm.DB) {
 	// Workers
 	worker.NewDigitizationWorker(db)
 	worker.StartAppointmentScheduler(appointmentService)
-	go worker.InitAsynqWorker(apiService, patientService, diagnosticService, medicalRecordsRepo, db, processStatusService, gmailSyncService)
+	worker.StartRecordPurgeScheduler(medicalRecordService)
+	worker.StartErasureScheduler(erasureService)
+	worker.StartCriticalAlertScheduler(criticalAlertService)
+	worker.StartDataExportSweeper(patientExportService)
+	go worker.InitAsynqWorker(apiService, patientService, diagnosticService, medicalRecordsRepo, db, processStatusService, gmailSyncService, fileStoreService, recordEncryptionService, deadLetterService, taskQueueService, patientExportService)
 
 }
 
@@ -214,6 +234,16 @@ func getMasterRoutes(masterController *controller.MasterController, patientContr
 		Route{"DTM", http.MethodPut, constant.DiagnosticComponent, masterController.UpdateDiagnosticComponent},
 		Route{"DTM", http.MethodGet, constant.SingleDiagnosticComponent, masterController.GetSingleDiagnosticComponent},
 		Route{"DTM", http.MethodPost, constant.DeleteDTComponent, masterController.DeleteDiagnosticTestComponent},
+		Route{"DTM", http.MethodGet, constant.DiagnosticComponentUnits, masterController.GetDiagnosticComponentUnits},
+		Route{"DTM", http.MethodPost, constant.DiagnosticComponentUnits, masterController.SaveDiagnosticComponentUnit},
+		Route{"DTM", http.MethodDelete, constant.DeleteDiagnosticComponentUnit, masterController.DeleteDiagnosticComponentUnit},
+		Route{"DTM", http.MethodGet, constant.DiagnosticCriticalThreshold, masterController.GetCriticalThreshold},
+		Route{"DTM", http.MethodPost, constant.DiagnosticCriticalThreshold, masterController.SaveCriticalThreshold},
+		Route{"DTM", http.MethodDelete, constant.DiagnosticCriticalThreshold, masterController.DeleteCriticalThreshold},
+		Route{"DTM", http.MethodGet, constant.ComponentAliasSuggestions, masterController.GetComponentAliasSuggestions},
+		Route{"DTM", http.MethodPost, constant.AcceptComponentAliasSuggestions, masterController.AcceptComponentAliasSuggestions},
+		Route{"DTM", http.MethodGet, constant.LoincCodes, masterController.SearchLoincCodes},
+		Route{"DTM", http.MethodGet, constant.LoincCode, masterController.GetLoincCode},
 
 		// Diagnostic Test Component Mapping Routes
 		Route{"DTM", http.MethodPost, constant.DiagnosticTestComponentMapping, masterController.CreateDiagnosticTestComponentMapping},
@@ -256,6 +286,7 @@ func getMasterRoutes(masterController *controller.MasterController, patientContr
 		Route{"Test Reference Range", http.MethodPut, constant.UpdateRefRange, masterController.UpdateTestReferenceRange},
 		Route{"Test Reference Range", http.MethodPost, constant.DeleteRefRange, masterController.DeleteTestReferenceRange},
 		Route{"Test Reference Range", http.MethodPost, constant.ViewRefRange, masterController.ViewTestReferenceRange},
+		Route{"Test Reference Range", http.MethodPost, constant.ReflagRefRange, masterController.ReflagTestResults},
 		Route{"Test Reference Range", http.MethodPost, constant.ViewAllRefRange, masterController.GetAllTestReferenceRange},
 		Route{"Test Reference Range", http.MethodPost, constant.ViewAuditRefRange, masterController.GetTestReferenceRangeAuditRecord},
 		Route{"Get Subsription status", http.MethodPost, constant.SubscriptionEnabledStatus, masterController.GetSubscriptionShowStatus},
@@ -264,6 +295,8 @@ func getMasterRoutes(masterController *controller.MasterController, patientContr
 
 		Route{"Create Users on notify", http.MethodPost, constant.RecipientDetails, masterController.CreateUsersOnNotify},
 		Route{"Create Users on notify", http.MethodPost, constant.MigrateToBioMail, masterController.CreateUsersOnMail},
+		Route{"Migrate record urls", http.MethodPost, constant.MigrateRecordURL, patientController.MigrateLegacyRecordUrls},
+		Route{"Rewrap record keys", http.MethodPost, constant.RewrapRecordKeys, patientController.RewrapRecordDataKeys},
 	}
 }
 func getPatientRoutes(patientController *controller.PatientController) Routes {
@@ -358,6 +391,35 @@ func getPatientRoutes(patientController *controller.PatientController) Routes {
 		Route{"medical records get single", http.MethodGet, constant.GetByRecordId, patientController.GetMedicalRecordByRecordId},
 		Route{"medical records update", http.MethodPut, constant.UpdateMedicalRecord, patientController.UpdateTblMedicalRecord},
 		Route{"medical records delete", http.MethodDelete, constant.DeleteMedicalRecord, patientController.DeleteTblMedicalRecord},
+		Route{"medical record versions", http.MethodGet, constant.RecordVersions, patientController.GetRecordVersions},
+		Route{"search medical records", http.MethodGet, constant.RecordSearch, patientController.SearchMedicalRecords},
+		Route{"import medical records zip", http.MethodPost, constant.ImportRecordsZip, patientController.ImportMedicalRecordsZip},
+		Route{"start patient data export", http.MethodPost, constant.StartDataExport, patientController.StartPatientDataExport},
+		Route{"patient data export status", http.MethodGet, constant.DataExportInfo, patientController.GetPatientDataExport},
+		Route{"erasure dry run", http.MethodGet, constant.ErasurePreview, patientController.PreviewErasure},
+		Route{"request erasure", http.MethodPost, constant.RequestErasure, patientController.RequestErasure},
+		Route{"erasure request status", http.MethodGet, constant.ErasureRequestByID, patientController.GetErasureRequest},
+		Route{"cancel erasure", http.MethodDelete, constant.ErasureRequestByID, patientController.CancelErasure},
+		Route{"verify erasure certificates", http.MethodGet, constant.VerifyErasureChain, patientController.VerifyErasureCertificates},
+		Route{"critical alerts", http.MethodGet, constant.CriticalAlerts, patientController.GetCriticalAlerts},
+		Route{"acknowledge critical alert", http.MethodPost, constant.AcknowledgeCritical, patientController.AcknowledgeCriticalAlert},
+		Route{"add report result", http.MethodPost, constant.ReportResults, patientController.AddReportResult},
+		Route{"update report result", http.MethodPut, constant.ReportResult, patientController.UpdateReportResult},
+		Route{"delete report result", http.MethodDelete, constant.ReportResult, patientController.DeleteReportResult},
+		Route{"report result audit", http.MethodGet, constant.ReportResultAudit, patientController.GetReportResultAudit},
+		Route{"digitization review queue", http.MethodGet, constant.ReviewQueue, patientController.GetReviewQueue},
+		Route{"approve review item", http.MethodPost, constant.ApproveReviewItem, patientController.ApproveReviewItem},
+		Route{"reject review item", http.MethodPost, constant.RejectReviewItem, patientController.RejectReviewItem},
+		Route{"compare reports", http.MethodGet, constant.CompareReports, patientController.CompareReports},
+		Route{"export report comparison", http.MethodGet, constant.ExportReportComparison, patientController.ExportReportComparison},
+		Route{"digitization dead letters", http.MethodGet, constant.DeadLetters, patientController.GetDeadLetters},
+		Route{"replay dead letters", http.MethodPost, constant.ReplayDeadLetters, patientController.ReplayDeadLetters},
+		Route{"discard dead letters", http.MethodPost, constant.DiscardDeadLetters, patientController.DiscardDeadLetters},
+		Route{"scrub dead letters", http.MethodPost, constant.ScrubDeadLetters, patientController.ScrubDeadLetters},
+		Route{"retry digitization", http.MethodPost, constant.RetryDigitization, patientController.RetryDigitization},
+		Route{"digitization queue status", http.MethodGet, constant.DigitizationQueueStatus, patientController.GetDigitizationQueueStatus},
+		Route{"medical record restore", http.MethodPost, constant.RestoreRecord, patientController.RestoreMedicalRecord},
+		Route{"medical record purge", http.MethodDelete, constant.PurgeRecord, patientController.PurgeMedicalRecord},
 
 		Route{"Appointments", http.MethodPost, constant.ScheduleAppointment, patientController.ScheduleAppointment},
 		Route{"Appointments", http.MethodPost, constant.GetAppointments, patientController.GetUserAppointments},
@@ -448,5 +510,8 @@ func getMailSyncRoutes(gmailSyncController *controller.GmailSyncController) Rout
 func getOpenRoutes(patientController *controller.PatientController) Routes {
 	return Routes{
 		Route{"Transcribe ", http.MethodPost, constant.Transcribe, patientController.TranscriptionHandler},
+		Route{"Download record", http.MethodGet, constant.RecordDownload, patientController.DownloadMedicalRecord},
+		Route{"Record thumbnail", http.MethodGet, constant.RecordThumbnail, patientController.GetRecordThumbnail},
+		Route{"Download data export", http.MethodGet, constant.DataExportDownload, patientController.DownloadPatientDataExport},
 	}
 }
@@ -134,7 +134,6 @@ func Routing(envFile string) {
 		ctx.JSON(http.StatusOK, gin.H{"message": "Biostack server running..."})
 	})
 	r.router.GET(constant.Version, func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": utils.GetBuildVersion()}) })
-	r.router.Static("/uploads", "./uploads")
 	apiGroup := r.router.Group(os.Getenv("ApiVersion"))
 	db := database.GetDBConn()
 	InitializeRoutes(apiGroup, db)
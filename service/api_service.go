@@ -12,7 +12,6 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
-	"os"
 	"time"
 
 	"github.com/google/uuid"
@@ -57,13 +56,13 @@ type ApiServiceImpl struct {
 
 func NewApiService() ApiService {
 	return &ApiServiceImpl{
-		GeminiAPIURL:               os.Getenv("GEMINI_API_URL"),
+		GeminiAPIURL:               config.PropConfig.ApiURL.ReportDigitizationURL,
 		ExtractDocDetail:           config.PropConfig.ApiURL.ExtractDocDetail,
-		ReportSummaryAPI:           os.Getenv("REPORT_SUMMARY_API"),
-		PrescriptionAPI:            os.Getenv("PRESCRIPTION_API"),
-		PharmacokineticsAPI:        os.Getenv("PHARMACOKINETICS_API"),
-		SummarizeMedicalHistoryAPI: os.Getenv("SUMMARIZE_HISTORY_API"),
-		DigitizePrescriptionAPI:    os.Getenv("DIGITIZE_PRESCRIPTION_API"),
+		ReportSummaryAPI:           config.PropConfig.ApiURL.ReportSummaryURL,
+		PrescriptionAPI:            config.PropConfig.ApiURL.PrescriptionURL,
+		PharmacokineticsAPI:        config.PropConfig.ApiURL.PharmacokineticsURL,
+		SummarizeMedicalHistoryAPI: config.PropConfig.ApiURL.SummaryHistoryURL,
+		DigitizePrescriptionAPI:    config.PropConfig.ApiURL.PrescriptionDigitizationURL,
 		CheckPDFProtectionAPI:      config.PropConfig.ApiURL.CheckPDFProtectionAPI,
 		PDFPasswordAPI:             config.PropConfig.ApiURL.PDFPasswordAPI,
 		DocTypeCheckAPI:            config.PropConfig.ApiURL.DocTypeAPI,
@@ -133,7 +132,7 @@ func (s *ApiServiceImpl) CallGeminiService(file io.Reader, filename, relatives,
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return models.DocumentDetail{}, fmt.Errorf("service returned error: %s, body: %s", resp.Status, string(respBody))
+		return models.DocumentDetail{}, &APIStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
 	}
 
 	var reportData models.DocumentDetail
@@ -202,7 +201,7 @@ func (s *ApiServiceImpl) ClassifyDocGetGeminiReponse(file io.Reader, filename, r
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return models.DocumentResponse{}, fmt.Errorf("service returned error: %s, body: %s", resp.Status, string(respBody))
+		return models.DocumentResponse{}, &APIStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
 	}
 	var reportData models.DocumentResponse
 	if err := json.NewDecoder(resp.Body).Decode(&reportData); err != nil {
@@ -328,7 +327,7 @@ func (s *ApiServiceImpl) CallPrescriptionDigitizeAPI(file io.Reader, filename st
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return models.PatientPrescription{}, fmt.Errorf("service returned error: %s, body: %s", resp.Status, string(respBody))
+		return models.PatientPrescription{}, &APIStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
 	}
 
 	var prescriptionData models.PatientPrescriptionData
@@ -468,7 +467,7 @@ func (api *ApiServiceImpl) SummarizeMedicalHistory(input models.Pharmacokinetics
 }
 
 func (s *ApiServiceImpl) AskAI(message string, userId uint64, patientName string, query_type string) (*models.AskAPIResponse, error) {
-	apiURL := os.Getenv("ASK_API")
+	apiURL := config.PropConfig.ApiURL.AskChatBotURL
 	if apiURL == "" {
 		apiURL = "http://bio.alrn.in/api/ask"
 	}
@@ -675,7 +674,7 @@ func (s *ApiServiceImpl) CallDocumentTypeAPI(file io.Reader, filename string) (*
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("service returned error: %s, body: %s", resp.Status, string(respBody))
+		return nil, &APIStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
 	}
 
 	var apiResp models.DocTypeAPIResponse
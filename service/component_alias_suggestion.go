@@ -0,0 +1,247 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/database"
+	"biostat/models"
+	"biostat/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Below this name similarity a component is not suggested, however well its units and range
+// agree; many components share mg/dL.
+const minAliasNameScore = 0.5
+
+// unmappedComponent collects the pending review items parked under one component name.
+type unmappedComponent struct {
+	suggestion models.ComponentAliasSuggestion
+	rangeMin   *float64
+	rangeMax   *float64
+}
+
+// GetComponentAliasSuggestions ranks master components for every component name that is
+// waiting in the review queue because the digitizer could not map it.
+func (s *DiagnosticServiceImpl) GetComponentAliasSuggestions() ([]models.ComponentAliasSuggestion, error) {
+	unmapped, err := s.unmappedComponents()
+	if err != nil {
+		return nil, err
+	}
+	components, err := s.diagnosticRepo.GetMergeableComponents()
+	if err != nil {
+		return nil, err
+	}
+	units, err := s.diagnosticRepo.GetComponentUnits(nil)
+	if err != nil {
+		log.Println("@GetComponentAliasSuggestions->GetComponentUnits:", err)
+	}
+	unitRegistry := NewUnitRegistry(units)
+	ranges, err := s.diagnosticRepo.GetReferenceRanges(nil)
+	if err != nil {
+		log.Println("@GetComponentAliasSuggestions->GetReferenceRanges:", err)
+	}
+	rangesByComponent := map[uint64][]models.DiagnosticTestReferenceRange{}
+	for _, ref := range ranges {
+		rangesByComponent[ref.DiagnosticTestComponentId] = append(rangesByComponent[ref.DiagnosticTestComponentId], ref)
+	}
+
+	minScore := float64(config.PropConfig.AliasSuggestion.MinScorePercent) / 100
+	maxCandidates := config.PropConfig.AliasSuggestion.MaxCandidates
+	if maxCandidates <= 0 {
+		maxCandidates = 3
+	}
+	suggestions := make([]models.ComponentAliasSuggestion, 0, len(unmapped))
+	for _, name := range unmapped {
+		suggestion := name.suggestion
+		suggestion.Candidates = []models.ComponentMatchCandidate{}
+		for _, component := range components {
+			nameScore := utils.ComponentNameSimilarity(suggestion.AliasName, component.TestComponentName)
+			if nameScore < minAliasNameScore {
+				continue
+			}
+			candidate := models.ComponentMatchCandidate{
+				DiagnosticTestComponentId: component.DiagnosticTestComponentId,
+				TestComponentName:         component.TestComponentName,
+				Units:                     component.Units,
+				NameScore:                 roundUnitValue(nameScore),
+				UnitScore:                 unitSimilarity(suggestion.Units, component, unitRegistry),
+				RangeScore:                rangeSimilarity(name, component.DiagnosticTestComponentId, rangesByComponent[component.DiagnosticTestComponentId], unitRegistry),
+			}
+			candidate.Score = roundUnitValue(0.6*nameScore + 0.2*candidate.UnitScore + 0.2*candidate.RangeScore)
+			if candidate.Score >= minScore {
+				suggestion.Candidates = append(suggestion.Candidates, candidate)
+			}
+		}
+		sort.SliceStable(suggestion.Candidates, func(i, j int) bool {
+			return suggestion.Candidates[i].Score > suggestion.Candidates[j].Score
+		})
+		if len(suggestion.Candidates) > maxCandidates {
+			suggestion.Candidates = suggestion.Candidates[:maxCandidates]
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Occurrences > suggestions[j].Occurrences
+	})
+	return suggestions, nil
+}
+
+// unmappedComponents groups the pending unmapped review items by component name, keeping the
+// unit and reference range first seen for the name.
+func (s *DiagnosticServiceImpl) unmappedComponents() (map[string]*unmappedComponent, error) {
+	items, _, err := s.diagnosticRepo.GetReviewItems(models.ReviewQueueFilter{Status: constant.ReviewPending, Reason: constant.ReviewReasonUnmapped}, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	unmapped := map[string]*unmappedComponent{}
+	for _, item := range items {
+		key := strings.ToLower(strings.TrimSpace(item.TestComponentName))
+		if key == "" {
+			continue
+		}
+		name, exists := unmapped[key]
+		if !exists {
+			name = &unmappedComponent{suggestion: models.ComponentAliasSuggestion{AliasName: strings.TrimSpace(item.TestComponentName)}}
+			unmapped[key] = name
+		}
+		name.suggestion.Occurrences++
+		name.suggestion.PendingReviewIds = append(name.suggestion.PendingReviewIds, item.ReviewId)
+		if name.suggestion.Units == "" {
+			name.suggestion.Units = item.Units
+		}
+		if name.rangeMin == nil {
+			var component models.LabReportComponent
+			if err := json.Unmarshal(item.Component, &component); err == nil {
+				min, minErr := strconv.ParseFloat(component.ReferenceRange.Min, 64)
+				max, maxErr := strconv.ParseFloat(component.ReferenceRange.Max, 64)
+				if minErr == nil && maxErr == nil && max > min {
+					name.rangeMin, name.rangeMax = &min, &max
+					name.suggestion.ReferenceMin, name.suggestion.ReferenceMax = &min, &max
+				}
+			}
+		}
+	}
+	return unmapped, nil
+}
+
+// unitSimilarity is 1 when the unit is the component's own or registered for it, 0 when it is
+// not, and 0.5 when the extracted result had no unit.
+func unitSimilarity(unit string, component models.DiagnosticTestComponent, unitRegistry UnitRegistry) float64 {
+	if strings.TrimSpace(unit) == "" {
+		return 0.5
+	}
+	if NormalizeUnit(unit) == NormalizeUnit(component.Units) {
+		return 1
+	}
+	if _, ok := unitRegistry[component.DiagnosticTestComponentId][NormalizeUnit(unit)]; ok {
+		return 1
+	}
+	return 0
+}
+
+// rangeSimilarity is the best overlap, as intersection over union, between the extracted
+// reference range and a master range of the component, converted to the range's unit where
+// the registry allows. It is 0.5 when either side has no usable range.
+func rangeSimilarity(name *unmappedComponent, componentId uint64, ranges []models.DiagnosticTestReferenceRange, unitRegistry UnitRegistry) float64 {
+	if name.rangeMin == nil || name.rangeMax == nil {
+		return 0.5
+	}
+	best, compared := 0.0, false
+	for _, ref := range ranges {
+		if ref.NormalMax <= ref.NormalMin {
+			continue
+		}
+		min, max := *name.rangeMin, *name.rangeMax
+		if ref.Units != "" && name.suggestion.Units != "" {
+			convertedMin, okMin := unitRegistry.Convert(componentId, min, name.suggestion.Units, ref.Units)
+			convertedMax, okMax := unitRegistry.Convert(componentId, max, name.suggestion.Units, ref.Units)
+			if !okMin || !okMax {
+				continue
+			}
+			min, max = convertedMin, convertedMax
+		}
+		compared = true
+		overlap := math.Min(max, ref.NormalMax) - math.Max(min, ref.NormalMin)
+		union := math.Max(max, ref.NormalMax) - math.Min(min, ref.NormalMin)
+		if overlap > 0 && union > 0 && overlap/union > best {
+			best = overlap / union
+		}
+	}
+	if !compared {
+		return 0.5
+	}
+	return roundUnitValue(best)
+}
+
+// AcceptComponentAliasSuggestions records each accepted name as an alias of its component and
+// saves the results parked under that name through the review queue.
+func (s *DiagnosticServiceImpl) AcceptComponentAliasSuggestions(userId uint64, suggestions []models.AcceptAliasSuggestion) ([]models.AliasSuggestionResult, error) {
+	unmapped, err := s.unmappedComponents()
+	if err != nil {
+		return nil, err
+	}
+	components, err := s.diagnosticRepo.GetMergeableComponents()
+	if err != nil {
+		return nil, err
+	}
+	mergeable := make(map[uint64]bool, len(components))
+	for _, component := range components {
+		mergeable[component.DiagnosticTestComponentId] = true
+	}
+
+	results := make([]models.AliasSuggestionResult, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		result := models.AliasSuggestionResult{AliasName: suggestion.AliasName, DiagnosticTestComponentId: suggestion.DiagnosticTestComponentId}
+		if err := s.acceptAliasSuggestion(suggestion, mergeable, unmapped, userId, &result); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *DiagnosticServiceImpl) acceptAliasSuggestion(suggestion models.AcceptAliasSuggestion, mergeable map[uint64]bool, unmapped map[string]*unmappedComponent, userId uint64, result *models.AliasSuggestionResult) error {
+	if !mergeable[suggestion.DiagnosticTestComponentId] {
+		return fmt.Errorf("component %d is not a master component", suggestion.DiagnosticTestComponentId)
+	}
+	testNameCache, componentNameCache := s.diagnosticRepo.LoadDiagnosticTestMasterData()
+	if testNameCache == nil || componentNameCache == nil {
+		return fmt.Errorf("test and component master data not available")
+	}
+	s.addComponentAliases(componentNameCache)
+
+	key := strings.ToLower(strings.TrimSpace(suggestion.AliasName))
+	component := models.LabReportComponent{TestComponentName: strings.TrimSpace(suggestion.AliasName)}
+	if name, ok := unmapped[key]; ok {
+		component.Units = name.suggestion.Units
+	}
+	tx := database.DB.Begin()
+	if err := s.saveReviewAlias(tx, component, suggestion.DiagnosticTestComponentId, componentNameCache, userId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	name, ok := unmapped[key]
+	if !ok {
+		return nil
+	}
+	targetId := suggestion.DiagnosticTestComponentId
+	for _, reviewId := range name.suggestion.PendingReviewIds {
+		decision := models.ReviewDecisionRequest{DiagnosticTestComponentId: &targetId, Note: "Mapped by alias suggestion"}
+		if _, err := s.ApproveReviewItem(reviewId, userId, true, decision); err != nil {
+			log.Printf("@AcceptComponentAliasSuggestions->ApproveReviewItem %d: %v", reviewId, err)
+			continue
+		}
+		result.ApprovedReviewItems++
+	}
+	return nil
+}
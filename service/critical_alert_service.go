@@ -0,0 +1,257 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"biostat/repository"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CriticalAlertService raises an alert when a digitized result crosses the critical threshold
+// of its component, escalates it to the patient's primary caregiver and head of family, and
+// re-escalates it until somebody acknowledges it.
+type CriticalAlertService interface {
+	GetCriticalThreshold(componentId uint64) (*models.DiagnosticCriticalThreshold, error)
+	SaveCriticalThreshold(threshold *models.DiagnosticCriticalThreshold) error
+	DeleteCriticalThreshold(componentId uint64) error
+	EvaluateReport(patientId, reportId uint64) (int, error)
+	ReescalateDueAlerts() (int, error)
+	GetCriticalAlerts(patientId uint64, status string, limit, offset int) ([]models.CriticalResultAlert, int64, error)
+	AcknowledgeAlert(alertId uuid.UUID, userId uint64, note string) (*models.CriticalResultAlert, error)
+	ResolveResultAlert(tx *gorm.DB, testResultValueId int, userId uint64, note string) error
+}
+
+type criticalAlertServiceImpl struct {
+	alertRepo           repository.CriticalAlertRepository
+	diagnosticRepo      repository.DiagnosticRepository
+	userRepo            repository.UserRepository
+	patientService      PatientService
+	notificationService NotificationService
+}
+
+func NewCriticalAlertService(alertRepo repository.CriticalAlertRepository, diagnosticRepo repository.DiagnosticRepository,
+	userRepo repository.UserRepository, patientService PatientService, notificationService NotificationService) CriticalAlertService {
+	return &criticalAlertServiceImpl{
+		alertRepo:           alertRepo,
+		diagnosticRepo:      diagnosticRepo,
+		userRepo:            userRepo,
+		patientService:      patientService,
+		notificationService: notificationService,
+	}
+}
+
+func (s *criticalAlertServiceImpl) GetCriticalThreshold(componentId uint64) (*models.DiagnosticCriticalThreshold, error) {
+	return s.alertRepo.GetCriticalThreshold(componentId)
+}
+
+func (s *criticalAlertServiceImpl) SaveCriticalThreshold(threshold *models.DiagnosticCriticalThreshold) error {
+	if threshold.CriticalLow == nil && threshold.CriticalHigh == nil {
+		return errors.New("critical_low or critical_high is required")
+	}
+	if threshold.CriticalLow != nil && threshold.CriticalHigh != nil && *threshold.CriticalLow >= *threshold.CriticalHigh {
+		return errors.New("critical_low must be below critical_high")
+	}
+	return s.alertRepo.SaveCriticalThreshold(threshold)
+}
+
+func (s *criticalAlertServiceImpl) DeleteCriticalThreshold(componentId uint64) error {
+	return s.alertRepo.DeleteCriticalThreshold(componentId)
+}
+
+// EvaluateReport raises and escalates an alert for every critical result of the report and
+// returns how many were raised. Results older than CriticalAlert.MaxResultAgeHours are
+// historical uploads and are not escalated.
+func (s *criticalAlertServiceImpl) EvaluateReport(patientId, reportId uint64) (int, error) {
+	candidates, err := s.alertRepo.GetCriticalCandidates(reportId)
+	if err != nil || len(candidates) == 0 {
+		return 0, err
+	}
+	var componentIds []uint64
+	for _, c := range candidates {
+		componentIds = append(componentIds, c.DiagnosticTestComponentId)
+	}
+	units, err := s.diagnosticRepo.GetComponentUnits(componentIds)
+	if err != nil {
+		return 0, err
+	}
+	registry := NewUnitRegistry(units)
+	cutoff := time.Now().Add(-time.Duration(config.PropConfig.CriticalAlert.MaxResultAgeHours) * time.Hour)
+
+	raised := 0
+	for _, c := range candidates {
+		if c.ResultDate.Before(cutoff) {
+			continue
+		}
+		breach, threshold, ok := criticalBreach(registry, c)
+		if !ok {
+			continue
+		}
+		alert := &models.CriticalResultAlert{
+			PatientId:                 patientId,
+			TestResultValueId:         c.TestResultValueId,
+			PatientDiagnosticReportId: c.PatientDiagnosticReportId,
+			DiagnosticTestComponentId: c.DiagnosticTestComponentId,
+			TestComponentName:         c.TestComponentName,
+			ResultValue:               c.ResultValue,
+			ResultUnit:                c.ResultUnit,
+			ResultDate:                c.ResultDate,
+			Breach:                    breach,
+			ThresholdValue:            threshold,
+			Status:                    constant.CriticalAlertOpen,
+		}
+		created, err := s.alertRepo.CreateCriticalAlert(alert)
+		if err != nil {
+			log.Printf("@EvaluateReport->CreateCriticalAlert result %d: %v", c.TestResultValueId, err)
+			continue
+		}
+		if !created {
+			continue
+		}
+		raised++
+		if err := s.escalate(alert); err != nil {
+			log.Printf("@EvaluateReport->escalate %s: %v", alert.AlertId, err)
+		}
+	}
+	return raised, nil
+}
+
+// criticalBreach compares a result with its threshold, converting the threshold into the
+// result unit when both units are registered for the component. A result whose unit cannot
+// be matched with the threshold unit is not judged.
+func criticalBreach(registry UnitRegistry, c models.CriticalCandidate) (string, float64, bool) {
+	low, high := c.CriticalLow, c.CriticalHigh
+	if c.ThresholdUnits != "" && c.ResultUnit != "" {
+		convert := func(value *float64) (*float64, bool) {
+			if value == nil {
+				return nil, true
+			}
+			converted, ok := registry.Convert(c.DiagnosticTestComponentId, *value, c.ThresholdUnits, c.ResultUnit)
+			return &converted, ok
+		}
+		var lowOk, highOk bool
+		if low, lowOk = convert(low); !lowOk {
+			return "", 0, false
+		}
+		if high, highOk = convert(high); !highOk {
+			return "", 0, false
+		}
+	}
+	switch {
+	case low != nil && c.ResultValue <= *low:
+		return constant.RangeFlagLow, *low, true
+	case high != nil && c.ResultValue >= *high:
+		return constant.RangeFlagHigh, *high, true
+	}
+	return "", 0, false
+}
+
+// escalate notifies the primary caregiver and head of family of the patient, or the patient
+// when neither is linked, and schedules the next escalation.
+func (s *criticalAlertServiceImpl) escalate(alert *models.CriticalResultAlert) error {
+	patient, err := s.userRepo.GetSystemUserInfo(alert.PatientId)
+	if err != nil {
+		return err
+	}
+	recipients, err := s.alertRepo.GetEscalationRecipients(alert.PatientId, []string{string(constant.MappingTypePCG), string(constant.MappingTypeHOF)})
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		recipients = []models.CriticalAlertRecipient{{UserId: alert.PatientId, MappingType: string(constant.MappingTypeS)}}
+	}
+
+	attempt := alert.EscalationCount + 1
+	var escalations []models.CriticalAlertEscalation
+	for _, recipient := range recipients {
+		escalation := models.CriticalAlertEscalation{
+			AlertId:         alert.AlertId,
+			Attempt:         attempt,
+			RecipientUserId: recipient.UserId,
+			MappingType:     recipient.MappingType,
+		}
+		user, err := s.userRepo.GetSystemUserInfo(recipient.UserId)
+		if err == nil {
+			err = s.notificationService.SendCriticalResultAlert(&user, &patient, alert, attempt)
+		}
+		if err != nil {
+			log.Printf("@escalate %s to user %d: %v", alert.AlertId, recipient.UserId, err)
+			escalation.Error = err.Error()
+		}
+		escalations = append(escalations, escalation)
+	}
+	if err := s.alertRepo.SaveEscalations(escalations); err != nil {
+		log.Println("@escalate->SaveEscalations:", err)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"escalation_count":   attempt,
+		"last_escalated_at":  now,
+		"next_escalation_at": nil,
+	}
+	if attempt < config.PropConfig.CriticalAlert.MaxEscalations {
+		updates["next_escalation_at"] = now.Add(time.Duration(config.PropConfig.CriticalAlert.ReescalateMinutes) * time.Minute)
+	}
+	alert.EscalationCount = attempt
+	return s.alertRepo.UpdateCriticalAlert(alert.AlertId, updates)
+}
+
+// ReescalateDueAlerts escalates again every open alert nobody acknowledged in time and returns
+// how many were escalated.
+func (s *criticalAlertServiceImpl) ReescalateDueAlerts() (int, error) {
+	now := time.Now()
+	claimUntil := now.Add(time.Duration(config.PropConfig.CriticalAlert.ReescalateMinutes) * time.Minute)
+	alerts, err := s.alertRepo.ClaimDueEscalations(now, config.PropConfig.CriticalAlert.MaxEscalations, claimUntil)
+	if err != nil {
+		return 0, err
+	}
+	escalated := 0
+	for i := range alerts {
+		if err := s.escalate(&alerts[i]); err != nil {
+			log.Printf("@ReescalateDueAlerts %s: %v", alerts[i].AlertId, err)
+			continue
+		}
+		escalated++
+	}
+	return escalated, nil
+}
+
+func (s *criticalAlertServiceImpl) GetCriticalAlerts(patientId uint64, status string, limit, offset int) ([]models.CriticalResultAlert, int64, error) {
+	return s.alertRepo.GetCriticalAlerts(patientId, status, limit, offset)
+}
+
+// AcknowledgeAlert closes the alert on behalf of the patient or of anyone allowed to view the
+// patient's health data, which stops further escalation.
+func (s *criticalAlertServiceImpl) AcknowledgeAlert(alertId uuid.UUID, userId uint64, note string) (*models.CriticalResultAlert, error) {
+	alert, err := s.alertRepo.GetCriticalAlert(alertId)
+	if err != nil {
+		return nil, err
+	}
+	if alert.PatientId != userId {
+		if err := s.patientService.CanContinue(alert.PatientId, userId, constant.PermissionViewHealth); err != nil {
+			return nil, err
+		}
+	}
+	acknowledged, err := s.alertRepo.AcknowledgeCriticalAlert(alertId, userId, note)
+	if err != nil {
+		return nil, err
+	}
+	if !acknowledged {
+		return nil, fmt.Errorf("alert is already %s", alert.Status)
+	}
+	return s.alertRepo.GetCriticalAlert(alertId)
+}
+
+// ResolveResultAlert closes the open alert of a result that is being corrected or deleted in
+// tx. A corrected value that is still critical raises the alert again once the report is
+// evaluated.
+func (s *criticalAlertServiceImpl) ResolveResultAlert(tx *gorm.DB, testResultValueId int, userId uint64, note string) error {
+	return s.alertRepo.ResolveResultAlert(tx, testResultValueId, userId, note)
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"biostat/repository"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+type DeadLetterService interface {
+	RecordFailure(failure models.DigitizationDeadLetter, attempts []models.DeadLetterAttempt, exhausted bool) error
+	ResolveTask(taskType, taskKey string)
+	GetDeadLetters(filter models.DeadLetterFilter, limit, offset int) ([]models.DigitizationDeadLetter, int64, error)
+	ReplayDeadLetters(deadLetterIds []uint64, userId uint64) []models.DeadLetterActionResult
+	DiscardDeadLetters(deadLetterIds []uint64, userId uint64, note string) []models.DeadLetterActionResult
+	RetryRecordDigitization(recordId, patientId, userId uint64) (*models.DigitizationDeadLetter, error)
+	ScrubStoredPayloads() (int64, error)
+}
+
+type DeadLetterServiceImpl struct {
+	deadLetterRepo       repository.DeadLetterRepository
+	recordRepo           repository.TblMedicalRecordRepository
+	processStatusService ProcessStatusService
+	taskQueue            *asynq.Client
+	redisClient          *redis.Client
+}
+
+func NewDeadLetterService(deadLetterRepo repository.DeadLetterRepository, recordRepo repository.TblMedicalRecordRepository,
+	processStatusService ProcessStatusService, taskQueue *asynq.Client, redisClient *redis.Client) DeadLetterService {
+	return &DeadLetterServiceImpl{
+		deadLetterRepo:       deadLetterRepo,
+		recordRepo:           recordRepo,
+		processStatusService: processStatusService,
+		taskQueue:            taskQueue,
+		redisClient:          redisClient,
+	}
+}
+
+// RecordFailure adds the failed attempts of a task to its open dead-letter entry, creating one
+// on the first failure. The entry stays retrying while asynq has attempts left and turns dead
+// once exhausted.
+func (s *DeadLetterServiceImpl) RecordFailure(failure models.DigitizationDeadLetter, attempts []models.DeadLetterAttempt, exhausted bool) error {
+	status := constant.DeadLetterRetrying
+	if exhausted {
+		status = constant.DeadLetterDead
+	}
+	processLog := s.processLog(failure.ProcessId)
+	failure.Payload = storedPayload(failure.TaskType, failure.Payload)
+
+	existing, err := s.deadLetterRepo.GetOpenDeadLetter(failure.TaskType, failure.TaskKey)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	var history []models.DeadLetterAttempt
+	replay := 0
+	if existing != nil {
+		if len(existing.Attempts) > 0 {
+			if err := json.Unmarshal(existing.Attempts, &history); err != nil {
+				log.Printf("@RecordFailure: unreadable attempt history of dead letter %d: %v", existing.DeadLetterId, err)
+			}
+		}
+		replay = existing.ReplayCount
+	}
+	for _, attempt := range attempts {
+		attempt.Replay = replay
+		history = append(history, attempt)
+	}
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		failure.Attempts = historyJSON
+		failure.AttemptCount = len(history)
+		failure.ProcessLog = processLog
+		failure.Status = status
+		return s.deadLetterRepo.CreateDeadLetter(&failure)
+	}
+	updates := map[string]interface{}{
+		"queue_name":    failure.QueueName,
+		"process_id":    failure.ProcessId,
+		"payload":       failure.Payload,
+		"error_message": failure.ErrorMessage,
+		"attempt_count": len(history),
+		"attempts":      historyJSON,
+		"status":        status,
+	}
+	if processLog != nil {
+		updates["process_log"] = processLog
+	}
+	return s.deadLetterRepo.UpdateDeadLetter(existing.DeadLetterId, updates)
+}
+
+// unstoredPayloadFields are the digitization payload fields that must not outlive the task: the
+// PDF password of tasks enqueued before it was kept on the record, and the temp file path.
+var unstoredPayloadFields = []string{"pdf_password", "file_path"}
+
+// storedPayload drops unstoredPayloadFields from a digitization payload. A replay reads the
+// record from the file store with the password kept on the record.
+func storedPayload(taskType string, payload []byte) []byte {
+	if taskType != constant.TaskDigitizeRecord {
+		return payload
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		log.Printf("@RecordFailure: unreadable %s payload, not stored: %v", taskType, err)
+		return nil
+	}
+	for _, field := range unstoredPayloadFields {
+		delete(fields, field)
+	}
+	stored, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return stored
+}
+
+// ScrubStoredPayloads removes unstoredPayloadFields from entries stored before RecordFailure
+// dropped them. It is a one-off migration and returns how many entries were scrubbed.
+func (s *DeadLetterServiceImpl) ScrubStoredPayloads() (int64, error) {
+	return s.deadLetterRepo.ScrubDeadLetterPayloads(constant.TaskDigitizeRecord, unstoredPayloadFields)
+}
+
+// processLog snapshots the process of a failed task; a process that has expired from Redis
+// leaves the entry without one.
+func (s *DeadLetterServiceImpl) processLog(processId string) []byte {
+	id, err := uuid.Parse(processId)
+	if err != nil || id == uuid.Nil {
+		return nil
+	}
+	process, err := s.processStatusService.GetProcessStatusFromRedis(id)
+	if err != nil {
+		log.Println("@RecordFailure->GetProcessStatusFromRedis:", err)
+		return nil
+	}
+	raw, err := json.Marshal(process)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// ResolveTask closes the open entry of a task that has now succeeded, whether on an asynq
+// retry or after a replay.
+func (s *DeadLetterServiceImpl) ResolveTask(taskType, taskKey string) {
+	if err := s.deadLetterRepo.ResolveDeadLetters(taskType, taskKey); err != nil {
+		log.Printf("@ResolveTask: failed to resolve dead letters of %s %s: %v", taskType, taskKey, err)
+	}
+}
+
+func (s *DeadLetterServiceImpl) GetDeadLetters(filter models.DeadLetterFilter, limit, offset int) ([]models.DigitizationDeadLetter, int64, error) {
+	return s.deadLetterRepo.GetDeadLetters(filter, limit, offset)
+}
+
+// ReplayDeadLetters enqueues the stored payload of each dead entry again. A replayed doc type
+// check only refreshes its entry; the upload that waited for its answer has given up by then.
+func (s *DeadLetterServiceImpl) ReplayDeadLetters(deadLetterIds []uint64, userId uint64) []models.DeadLetterActionResult {
+	results := make([]models.DeadLetterActionResult, 0, len(deadLetterIds))
+	for _, deadLetterId := range deadLetterIds {
+		result := models.DeadLetterActionResult{DeadLetterId: deadLetterId}
+		entry, err := s.deadLetterRepo.GetDeadLetter(deadLetterId)
+		if err == nil {
+			err = s.replay(entry, userId)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Status = constant.DeadLetterReplayed
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (s *DeadLetterServiceImpl) replay(entry *models.DigitizationDeadLetter, userId uint64) error {
+	now := time.Now()
+	replayed, err := s.deadLetterRepo.CloseDeadLetter(entry.DeadLetterId, []string{constant.DeadLetterDead}, map[string]interface{}{
+		"status":       constant.DeadLetterReplayed,
+		"replay_count": gorm.Expr("replay_count + 1"),
+		"replayed_by":  userId,
+		"replayed_at":  now,
+	})
+	if err != nil {
+		return err
+	}
+	if !replayed {
+		return fmt.Errorf("dead letter %d is %s, only dead tasks can be replayed", entry.DeadLetterId, entry.Status)
+	}
+	queue := constant.QueueDefault
+	if entry.TaskType == constant.TaskDigitizeRecord {
+		var payload models.DigitizationPayload
+		if err := json.Unmarshal(entry.Payload, &payload); err != nil {
+			log.Printf("@replay: unreadable payload of dead letter %d: %v", entry.DeadLetterId, err)
+		}
+		queue = DigitizationQueue(payload.Priority)
+	}
+	task := asynq.NewTask(entry.TaskType, entry.Payload)
+	if _, err := s.taskQueue.Enqueue(task, asynq.Queue(queue), asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention))); err != nil {
+		if revertErr := s.deadLetterRepo.UpdateDeadLetter(entry.DeadLetterId, map[string]interface{}{"status": constant.DeadLetterDead}); revertErr != nil {
+			log.Printf("@replay: failed to reopen dead letter %d: %v", entry.DeadLetterId, revertErr)
+		}
+		return fmt.Errorf("failed to enqueue replay: %w", err)
+	}
+	if entry.TaskType == constant.TaskDigitizeRecord && entry.RecordId != nil {
+		if _, err := s.recordRepo.UpdateTblMedicalRecord(&models.TblMedicalRecord{RecordId: *entry.RecordId, Status: constant.StatusQueued}); err != nil {
+			log.Printf("@replay: failed to mark record %d queued: %v", *entry.RecordId, err)
+		}
+		s.redisClient.Set(context.Background(), fmt.Sprintf("record_status:%d", *entry.RecordId), string(constant.StatusQueued), time.Duration(config.PropConfig.TaskQueue.Expiration))
+	}
+	log.Printf("Dead letter %d replayed by user %d: %s %s", entry.DeadLetterId, userId, entry.TaskType, entry.TaskKey)
+	return nil
+}
+
+// DiscardDeadLetters gives up on entries for good. Entries still retrying can be discarded too;
+// a later failure of the task then starts a new entry.
+func (s *DeadLetterServiceImpl) DiscardDeadLetters(deadLetterIds []uint64, userId uint64, note string) []models.DeadLetterActionResult {
+	results := make([]models.DeadLetterActionResult, 0, len(deadLetterIds))
+	for _, deadLetterId := range deadLetterIds {
+		result := models.DeadLetterActionResult{DeadLetterId: deadLetterId}
+		discarded, err := s.deadLetterRepo.CloseDeadLetter(deadLetterId, []string{constant.DeadLetterRetrying, constant.DeadLetterDead}, map[string]interface{}{
+			"status":       constant.DeadLetterDiscarded,
+			"discarded_by": userId,
+			"discarded_at": time.Now(),
+			"note":         note,
+		})
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case !discarded:
+			result.Error = fmt.Sprintf("dead letter %d is not open", deadLetterId)
+		default:
+			result.Status = constant.DeadLetterDiscarded
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// RetryRecordDigitization replays the failed digitization of one of the patient's records.
+func (s *DeadLetterServiceImpl) RetryRecordDigitization(recordId, patientId, userId uint64) (*models.DigitizationDeadLetter, error) {
+	entry, err := s.deadLetterRepo.GetOpenDeadLetter(constant.TaskDigitizeRecord, strconv.FormatUint(recordId, 10))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && (entry.PatientId == nil || *entry.PatientId != patientId)) {
+		return nil, errors.New("no failed digitization found for this record")
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch entry.Status {
+	case constant.DeadLetterRetrying:
+		return nil, errors.New("digitization of this record is still being retried")
+	case constant.DeadLetterReplayed:
+		return nil, errors.New("digitization of this record is already queued again")
+	}
+	if err := s.replay(entry, userId); err != nil {
+		return nil, err
+	}
+	return s.deadLetterRepo.GetDeadLetter(entry.DeadLetterId)
+}
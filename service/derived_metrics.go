@@ -0,0 +1,429 @@
+package service
+
+import (
+	"biostat/database"
+	"biostat/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// derivedTestName is the diagnostic test that groups the derived results of a report.
+const derivedTestName = "Calculated Parameters"
+
+// derivedInput is a measured component a derived metric reads, matched by LOINC code or by
+// component name. Values are read in Unit; SIFactors convert the common SI units of the
+// component when the unit registry does not know them.
+type derivedInput struct {
+	Unit      string
+	Loinc     []string
+	Names     []string
+	SIFactors map[string]float64
+}
+
+var derivedInputs = map[string]derivedInput{
+	"creatinine": {Unit: "mg/dL", Loinc: []string{"2160-0", "38483-4"},
+		Names:     []string{"creatinine", "serum creatinine", "creatinine, serum", "creatinine serum", "s. creatinine", "s.creatinine"},
+		SIFactors: map[string]float64{"umol/l": 1 / 88.42}},
+	"cholesterol": {Unit: "mg/dL", Loinc: []string{"2093-3"},
+		Names:     []string{"total cholesterol", "cholesterol", "cholesterol, total", "cholesterol total", "serum cholesterol", "s. cholesterol"},
+		SIFactors: map[string]float64{"mmol/l": 38.67}},
+	"hdl": {Unit: "mg/dL", Loinc: []string{"2085-9"},
+		Names:     []string{"hdl cholesterol", "hdl", "hdl-c", "hdl-cholesterol", "cholesterol, hdl", "hdl cholesterol direct", "hdl cholesterol - direct"},
+		SIFactors: map[string]float64{"mmol/l": 38.67}},
+	"ldl": {Unit: "mg/dL", Loinc: []string{"2089-1", "18262-6"},
+		Names:     []string{"ldl cholesterol", "ldl", "ldl-c", "ldl-cholesterol", "cholesterol, ldl", "ldl cholesterol direct", "ldl cholesterol - direct"},
+		SIFactors: map[string]float64{"mmol/l": 38.67}},
+	"triglycerides": {Unit: "mg/dL", Loinc: []string{"2571-8"},
+		Names:     []string{"triglycerides", "triglyceride", "serum triglycerides", "s. triglycerides", "tg"},
+		SIFactors: map[string]float64{"mmol/l": 88.57}},
+	"fasting_glucose": {Unit: "mg/dL", Loinc: []string{"1558-6", "76629-5"},
+		Names:     []string{"fasting blood sugar", "fasting glucose", "glucose fasting", "glucose, fasting", "fasting plasma glucose", "fbs", "blood sugar fasting", "plasma glucose fasting"},
+		SIFactors: map[string]float64{"mmol/l": 18.016}},
+	"fasting_insulin": {Unit: "uIU/mL", Loinc: []string{"1554-5", "20448-7"},
+		Names:     []string{"fasting insulin", "insulin fasting", "insulin, fasting", "insulin", "serum insulin"},
+		SIFactors: map[string]float64{"uu/ml": 1, "miu/l": 1, "mu/l": 1, "uiu/l": 0.001, "pmol/l": 1 / 6.0}},
+	"bun": {Unit: "mg/dL", Loinc: []string{"3094-0", "6299-2"},
+		Names:     []string{"blood urea nitrogen", "bun", "urea nitrogen", "serum urea nitrogen"},
+		SIFactors: map[string]float64{"mmol/l": 2.801}},
+	"albumin": {Unit: "g/dL", Loinc: []string{"1751-7", "61151-7"},
+		Names:     []string{"albumin", "serum albumin", "albumin, serum", "s. albumin"},
+		SIFactors: map[string]float64{"g/l": 0.1}},
+	"total_protein": {Unit: "g/dL", Loinc: []string{"2885-2"},
+		Names:     []string{"total protein", "protein, total", "protein total", "serum total protein", "total proteins"},
+		SIFactors: map[string]float64{"g/l": 0.1}},
+}
+
+// derivedSubject holds the patient attributes some formulas need, as of the result date.
+type derivedSubject struct {
+	Age      float64
+	HasAge   bool
+	Sex      string
+	WeightKG float64
+}
+
+// derivedMetric is a value calculated from other results. Provides names the input key the
+// result can stand in for in later metrics when that input was not measured.
+type derivedMetric struct {
+	Name     string
+	Loinc    string
+	Unit     string
+	Formula  string
+	Inputs   []string
+	Provides string
+	Compute  func(v map[string]float64, p derivedSubject) (float64, []models.DerivedMetricInput, bool)
+}
+
+// derivedMetrics run in order, so a metric may use the result of an earlier one.
+var derivedMetrics = []derivedMetric{
+	{
+		Name: "eGFR (CKD-EPI 2021)", Loinc: "98979-8", Unit: "mL/min/1.73m2",
+		Formula: "142 x min(Scr/k, 1)^a x max(Scr/k, 1)^-1.200 x 0.9938^age [x 1.012 if female]; k = 0.7 (F) / 0.9 (M), a = -0.241 (F) / -0.302 (M)",
+		Inputs:  []string{"creatinine"},
+		Compute: func(v map[string]float64, p derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			if !p.HasAge || p.Age < 18 || p.Sex == "" {
+				return 0, nil, false
+			}
+			kappa, alpha, sexFactor := 0.9, -0.302, 1.0
+			if p.Sex == "female" {
+				kappa, alpha, sexFactor = 0.7, -0.241, 1.012
+			}
+			ratio := v["creatinine"] / kappa
+			egfr := 142 * math.Pow(math.Min(ratio, 1), alpha) * math.Pow(math.Max(ratio, 1), -1.200) * math.Pow(0.9938, p.Age) * sexFactor
+			return egfr, []models.DerivedMetricInput{ageInput(p), sexInput(p)}, true
+		},
+	},
+	{
+		Name: "Creatinine Clearance (Cockcroft-Gault)", Unit: "mL/min",
+		Formula: "(140 - age) x weight(kg) / (72 x Scr) [x 0.85 if female]",
+		Inputs:  []string{"creatinine"},
+		Compute: func(v map[string]float64, p derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			if !p.HasAge || p.Age < 18 || p.Sex == "" || p.WeightKG <= 0 {
+				return 0, nil, false
+			}
+			clearance := (140 - p.Age) * p.WeightKG / (72 * v["creatinine"])
+			if p.Sex == "female" {
+				clearance *= 0.85
+			}
+			weight := models.DerivedMetricInput{Name: "weight", Value: p.WeightKG, Unit: "kg"}
+			return clearance, []models.DerivedMetricInput{ageInput(p), sexInput(p), weight}, true
+		},
+	},
+	{
+		Name: "LDL Cholesterol (Friedewald)", Loinc: "13457-7", Unit: "mg/dL", Provides: "ldl",
+		Formula: "Total cholesterol - HDL - Triglycerides / 5 (valid for triglycerides below 400 mg/dL)",
+		Inputs:  []string{"cholesterol", "hdl", "triglycerides"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			if v["triglycerides"] >= 400 {
+				return 0, nil, false
+			}
+			ldl := v["cholesterol"] - v["hdl"] - v["triglycerides"]/5
+			return ldl, nil, ldl > 0
+		},
+	},
+	{
+		Name: "Non-HDL Cholesterol", Loinc: "43396-1", Unit: "mg/dL",
+		Formula: "Total cholesterol - HDL",
+		Inputs:  []string{"cholesterol", "hdl"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			value := v["cholesterol"] - v["hdl"]
+			return value, nil, value > 0
+		},
+	},
+	{
+		Name: "Cholesterol/HDL Ratio", Loinc: "9830-1", Unit: "ratio",
+		Formula: "Total cholesterol / HDL",
+		Inputs:  []string{"cholesterol", "hdl"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			return v["cholesterol"] / v["hdl"], nil, true
+		},
+	},
+	{
+		Name: "LDL/HDL Ratio", Loinc: "11054-4", Unit: "ratio",
+		Formula: "LDL / HDL",
+		Inputs:  []string{"ldl", "hdl"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			return v["ldl"] / v["hdl"], nil, true
+		},
+	},
+	{
+		Name: "Triglycerides/HDL Ratio", Unit: "ratio",
+		Formula: "Triglycerides / HDL",
+		Inputs:  []string{"triglycerides", "hdl"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			return v["triglycerides"] / v["hdl"], nil, true
+		},
+	},
+	{
+		Name: "HOMA-IR", Unit: "index",
+		Formula: "Fasting glucose (mg/dL) x Fasting insulin (uIU/mL) / 405",
+		Inputs:  []string{"fasting_glucose", "fasting_insulin"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			return v["fasting_glucose"] * v["fasting_insulin"] / 405, nil, true
+		},
+	},
+	{
+		Name: "BUN/Creatinine Ratio", Loinc: "3097-3", Unit: "ratio",
+		Formula: "Blood urea nitrogen / Creatinine",
+		Inputs:  []string{"bun", "creatinine"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			return v["bun"] / v["creatinine"], nil, true
+		},
+	},
+	{
+		Name: "Globulin", Loinc: "10834-0", Unit: "g/dL",
+		Formula: "Total protein - Albumin",
+		Inputs:  []string{"total_protein", "albumin"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			globulin := v["total_protein"] - v["albumin"]
+			return globulin, nil, globulin > 0
+		},
+	},
+	{
+		Name: "Albumin/Globulin Ratio", Loinc: "1759-0", Unit: "ratio",
+		Formula: "Albumin / (Total protein - Albumin)",
+		Inputs:  []string{"albumin", "total_protein"},
+		Compute: func(v map[string]float64, _ derivedSubject) (float64, []models.DerivedMetricInput, bool) {
+			globulin := v["total_protein"] - v["albumin"]
+			if globulin <= 0 {
+				return 0, nil, false
+			}
+			return v["albumin"] / globulin, nil, true
+		},
+	},
+}
+
+func ageInput(p derivedSubject) models.DerivedMetricInput {
+	return models.DerivedMetricInput{Name: "age", Value: math.Round(p.Age*10) / 10, Unit: "years"}
+}
+
+func sexInput(p derivedSubject) models.DerivedMetricInput {
+	return models.DerivedMetricInput{Name: "sex", Text: p.Sex}
+}
+
+// matchDerivedInput returns the input key a stored component feeds, if any.
+func matchDerivedInput(source models.DerivationSource) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(source.TestComponentName))
+	for key, input := range derivedInputs {
+		for _, code := range input.Loinc {
+			if source.LoincCode != "" && source.LoincCode == code {
+				return key, true
+			}
+		}
+		for _, n := range input.Names {
+			if name == n {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// derivedInputValue reads a source in the unit the formulas expect.
+func derivedInputValue(input derivedInput, source models.DerivationSource, units UnitRegistry) (float64, bool) {
+	if source.ResultUnit == "" || NormalizeUnit(source.ResultUnit) == NormalizeUnit(input.Unit) {
+		return source.ResultValue, true
+	}
+	if value, ok := units.Convert(source.DiagnosticTestComponentId, source.ResultValue, source.ResultUnit, input.Unit); ok {
+		return value, true
+	}
+	if factor, ok := input.SIFactors[NormalizeUnit(source.ResultUnit)]; ok {
+		return source.ResultValue * factor, true
+	}
+	return 0, false
+}
+
+// deriveReportMetrics recalculates the derived results of a report from its measured results,
+// completed by same-day results of the patient's other reports and by the patient's age, sex
+// and weight. Derived results are stored as ordinary result rows under the derived test,
+// flagged is_derived with their formula and inputs, and returns how many were stored.
+func (s *DiagnosticServiceImpl) deriveReportMetrics(patientId, reportId uint64, testNameCache, componentNameCache map[string]uint64,
+	unitRegistry UnitRegistry, rangeResolver *PatientRangeResolver) (int, error) {
+	sources, err := s.diagnosticRepo.GetDerivationSources(patientId, reportId)
+	if err != nil {
+		return 0, err
+	}
+	values := map[string]float64{}
+	used := map[string]models.DerivedMetricInput{}
+	reported := map[uint64]bool{}
+	var resultDate time.Time
+	for _, source := range sources {
+		if source.PatientDiagnosticReportId == reportId {
+			reported[source.DiagnosticTestComponentId] = true
+			if source.ResultDate.After(resultDate) {
+				resultDate = source.ResultDate
+			}
+		}
+		key, ok := matchDerivedInput(source)
+		if !ok {
+			continue
+		}
+		if _, seen := values[key]; seen {
+			continue
+		}
+		value, ok := derivedInputValue(derivedInputs[key], source, unitRegistry)
+		if !ok || value <= 0 {
+			log.Printf("@deriveReportMetrics: %s in %q cannot be used for %s", source.TestComponentName, source.ResultUnit, key)
+			continue
+		}
+		values[key] = value
+		used[key] = models.DerivedMetricInput{
+			Name:                      source.TestComponentName,
+			DiagnosticTestComponentId: source.DiagnosticTestComponentId,
+			TestResultValueId:         source.TestResultValueId,
+			Value:                     value,
+			Unit:                      derivedInputs[key].Unit,
+		}
+	}
+	if resultDate.IsZero() {
+		return 0, nil
+	}
+
+	subject := derivedSubject{}
+	if patient, err := s.patientService.GetUserProfileByUserId(patientId); err == nil {
+		subject.Age, subject.HasAge = ageAt(patient.DateOfBirth, resultDate)
+		subject.Sex = normalizeGender(patient.Gender)
+	}
+	if profile, err := s.patientService.GetPatientHealthDetail(patientId); err == nil {
+		subject.WeightKG = profile.WeightKG
+	}
+
+	var results []models.PatientDiagnosticTestResultValue
+	var outputs []derivedMetric
+	for _, metric := range derivedMetrics {
+		// The lab already printed this value; the measured one wins.
+		if id, ok := componentNameCache[strings.ToLower(metric.Name)]; ok && reported[id] {
+			continue
+		}
+		inputs := make([]models.DerivedMetricInput, 0, len(metric.Inputs))
+		complete := true
+		for _, key := range metric.Inputs {
+			if _, ok := values[key]; !ok {
+				complete = false
+				break
+			}
+			inputs = append(inputs, used[key])
+		}
+		if !complete {
+			continue
+		}
+		value, extra, ok := metric.Compute(values, subject)
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		value = math.Round(value*100) / 100
+		if metric.Provides != "" {
+			if _, measured := values[metric.Provides]; !measured {
+				values[metric.Provides] = value
+				used[metric.Provides] = models.DerivedMetricInput{Name: metric.Name, Value: value, Unit: metric.Unit}
+			}
+		}
+		inputsJSON, err := json.Marshal(append(inputs, extra...))
+		if err != nil {
+			return 0, err
+		}
+		results = append(results, models.PatientDiagnosticTestResultValue{
+			PatientDiagnosticReportId: reportId,
+			PatientId:                 patientId,
+			ResultValue:               value,
+			ResultUnit:                metric.Unit,
+			ResultDate:                resultDate,
+			IsDerived:                 true,
+			DerivedFormula:            metric.Formula,
+			DerivedInputs:             inputsJSON,
+		})
+		outputs = append(outputs, metric)
+	}
+
+	tx := database.DB.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered in deriveReportMetrics:", r)
+			tx.Rollback()
+		}
+	}()
+	testId, err := s.derivedTestId(tx, testNameCache)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := s.diagnosticRepo.DeleteDerivedResults(tx, reportId, testId); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, tx.Commit().Error
+	}
+	testRecord := models.PatientDiagnosticTest{
+		PatientDiagnosticReportId: reportId,
+		DiagnosticTestId:          testId,
+		TestNote:                  "Calculated from the measured results of this report",
+		TestDate:                  resultDate,
+	}
+	if _, err := s.diagnosticRepo.SavePatientDiagnosticTestInterpretation(tx, &testRecord); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for i := range results {
+		componentId, err := s.derivedComponentId(tx, testId, outputs[i], componentNameCache)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		results[i].DiagnosticTestId = testId
+		results[i].DiagnosticTestComponentId = componentId
+		if rangeResolver != nil {
+			rangeResolver.Apply(&results[i])
+		}
+		if _, err := s.diagnosticRepo.SavePatientReportResultValue(tx, &results[i]); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("error while saving derived result %s: %w", outputs[i].Name, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return len(results), nil
+}
+
+func (s *DiagnosticServiceImpl) derivedTestId(tx *gorm.DB, testNameCache map[string]uint64) (uint64, error) {
+	key := strings.ToLower(derivedTestName)
+	if id, ok := testNameCache[key]; ok {
+		return id, nil
+	}
+	test, err := s.diagnosticRepo.CreateDiagnosticTest(tx, &models.DiagnosticTest{TestName: derivedTestName, TestType: "derived"}, "System")
+	if err != nil {
+		return 0, fmt.Errorf("error while creating diagnostic test %s: %w", derivedTestName, err)
+	}
+	testNameCache[key] = test.DiagnosticTestId
+	return test.DiagnosticTestId, nil
+}
+
+func (s *DiagnosticServiceImpl) derivedComponentId(tx *gorm.DB, testId uint64, metric derivedMetric, componentNameCache map[string]uint64) (uint64, error) {
+	key := strings.ToLower(metric.Name)
+	if id, ok := componentNameCache[key]; ok {
+		return id, nil
+	}
+	component, err := s.diagnosticRepo.CreateDiagnosticComponent(tx, &models.DiagnosticTestComponent{
+		TestComponentName:      metric.Name,
+		LoincCode:              metric.Loinc,
+		TestComponentType:      "derived",
+		Description:            metric.Formula,
+		Units:                  metric.Unit,
+		TestComponentFrequency: "0",
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error while creating diagnostic test component %s: %w", metric.Name, err)
+	}
+	mapping := models.DiagnosticTestComponentMapping{DiagnosticTestId: testId, DiagnosticComponentId: component.DiagnosticTestComponentId}
+	if _, err := s.diagnosticRepo.CreateDiagnosticTestComponentMapping(tx, &mapping); err != nil {
+		return 0, fmt.Errorf("error while creating diagnostic test component mapping: %w", err)
+	}
+	componentNameCache[key] = component.DiagnosticTestComponentId
+	return component.DiagnosticTestComponentId, nil
+}
@@ -47,6 +47,9 @@ type DiagnosticService interface {
 	UpdateDiagnosticComponent(authUserId string, diagnosticComponent *models.DiagnosticTestComponent) (*models.DiagnosticTestComponent, error)
 	DeleteDiagnosticTestComponent(diagnosticTestComponetId uint64, updatedBy string) error
 	GetSingleDiagnosticComponent(diagnosticComponentId int) (*models.DiagnosticTestComponent, error)
+	GetComponentUnits(diagnosticComponentId uint64) ([]models.DiagnosticTestComponentUnit, error)
+	SaveComponentUnit(unit *models.DiagnosticTestComponentUnit) error
+	DeleteComponentUnit(componentUnitId uint64) error
 
 	GetAllDiagnosticTestComponentMappings(limit int, offset int) ([]models.DiagnosticTestComponentMapping, int64, error)
 	CreateDiagnosticTestComponentMapping(diagnosticTestComponentMapping *models.DiagnosticTestComponentMapping) (*models.DiagnosticTestComponentMapping, error)
@@ -59,6 +62,7 @@ type DiagnosticService interface {
 	AddTestReferenceRange(input *models.DiagnosticTestReferenceRange) error
 	UpdateTestReferenceRange(input *models.DiagnosticTestReferenceRange, updatedBy string) error
 	DeleteTestReferenceRange(testReferenceRangeId uint64, deletedBy string) error
+	ReflagResults(componentId, patientId *uint64) (int, error)
 	GetAllTestRefRangeView(limit int, offset int, isDeleted uint64) ([]models.Diagnostic_Test_Component_ReferenceRange, int64, error)
 	ViewTestReferenceRange(testReferenceRangeId uint64) (*models.DiagnosticTestReferenceRange, error)
 	GetTestReferenceRangeAuditRecord(testReferenceRangeId, auditId uint64, limit, offset int) ([]models.Diagnostic_Test_Component_ReferenceRange, int64, error)
@@ -66,10 +70,21 @@ type DiagnosticService interface {
 	CheckReportExistWithSampleDateTestComponent(reportData models.LabReport, patientId uint64, recordId *uint64, processId uuid.UUID, attachmentId *string, reportId *uint64) error
 	AddMappingToMergeTestComponent(mapping []models.DiagnosticTestComponentAliasMapping) error
 	NotifyAbnormalResult(patientId uint64) error
-	ArchivePatientDiagnosticReport(reportID uint64, isDeleted int) error
+	ArchivePatientDiagnosticReport(tx *gorm.DB, reportID uint64, isDeleted int) error
 	GetSources(patientId uint64, limit, offset int) ([]models.HealthVitalSourceType, int64, error)
 	GetDiagnosticLabReportName(patientId uint64) ([]models.DiagnosticReport, error)
 	CreatePatientReportAndAttachment(userId uint64, recordId uint64) (*models.PatientDiagnosticReport, error)
+	AddResultValue(reportId, userId uint64, input models.ManualResultRequest) (*models.PatientDiagnosticTestResultValue, error)
+	UpdateResultValue(resultId int, userId uint64, input models.ManualResultRequest) (*models.PatientDiagnosticTestResultValue, error)
+	DeleteResultValue(resultId int, userId uint64, reason string) error
+	GetResultValueAudit(resultId int, userId uint64) ([]models.PatientDiagnosticResultAudit, error)
+	GetReviewQueue(filter models.ReviewQueueFilter, limit, offset int) ([]models.DigitizationReviewItem, int64, error)
+	ApproveReviewItem(reviewId, userId uint64, isAdmin bool, input models.ReviewDecisionRequest) (*models.DigitizationReviewItem, error)
+	RejectReviewItem(reviewId, userId uint64, isAdmin bool, note string) (*models.DigitizationReviewItem, error)
+	GetComponentAliasSuggestions() ([]models.ComponentAliasSuggestion, error)
+	SearchLoincCodes(search string, limit, offset int) ([]models.LoincCode, int64, error)
+	GetLoincCodeDetail(loincCode string) (*models.LoincCodeDetail, error)
+	AcceptComponentAliasSuggestions(userId uint64, suggestions []models.AcceptAliasSuggestion) ([]models.AliasSuggestionResult, error)
 }
 
 type DiagnosticServiceImpl struct {
@@ -78,6 +93,7 @@ type DiagnosticServiceImpl struct {
 	patientService       PatientService
 	medicalRecordsRepo   repository.TblMedicalRecordRepository
 	processStatusService ProcessStatusService
+	criticalAlertService CriticalAlertService
 }
 
 func (s *DiagnosticServiceImpl) SavePatientReportAttachmentMapping(tx *gorm.DB, recordMapping *models.PatientReportAttachment) error {
@@ -125,9 +141,10 @@ func (s *DiagnosticServiceImpl) GeneratePatientDiagnosticReport(tx *gorm.DB, pat
 }
 
 func NewDiagnosticService(repo repository.DiagnosticRepository, emailService EmailService, patientService PatientService,
-	medicalRecordsRepo repository.TblMedicalRecordRepository, processStatusService ProcessStatusService) DiagnosticService {
+	medicalRecordsRepo repository.TblMedicalRecordRepository, processStatusService ProcessStatusService,
+	criticalAlertService CriticalAlertService) DiagnosticService {
 	return &DiagnosticServiceImpl{diagnosticRepo: repo, emailService: emailService, patientService: patientService,
-		medicalRecordsRepo: medicalRecordsRepo, processStatusService: processStatusService}
+		medicalRecordsRepo: medicalRecordsRepo, processStatusService: processStatusService, criticalAlertService: criticalAlertService}
 }
 
 func (s *DiagnosticServiceImpl) GetSources(patientId uint64, limit, offset int) ([]models.HealthVitalSourceType, int64, error) {
@@ -177,11 +194,14 @@ func (s *DiagnosticServiceImpl) AddMapping(patientId uint64, labInfo *models.Dia
 	return nil
 }
 
-func (ds *DiagnosticServiceImpl) ArchivePatientDiagnosticReport(reportID uint64, isDeleted int) error {
-	return ds.diagnosticRepo.ArchivePatientDiagnosticReport(reportID, isDeleted)
+func (ds *DiagnosticServiceImpl) ArchivePatientDiagnosticReport(tx *gorm.DB, reportID uint64, isDeleted int) error {
+	return ds.diagnosticRepo.ArchivePatientDiagnosticReport(tx, reportID, isDeleted)
 }
 
 func (s *DiagnosticServiceImpl) CreateDiagnosticTest(diagnosticTest *models.DiagnosticTest, createdBy string) (*models.DiagnosticTest, error) {
+	if err := validateLoincCode(diagnosticTest.LoincCode); err != nil {
+		return nil, err
+	}
 	tx := database.DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -201,6 +221,9 @@ func (s *DiagnosticServiceImpl) CreateDiagnosticTest(diagnosticTest *models.Diag
 }
 
 func (s *DiagnosticServiceImpl) UpdateDiagnosticTest(diagnosticTest *models.DiagnosticTest, updatedBy string) (*models.DiagnosticTest, error) {
+	if err := validateLoincCode(diagnosticTest.LoincCode); err != nil {
+		return nil, err
+	}
 	return s.diagnosticRepo.UpdateDiagnosticTest(diagnosticTest, updatedBy)
 }
 
@@ -217,6 +240,9 @@ func (s *DiagnosticServiceImpl) GetAllDiagnosticComponents(limit int, offset int
 }
 
 func (s *DiagnosticServiceImpl) CreateDiagnosticComponent(diagnosticComponent *models.DiagnosticTestComponent) (*models.DiagnosticTestComponent, error) {
+	if err := validateLoincCode(diagnosticComponent.LoincCode); err != nil {
+		return nil, err
+	}
 	tx := database.DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -237,6 +263,9 @@ func (s *DiagnosticServiceImpl) CreateDiagnosticComponent(diagnosticComponent *m
 }
 
 func (s *DiagnosticServiceImpl) UpdateDiagnosticComponent(authUserId string, diagnosticComponent *models.DiagnosticTestComponent) (*models.DiagnosticTestComponent, error) {
+	if err := validateLoincCode(diagnosticComponent.LoincCode); err != nil {
+		return nil, err
+	}
 	return s.diagnosticRepo.UpdateDiagnosticComponent(authUserId, diagnosticComponent)
 }
 
@@ -248,6 +277,33 @@ func (s *DiagnosticServiceImpl) GetSingleDiagnosticComponent(diagnosticComponent
 	return s.diagnosticRepo.GetSingleDiagnosticComponent(diagnosticComponentId)
 }
 
+func (s *DiagnosticServiceImpl) GetComponentUnits(diagnosticComponentId uint64) ([]models.DiagnosticTestComponentUnit, error) {
+	return s.diagnosticRepo.GetComponentUnits([]uint64{diagnosticComponentId})
+}
+
+// SaveComponentUnit registers a unit of a component. The canonical unit converts to itself,
+// so its factor and offset are fixed.
+func (s *DiagnosticServiceImpl) SaveComponentUnit(unit *models.DiagnosticTestComponentUnit) error {
+	unit.Unit = strings.TrimSpace(unit.Unit)
+	if unit.Unit == "" {
+		return errors.New("unit is required")
+	}
+	if _, err := s.diagnosticRepo.GetSingleDiagnosticComponent(int(unit.DiagnosticTestComponentId)); err != nil {
+		return fmt.Errorf("diagnostic component %d not found: %w", unit.DiagnosticTestComponentId, err)
+	}
+	if unit.IsCanonical {
+		unit.Factor = 1
+		unit.Offset = 0
+	} else if unit.Factor == 0 {
+		return errors.New("factor to the canonical unit is required")
+	}
+	return s.diagnosticRepo.SaveComponentUnit(unit)
+}
+
+func (s *DiagnosticServiceImpl) DeleteComponentUnit(componentUnitId uint64) error {
+	return s.diagnosticRepo.DeleteComponentUnit(componentUnitId)
+}
+
 func (s *DiagnosticServiceImpl) GetAllDiagnosticTestComponentMappings(limit int, offset int) ([]models.DiagnosticTestComponentMapping, int64, error) {
 	return s.diagnosticRepo.GetAllDiagnosticTestComponentMappings(limit, offset)
 }
@@ -426,15 +482,115 @@ func (s *DiagnosticServiceImpl) AddDiseaseDiagnosticTestMapping(mapping *models.
 }
 
 func (s *DiagnosticServiceImpl) AddTestReferenceRange(input *models.DiagnosticTestReferenceRange) error {
-	return s.diagnosticRepo.AddTestReferenceRange(input)
+	if err := s.diagnosticRepo.AddTestReferenceRange(input); err != nil {
+		return err
+	}
+	s.reflagInBackground(input.DiagnosticTestComponentId)
+	return nil
 }
 
 func (s *DiagnosticServiceImpl) UpdateTestReferenceRange(input *models.DiagnosticTestReferenceRange, updatedBy string) error {
-	return s.diagnosticRepo.UpdateTestReferenceRange(input, updatedBy)
+	old, err := s.diagnosticRepo.GetTestReferenceRange(input.TestReferenceRangeId)
+	if err != nil {
+		return err
+	}
+	if err := s.diagnosticRepo.UpdateTestReferenceRange(input, updatedBy); err != nil {
+		return err
+	}
+	s.reflagInBackground(old.DiagnosticTestComponentId)
+	if input.DiagnosticTestComponentId != 0 && input.DiagnosticTestComponentId != old.DiagnosticTestComponentId {
+		s.reflagInBackground(input.DiagnosticTestComponentId)
+	}
+	return nil
 }
 
 func (s *DiagnosticServiceImpl) DeleteTestReferenceRange(testReferenceRangeId uint64, deletedBy string) error {
-	return s.diagnosticRepo.DeleteTestReferenceRange(testReferenceRangeId, deletedBy)
+	old, err := s.diagnosticRepo.GetTestReferenceRange(testReferenceRangeId)
+	if err != nil {
+		return err
+	}
+	if err := s.diagnosticRepo.DeleteTestReferenceRange(testReferenceRangeId, deletedBy); err != nil {
+		return err
+	}
+	s.reflagInBackground(old.DiagnosticTestComponentId)
+	return nil
+}
+
+const reflagBatchSize = 500
+
+// ReflagResults resolves the reference range of stored results again, for one component,
+// one patient, or everything, and returns how many results changed range or flag.
+func (s *DiagnosticServiceImpl) ReflagResults(componentId, patientId *uint64) (int, error) {
+	var componentIds []uint64
+	if componentId != nil {
+		componentIds = []uint64{*componentId}
+	}
+	ranges, err := s.diagnosticRepo.GetReferenceRanges(componentIds)
+	if err != nil {
+		return 0, err
+	}
+	units, err := s.diagnosticRepo.GetComponentUnits(componentIds)
+	if err != nil {
+		return 0, err
+	}
+	unitRegistry := NewUnitRegistry(units)
+
+	resolvers := map[uint64]*PatientRangeResolver{}
+	changed, afterId := 0, 0
+	for {
+		results, err := s.diagnosticRepo.GetResultValuesAfter(componentId, patientId, afterId, reflagBatchSize)
+		if err != nil {
+			return changed, err
+		}
+		if len(results) == 0 {
+			return changed, nil
+		}
+		for i := range results {
+			result := &results[i]
+			afterId = result.TestResultValueId
+			resolver, loaded := resolvers[result.PatientId]
+			if !loaded {
+				resolver, err = s.newPatientRangeResolver(result.PatientId, unitRegistry, ranges)
+				if err != nil {
+					log.Printf("@ReflagResults patient %d: %v", result.PatientId, err)
+				}
+				resolvers[result.PatientId] = resolver
+			}
+			if resolver == nil || !resolver.Apply(result) {
+				continue
+			}
+			if err := s.diagnosticRepo.UpdateResultValueRange(result); err != nil {
+				return changed, err
+			}
+			changed++
+		}
+	}
+}
+
+func (s *DiagnosticServiceImpl) reflagInBackground(componentId uint64) {
+	if componentId == 0 {
+		return
+	}
+	go func() {
+		changed, err := s.ReflagResults(&componentId, nil)
+		if err != nil {
+			log.Printf("@reflagInBackground component %d: %v", componentId, err)
+			return
+		}
+		log.Printf("Re-flagged %d results of component %d after a reference range change", changed, componentId)
+	}()
+}
+
+func (s *DiagnosticServiceImpl) newPatientRangeResolver(patientId uint64, unitRegistry UnitRegistry, ranges []models.DiagnosticTestReferenceRange) (*PatientRangeResolver, error) {
+	patient, err := s.patientService.GetUserProfileByUserId(patientId)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := s.diagnosticRepo.GetPatientTestReferenceRanges(patientId)
+	if err != nil {
+		return nil, err
+	}
+	return NewPatientRangeResolver(patient, ranges, overrides, unitRegistry), nil
 }
 
 func (s *DiagnosticServiceImpl) ViewTestReferenceRange(testReferenceRangeId uint64) (*models.DiagnosticTestReferenceRange, error) {
@@ -455,6 +611,7 @@ func (s *DiagnosticServiceImpl) DigitizeDiagnosticReport(reportData models.LabRe
 		log.Println("Failed to load diagnostic test master data")
 		return "", errors.New("test and component master data not available")
 	}
+	s.addComponentAliases(componentNameCache)
 
 	diagnosticLabs := s.diagnosticRepo.LoadDiagnosticLabData()
 	if diagnosticLabs == nil {
@@ -462,6 +619,18 @@ func (s *DiagnosticServiceImpl) DigitizeDiagnosticReport(reportData models.LabRe
 		return "", errors.New("diagnostic lab data not available")
 	}
 
+	componentUnits, err := s.diagnosticRepo.GetComponentUnits(nil)
+	if err != nil {
+		log.Println("Failed to load component unit registry, values are stored as reported:", err)
+	}
+	unitRegistry := NewUnitRegistry(componentUnits)
+	var rangeResolver *PatientRangeResolver
+	if ranges, err := s.diagnosticRepo.GetReferenceRanges(nil); err != nil {
+		log.Println("Failed to load reference ranges, results are stored unflagged:", err)
+	} else if rangeResolver, err = s.newPatientRangeResolver(patientId, unitRegistry, ranges); err != nil {
+		log.Println("Failed to load patient for reference range resolution, results are stored unflagged:", err)
+	}
+
 	tx := database.DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -579,6 +748,7 @@ func (s *DiagnosticServiceImpl) DigitizeDiagnosticReport(reportData models.LabRe
 		}
 
 	}
+	parked := 0
 	for _, testData := range reportData.Tests {
 		testName := testData.TestName
 		testInterpretation := testData.Interpretation
@@ -614,99 +784,17 @@ func (s *DiagnosticServiceImpl) DigitizeDiagnosticReport(reportData models.LabRe
 
 		// Save all component values
 		for _, component := range testData.Components {
-			var diagnosticComponentId uint64
-			parsedResultValue, _ := strconv.ParseFloat(component.ResultValue, 64)
-			resultStatus := component.Status
-			var Qualifier string
-			if component.Qualifier != nil {
-				Qualifier = *component.Qualifier
-			}
-			if parsedResultValue == 0 {
-				resultStatus = component.ResultValue
-			}
-			if id, exists := componentNameCache[strings.ToLower(strings.TrimSpace(component.TestComponentName))]; exists {
-				diagnosticComponentId = id
-				if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportInfo.PatientDiagnosticReportId, Qualifier); err != nil {
+			if reason := digitizationReviewReason(reportData, component, componentNameCache); reason != "" {
+				if err := s.parkForReview(tx, reason, component, testName, diagnosticTestId, patientId, reportInfo.PatientDiagnosticReportId, recordId, reportDate); err != nil {
 					tx.Rollback()
 					return "", err
 				}
-			} else {
-				newComponent := models.DiagnosticTestComponent{
-					TestComponentName:      component.TestComponentName,
-					Units:                  component.Units,
-					TestComponentFrequency: "0",
-				}
-				componentInfo, err := s.diagnosticRepo.CreateDiagnosticComponent(tx, &newComponent)
-				if err != nil {
-					log.Println("Error while creating Diagnostic Component:", err)
-					tx.Rollback()
-					return "", fmt.Errorf("error while creating diagnostic test component: %w", err)
-				}
-				diagnosticComponentId = componentInfo.DiagnosticTestComponentId
-				componentNameCache[strings.ToLower(strings.TrimSpace(componentInfo.TestComponentName))] = diagnosticComponentId
-
-				mapping := models.DiagnosticTestComponentMapping{
-					DiagnosticTestId:      diagnosticTestId,
-					DiagnosticComponentId: diagnosticComponentId,
-				}
-				if _, err := s.diagnosticRepo.CreateDiagnosticTestComponentMapping(tx, &mapping); err != nil {
-					log.Println("Error while creating DiagnosticTestComponentMapping:", err)
-					tx.Rollback()
-					return "", fmt.Errorf("error while creating diagnostic test component mapping: %w", err) // Wrap error
-				}
-				normalMin := func() float64 { v, _ := strconv.ParseFloat(component.ReferenceRange.Min, 64); return v }()
-				normalMax := func() float64 { v, _ := strconv.ParseFloat(component.ReferenceRange.Max, 64); return v }()
-				referenceMap, err := s.diagnosticRepo.GetAllDiagnosticReferenceRange()
-				if err != nil {
-					log.Println("Error while GetAllDiagnosticReferenceRange :", err)
-				}
-				lookupKey := fmt.Sprintf("%d-%d", diagnosticTestId, diagnosticComponentId)
-				existingRef, exists := referenceMap[lookupKey]
-				if !exists {
-					referenceRange := models.DiagnosticTestReferenceRange{
-						DiagnosticTestId:               diagnosticTestId,
-						DiagnosticTestComponentId:      diagnosticComponentId,
-						NormalMin:                      normalMin,
-						NormalMax:                      normalMax,
-						BiologicalReferenceDescription: component.BiologicalReferenceDescription,
-						Units:                          component.Units,
-					}
-					refRangeErr := s.diagnosticRepo.AddTestReferenceRange(&referenceRange)
-					if refRangeErr != nil {
-						log.Println("ERROR saving test Ref. range:", refRangeErr)
-						tx.Rollback()
-						return "", fmt.Errorf("error while saving test reference range: %w", refRangeErr)
-					}
-					if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportInfo.PatientDiagnosticReportId, Qualifier); err != nil {
-						tx.Rollback()
-						return "", err
-					}
-				} else {
-					if existingRef.NormalMin != normalMin || existingRef.NormalMax != normalMax {
-						log.Println("Mismatch detected → inserting updated value against patient Id")
-						patientRefRange := models.PatientTestReferenceRange{
-							PatientId:                 patientId,
-							DiagnosticTestID:          diagnosticTestId,
-							DiagnosticTestComponentId: diagnosticComponentId,
-							NormalMin:                 normalMin,
-							NormalMax:                 normalMax,
-							BiologicalReferenceDesc:   *component.BiologicalReferenceDescription,
-							Units:                     component.Units,
-						}
-
-						if err := s.diagnosticRepo.AddPatientTestReferenceRange(&patientRefRange); err != nil {
-							log.Println("ERROR saving Patient-specific Ref. range:", err)
-							tx.Rollback()
-							return "", fmt.Errorf("error while saving patient-specific reference range: %w", err)
-						}
-						if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportInfo.PatientDiagnosticReportId, Qualifier); err != nil {
-							tx.Rollback()
-							return "", err
-						}
-					} else {
-						log.Println("Master reference matches → no patient-specific range needed")
-					}
-				}
+				parked++
+				continue
+			}
+			if err := s.saveLabReportComponent(tx, component, diagnosticTestId, patientId, reportInfo.PatientDiagnosticReportId, reportDate, componentNameCache, unitRegistry, rangeResolver); err != nil {
+				tx.Rollback()
+				return "", err
 			}
 		}
 	}
@@ -714,9 +802,149 @@ func (s *DiagnosticServiceImpl) DigitizeDiagnosticReport(reportData models.LabRe
 		log.Printf("ERROR committing transaction: err : %v", err)
 		return "", err
 	}
+	if parked > 0 {
+		log.Printf("Parked %d results of report %d for review", parked, reportInfo.PatientDiagnosticReportId)
+	}
+	if reportInfo != nil {
+		if derived, err := s.deriveReportMetrics(patientId, reportInfo.PatientDiagnosticReportId, testNameCache, componentNameCache, unitRegistry, rangeResolver); err != nil {
+			log.Printf("@DigitizeDiagnosticReport->deriveReportMetrics %d: %v", reportInfo.PatientDiagnosticReportId, err)
+		} else if derived > 0 {
+			log.Printf("Stored %d derived results for report %d", derived, reportInfo.PatientDiagnosticReportId)
+		}
+	}
+	if s.criticalAlertService != nil && reportInfo != nil {
+		go func(reportId uint64) {
+			if _, err := s.criticalAlertService.EvaluateReport(patientId, reportId); err != nil {
+				log.Printf("@DigitizeDiagnosticReport->EvaluateReport %d: %v", reportId, err)
+			}
+		}(reportInfo.PatientDiagnosticReportId)
+	}
+	if s.patientService != nil && reportInfo != nil {
+		go func(reportId uint64) {
+			if _, err := s.patientService.NotifyTrendDrift(patientId, reportId); err != nil {
+				log.Printf("@DigitizeDiagnosticReport->NotifyTrendDrift %d: %v", reportId, err)
+			}
+		}(reportInfo.PatientDiagnosticReportId)
+	}
 	return "Diagnostic report created!", nil
 }
 
+// labComponentValue returns the numeric value of an extracted result, its status, which is the
+// text itself for a non-numeric result, and its qualifier.
+func labComponentValue(component models.LabReportComponent) (float64, string, string) {
+	parsedResultValue, _ := strconv.ParseFloat(component.ResultValue, 64)
+	resultStatus := component.Status
+	var qualifier string
+	if component.Qualifier != nil {
+		qualifier = *component.Qualifier
+	}
+	if parsedResultValue == 0 {
+		resultStatus = component.ResultValue
+	}
+	return parsedResultValue, resultStatus, qualifier
+}
+
+// saveLabReportComponent stores one extracted result under the test of the report. A component
+// that is not in the master yet is created together with its test mapping and reference range.
+func (s *DiagnosticServiceImpl) saveLabReportComponent(
+	tx *gorm.DB,
+	component models.LabReportComponent,
+	diagnosticTestId uint64,
+	patientId uint64,
+	reportId uint64,
+	reportDate time.Time,
+	componentNameCache map[string]uint64,
+	unitRegistry UnitRegistry,
+	rangeResolver *PatientRangeResolver,
+) error {
+	var diagnosticComponentId uint64
+	parsedResultValue, resultStatus, Qualifier := labComponentValue(component)
+	if id, exists := componentNameCache[strings.ToLower(strings.TrimSpace(component.TestComponentName))]; exists {
+		diagnosticComponentId = id
+		if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportId, Qualifier, component.Units, unitRegistry, rangeResolver); err != nil {
+			return err
+		}
+	} else {
+		newComponent := models.DiagnosticTestComponent{
+			TestComponentName:      component.TestComponentName,
+			Units:                  component.Units,
+			TestComponentFrequency: "0",
+		}
+		componentInfo, err := s.diagnosticRepo.CreateDiagnosticComponent(tx, &newComponent)
+		if err != nil {
+			log.Println("Error while creating Diagnostic Component:", err)
+			return fmt.Errorf("error while creating diagnostic test component: %w", err)
+		}
+		diagnosticComponentId = componentInfo.DiagnosticTestComponentId
+		componentNameCache[strings.ToLower(strings.TrimSpace(componentInfo.TestComponentName))] = diagnosticComponentId
+
+		mapping := models.DiagnosticTestComponentMapping{
+			DiagnosticTestId:      diagnosticTestId,
+			DiagnosticComponentId: diagnosticComponentId,
+		}
+		if _, err := s.diagnosticRepo.CreateDiagnosticTestComponentMapping(tx, &mapping); err != nil {
+			log.Println("Error while creating DiagnosticTestComponentMapping:", err)
+			return fmt.Errorf("error while creating diagnostic test component mapping: %w", err) // Wrap error
+		}
+		normalMin := func() float64 { v, _ := strconv.ParseFloat(component.ReferenceRange.Min, 64); return v }()
+		normalMax := func() float64 { v, _ := strconv.ParseFloat(component.ReferenceRange.Max, 64); return v }()
+		referenceMap, err := s.diagnosticRepo.GetAllDiagnosticReferenceRange()
+		if err != nil {
+			log.Println("Error while GetAllDiagnosticReferenceRange :", err)
+		}
+		lookupKey := fmt.Sprintf("%d-%d", diagnosticTestId, diagnosticComponentId)
+		existingRef, exists := referenceMap[lookupKey]
+		if !exists {
+			referenceRange := models.DiagnosticTestReferenceRange{
+				DiagnosticTestId:               diagnosticTestId,
+				DiagnosticTestComponentId:      diagnosticComponentId,
+				NormalMin:                      normalMin,
+				NormalMax:                      normalMax,
+				BiologicalReferenceDescription: component.BiologicalReferenceDescription,
+				Units:                          component.Units,
+			}
+			refRangeErr := s.diagnosticRepo.AddTestReferenceRange(&referenceRange)
+			if refRangeErr != nil {
+				log.Println("ERROR saving test Ref. range:", refRangeErr)
+				return fmt.Errorf("error while saving test reference range: %w", refRangeErr)
+			}
+			if rangeResolver != nil {
+				rangeResolver.AddRange(referenceRange)
+			}
+			if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportId, Qualifier, component.Units, unitRegistry, rangeResolver); err != nil {
+				return err
+			}
+		} else {
+			if existingRef.NormalMin != normalMin || existingRef.NormalMax != normalMax {
+				log.Println("Mismatch detected → inserting updated value against patient Id")
+				patientRefRange := models.PatientTestReferenceRange{
+					PatientId:                 patientId,
+					DiagnosticTestID:          diagnosticTestId,
+					DiagnosticTestComponentId: diagnosticComponentId,
+					NormalMin:                 normalMin,
+					NormalMax:                 normalMax,
+					BiologicalReferenceDesc:   *component.BiologicalReferenceDescription,
+					Units:                     component.Units,
+				}
+
+				if err := s.diagnosticRepo.AddPatientTestReferenceRange(&patientRefRange); err != nil {
+					log.Println("ERROR saving Patient-specific Ref. range:", err)
+					return fmt.Errorf("error while saving patient-specific reference range: %w", err)
+				}
+				if rangeResolver != nil {
+					rangeResolver.AddOverride(patientRefRange)
+				}
+				if err := s.SaveDiagnosticResultValue(tx, diagnosticTestId, diagnosticComponentId, resultStatus, parsedResultValue, reportDate, patientId, reportId, Qualifier, component.Units, unitRegistry, rangeResolver); err != nil {
+					return err
+				}
+			} else {
+				log.Println("Master reference matches → no patient-specific range needed")
+			}
+		}
+	}
+	return nil
+}
+
 func (s *DiagnosticServiceImpl) SaveDiagnosticResultValue(
 	tx *gorm.DB,
 	diagnosticTestId, diagnosticComponentId uint64,
@@ -726,17 +954,23 @@ func (s *DiagnosticServiceImpl) SaveDiagnosticResultValue(
 	patientId uint64,
 	reportId uint64,
 	Qualifier string,
+	reportedUnit string,
+	unitRegistry UnitRegistry,
+	rangeResolver *PatientRangeResolver,
 ) error {
 	result := models.PatientDiagnosticTestResultValue{
 		DiagnosticTestId:          diagnosticTestId,
 		DiagnosticTestComponentId: diagnosticComponentId,
 		ResultStatus:              resultStatus,
 		ResultValue:               parsedResultValue,
+		ResultUnit:                reportedUnit,
 		ResultDate:                reportDate,
 		PatientId:                 patientId,
 		UDF1:                      Qualifier,
 		PatientDiagnosticReportId: reportId,
+		Source:                    constant.ResultSourceAI,
 	}
+	normalizeResultValue(&result, unitRegistry, rangeResolver)
 
 	_, err := s.diagnosticRepo.SavePatientReportResultValue(tx, &result)
 	if err != nil {
@@ -746,6 +980,28 @@ func (s *DiagnosticServiceImpl) SaveDiagnosticResultValue(
 	return nil
 }
 
+// normalizeResultValue stores a numeric value in the component's canonical unit, keeping what
+// was reported, and applies the reference range of the patient.
+func normalizeResultValue(result *models.PatientDiagnosticTestResultValue, unitRegistry UnitRegistry, rangeResolver *PatientRangeResolver) {
+	result.OriginalValue, result.OriginalUnit = nil, ""
+	if result.ResultValue != 0 {
+		reported, reportedUnit := result.ResultValue, result.ResultUnit
+		if canonicalValue, canonicalUnit, ok := unitRegistry.ToCanonical(result.DiagnosticTestComponentId, reported, reportedUnit); ok {
+			result.OriginalValue = &reported
+			result.OriginalUnit = reportedUnit
+			result.ResultValue = canonicalValue
+			result.ResultUnit = canonicalUnit
+		} else if reportedUnit != "" {
+			if _, hasCanonical := unitRegistry.Canonical(result.DiagnosticTestComponentId); hasCanonical {
+				log.Printf("Unit %q is not registered for component %d, stored as reported", reportedUnit, result.DiagnosticTestComponentId)
+			}
+		}
+	}
+	if rangeResolver != nil {
+		rangeResolver.Apply(result)
+	}
+}
+
 func GetResultStatus(resultVal, minStr, maxStr, status string) string {
 	if resultVal == "" {
 		return "-"
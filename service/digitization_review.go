@@ -0,0 +1,283 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/database"
+	"biostat/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// addComponentAliases lets digitization recognise the names of components merged into another
+// one, which the master cache leaves out.
+func (s *DiagnosticServiceImpl) addComponentAliases(componentNameCache map[string]uint64) {
+	aliases, err := s.diagnosticRepo.LoadComponentAliasNames()
+	if err != nil {
+		log.Println("Failed to load component aliases:", err)
+		return
+	}
+	for name, componentId := range aliases {
+		if _, exists := componentNameCache[name]; !exists {
+			componentNameCache[name] = componentId
+		}
+	}
+}
+
+// digitizationReviewReason tells why an extracted result has to be reviewed before it is saved,
+// or returns an empty string when it can be saved straight away. Health vitals entered by the
+// user are never reviewed.
+func digitizationReviewReason(reportData models.LabReport, component models.LabReportComponent, componentNameCache map[string]uint64) string {
+	if !config.PropConfig.DigitizationReview.Enabled || reportData.ReportDetails.IsHealthVital {
+		return ""
+	}
+	if _, exists := componentNameCache[strings.ToLower(strings.TrimSpace(component.TestComponentName))]; !exists {
+		return constant.ReviewReasonUnmapped
+	}
+	if confidence, ok := componentConfidence(component); ok && confidence*100 < float64(config.PropConfig.DigitizationReview.MinConfidencePercent) {
+		return constant.ReviewReasonLowConfidence
+	}
+	return ""
+}
+
+// componentConfidence returns the lowest confidence reported for the result, overall or per
+// field, as a fraction. Values above 1 are taken as percentages.
+func componentConfidence(component models.LabReportComponent) (float64, bool) {
+	lowest, found := 0.0, false
+	consider := func(value float64) {
+		if value > 1 {
+			value /= 100
+		}
+		if !found || value < lowest {
+			lowest, found = value, true
+		}
+	}
+	if component.Confidence != nil {
+		consider(*component.Confidence)
+	}
+	for _, value := range component.FieldConfidence {
+		consider(value)
+	}
+	return lowest, found
+}
+
+func (s *DiagnosticServiceImpl) parkForReview(tx *gorm.DB, reason string, component models.LabReportComponent, testName string, diagnosticTestId, patientId, reportId uint64, recordId *uint64, reportDate time.Time) error {
+	extracted, err := json.Marshal(component)
+	if err != nil {
+		return fmt.Errorf("error while parking result for review: %w", err)
+	}
+	item := models.DigitizationReviewItem{
+		PatientId:                 patientId,
+		PatientDiagnosticReportId: reportId,
+		DiagnosticTestId:          diagnosticTestId,
+		TestName:                  testName,
+		TestComponentName:         component.TestComponentName,
+		ResultValue:               component.ResultValue,
+		Units:                     component.Units,
+		ResultDate:                reportDate,
+		Component:                 extracted,
+		Reason:                    reason,
+		Status:                    constant.ReviewPending,
+	}
+	if recordId != nil && *recordId != 0 {
+		item.RecordId = recordId
+	}
+	if confidence, ok := componentConfidence(component); ok {
+		item.Confidence = &confidence
+	}
+	if err := s.diagnosticRepo.CreateReviewItem(tx, &item); err != nil {
+		log.Println("ERROR parking result for review:", err)
+		return fmt.Errorf("error while parking result for review: %w", err)
+	}
+	return nil
+}
+
+func (s *DiagnosticServiceImpl) GetReviewQueue(filter models.ReviewQueueFilter, limit, offset int) ([]models.DigitizationReviewItem, int64, error) {
+	return s.diagnosticRepo.GetReviewItems(filter, limit, offset)
+}
+
+// ApproveReviewItem saves a parked result, with the corrections of the reviewer, through the
+// same path as digitization. Mapping it to a component saves it under that component instead
+// of the extracted name. Saving it under the extracted name can add master components and
+// ranges, so only admins may approve without a component.
+func (s *DiagnosticServiceImpl) ApproveReviewItem(reviewId, userId uint64, isAdmin bool, input models.ReviewDecisionRequest) (*models.DigitizationReviewItem, error) {
+	item, err := s.pendingReviewItem(reviewId, userId, isAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin && input.DiagnosticTestComponentId == nil {
+		return nil, errors.New("diagnostic_test_component_id is required to approve a result")
+	}
+	if input.DiagnosticTestComponentId != nil {
+		if _, err := s.diagnosticRepo.GetSingleDiagnosticComponent(int(*input.DiagnosticTestComponentId)); err != nil {
+			return nil, fmt.Errorf("diagnostic component %d not found: %w", *input.DiagnosticTestComponentId, err)
+		}
+	}
+	if input.SaveAsAlias {
+		if !isAdmin {
+			return nil, errors.New("only admins can save aliases of master components")
+		}
+		if input.DiagnosticTestComponentId == nil {
+			return nil, errors.New("diagnostic_test_component_id is required to save an alias")
+		}
+	}
+	var component models.LabReportComponent
+	if err := json.Unmarshal(item.Component, &component); err != nil {
+		return nil, fmt.Errorf("review item %d has no readable result: %w", reviewId, err)
+	}
+	if input.TestComponentName != nil && strings.TrimSpace(*input.TestComponentName) != "" {
+		component.TestComponentName = strings.TrimSpace(*input.TestComponentName)
+	}
+	if input.ResultValue != nil {
+		component.ResultValue = *input.ResultValue
+	}
+	if input.Units != nil {
+		component.Units = *input.Units
+	}
+	reviewed, err := json.Marshal(component)
+	if err != nil {
+		return nil, err
+	}
+
+	testNameCache, componentNameCache := s.diagnosticRepo.LoadDiagnosticTestMasterData()
+	if testNameCache == nil || componentNameCache == nil {
+		return nil, errors.New("test and component master data not available")
+	}
+	s.addComponentAliases(componentNameCache)
+	componentUnits, err := s.diagnosticRepo.GetComponentUnits(nil)
+	if err != nil {
+		log.Println("@ApproveReviewItem->GetComponentUnits:", err)
+	}
+	unitRegistry := NewUnitRegistry(componentUnits)
+	var rangeResolver *PatientRangeResolver
+	if ranges, err := s.diagnosticRepo.GetReferenceRanges(nil); err != nil {
+		log.Println("@ApproveReviewItem->GetReferenceRanges:", err)
+	} else if rangeResolver, err = s.newPatientRangeResolver(item.PatientId, unitRegistry, ranges); err != nil {
+		log.Println("@ApproveReviewItem->newPatientRangeResolver:", err)
+	}
+
+	tx := database.DB.Begin()
+	testRecord := models.PatientDiagnosticTest{PatientDiagnosticReportId: item.PatientDiagnosticReportId, DiagnosticTestId: item.DiagnosticTestId, TestDate: item.ResultDate}
+	if err := s.diagnosticRepo.EnsurePatientDiagnosticTest(tx, &testRecord); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if input.DiagnosticTestComponentId != nil {
+		if input.SaveAsAlias {
+			if err := s.saveReviewAlias(tx, component, *input.DiagnosticTestComponentId, componentNameCache, userId); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		parsedResultValue, resultStatus, qualifier := labComponentValue(component)
+		if err := s.SaveDiagnosticResultValue(tx, item.DiagnosticTestId, *input.DiagnosticTestComponentId, resultStatus, parsedResultValue, item.ResultDate, item.PatientId, item.PatientDiagnosticReportId, qualifier, component.Units, unitRegistry, rangeResolver); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	} else if err := s.saveLabReportComponent(tx, component, item.DiagnosticTestId, item.PatientId, item.PatientDiagnosticReportId, item.ResultDate, componentNameCache, unitRegistry, rangeResolver); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	closed, err := s.diagnosticRepo.CloseReviewItem(tx, reviewId, map[string]interface{}{
+		"status":              constant.ReviewApproved,
+		"test_component_name": component.TestComponentName,
+		"result_value":        component.ResultValue,
+		"units":               component.Units,
+		"component":           reviewed,
+		"reviewed_by":         userId,
+		"reviewed_at":         time.Now(),
+		"review_note":         input.Note,
+	})
+	if err != nil || !closed {
+		tx.Rollback()
+		if err == nil {
+			err = errors.New("review item was already reviewed")
+		}
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	s.refreshReportResults(item.PatientId, item.PatientDiagnosticReportId)
+	return s.diagnosticRepo.GetReviewItem(reviewId)
+}
+
+// saveReviewAlias records the extracted name as an alias of the chosen component, so later
+// reports using that name are mapped without review.
+func (s *DiagnosticServiceImpl) saveReviewAlias(tx *gorm.DB, component models.LabReportComponent, targetComponentId uint64, componentNameCache map[string]uint64, userId uint64) error {
+	key := strings.ToLower(strings.TrimSpace(component.TestComponentName))
+	aliasId, exists := componentNameCache[key]
+	if exists && aliasId == targetComponentId {
+		return nil
+	}
+	aliases, err := s.diagnosticRepo.LoadComponentAliasNames()
+	if err != nil {
+		return err
+	}
+	if mergedInto, isAlias := aliases[key]; isAlias {
+		return fmt.Errorf("%q is already an alias of component %d", component.TestComponentName, mergedInto)
+	}
+	if !exists {
+		newComponent := models.DiagnosticTestComponent{
+			TestComponentName:      component.TestComponentName,
+			Units:                  component.Units,
+			TestComponentFrequency: "0",
+		}
+		componentInfo, err := s.diagnosticRepo.CreateDiagnosticComponent(tx, &newComponent)
+		if err != nil {
+			return fmt.Errorf("error while creating alias component: %w", err)
+		}
+		aliasId = componentInfo.DiagnosticTestComponentId
+	}
+	alias := models.DiagnosticTestComponentAliasMapping{
+		DiagnosticTestComponentId: targetComponentId,
+		AliasTestComponentId:      aliasId,
+		CreatedBy:                 fmt.Sprint(userId),
+	}
+	if err := s.diagnosticRepo.CreateComponentAlias(tx, &alias); err != nil {
+		return fmt.Errorf("error while saving component alias: %w", err)
+	}
+	return nil
+}
+
+// RejectReviewItem discards a parked result.
+func (s *DiagnosticServiceImpl) RejectReviewItem(reviewId, userId uint64, isAdmin bool, note string) (*models.DigitizationReviewItem, error) {
+	if _, err := s.pendingReviewItem(reviewId, userId, isAdmin); err != nil {
+		return nil, err
+	}
+	closed, err := s.diagnosticRepo.CloseReviewItem(database.DB, reviewId, map[string]interface{}{
+		"status":      constant.ReviewRejected,
+		"reviewed_by": userId,
+		"reviewed_at": time.Now(),
+		"review_note": note,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !closed {
+		return nil, errors.New("review item was already reviewed")
+	}
+	return s.diagnosticRepo.GetReviewItem(reviewId)
+}
+
+func (s *DiagnosticServiceImpl) pendingReviewItem(reviewId, userId uint64, isAdmin bool) (*models.DigitizationReviewItem, error) {
+	item, err := s.diagnosticRepo.GetReviewItem(reviewId)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		if err := s.canChangeResults(item.PatientId, userId); err != nil {
+			return nil, err
+		}
+	}
+	if item.Status != constant.ReviewPending {
+		return nil, fmt.Errorf("review item was already %s", item.Status)
+	}
+	return item, nil
+}
@@ -6,8 +6,10 @@ import (
 	"biostat/utils"
 	"fmt"
 	"io"
+	"log"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -108,6 +110,8 @@ func (s *DiseaseServiceImpl) ProcessUploadFromStream(entity, authUserId string,
 		return ProcessAndInsert[models.Service](s, reader, authUserId)
 	case "MedicationMaster":
 		return processMedicationInsert(s, reader, authUserId)
+	case "LoincMaster":
+		return processLoincInsert(s, reader, authUserId)
 	default:
 		return 0, fmt.Errorf("unsupported entity: %s", entity)
 	}
@@ -149,6 +153,75 @@ func SetBulkUpload[T any](ptrList []*T) {
 	}
 }
 
+// processLoincInsert imports a LOINC subset. A row naming a master test or component also
+// assigns the code to it.
+func processLoincInsert(s *DiseaseServiceImpl, reader io.Reader, authUserId string) (int, error) {
+
+	type LoincExcelRow struct {
+		LoincNum          string `json:"loinc_num"`
+		LongCommonName    string `json:"long_common_name"`
+		ShortName         string `json:"short_name"`
+		Component         string `json:"component"`
+		Property          string `json:"property"`
+		TimeAspect        string `json:"time_aspect"`
+		System            string `json:"system"`
+		ScaleType         string `json:"scale_type"`
+		Class             string `json:"class"`
+		ExampleUnits      string `json:"example_units"`
+		Status            string `json:"status"`
+		TestName          string `json:"test_name"`
+		TestComponentName string `json:"test_component_name"`
+	}
+
+	data, err := utils.ParseExcelFromReader[LoincExcelRow](reader)
+	if err != nil {
+		return 0, err
+	}
+
+	codes := make([]models.LoincCode, 0, len(data))
+	for i, row := range data {
+		row.LoincNum = strings.TrimSpace(row.LoincNum)
+		if !utils.IsValidLoincCode(row.LoincNum) {
+			return 0, fmt.Errorf("row %d: invalid LOINC code %q", i+2, row.LoincNum)
+		}
+		codes = append(codes, models.LoincCode{
+			LoincNum:       row.LoincNum,
+			LongCommonName: row.LongCommonName,
+			ShortName:      row.ShortName,
+			Component:      row.Component,
+			Property:       row.Property,
+			TimeAspect:     row.TimeAspect,
+			System:         row.System,
+			ScaleType:      row.ScaleType,
+			Class:          row.Class,
+			ExampleUnits:   row.ExampleUnits,
+			Status:         row.Status,
+			CreatedBy:      authUserId,
+		})
+	}
+	if err := s.diseaseRepo.UpsertLoincCodes(codes); err != nil {
+		return 0, err
+	}
+
+	for _, row := range data {
+		if strings.TrimSpace(row.TestName) != "" {
+			if updated, err := s.diseaseRepo.AssignTestLoincCode(row.TestName, row.LoincNum); err != nil {
+				return len(codes), err
+			} else if updated == 0 {
+				log.Printf("LOINC %s: no diagnostic test named %q", row.LoincNum, row.TestName)
+			}
+		}
+		if strings.TrimSpace(row.TestComponentName) != "" {
+			if updated, err := s.diseaseRepo.AssignComponentLoincCode(row.TestComponentName, row.LoincNum); err != nil {
+				return len(codes), err
+			} else if updated == 0 {
+				log.Printf("LOINC %s: no diagnostic test component named %q", row.LoincNum, row.TestComponentName)
+			}
+		}
+	}
+	return len(codes), nil
+}
+
 func processMedicationInsert(s *DiseaseServiceImpl, reader io.Reader, authUserId string) (int, error) {
 
 	type MedicationExcelRow struct {
@@ -242,7 +242,7 @@ func (e *EmailServiceImpl) SendAppointmentMail(appointment models.AppointmentRes
 		},
 	}
 
-	scheduleStatus, scheduleData, scheduleErr := e.apiService.MakeRESTRequest(http.MethodPost, os.Getenv("NOTIFY_SERVER_URL")+"/api/v1/notifications/schedule", scheduleBody, header)
+	scheduleStatus, scheduleData, scheduleErr := e.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotifyServerURL+"/api/v1/notifications/schedule", scheduleBody, header)
 	var errs []string
 	if sendErr != nil {
 		errs = append(errs, fmt.Sprintf("send failed: %v (status: %d, data: %v)", sendErr, sendStatus, sendData))
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"biostat/repository"
+	"biostat/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErasureService implements the right to erasure: a dry-run report, a request that waits out
+// a grace period, and the execution that deletes or anonymizes every patient-owned row,
+// removes stored files, revokes the Keycloak account and writes an erasure certificate.
+type ErasureService interface {
+	PreviewErasure(userId uint64) (*models.ErasureReport, error)
+	RequestErasure(userId, requestedBy uint64, reason string) (*models.PatientErasureRequest, error)
+	GetErasureRequest(erasureId uuid.UUID, userId uint64) (*models.PatientErasureRequest, error)
+	CancelErasure(erasureId uuid.UUID, userId uint64) error
+	ExecuteDueErasures() (int, error)
+	VerifyErasureCertificates() (*models.ErasureCertificateVerification, error)
+}
+
+type erasureServiceImpl struct {
+	erasureRepo repository.ErasureRepository
+	userRepo    repository.UserRepository
+	fileStore   FileStoreService
+}
+
+func NewErasureService(erasureRepo repository.ErasureRepository, userRepo repository.UserRepository, fileStore FileStoreService) ErasureService {
+	return &erasureServiceImpl{erasureRepo: erasureRepo, userRepo: userRepo, fileStore: fileStore}
+}
+
+func (s *erasureServiceImpl) PreviewErasure(userId uint64) (*models.ErasureReport, error) {
+	tables, err := s.erasureRepo.CountErasureTargets(userId)
+	if err != nil {
+		return nil, err
+	}
+	records, versions, exports, err := s.erasureRepo.GetErasureFiles(userId)
+	if err != nil {
+		return nil, err
+	}
+	report := &models.ErasureReport{
+		UserID:          userId,
+		Tables:          tables,
+		StoredFiles:     len(erasureBlobs(records, versions, exports)),
+		GracePeriodDays: config.PropConfig.Erasure.GracePeriodDays,
+	}
+	for _, table := range tables {
+		report.TotalRows += table.Rows
+	}
+	pending, err := s.erasureRepo.GetPendingErasureRequest(userId)
+	if err == nil {
+		report.PendingRequest = &pending.ErasureId
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return report, nil
+}
+
+// RequestErasure schedules the erasure of userId after the grace period, keeping the dry-run
+// report taken at request time.
+func (s *erasureServiceImpl) RequestErasure(userId, requestedBy uint64, reason string) (*models.PatientErasureRequest, error) {
+	report, err := s.PreviewErasure(userId)
+	if err != nil {
+		return nil, err
+	}
+	if report.PendingRequest != nil {
+		return nil, fmt.Errorf("an erasure is already scheduled for this account (%s)", report.PendingRequest)
+	}
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	request := &models.PatientErasureRequest{
+		UserID:       userId,
+		RequestedBy:  requestedBy,
+		Reason:       reason,
+		Status:       constant.ErasureScheduled,
+		DryRunReport: reportJSON,
+		ScheduledFor: time.Now().AddDate(0, 0, config.PropConfig.Erasure.GracePeriodDays),
+	}
+	if err := s.erasureRepo.CreateErasureRequest(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (s *erasureServiceImpl) GetErasureRequest(erasureId uuid.UUID, userId uint64) (*models.PatientErasureRequest, error) {
+	request, err := s.erasureRepo.GetErasureRequest(erasureId)
+	if err != nil {
+		return nil, err
+	}
+	if request.UserID != userId && request.RequestedBy != userId {
+		return nil, errors.New("erasure request not found")
+	}
+	return request, nil
+}
+
+func (s *erasureServiceImpl) CancelErasure(erasureId uuid.UUID, userId uint64) error {
+	request, err := s.GetErasureRequest(erasureId, userId)
+	if err != nil {
+		return err
+	}
+	if request.Status != constant.ErasureScheduled {
+		return fmt.Errorf("erasure request is %s and can no longer be cancelled", request.Status)
+	}
+	return s.erasureRepo.UpdateErasureRequest(erasureId, map[string]interface{}{
+		"status":       constant.ErasureCancelled,
+		"cancelled_at": time.Now(),
+	})
+}
+
+// errErasureRetry fails an erasure run before anything was erased. The request stays scheduled
+// and the next run tries again.
+var errErasureRetry = errors.New("erasure not started, will retry")
+
+// ExecuteDueErasures runs every scheduled erasure whose grace period is over and returns how
+// many completed.
+func (s *erasureServiceImpl) ExecuteDueErasures() (int, error) {
+	requests, err := s.erasureRepo.GetDueErasureRequests(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	completed := 0
+	for i := range requests {
+		if err := s.executeErasure(&requests[i]); err != nil {
+			log.Printf("@ExecuteDueErasures %s: %v", requests[i].ErasureId, err)
+			updates := map[string]interface{}{"failure_reason": err.Error()}
+			if !errors.Is(err, errErasureRetry) {
+				updates["status"] = constant.Failure
+			}
+			if err := s.erasureRepo.UpdateErasureRequest(requests[i].ErasureId, updates); err != nil {
+				log.Println("@ExecuteDueErasures->UpdateErasureRequest:", err)
+			}
+			continue
+		}
+		completed++
+	}
+	return completed, nil
+}
+
+func (s *erasureServiceImpl) executeErasure(request *models.PatientErasureRequest) error {
+	user, err := s.userRepo.GetSystemUserInfo(request.UserID)
+	if err != nil {
+		return err
+	}
+	records, versions, exports, err := s.erasureRepo.GetErasureFiles(request.UserID)
+	if err != nil {
+		return err
+	}
+	blobs := erasureBlobs(records, versions, exports)
+	summary := models.ErasureSummary{StoredFiles: len(blobs)}
+
+	// Revoke first so the account cannot be used while its data is going away. Without the
+	// revoke nothing is erased, since the login would outlive its link to the account.
+	if user.AuthUserId != "" {
+		if err := revokeKeycloakUser(user.AuthUserId); err != nil {
+			return fmt.Errorf("%w: %v", errErasureRetry, err)
+		}
+		summary.KeycloakRevoked = true
+	}
+
+	certificate, err := s.erasureRepo.ExecuteErasure(request, func(tables []models.ErasureTableCount, prevHash string) (*models.ErasureCertificate, error) {
+		summary.Tables = tables
+		for _, table := range tables {
+			summary.TotalRows += table.Rows
+		}
+		summaryJSON, err := json.Marshal(summary)
+		if err != nil {
+			return nil, err
+		}
+		certificate := &models.ErasureCertificate{
+			ErasureId:   request.ErasureId,
+			SubjectHash: utils.ComputeContentHash([]byte(fmt.Sprintf("%d:%s", user.UserId, user.AuthUserId))),
+			RequestedBy: request.RequestedBy,
+			Summary:     summaryJSON,
+			ExecutedAt:  time.Now().UTC().Truncate(time.Microsecond),
+			PrevHash:    prevHash,
+		}
+		certificate.Hash = erasureCertificateHash(certificate)
+		return certificate, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Blobs go only after the rows pointing at them are committed away.
+	for _, blob := range blobs {
+		if err := s.fileStore.DeleteFile(context.Background(), blob.destination, blob.url); err != nil {
+			log.Printf("@executeErasure %s DeleteFile %s: %v", request.ErasureId, blob.url, err)
+		}
+	}
+	log.Printf("@executeErasure %s completed, certificate %d", request.ErasureId, certificate.CertificateId)
+	return nil
+}
+
+// VerifyErasureCertificates walks the certificate chain and reports the first entry whose
+// hash or link to its predecessor does not match.
+func (s *erasureServiceImpl) VerifyErasureCertificates() (*models.ErasureCertificateVerification, error) {
+	certificates, err := s.erasureRepo.GetErasureCertificates()
+	if err != nil {
+		return nil, err
+	}
+	result := &models.ErasureCertificateVerification{Valid: true}
+	prevHash := ""
+	for i := range certificates {
+		certificate := &certificates[i]
+		result.Checked++
+		if certificate.PrevHash != prevHash || erasureCertificateHash(certificate) != certificate.Hash {
+			result.Valid = false
+			result.BrokenCertificateId = &certificate.CertificateId
+			break
+		}
+		prevHash = certificate.Hash
+	}
+	return result, nil
+}
+
+func erasureCertificateHash(certificate *models.ErasureCertificate) string {
+	payload := fmt.Sprintf("%s|%s|%s|%d|%d|%s", certificate.PrevHash, certificate.ErasureId, certificate.SubjectHash,
+		certificate.RequestedBy, certificate.ExecutedAt.UnixMicro(), certificate.Summary)
+	return utils.GenerateHMAC([]byte(payload), config.PropConfig.Erasure.CertificateSecret)
+}
+
+type erasureBlob struct {
+	destination string
+	url         string
+}
+
+// erasureBlobs lists each stored file once; record versions usually share their blob with
+// the record or with each other.
+func erasureBlobs(records []models.TblMedicalRecord, versions []models.TblMedicalRecordVersion, exports []models.PatientDataExport) []erasureBlob {
+	var blobs []erasureBlob
+	seen := map[string]bool{}
+	add := func(destination, url string) {
+		if url == "" || destination == constant.UploadDestinationDigiLocker || seen[url] {
+			return
+		}
+		seen[url] = true
+		blobs = append(blobs, erasureBlob{destination: destination, url: url})
+	}
+	for _, record := range records {
+		add(record.UploadDestination, record.RecordUrl)
+		add(DestinationFromURL(record.ThumbnailUrl), record.ThumbnailUrl)
+	}
+	for _, version := range versions {
+		add(version.UploadDestination, version.RecordUrl)
+	}
+	for _, export := range exports {
+		add(export.UploadDestination, export.FileUrl)
+	}
+	return blobs
+}
+
+// revokeKeycloakUser ends every session of the Keycloak user and deletes it.
+func revokeKeycloakUser(authUserId string) error {
+	if config.Client == nil {
+		return errors.New("keycloak client is not initialized")
+	}
+	ctx := context.Background()
+	token, err := config.Client.LoginAdmin(ctx, config.KeycloakAdminUser, config.KeycloakAdminPassword, "master")
+	if err != nil {
+		return fmt.Errorf("admin login failed: %w", err)
+	}
+	if err := config.Client.LogoutAllSessions(ctx, token.AccessToken, config.KeycloakRealm, authUserId); err != nil {
+		log.Println("@revokeKeycloakUser->LogoutAllSessions:", err)
+	}
+	err = config.Client.DeleteUser(ctx, token.AccessToken, config.KeycloakRealm, authUserId)
+	var apiErr *gocloak.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		// Deleted by an earlier run that failed afterwards.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,336 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"biostat/utils"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// LocalRecordURLPrefix is stored in RecordUrl for blobs on the local store. It is a
+// store reference, not a public link; clients get signed download urls instead.
+const LocalRecordURLPrefix = "uploads/"
+
+// FileStore is a blob backend that holds uploaded medical record files.
+// Objects are addressed by a flat object key (the sanitized unique file name).
+type FileStore interface {
+	Destination() string
+	Save(ctx context.Context, objectKey string, data []byte, contentType string) (string, error)
+	SaveStream(ctx context.Context, objectKey string, r io.Reader, contentType string) (string, error)
+	Read(ctx context.Context, objectKey string) ([]byte, error)
+	Open(ctx context.Context, objectKey string) (io.ReadCloser, error)
+	Delete(ctx context.Context, objectKey string) error
+}
+
+type FileStoreService interface {
+	SaveFile(ctx context.Context, objectKey string, data []byte, contentType string) (destination string, recordURL string, err error)
+	SaveFileStream(ctx context.Context, objectKey string, r io.Reader, contentType string) (destination string, recordURL string, err error)
+	ReadFile(ctx context.Context, destination string, recordURL string) ([]byte, error)
+	OpenFile(ctx context.Context, destination string, recordURL string) (io.ReadCloser, error)
+	DeleteFile(ctx context.Context, destination string, recordURL string) error
+	PrimaryDestination() string
+	SaveRecordFile(ctx context.Context, record *models.TblMedicalRecord, objectKey string, data []byte) error
+	ReadRecordFile(ctx context.Context, record *models.TblMedicalRecord) ([]byte, error)
+	SaveRecordDerivative(ctx context.Context, record *models.TblMedicalRecord, objectKey string, data []byte, contentType string) (string, error)
+	ReadRecordDerivative(ctx context.Context, record *models.TblMedicalRecord, derivativeURL string) ([]byte, error)
+}
+
+type fileStoreServiceImpl struct {
+	primary    FileStore
+	stores     map[string]FileStore
+	encryption RecordEncryptionService
+}
+
+// NewFileStoreService builds the configured primary store. The local store is always
+// registered so records written before a backend switch remain readable. An S3 backend that
+// cannot be reached stops startup rather than writing records to local disk.
+func NewFileStoreService(encryption RecordEncryptionService) FileStoreService {
+	cfg := config.PropConfig.FileStore
+	local := NewLocalFileStore(cfg.LocalDir)
+	stores := map[string]FileStore{local.Destination(): local}
+	var primary FileStore = local
+	if strings.EqualFold(cfg.Backend, constant.UploadDestinationS3) {
+		s3Store, err := NewS3FileStore(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3UseSSL)
+		if err != nil {
+			log.Fatalf("@NewFileStoreService->NewS3FileStore: %v", err)
+		}
+		stores[s3Store.Destination()] = s3Store
+		primary = s3Store
+	}
+	return &fileStoreServiceImpl{primary: primary, stores: stores, encryption: encryption}
+}
+
+func (s *fileStoreServiceImpl) PrimaryDestination() string {
+	return s.primary.Destination()
+}
+
+func (s *fileStoreServiceImpl) SaveFile(ctx context.Context, objectKey string, data []byte, contentType string) (string, string, error) {
+	recordURL, err := s.primary.Save(ctx, objectKey, data, contentType)
+	if err != nil {
+		return "", "", err
+	}
+	return s.primary.Destination(), recordURL, nil
+}
+
+// SaveFileStream stores what r yields without holding it in memory.
+func (s *fileStoreServiceImpl) SaveFileStream(ctx context.Context, objectKey string, r io.Reader, contentType string) (string, string, error) {
+	recordURL, err := s.primary.SaveStream(ctx, objectKey, r, contentType)
+	if err != nil {
+		return "", "", err
+	}
+	return s.primary.Destination(), recordURL, nil
+}
+
+func (s *fileStoreServiceImpl) ReadFile(ctx context.Context, destination string, recordURL string) ([]byte, error) {
+	store, err := s.storeFor(destination)
+	if err != nil {
+		return nil, err
+	}
+	return store.Read(ctx, ObjectKeyFromURL(recordURL))
+}
+
+func (s *fileStoreServiceImpl) OpenFile(ctx context.Context, destination string, recordURL string) (io.ReadCloser, error) {
+	store, err := s.storeFor(destination)
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(ctx, ObjectKeyFromURL(recordURL))
+}
+
+func (s *fileStoreServiceImpl) DeleteFile(ctx context.Context, destination string, recordURL string) error {
+	store, err := s.storeFor(destination)
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, ObjectKeyFromURL(recordURL))
+}
+
+// SaveRecordFile encrypts data with the record's data key and stores it, filling in the
+// record's destination, url, key and content hash fields.
+func (s *fileStoreServiceImpl) SaveRecordFile(ctx context.Context, record *models.TblMedicalRecord, objectKey string, data []byte) error {
+	record.ContentHash = utils.ComputeContentHash(data)
+	encrypted, err := s.encryption.EncryptRecordData(record, data)
+	if err != nil {
+		return err
+	}
+	destination, recordURL, err := s.SaveFile(ctx, objectKey, encrypted, record.FileType)
+	if err != nil {
+		return err
+	}
+	record.UploadDestination = destination
+	record.RecordUrl = recordURL
+	return nil
+}
+
+// ReadRecordFile returns the decrypted record file, taking the inline file data of synced
+// records when present and the stored blob otherwise.
+func (s *fileStoreServiceImpl) ReadRecordFile(ctx context.Context, record *models.TblMedicalRecord) ([]byte, error) {
+	if len(record.FileData) > 0 {
+		return s.encryption.DecryptRecordData(record, record.FileData)
+	}
+	data, err := s.ReadFile(ctx, record.UploadDestination, record.RecordUrl)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryption.DecryptRecordData(record, data)
+}
+
+// SaveRecordDerivative stores a file generated from the record, such as its thumbnail, on
+// the primary store. It is encrypted with the record's data key when the record has one;
+// the record itself is left untouched.
+func (s *fileStoreServiceImpl) SaveRecordDerivative(ctx context.Context, record *models.TblMedicalRecord, objectKey string, data []byte, contentType string) (string, error) {
+	if record.DataKey != "" {
+		encrypted, err := s.encryption.EncryptRecordData(record, data)
+		if err != nil {
+			return "", err
+		}
+		data = encrypted
+	}
+	_, derivativeURL, err := s.SaveFile(ctx, objectKey, data, contentType)
+	return derivativeURL, err
+}
+
+func (s *fileStoreServiceImpl) ReadRecordDerivative(ctx context.Context, record *models.TblMedicalRecord, derivativeURL string) ([]byte, error) {
+	data, err := s.ReadFile(ctx, DestinationFromURL(derivativeURL), derivativeURL)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryption.DecryptRecordData(record, data)
+}
+
+func (s *fileStoreServiceImpl) storeFor(destination string) (FileStore, error) {
+	if destination == "" {
+		destination = constant.UploadDestinationLocal
+	}
+	store, ok := s.stores[destination]
+	if !ok {
+		return nil, fmt.Errorf("file store %q is not configured", destination)
+	}
+	return store, nil
+}
+
+// DestinationFromURL returns the store a file store url was written to.
+func DestinationFromURL(recordURL string) string {
+	if strings.HasPrefix(recordURL, "s3://") {
+		return constant.UploadDestinationS3
+	}
+	return constant.UploadDestinationLocal
+}
+
+// ObjectKeyFromURL returns the object key part of a stored record url. It also accepts
+// the legacy public "<SHORT_URL_BASE>/uploads/<key>" form.
+func ObjectKeyFromURL(recordURL string) string {
+	return path.Base(strings.SplitN(recordURL, "?", 2)[0])
+}
+
+type localFileStore struct {
+	baseDir string
+}
+
+func NewLocalFileStore(baseDir string) FileStore {
+	if baseDir == "" {
+		baseDir = "uploads"
+	}
+	return &localFileStore{baseDir: baseDir}
+}
+
+func (l *localFileStore) Destination() string {
+	return constant.UploadDestinationLocal
+}
+
+func (l *localFileStore) Save(ctx context.Context, objectKey string, data []byte, contentType string) (string, error) {
+	if err := os.MkdirAll(l.baseDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(l.objectPath(objectKey), data, 0644); err != nil {
+		return "", err
+	}
+	return LocalRecordURLPrefix + objectKey, nil
+}
+
+// SaveStream writes to a temp file first so a failed stream never leaves a partial object.
+func (l *localFileStore) SaveStream(ctx context.Context, objectKey string, r io.Reader, contentType string) (string, error) {
+	if err := os.MkdirAll(l.baseDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(l.baseDir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), l.objectPath(objectKey)); err != nil {
+		return "", err
+	}
+	return LocalRecordURLPrefix + objectKey, nil
+}
+
+func (l *localFileStore) Read(ctx context.Context, objectKey string) ([]byte, error) {
+	return os.ReadFile(l.objectPath(objectKey))
+}
+
+func (l *localFileStore) Open(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+	return os.Open(l.objectPath(objectKey))
+}
+
+func (l *localFileStore) Delete(ctx context.Context, objectKey string) error {
+	err := os.Remove(l.objectPath(objectKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *localFileStore) objectPath(objectKey string) string {
+	return filepath.Join(l.baseDir, filepath.Base(objectKey))
+}
+
+type s3FileStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3FileStore(endpoint, region, bucket, accessKey, secretKey string, useSSL bool) (FileStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are required")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("check bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+			return nil, fmt.Errorf("create bucket %s: %w", bucket, err)
+		}
+	}
+	return &s3FileStore{client: client, bucket: bucket}, nil
+}
+
+func (s *s3FileStore) Destination() string {
+	return constant.UploadDestinationS3
+}
+
+func (s *s3FileStore) Save(ctx context.Context, objectKey string, data []byte, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, objectKey, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, objectKey), nil
+}
+
+// SaveStream uploads in parts as r is read, since the size is not known up front.
+func (s *s3FileStore) SaveStream(ctx context.Context, objectKey string, r io.Reader, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, objectKey, r, -1, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, objectKey), nil
+}
+
+func (s *s3FileStore) Open(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+	return s.client.GetObject(ctx, s.bucket, objectKey, minio.GetObjectOptions{})
+}
+
+func (s *s3FileStore) Read(ctx context.Context, objectKey string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+func (s *s3FileStore) Delete(ctx context.Context, objectKey string) error {
+	return s.client.RemoveObject(ctx, s.bucket, objectKey, minio.RemoveObjectOptions{})
+}
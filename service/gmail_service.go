@@ -9,10 +9,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -23,6 +22,7 @@ import (
 
 	"github.com/google/uuid"
 	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
 	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
@@ -55,10 +55,11 @@ type GmailSyncServiceImpl struct {
 	patientService       PatientService
 	recordRepo           repository.TblMedicalRecordRepository
 	db                   *gorm.DB
+	fileStore            FileStoreService
 }
 
-func NewGmailSyncService(processStatusService ProcessStatusService, medRecordService TblMedicalRecordService, userService UserService, diagnosticRepo repository.DiagnosticRepository, apiService ApiService, patientService PatientService, recordRepo repository.TblMedicalRecordRepository, db *gorm.DB) GmailSyncService {
-	return &GmailSyncServiceImpl{processStatusService: processStatusService, medRecordService: medRecordService, userService: userService, diagnosticRepo: diagnosticRepo, apiService: apiService, patientService: patientService, recordRepo: recordRepo, db: db}
+func NewGmailSyncService(processStatusService ProcessStatusService, medRecordService TblMedicalRecordService, userService UserService, diagnosticRepo repository.DiagnosticRepository, apiService ApiService, patientService PatientService, recordRepo repository.TblMedicalRecordRepository, db *gorm.DB, fileStore FileStoreService) GmailSyncService {
+	return &GmailSyncServiceImpl{processStatusService: processStatusService, medRecordService: medRecordService, userService: userService, diagnosticRepo: diagnosticRepo, apiService: apiService, patientService: patientService, recordRepo: recordRepo, db: db, fileStore: fileStore}
 }
 
 func (gs *GmailSyncServiceImpl) GetGmailAuthURL(userId uint64) (string, error) {
@@ -221,6 +222,16 @@ func (s *GmailSyncServiceImpl) ExtractAttachment(service *gmail.Service, message
 			msg := fmt.Sprintf("Downloading attachment %s Dated on %s from EmailSub %s", part.Filename, emailDate, subject)
 			log.Println("@ExtractAttachments Processing Record from Email:", mailIdx, "-", recordIndexCount, "/", len(message.Payload.Parts), ": ", part.Filename, "-", subject)
 			s.processStatusService.LogStep(processID, step, constant.Running, msg, errorMsg, nil, &recordIndexCount, &recordIndexCount, nil, nil, &attachmentId)
+			// Attachment ids change between fetches, the message id and part id do not.
+			sourceDocumentId := fmt.Sprintf("gmail:%s:%s", message.Id, part.PartId)
+			synced, err := s.recordRepo.IsSourceDocumentSynced(userId, sourceDocumentId)
+			if err != nil {
+				log.Printf("@ExtractAttachments->IsSourceDocumentSynced %s: %v", part.Filename, err)
+			} else if synced {
+				msg = fmt.Sprintf("Attachment %s from %s Dated on %s already synced, skipped", part.Filename, subject, emailDate)
+				s.processStatusService.LogStep(processID, step, constant.Success, msg, errorMsg, nil, &recordIndexCount, &recordIndexCount, nil, nil, &attachmentId)
+				continue
+			}
 			attachmentData, err := utils.DownloadAttachment(service, message.Id, attachmentId)
 			if err != nil {
 				log.Printf("@ExtractAttachments->DownloadAttachment %s: %v", part.Filename, err)
@@ -240,34 +251,32 @@ func (s *GmailSyncServiceImpl) ExtractAttachment(service *gmail.Service, message
 			extension := filepath.Ext(part.Filename)
 			uniqueSuffix := time.Now().Format("20060102150405") + "-" + uuid.New().String()[:8]
 			safeFileName := fmt.Sprintf("%s_%s%s", originalName, uniqueSuffix, extension)
-			destinationPath := filepath.Join("uploads", safeFileName)
 
-			if err := os.WriteFile(destinationPath, attachmentData, 0644); err != nil {
-				log.Printf("@ExtractAttachments->Failed to save attachment locally %s: %v", part.Filename, err)
-				continue
-			}
 			initialMetadata := map[string]interface{}{
-				"attachment_id": attachmentId,
+				"attachment_id":       attachmentId,
+				"source_document_ids": []string{sourceDocumentId},
 			}
 			metadataJSON, _ := json.Marshal(initialMetadata)
-			recordURL := fmt.Sprintf("%s/uploads/%s", os.Getenv("SHORT_URL_BASE"), safeFileName)
 			subBody := fmt.Sprintf("Subject and body of email sub : %s : Body :%+v ", subject, bodyText)
 			newRecord := &models.TblMedicalRecord{
-				RecordName:        safeFileName,
-				RecordSize:        int64(len(attachmentData)),
-				FileType:          part.MimeType,
-				RecordUrl:         recordURL,
-				UploadDestination: "LocalServer",
-				Description:       subBody,
-				UploadSource:      "Gmail",
-				RecordCategory:    string(constant.OTHER),
-				SourceAccount:     userEmail,
-				UDF1:              subject,
-				UDF2:              emailDate,
-				Status:            constant.StatusProcessing,
-				Metadata:          metadataJSON,
-				UploadedBy:        userId,
-				FetchedAt:         time.Now(),
+				RecordName:       safeFileName,
+				RecordSize:       int64(len(attachmentData)),
+				FileType:         part.MimeType,
+				Description:      subBody,
+				UploadSource:     "Gmail",
+				RecordCategory:   string(constant.OTHER),
+				SourceAccount:    userEmail,
+				UDF1:             subject,
+				UDF2:             emailDate,
+				Status:           constant.StatusProcessing,
+				Metadata:         metadataJSON,
+				UploadedBy:       userId,
+				FetchedAt:        time.Now(),
+				SourceDocumentId: sourceDocumentId,
+			}
+			if err := s.fileStore.SaveRecordFile(context.Background(), newRecord, safeFileName, attachmentData); err != nil {
+				log.Printf("@ExtractAttachments->Failed to save attachment %s: %v", part.Filename, err)
+				continue
 			}
 			successCount++
 			records = append(records, newRecord)
@@ -361,9 +370,7 @@ func (gs *GmailSyncServiceImpl) GmailSyncCore(userId uint64, processID uuid.UUID
 		if err != nil {
 			log.Println("GetAttachmentIDFromRecord Error:", err)
 		}
-		fileName := filepath.Base(record.RecordUrl)
-		localPath := filepath.Join("uploads", fileName)
-		fileData, err := os.ReadFile(localPath)
+		fileData, err := gs.fileStore.ReadRecordFile(context.Background(), record)
 		if err != nil {
 			log.Println("error while reading file while getting Doctype", record.RecordName)
 			continue
@@ -468,6 +475,12 @@ func (gs *GmailSyncServiceImpl) GmailSyncCore(userId uint64, processID uuid.UUID
 	}
 	for idx, record := range emailMedRecords {
 		recordInfo := fmt.Sprintf("%s:- %s", record.UDF2, record.UDF1)
+		if record.IsDuplicate {
+			attachmentId, _ := utils.GetAttachmentIDFromRecord(record)
+			msg := fmt.Sprintf("Processing doc %d | %s (record id %d) | %s", idx+1, constant.DuplicateRecordLinked, record.RecordId, recordInfo)
+			gs.processStatusService.LogStep(processID, string(constant.CheckContentDuplication), constant.Success, msg, errorMsg, &record.RecordId, nil, nil, nil, nil, &attachmentId)
+			continue
+		}
 		if !flag {
 			if record.RecordCategory == string(constant.TESTREPORT) || record.RecordCategory == string(constant.MEDICATION) {
 				attachmentId, err := utils.GetAttachmentIDFromRecord(record)
@@ -479,16 +492,14 @@ func (gs *GmailSyncServiceImpl) GmailSyncCore(userId uint64, processID uuid.UUID
 				msg := fmt.Sprintf("Processing doc %d | Starting digitization for report id :%d category: %s %s | %s", idx+1, record.RecordId, record.RecordCategory, record.RecordName, recordInfo)
 				gs.processStatusService.LogStep(processID, step4, constant.Running, msg, errorMsg, &record.RecordId, nil, nil, nil, nil, &attachmentId)
 				log.Println("Starting to Digitize saved record :", record.RecordId)
-				resp, err := http.Get(record.RecordUrl)
+				fileData, err := gs.fileStore.ReadRecordFile(context.Background(), record)
 				if err != nil {
-					log.Printf("Error @GmailSyncCore->Read File From URL:%v", err)
+					log.Printf("Error @GmailSyncCore->Read File From Store:%v", err)
 					continue
 				}
-				defer resp.Body.Close()
-
-				fileBuf := new(bytes.Buffer)
-				_, _ = io.Copy(fileBuf, resp.Body)
+				fileBuf := bytes.NewBuffer(fileData)
 				filename := filepath.Base(record.RecordUrl)
+				record.DigitizationPriority = SyncedRecordPriority(record.UDF2)
 				taskErr := gs.medRecordService.CreateDigitizationTask(record, userInfo, userId, fileBuf, filename, processID, &attachmentId)
 				if taskErr != nil {
 					msg := fmt.Sprintf("Processing doc %d | Failed digitization for report id :%d category: %s %s | %s", idx+1, record.RecordId, record.RecordCategory, record.RecordName, recordInfo)
@@ -539,16 +550,15 @@ func (gs *GmailSyncServiceImpl) GmailSyncCore(userId uint64, processID uuid.UUID
 			msg := fmt.Sprintf("Processing doc %d | Starting digitization for report id :%d category: %s %s | %s", idx+1, record.RecordId, record.RecordCategory, record.RecordName, recordInfo)
 			gs.processStatusService.LogStep(processID, step4, constant.Running, msg, errorMsg, &record.RecordId, nil, nil, nil, nil, &attachmentId)
 			log.Println("Starting to Digitize saved record :", record.RecordId)
-			resp, err := http.Get(record.RecordUrl)
+			fileData, err := gs.fileStore.ReadRecordFile(context.Background(), record)
 			if err != nil {
-				log.Printf("Error @GmailSyncCore->Read File From URL:%v", err)
+				log.Printf("Error @GmailSyncCore->Read File From Store:%v", err)
 				continue
 			}
-			defer resp.Body.Close()
 			log.Println("Data else condition")
-			fileBuf := new(bytes.Buffer)
-			_, _ = io.Copy(fileBuf, resp.Body)
+			fileBuf := bytes.NewBuffer(fileData)
 			filename := filepath.Base(record.RecordUrl)
+			record.DigitizationPriority = SyncedRecordPriority(record.UDF2)
 			taskErr := gs.medRecordService.CreateDigitizationTask(record, userInfo, userId, fileBuf, filename, processID, &attachmentId)
 			if taskErr != nil {
 				msg := fmt.Sprintf("Processing doc %d | Failed digitization for report id :%d category: %s %s | %s", idx+1, record.RecordId, record.RecordCategory, record.RecordName, recordInfo)
@@ -752,8 +762,11 @@ func DecryptPDFIfProtected(fileData []byte, password string) ([]byte, error) {
 	// conf := model.NewAESConfiguration(password, "", 256)
 
 	err := pdfcpuapi.Decrypt(bytes.NewReader(fileData), buf, conf)
+	if errors.Is(err, pdfcpu.ErrWrongPassword) {
+		return nil, fmt.Errorf("failed to decrypt PDF: %w", ErrPDFPassword)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt PDF: %w", err)
+		return nil, fmt.Errorf("failed to decrypt PDF: %w: %v", ErrUnsupportedFile, err)
 	}
 	return buf.Bytes(), nil
 }
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"biostat/models"
+	"biostat/utils"
+	"fmt"
+	"strings"
+)
+
+// validateLoincCode accepts an empty code, since most tests and components are not coded yet.
+func validateLoincCode(code string) error {
+	if strings.TrimSpace(code) != "" && !utils.IsValidLoincCode(code) {
+		return fmt.Errorf("invalid LOINC code %q", code)
+	}
+	return nil
+}
+
+func (s *DiagnosticServiceImpl) SearchLoincCodes(search string, limit, offset int) ([]models.LoincCode, int64, error) {
+	return s.diagnosticRepo.SearchLoincCodes(search, limit, offset)
+}
+
+// GetLoincCodeDetail looks a code up with the master tests and components mapped to it. A code
+// outside the imported subset is still returned when the master uses it.
+func (s *DiagnosticServiceImpl) GetLoincCodeDetail(loincCode string) (*models.LoincCodeDetail, error) {
+	if err := validateLoincCode(loincCode); err != nil || loincCode == "" {
+		return nil, fmt.Errorf("invalid LOINC code %q", loincCode)
+	}
+	tests, components, err := s.diagnosticRepo.GetLoincMappings(loincCode)
+	if err != nil {
+		return nil, err
+	}
+	detail := &models.LoincCodeDetail{Tests: tests, Components: components}
+	code, err := s.diagnosticRepo.GetLoincCode(loincCode)
+	if err != nil {
+		if len(tests) == 0 && len(components) == 0 {
+			return nil, err
+		}
+		code = &models.LoincCode{LoincNum: loincCode}
+	}
+	detail.LoincCode = *code
+	return detail, nil
+}
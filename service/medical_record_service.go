@@ -1,6 +1,7 @@
 package service
 
 import (
+	"archive/zip"
 	"biostat/config"
 	"biostat/constant"
 	"biostat/database"
@@ -17,9 +18,12 @@ import (
 	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,7 +37,7 @@ import (
 )
 
 type TblMedicalRecordService interface {
-	GetAllMedicalRecord(patientId uint64, limit int, offset int) ([]map[string]interface{}, int64, error)
+	GetAllMedicalRecord(patientId, reqUserID uint64, limit int, offset int) ([]map[string]interface{}, int64, error)
 	GetUserMedicalRecords(userID uint64) ([]models.TblMedicalRecord, error)
 	CreateTblMedicalRecord(createdBy uint64, authUserId string, file multipart.File, header *multipart.FileHeader, uploadSource string, description string, recordCategory, recordSubCategory string, attachment []*multipart.FileHeader, tags string) (*models.TblMedicalRecord, error)
 	CreateDigitizationTask(record *models.TblMedicalRecord, userInfo models.SystemUser_, userId uint64, file *bytes.Buffer, filename string, processID uuid.UUID, attachmentId *string) error
@@ -41,12 +45,26 @@ type TblMedicalRecordService interface {
 	SaveMedicalRecords(data []*models.TblMedicalRecord, userId uint64) error
 	UpdateTblMedicalRecord(userId uint64, data *models.TblMedicalRecord) (*models.TblMedicalRecord, error)
 	GetMedicalRecordByRecordId(RecordId uint64) (*models.TblMedicalRecord, error)
-	DeleteTblMedicalRecord(id int, updatedBy string) error
+	DeleteTblMedicalRecord(userId uint64, recordId uint64) error
+	GetRecordVersions(userId uint64, recordId uint64) ([]models.TblMedicalRecordVersion, error)
+	RestoreMedicalRecord(userId uint64, recordId uint64, versionId uint64) (*models.TblMedicalRecord, error)
+	PurgeMedicalRecord(userId uint64, recordId uint64) error
+	PurgeExpiredRecords() (int, error)
 	IsRecordAccessibleToUser(userID uint64, recordID uint64) (bool, error)
-	GetMedicalRecords(userID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error)
-	GetPrecription(userID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error)
+	GetMedicalRecords(userID, reqUserID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error)
+	GetPrecription(userID, reqUserID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error)
 
 	ReadMedicalRecord(ResourceId uint64, userId, reqUserId uint64) (interface{}, error)
+	ReadRecordFile(record *models.TblMedicalRecord) ([]byte, error)
+	BuildRecordDownloadURL(recordID, userID uint64) string
+	BuildRecordThumbnailURL(record *models.TblMedicalRecord, userID uint64) string
+	ReadSignedMedicalRecord(recordID, userID uint64, expiresAt int64, signature string) (*models.LocalServerFile, string, error)
+	ReadSignedRecordThumbnail(recordID, userID uint64, expiresAt int64, signature string) (*models.LocalServerFile, error)
+	EnqueueRecordPreviewTask(recordID uint64) error
+	SearchMedicalRecords(userID uint64, patientID *uint64, query string, limit, offset int) ([]models.RecordSearchResult, int64, error)
+	ImportMedicalRecordsZip(userId uint64, authUserId string, file multipart.File, header *multipart.FileHeader, uploadSource, description, recordCategory, recordSubCategory, tags string) (uuid.UUID, error)
+	MigrateLegacyRecordUrls() (int64, error)
+	RewrapRecordDataKeys(userId uint64) (uuid.UUID, error)
 	MovePatientRecord(patientId, targetPatientId, recordId, reportId uint64) error
 	GetAllReportTag(userId uint64, limit, offset int) ([]models.UserTag, int64, error)
 	AddTagsToRecordOrReport(req models.AddTagRequest) ([]models.UserTag, error)
@@ -62,24 +80,47 @@ type tblMedicalRecordServiceImpl struct {
 	redisClient          *redis.Client
 	processStatusService ProcessStatusService
 	patientRepo          repository.PatientRepository
+	fileStore            FileStoreService
+	encryption           RecordEncryptionService
 }
 
 func NewTblMedicalRecordService(repo repository.TblMedicalRecordRepository, apiService ApiService, diagnosticService DiagnosticService, patientService PatientService, userService UserService, taskQueue *asynq.Client,
-	redisClient *redis.Client, processStatusService ProcessStatusService, patientRepo repository.PatientRepository) TblMedicalRecordService {
+	redisClient *redis.Client, processStatusService ProcessStatusService, patientRepo repository.PatientRepository, fileStore FileStoreService, encryption RecordEncryptionService) TblMedicalRecordService {
 	return &tblMedicalRecordServiceImpl{tblMedicalRecordRepo: repo, apiService: apiService, diagnosticService: diagnosticService, patientService: patientService, userService: userService, taskQueue: taskQueue,
-		redisClient: redisClient, processStatusService: processStatusService, patientRepo: patientRepo}
+		redisClient: redisClient, processStatusService: processStatusService, patientRepo: patientRepo, fileStore: fileStore, encryption: encryption}
 }
 
 func (s *tblMedicalRecordServiceImpl) GetUserMedicalRecords(userID uint64) ([]models.TblMedicalRecord, error) {
-	return s.tblMedicalRecordRepo.GetMedicalRecordsByUserID(userID, nil)
+	records, err := s.tblMedicalRecordRepo.GetMedicalRecordsByUserID(userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].FileData == nil {
+			continue
+		}
+		fileData, err := s.encryption.DecryptRecordData(&records[i], records[i].FileData)
+		if err != nil {
+			return nil, err
+		}
+		records[i].FileData = fileData
+	}
+	return records, nil
 }
 
-func (s *tblMedicalRecordServiceImpl) GetAllMedicalRecord(patientId uint64, limit int, offset int) ([]map[string]interface{}, int64, error) {
+// GetAllMedicalRecord lists the records of patientId with download links signed for
+// reqUserID, the user who will follow them.
+func (s *tblMedicalRecordServiceImpl) GetAllMedicalRecord(patientId, reqUserID uint64, limit int, offset int) ([]map[string]interface{}, int64, error) {
 	data, totalRecords, err := s.tblMedicalRecordRepo.GetAllMedicalRecord(patientId, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
 	processed := s.tblMedicalRecordRepo.ProcessMedicalRecordResponse(data)
+	for _, item := range processed {
+		if recordID, ok := item["record_id"].(uint64); ok {
+			item["record_url"] = s.BuildRecordDownloadURL(recordID, reqUserID)
+		}
+	}
 	return processed, totalRecords, nil
 }
 
@@ -99,24 +140,43 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 		return nil, err
 	}
 
-	fileName := utils.SanitizeFileName(header.Filename)
-	uniqueSuffix := time.Now().Format("20060102150405") + "-" + uuid.New().String()[:8]
-	ext := filepath.Ext(fileName)
-	originalName := strings.TrimSuffix(fileName, ext)
-	safeFileName := fmt.Sprintf("%s_%s%s", originalName, uniqueSuffix, ext)
-	destinationPath := filepath.Join("uploads", safeFileName)
-	if err := os.MkdirAll("uploads", os.ModePerm); err != nil {
+	var fileBuf bytes.Buffer
+	tee := io.TeeReader(file, &fileBuf)
+	if _, err := io.ReadAll(tee); err != nil {
 		return nil, err
 	}
-	if err := utils.SaveFile(header, destinationPath); err != nil {
-		log.Println("save file error : ", err)
+	record, err := s.saveUploadedRecord(processID, nil, userId, uploadingPerson, header.Filename, int64(header.Size), header.Header.Get("Content-Type"), fileBuf.Bytes(),
+		uploadSource, description, recordCategory, recordSubCategory, attachments, tags, constant.PriorityHigh)
+	if err != nil {
+		s.processStatusService.LogStepAndFail(processID, step, constant.Failure, "Failed to save record", err.Error(), nil, nil, nil)
 		return nil, err
 	}
+	if record.IsDuplicate {
+		s.processStatusService.UpdateProcessStatusInRedis(processID, constant.Success, string(constant.DuplicateRecordLinked), string(constant.CheckContentDuplication), true, nil)
+	}
+	return record, nil
+}
 
-	var fileBuf bytes.Buffer
-	tee := io.TeeReader(file, &fileBuf)
-	if _, err := io.ReadAll(tee); err != nil {
-		return nil, err
+// saveUploadedRecord stores one uploaded file as a medical record under processID, creating
+// its diagnostic report, attachments and tags and queueing digitization. attachmentId keys
+// the per-file step logs when the upload is part of a batch.
+func (s *tblMedicalRecordServiceImpl) saveUploadedRecord(processID uuid.UUID, attachmentId *string, userId, uploadingPerson uint64, uploadedName string, size int64, contentType string, data []byte,
+	uploadSource, description, recordCategory, recordSubCategory string, attachments []*multipart.FileHeader, tags, priority string) (*models.TblMedicalRecord, error) {
+	step := string(constant.ProcessSaveRecords)
+	msg := string(constant.SaveRecord)
+	errorMsg := ""
+
+	fileName := utils.SanitizeFileName(uploadedName)
+	uniqueSuffix := time.Now().Format("20060102150405") + "-" + uuid.New().String()[:8]
+	ext := filepath.Ext(fileName)
+	originalName := strings.TrimSuffix(fileName, ext)
+	safeFileName := fmt.Sprintf("%s_%s%s", originalName, uniqueSuffix, ext)
+
+	duplicate, err := s.tblMedicalRecordRepo.GetRecordByContentHash(userId, utils.ComputeContentHash(data))
+	if err != nil {
+		log.Println("GetRecordByContentHash ERROR : ", err)
+	} else if duplicate != nil {
+		return s.linkDuplicateUpload(processID, attachmentId, userId, uploadingPerson, duplicate, uploadSource, description, recordCategory, recordSubCategory, attachments, tags)
 	}
 	Status := constant.StatusQueued
 	IsLabReport := true
@@ -126,14 +186,11 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 	}
 	var record *models.TblMedicalRecord
 	var reportInfo *models.PatientDiagnosticReport
-	var recordErr error
 	var reportErr error
 	newRecord := models.TblMedicalRecord{
-		RecordName:        header.Filename,
-		RecordSize:        int64(header.Size),
-		FileType:          header.Header.Get("Content-Type"),
-		RecordUrl:         fmt.Sprintf("%s/uploads/%s", os.Getenv("SHORT_URL_BASE"), safeFileName),
-		UploadDestination: "LocalServer",
+		RecordName:        uploadedName,
+		RecordSize:        size,
+		FileType:          contentType,
 		UploadSource:      uploadSource,
 		Description:       description,
 		RecordCategory:    recordCategory,
@@ -142,6 +199,27 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 		UploadedBy:        uploadingPerson,
 		SourceAccount:     fmt.Sprint(uploadSource),
 		Status:            Status,
+		OwnerId:           &userId,
+	}
+	if err := s.fileStore.SaveRecordFile(context.Background(), &newRecord, safeFileName, data); err != nil {
+		log.Println("save file error : ", err)
+		return nil, err
+	}
+	// linkConcurrentDuplicate handles losing the insert to a concurrent upload of the same
+	// file: the stored copy and the report are dropped and the winner is linked instead.
+	linkConcurrentDuplicate := func(tx *gorm.DB) (*models.TblMedicalRecord, error) {
+		tx.Rollback()
+		if err := s.fileStore.DeleteFile(context.Background(), newRecord.UploadDestination, newRecord.RecordUrl); err != nil {
+			log.Println("@saveUploadedRecord->DeleteFile:", err)
+		}
+		duplicate, err := s.tblMedicalRecordRepo.GetRecordByContentHash(userId, newRecord.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate == nil {
+			return nil, fmt.Errorf("record with content hash %s not found after conflict", newRecord.ContentHash)
+		}
+		return s.linkDuplicateUpload(processID, attachmentId, userId, uploadingPerson, duplicate, uploadSource, description, recordCategory, recordSubCategory, attachments, tags)
 	}
 	tx := database.DB.Begin()
 	defer func() {
@@ -184,14 +262,16 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 		// 	Status:            Status,
 		// }
 
-		record, recordErr = s.tblMedicalRecordRepo.CreateTblMedicalRecord(tx, &newRecord)
+		created, recordErr := s.tblMedicalRecordRepo.CreateOwnedTblMedicalRecord(tx, &newRecord)
 		if recordErr != nil {
-			msg = "Failed to save record"
-			log.Println("CreateTblMedicalRecord ERROR : ", recordErr)
-			s.processStatusService.LogStepAndFail(processID, step, constant.Failure, msg, recordErr.Error(), nil, nil, nil)
+			log.Println("CreateOwnedTblMedicalRecord ERROR : ", recordErr)
 			tx.Rollback()
-			return nil, err
+			return nil, recordErr
 		}
+		if !created {
+			return linkConcurrentDuplicate(tx)
+		}
+		record = &newRecord
 		var mappings []models.TblMedicalRecordUserMapping
 		mappings = append(mappings, models.TblMedicalRecordUserMapping{
 			UserID:   userId,
@@ -238,14 +318,16 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 		}
 	} else {
 		log.Println("record catgory inside else ", recordCategory)
-		record, recordErr = s.tblMedicalRecordRepo.CreateTblMedicalRecord(tx, &newRecord)
+		created, recordErr := s.tblMedicalRecordRepo.CreateOwnedTblMedicalRecord(tx, &newRecord)
 		if recordErr != nil {
-			msg = "Failed to save record"
-			log.Println("CreateTblMedicalRecord ERROR : ", recordErr)
-			s.processStatusService.LogStepAndFail(processID, step, constant.Failure, msg, recordErr.Error(), nil, nil, nil)
+			log.Println("CreateOwnedTblMedicalRecord ERROR : ", recordErr)
 			tx.Rollback()
-			return nil, err
+			return nil, recordErr
 		}
+		if !created {
+			return linkConcurrentDuplicate(tx)
+		}
+		record = &newRecord
 		var mappings []models.TblMedicalRecordUserMapping
 		mappings = append(mappings, models.TblMedicalRecordUserMapping{
 			UserID:   userId,
@@ -262,6 +344,9 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 		}
 
 	}
+	if err := s.EnqueueRecordPreviewTask(record.RecordId); err != nil {
+		log.Printf("Preview task failed: %v", err)
+	}
 	if record.RecordCategory == string(constant.TESTREPORT) || record.RecordCategory == string(constant.MEDICATION) {
 		userInfo, err := s.userService.GetSystemUserInfoByUserID(userId)
 		if err != nil {
@@ -272,17 +357,213 @@ func (s *tblMedicalRecordServiceImpl) CreateTblMedicalRecord(userId uint64, auth
 			record.PatientDiagnosticReportId = &reportInfo.PatientDiagnosticReportId
 		}
 		log.Println("data to create queue")
-		if err := s.CreateDigitizationTask(record, userInfo, userId, &fileBuf, fileName, processID, nil); err != nil {
+		record.DigitizationPriority = priority
+		if err := s.CreateDigitizationTask(record, userInfo, userId, bytes.NewBuffer(data), fileName, processID, attachmentId); err != nil {
 			log.Printf("Digitization task failed: %v", err)
-			s.processStatusService.LogStepAndFail(processID, step, constant.Failure, msg, err.Error(), nil, nil, nil)
+			s.processStatusService.LogStep(processID, step, constant.Failure, msg, err.Error(), &record.RecordId, nil, nil, nil, nil, attachmentId)
+		} else {
+			s.processStatusService.LogStep(processID, step, constant.Success, "Record saved, digitization is in progress", errorMsg, &record.RecordId, nil, nil, nil, nil, attachmentId)
 		}
-		s.processStatusService.LogStep(processID, step, constant.Success, "Record saved, digitization is in progress", errorMsg, nil, nil, nil, nil, nil, nil)
 	} else {
-		s.processStatusService.LogStep(processID, step, constant.Success, "Record saved successfully", errorMsg, nil, nil, nil, nil, nil, nil)
+		s.processStatusService.LogStep(processID, step, constant.Success, "Record saved successfully", errorMsg, &record.RecordId, nil, nil, nil, nil, attachmentId)
 	}
 	return record, nil
 }
 
+// linkDuplicateUpload handles a manual upload whose file already exists for the patient:
+// no new record is created or digitized, attachments and tags go to the existing report.
+func (s *tblMedicalRecordServiceImpl) linkDuplicateUpload(processID uuid.UUID, attachmentId *string, userId, uploadingPerson uint64, duplicate *models.TblMedicalRecord,
+	uploadSource, description, recordCategory, recordSubCategory string, attachments []*multipart.FileHeader, tags string) (*models.TblMedicalRecord, error) {
+	step := string(constant.CheckContentDuplication)
+	msg := fmt.Sprintf("%s (record id %d)", constant.DuplicateRecordLinked, duplicate.RecordId)
+	if duplicate.PatientDiagnosticReportId != nil && (len(attachments) > 0 || tags != "") {
+		tx := database.DB.Begin()
+		if len(attachments) > 0 {
+			if err := s.SaveAttachments(tx, userId, uploadingPerson, uploadSource, description, recordCategory, recordSubCategory, attachments, *duplicate.PatientDiagnosticReportId); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if tags != "" {
+			if _, err := s.diagnosticService.SaveUserTag(tx, userId, tags, &duplicate.RecordId, duplicate.PatientDiagnosticReportId); err != nil {
+				log.Println("Error while creating SaveUserTag:", err)
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+	duplicate.IsDuplicate = true
+	s.processStatusService.LogStep(processID, step, constant.Success, msg, "", &duplicate.RecordId, nil, nil, nil, nil, attachmentId)
+	return duplicate, nil
+}
+
+// zipImportContentTypes are the document types imported from an archive, by extension.
+var zipImportContentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// ImportMedicalRecordsZip checks an uploaded ZIP against the configured limits and imports
+// each file in it as its own medical record in the background. The batch is tracked as one
+// process with a step log per archive entry; the process id is returned right away.
+func (s *tblMedicalRecordServiceImpl) ImportMedicalRecordsZip(userId uint64, authUserId string, file multipart.File, header *multipart.FileHeader,
+	uploadSource, description, recordCategory, recordSubCategory, tags string) (uuid.UUID, error) {
+	uploadingPerson, err := s.userService.GetUserIdBySUB(authUserId)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	limits := config.PropConfig.BulkImport
+	if header.Size > int64(limits.MaxTotalSizeMB)<<20 {
+		return uuid.Nil, fmt.Errorf("archive is larger than %d MB", limits.MaxTotalSizeMB)
+	}
+	// The multipart temp file is removed when the request ends, keep our own copy.
+	archive, err := os.CreateTemp("", "record_import_*.zip")
+	if err != nil {
+		return uuid.Nil, err
+	}
+	cleanup := func() {
+		archive.Close()
+		os.Remove(archive.Name())
+	}
+	if _, err := io.Copy(archive, file); err != nil {
+		cleanup()
+		return uuid.Nil, err
+	}
+	reader, err := zip.NewReader(archive, header.Size)
+	if err != nil {
+		cleanup()
+		return uuid.Nil, fmt.Errorf("invalid zip archive: %w", err)
+	}
+	entries, err := validateZipEntries(reader.File)
+	if err != nil {
+		cleanup()
+		return uuid.Nil, err
+	}
+	if recordCategory == "" {
+		recordCategory = string(constant.TESTREPORT)
+	}
+	processID, _ := s.processStatusService.StartProcessInRedis(userId, string(constant.BulkRecordImport), strconv.FormatUint(userId, 10),
+		string(constant.MedicalRecordEntity),
+		string(constant.ExtractZipArchive),
+	)
+	go func() {
+		defer cleanup()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Println("Recovered in importZipEntries:", r)
+				log.Println("Stack trace:\n" + string(debug.Stack()))
+				s.processStatusService.LogStepAndFail(processID, string(constant.ExtractZipArchive), constant.Failure, string(constant.ZipImportFailed), fmt.Sprint(r), nil, nil, nil)
+			}
+		}()
+		s.importZipEntries(processID, entries, userId, uploadingPerson, uploadSource, description, recordCategory, recordSubCategory, tags)
+	}()
+	return processID, nil
+}
+
+// validateZipEntries returns the file entries of an archive, rejecting it when an entry
+// path escapes the archive root (zip slip) or when the entry count, declared total size
+// or any entry's compression ratio is beyond the configured limits (zip bomb). Folders and
+// OS metadata files are left out.
+func validateZipEntries(files []*zip.File) ([]*zip.File, error) {
+	limits := config.PropConfig.BulkImport
+	var entries []*zip.File
+	var totalSize uint64
+	for _, f := range files {
+		name := f.Name
+		if strings.Contains(name, `\`) || !filepath.IsLocal(filepath.FromSlash(name)) {
+			return nil, fmt.Errorf("archive entry %q has an unsafe path", name)
+		}
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > uint64(limits.MaxCompressionRatio) {
+			return nil, fmt.Errorf("archive entry %q has a suspicious compression ratio", name)
+		}
+		totalSize += f.UncompressedSize64
+		entries = append(entries, f)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("archive does not contain any files")
+	}
+	if len(entries) > limits.MaxFiles {
+		return nil, fmt.Errorf("archive contains more than %d files", limits.MaxFiles)
+	}
+	if totalSize > uint64(limits.MaxTotalSizeMB)<<20 {
+		return nil, fmt.Errorf("archive expands to more than %d MB", limits.MaxTotalSizeMB)
+	}
+	return entries, nil
+}
+
+func (s *tblMedicalRecordServiceImpl) importZipEntries(processID uuid.UUID, entries []*zip.File, userId, uploadingPerson uint64,
+	uploadSource, description, recordCategory, recordSubCategory, tags string) {
+	step := string(constant.ExtractZipArchive)
+	total := len(entries)
+	successCount, failedCount := 0, 0
+	for i, entry := range entries {
+		index := i + 1
+		attachmentId := entry.Name
+		s.processStatusService.LogStep(processID, step, constant.Running, fmt.Sprintf("%s (%d/%d)", constant.ExtractZipArchiveMsg, index, total), "", nil, &index, &total, &successCount, &failedCount, &attachmentId)
+		// A panic on one malformed entry fails that entry only.
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("Recovered in importZipEntry:", r)
+					log.Println("Stack trace:\n" + string(debug.Stack()))
+					err = fmt.Errorf("import of %s failed: %v", entry.Name, r)
+				}
+			}()
+			return s.importZipEntry(processID, entry, &attachmentId, userId, uploadingPerson, uploadSource, description, recordCategory, recordSubCategory, tags)
+		}()
+		if err != nil {
+			log.Printf("@importZipEntries %s: %v", entry.Name, err)
+			failedCount++
+			s.processStatusService.LogStep(processID, step, constant.Failure, string(constant.FailedSaveRecords), err.Error(), nil, &index, &total, &successCount, &failedCount, &attachmentId)
+			continue
+		}
+		successCount++
+	}
+	status, msg := constant.Success, string(constant.ZipImportCompleted)
+	if successCount == 0 {
+		status, msg = constant.Failure, string(constant.ZipImportFailed)
+	}
+	msg = fmt.Sprintf("%s: %d imported, %d failed", msg, successCount, failedCount)
+	s.processStatusService.LogStep(processID, step, status, msg, "", nil, nil, &total, &successCount, &failedCount, nil)
+	s.processStatusService.UpdateProcessStatusInRedis(processID, status, msg, step, true, nil)
+}
+
+func (s *tblMedicalRecordServiceImpl) importZipEntry(processID uuid.UUID, entry *zip.File, attachmentId *string, userId, uploadingPerson uint64,
+	uploadSource, description, recordCategory, recordSubCategory, tags string) error {
+	fileName := path.Base(entry.Name)
+	contentType, ok := zipImportContentTypes[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		return ErrUnsupportedFile
+	}
+	maxSize := int64(config.PropConfig.BulkImport.MaxFileSizeMB) << 20
+	if entry.UncompressedSize64 > uint64(maxSize) {
+		return fmt.Errorf("file is larger than %d MB", config.PropConfig.BulkImport.MaxFileSizeMB)
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// Declared sizes can lie, never read past the limit.
+	data, err := io.ReadAll(io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxSize {
+		return fmt.Errorf("file is larger than %d MB", config.PropConfig.BulkImport.MaxFileSizeMB)
+	}
+	// Zip archives hold past records, they are digitized as backfill.
+	_, err = s.saveUploadedRecord(processID, attachmentId, userId, uploadingPerson, fileName, int64(len(data)), contentType, data,
+		uploadSource, description, recordCategory, recordSubCategory, nil, tags, constant.PriorityLow)
+	return err
+}
+
 func (s *tblMedicalRecordServiceImpl) SaveAttachments(tx *gorm.DB,
 	userId uint64,
 	uploadingPerson uint64,
@@ -297,13 +578,13 @@ func (s *tblMedicalRecordServiceImpl) SaveAttachments(tx *gorm.DB,
 		attExt := filepath.Ext(attFileName)
 		attOriginalName := strings.TrimSuffix(attFileName, attExt)
 		attSafeFileName := fmt.Sprintf("%s_%s%s", attOriginalName, attUniqueSuffix, attExt)
-		attDestinationPath := filepath.Join("uploads", attSafeFileName)
 
-		if err := os.MkdirAll("uploads", os.ModePerm); err != nil {
+		attFile, err := att.Open()
+		if err != nil {
 			return err
 		}
-		if err := utils.SaveFile(att, attDestinationPath); err != nil {
-			log.Println("SaveFile (attachment) ERROR:", err)
+		attData, err := utils.ReadFileBytes(attFile)
+		if err != nil {
 			return err
 		}
 
@@ -312,8 +593,6 @@ func (s *tblMedicalRecordServiceImpl) SaveAttachments(tx *gorm.DB,
 			RecordName:        att.Filename,
 			RecordSize:        int64(att.Size),
 			FileType:          att.Header.Get("Content-Type"),
-			RecordUrl:         fmt.Sprintf("%s/uploads/%s", os.Getenv("SHORT_URL_BASE"), attSafeFileName),
-			UploadDestination: "LocalServer",
 			UploadSource:      uploadSource,
 			Description:       description,
 			RecordCategory:    string(constant.SUPPORTINGDOC),
@@ -323,6 +602,10 @@ func (s *tblMedicalRecordServiceImpl) SaveAttachments(tx *gorm.DB,
 			SourceAccount:     fmt.Sprint(uploadSource),
 			Status:            constant.StatusSuccess,
 		}
+		if err := s.fileStore.SaveRecordFile(context.Background(), &attRecord, attSafeFileName, attData); err != nil {
+			log.Println("SaveFile (attachment) ERROR:", err)
+			return err
+		}
 
 		savedAttRecord, err := s.tblMedicalRecordRepo.CreateTblMedicalRecord(tx, &attRecord)
 		if err != nil {
@@ -348,6 +631,9 @@ func (s *tblMedicalRecordServiceImpl) SaveAttachments(tx *gorm.DB,
 		if err := s.diagnosticService.SavePatientReportAttachmentMapping(tx, &reportAttachment); err != nil {
 			log.Println("Error while creating SavePatientReportAttachmentMapping:", err)
 		}
+		if err := s.EnqueueRecordPreviewTask(savedAttRecord.RecordId); err != nil {
+			log.Printf("Preview task failed for attachment %d: %v", savedAttRecord.RecordId, err)
+		}
 	}
 	return nil
 }
@@ -383,10 +669,27 @@ func (s *tblMedicalRecordServiceImpl) CreateDigitizationTask(record *models.TblM
 		FilePath:                  tempPath,
 		Category:                  record.RecordCategory,
 		RecordURL:                 record.RecordUrl,
+		UploadDestination:         record.UploadDestination,
 		FileName:                  filename,
 		ProcessID:                 processID,
 		AttachmentId:              attachmentId,
 		PatientDiagnosticReportId: record.PatientDiagnosticReportId,
+		Priority:                  record.DigitizationPriority,
+	}
+	if payload.Priority == "" {
+		payload.Priority = constant.PriorityHigh
+	}
+	if record.IsPasswordProtected {
+		// The payload only carries the decrypted temp file. A worker on another host reads the
+		// record from the file store instead and needs the password kept on the record.
+		payload.IsPasswordProtected = &record.IsPasswordProtected
+		sealed, err := s.encryption.SealRecordSecret(record, record.PDFPassword)
+		if err == nil {
+			err = s.tblMedicalRecordRepo.SetRecordPDFPassword(record.RecordId, sealed)
+		}
+		if err != nil {
+			log.Printf("PDF password of record %d not kept, it can only be digitized from the temp file: %v", record.RecordId, err)
+		}
 	}
 
 	payloadBytes, err := json.Marshal(payload)
@@ -396,7 +699,7 @@ func (s *tblMedicalRecordServiceImpl) CreateDigitizationTask(record *models.TblM
 	}
 
 	task := asynq.NewTask("digitize:record", payloadBytes)
-	if _, err := s.taskQueue.Enqueue(task, asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention)), asynq.ProcessIn(time.Duration(config.PropConfig.TaskQueue.Delay))); err != nil {
+	if _, err := s.taskQueue.Enqueue(task, asynq.Queue(DigitizationQueue(payload.Priority)), asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention)), asynq.ProcessIn(time.Duration(config.PropConfig.TaskQueue.Delay))); err != nil {
 		log.Printf("Failed to enqueue digitization task for record %d: %v", record.RecordId, err)
 		return err
 	}
@@ -406,6 +709,19 @@ func (s *tblMedicalRecordServiceImpl) CreateDigitizationTask(record *models.TblM
 	return nil
 }
 
+// EnqueueRecordPreviewTask queues thumbnail and page count generation for a stored record.
+// The task is delayed like digitization so records saved inside a transaction are committed
+// before the worker loads them.
+func (s *tblMedicalRecordServiceImpl) EnqueueRecordPreviewTask(recordID uint64) error {
+	payloadBytes, err := json.Marshal(models.RecordPreviewPayload{RecordID: recordID})
+	if err != nil {
+		return err
+	}
+	task := asynq.NewTask("preview:record", payloadBytes)
+	_, err = s.taskQueue.Enqueue(task, asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention)), asynq.ProcessIn(time.Duration(config.PropConfig.TaskQueue.Delay)))
+	return err
+}
+
 // Global map to store responses for doc type checks
 // var DocTypeResponses = struct {
 // 	sync.Mutex
@@ -541,18 +857,49 @@ func MatchPatientNameWithRelative(relatives []models.PatientRelative, patientNam
 
 func (s *tblMedicalRecordServiceImpl) SaveMedicalRecords(records []*models.TblMedicalRecord, userId uint64) error {
 	var uniqueRecords []*models.TblMedicalRecord
+	firstInBatch := map[string]*models.TblMedicalRecord{}
+	var batchDuplicates []*models.TblMedicalRecord
 	for _, record := range records {
 		exists, err := s.tblMedicalRecordRepo.ExistsRecordForUser(userId, record.UploadSource, record.RecordUrl)
 		if err != nil {
 			return err
 		}
-		if !exists {
-			uniqueRecords = append(uniqueRecords, record)
+		if exists {
+			continue
+		}
+		if record.ContentHash == "" && record.FileData != nil {
+			record.ContentHash = utils.ComputeContentHash(record.FileData)
 		}
+		if record.ContentHash != "" {
+			if _, seen := firstInBatch[record.ContentHash]; seen {
+				batchDuplicates = append(batchDuplicates, record)
+				continue
+			}
+			duplicate, err := s.tblMedicalRecordRepo.GetRecordByContentHash(userId, record.ContentHash)
+			if err != nil {
+				return err
+			}
+			if duplicate != nil {
+				s.linkDuplicateRecord(record, duplicate)
+				continue
+			}
+			firstInBatch[record.ContentHash] = record
+		}
+		uniqueRecords = append(uniqueRecords, record)
 	}
 	if len(uniqueRecords) == 0 {
 		return nil
 	}
+	for _, record := range uniqueRecords {
+		if record.FileData == nil {
+			continue
+		}
+		fileData, err := s.encryption.EncryptRecordData(record, record.FileData)
+		if err != nil {
+			return err
+		}
+		record.FileData = fileData
+	}
 
 	tx := database.DB.Begin()
 	defer func() {
@@ -560,13 +907,22 @@ func (s *tblMedicalRecordServiceImpl) SaveMedicalRecords(records []*models.TblMe
 			tx.Rollback()
 		}
 	}()
-	err := s.tblMedicalRecordRepo.CreateMultipleTblMedicalRecords(tx, uniqueRecords)
-	if err != nil {
-		tx.Rollback()
-		return err
+	var savedRecords, concurrentDuplicates []*models.TblMedicalRecord
+	for _, record := range uniqueRecords {
+		record.OwnerId = &userId
+		created, err := s.tblMedicalRecordRepo.CreateOwnedTblMedicalRecord(tx, record)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if !created {
+			concurrentDuplicates = append(concurrentDuplicates, record)
+			continue
+		}
+		savedRecords = append(savedRecords, record)
 	}
 	var mappings []models.TblMedicalRecordUserMapping
-	for _, record := range uniqueRecords {
+	for _, record := range savedRecords {
 		mappings = append(mappings, models.TblMedicalRecordUserMapping{
 			UserID:   userId,
 			RecordID: record.RecordId,
@@ -581,10 +937,51 @@ func (s *tblMedicalRecordServiceImpl) SaveMedicalRecords(records []*models.TblMe
 	if err := tx.Commit().Error; err != nil {
 		return err
 	}
+	for _, record := range savedRecords {
+		if err := s.EnqueueRecordPreviewTask(record.RecordId); err != nil {
+			log.Printf("Preview task failed for record %d: %v", record.RecordId, err)
+		}
+	}
+	for _, record := range concurrentDuplicates {
+		duplicate, err := s.tblMedicalRecordRepo.GetRecordByContentHash(userId, record.ContentHash)
+		if err != nil {
+			return err
+		}
+		if duplicate == nil {
+			return fmt.Errorf("record with content hash %s not found after conflict", record.ContentHash)
+		}
+		s.linkDuplicateRecord(record, duplicate)
+	}
+	for _, record := range batchDuplicates {
+		s.linkDuplicateRecord(record, firstInBatch[record.ContentHash])
+	}
 
 	return nil
 }
 
+// linkDuplicateRecord points a synced record at the already stored copy of the same file
+// and drops the blob that was just written for it. The source document is noted on the
+// stored copy so the next sync does not download it again.
+func (s *tblMedicalRecordServiceImpl) linkDuplicateRecord(record, existing *models.TblMedicalRecord) {
+	if record.SourceDocumentId != "" {
+		if err := s.tblMedicalRecordRepo.AddRecordSourceDocument(existing.RecordId, record.SourceDocumentId); err != nil {
+			log.Println("@linkDuplicateRecord->AddRecordSourceDocument:", err)
+		}
+	}
+	if record.RecordUrl != "" && record.RecordUrl != existing.RecordUrl {
+		if err := s.fileStore.DeleteFile(context.Background(), record.UploadDestination, record.RecordUrl); err != nil {
+			log.Println("@linkDuplicateRecord->DeleteFile:", err)
+		}
+	}
+	record.RecordId = existing.RecordId
+	record.RecordUrl = existing.RecordUrl
+	record.UploadDestination = existing.UploadDestination
+	record.DataKey = existing.DataKey
+	record.KeyVersion = existing.KeyVersion
+	record.PatientDiagnosticReportId = existing.PatientDiagnosticReportId
+	record.IsDuplicate = true
+}
+
 // func (s *tblMedicalRecordServiceImpl) SaveMedicalRecords(records []*models.TblMedicalRecord, userId uint64) error {
 // 	var uniqueRecords []*models.TblMedicalRecord
 // 	for _, record := range records {
@@ -679,7 +1076,20 @@ func (s *tblMedicalRecordServiceImpl) UpdateTblMedicalRecord(userId uint64, data
 			}
 		}
 	}
-	return s.tblMedicalRecordRepo.UpdateTblMedicalRecord(data)
+	existing, err := s.tblMedicalRecordRepo.GetMedicalRecordByRecordId(data.RecordId)
+	if err != nil {
+		return nil, err
+	}
+	if data.FileData != nil {
+		fileData, err := s.encryption.EncryptRecordData(existing, data.FileData)
+		if err != nil {
+			return nil, err
+		}
+		data.FileData = fileData
+		data.DataKey = existing.DataKey
+		data.KeyVersion = existing.KeyVersion
+	}
+	return s.tblMedicalRecordRepo.UpdateTblMedicalRecordWithVersion(data, userId)
 
 }
 
@@ -687,8 +1097,133 @@ func (s *tblMedicalRecordServiceImpl) GetMedicalRecordByRecordId(RecordId uint64
 	return s.tblMedicalRecordRepo.GetMedicalRecordByRecordId(RecordId)
 }
 
-func (s *tblMedicalRecordServiceImpl) DeleteTblMedicalRecord(id int, updatedBy string) error {
-	return s.tblMedicalRecordRepo.DeleteTblMedicalRecordWithMappings(id, updatedBy)
+// DeleteTblMedicalRecord archives the record so it can be restored until the retention
+// window passes and the record is purged.
+func (s *tblMedicalRecordServiceImpl) DeleteTblMedicalRecord(userId uint64, recordId uint64) error {
+	record, err := s.getAccessibleRecord(userId, recordId)
+	if err != nil {
+		return err
+	}
+	tx := database.DB.Begin()
+	if err := s.tblMedicalRecordRepo.CreateRecordVersionSnapshot(tx, record, "deleted", userId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := s.diagnosticService.ArchivePatientDiagnosticReport(tx, recordId, 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *tblMedicalRecordServiceImpl) getAccessibleRecord(userId uint64, recordId uint64) (*models.TblMedicalRecord, error) {
+	isAccessible, err := s.IsRecordAccessibleToUser(userId, recordId)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccessible {
+		return nil, errors.New("you do not have access to this record")
+	}
+	return s.tblMedicalRecordRepo.GetMedicalRecordByRecordId(recordId)
+}
+
+func (s *tblMedicalRecordServiceImpl) GetRecordVersions(userId uint64, recordId uint64) ([]models.TblMedicalRecordVersion, error) {
+	if _, err := s.getAccessibleRecord(userId, recordId); err != nil {
+		return nil, err
+	}
+	return s.tblMedicalRecordRepo.GetRecordVersions(recordId)
+}
+
+// RestoreMedicalRecord brings back a deleted record when versionId is 0, otherwise rolls
+// the record back to the given version. The state being replaced is kept as a version too.
+func (s *tblMedicalRecordServiceImpl) RestoreMedicalRecord(userId uint64, recordId uint64, versionId uint64) (*models.TblMedicalRecord, error) {
+	record, err := s.getAccessibleRecord(userId, recordId)
+	if err != nil {
+		return nil, err
+	}
+	var version *models.TblMedicalRecordVersion
+	if versionId != 0 {
+		version, err = s.tblMedicalRecordRepo.GetRecordVersion(recordId, versionId)
+		if err != nil {
+			return nil, err
+		}
+		if len(version.FileData) == 0 && len(record.FileData) > 0 {
+			// Versions taken before file_data was snapshotted would pair the current content
+			// with the data key of the version.
+			return nil, errors.New("this version does not hold the record content and cannot be restored")
+		}
+	} else if record.IsDeleted == 0 {
+		return nil, errors.New("record is not deleted")
+	}
+	tx := database.DB.Begin()
+	if err := s.tblMedicalRecordRepo.CreateRecordVersionSnapshot(tx, record, "restored", userId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if version != nil {
+		if err := s.tblMedicalRecordRepo.RestoreRecordFromVersion(tx, version); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if record.IsDeleted == 1 && (version == nil || version.IsDeleted == 0) {
+		if err := s.diagnosticService.ArchivePatientDiagnosticReport(tx, recordId, 0); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return s.tblMedicalRecordRepo.GetMedicalRecordByRecordId(recordId)
+}
+
+// PurgeMedicalRecord permanently deletes a record and its file once it has been in the
+// deleted state for longer than the configured retention window.
+func (s *tblMedicalRecordServiceImpl) PurgeMedicalRecord(userId uint64, recordId uint64) error {
+	record, err := s.getAccessibleRecord(userId, recordId)
+	if err != nil {
+		return err
+	}
+	if record.IsDeleted != 1 || record.DeletedAt == nil {
+		return errors.New("only deleted records can be purged")
+	}
+	purgeableAt := record.DeletedAt.AddDate(0, 0, config.PropConfig.RecordRetention.PurgeAfterDays)
+	if time.Now().Before(purgeableAt) {
+		return fmt.Errorf("record can be purged after %s", utils.FormatDateTime(&purgeableAt))
+	}
+	return s.purgeRecord(record)
+}
+
+func (s *tblMedicalRecordServiceImpl) PurgeExpiredRecords() (int, error) {
+	deletedBefore := time.Now().AddDate(0, 0, -config.PropConfig.RecordRetention.PurgeAfterDays)
+	records, err := s.tblMedicalRecordRepo.GetPurgeableRecords(deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for i := range records {
+		if err := s.purgeRecord(&records[i]); err != nil {
+			log.Printf("@PurgeExpiredRecords record %d: %v", records[i].RecordId, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (s *tblMedicalRecordServiceImpl) purgeRecord(record *models.TblMedicalRecord) error {
+	if record.ThumbnailUrl != "" {
+		if err := s.fileStore.DeleteFile(context.Background(), DestinationFromURL(record.ThumbnailUrl), record.ThumbnailUrl); err != nil {
+			return err
+		}
+	}
+	if record.UploadDestination != constant.UploadDestinationDigiLocker && record.RecordUrl != "" {
+		if err := s.fileStore.DeleteFile(context.Background(), record.UploadDestination, record.RecordUrl); err != nil {
+			return err
+		}
+	}
+	return s.tblMedicalRecordRepo.PurgeMedicalRecord(record.RecordId)
 }
 
 func (s *tblMedicalRecordServiceImpl) IsRecordAccessibleToUser(userID uint64, recordID uint64) (bool, error) {
@@ -720,16 +1255,12 @@ func (s *tblMedicalRecordServiceImpl) ReadUserDigiLockerFile(userId uint64, digi
 	return digiResp, nil
 }
 
-func (s *tblMedicalRecordServiceImpl) ReadUserLocalServerFile(localFileUrl string) (*models.LocalServerFile, error) {
-	log.Println("Read Local")
+func (s *tblMedicalRecordServiceImpl) ReadUserLocalServerFile(record *models.TblMedicalRecord) (*models.LocalServerFile, error) {
 	var res models.LocalServerFile
-	urlParts := strings.Split(localFileUrl, "/uploads/")
-	if len(urlParts) < 2 {
+	if record.RecordUrl == "" {
 		return nil, errors.New("invalid file url")
 	}
-	filename := urlParts[1]
-	localPath := fmt.Sprintf("uploads/%s", filename)
-	fileBytes, err := os.ReadFile(localPath)
+	fileBytes, err := s.fileStore.ReadRecordFile(context.Background(), record)
 	if err != nil {
 		return nil, err
 	}
@@ -738,6 +1269,188 @@ func (s *tblMedicalRecordServiceImpl) ReadUserLocalServerFile(localFileUrl strin
 	return &res, nil
 }
 
+func (s *tblMedicalRecordServiceImpl) ReadRecordFile(record *models.TblMedicalRecord) ([]byte, error) {
+	return s.fileStore.ReadRecordFile(context.Background(), record)
+}
+
+// BuildRecordDownloadURL returns a short lived link to the record file, signed for the
+// user the record was listed for. Links are served by the public download route.
+func (s *tblMedicalRecordServiceImpl) BuildRecordDownloadURL(recordID, userID uint64) string {
+	return RecordDownloadURL(recordID, userID)
+}
+
+// RecordDownloadURL signs a download link for userID, the user who requested the listing,
+// so the link stops working once that user loses access to the record.
+func RecordDownloadURL(recordID, userID uint64) string {
+	return signedRecordURL(constant.RecordDownload, recordID, userID)
+}
+
+func signedRecordURL(route string, recordID, userID uint64) string {
+	expiresAt := time.Now().Add(time.Duration(config.PropConfig.FileStore.DownloadURLExpiry) * time.Second).Unix()
+	query := url.Values{}
+	query.Set("uid", strconv.FormatUint(userID, 10))
+	query.Set("exp", strconv.FormatInt(expiresAt, 10))
+	query.Set("sig", utils.GenerateRecordDownloadSignature(recordID, userID, expiresAt, config.PropConfig.FileStore.DownloadSecret))
+	downloadPath := strings.Replace(route, ":record_id", strconv.FormatUint(recordID, 10), 1)
+	return fmt.Sprintf("%s%s/public%s?%s", config.PropConfig.ApiURL.ShortBaseURL, os.Getenv("ApiVersion"), downloadPath, query.Encode())
+}
+
+// BuildRecordThumbnailURL returns a signed link to the record thumbnail, or an empty string
+// while none has been generated.
+func (s *tblMedicalRecordServiceImpl) BuildRecordThumbnailURL(record *models.TblMedicalRecord, userID uint64) string {
+	if record.ThumbnailUrl == "" {
+		return ""
+	}
+	return signedRecordURL(constant.RecordThumbnail, record.RecordId, userID)
+}
+
+func (s *tblMedicalRecordServiceImpl) ReadSignedMedicalRecord(recordID, userID uint64, expiresAt int64, signature string) (*models.LocalServerFile, string, error) {
+	record, err := s.getSignedRecord(recordID, userID, expiresAt, signature)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.UploadDestination == constant.UploadDestinationDigiLocker {
+		digiFile, err := s.ReadUserDigiLockerFile(userID, record.RecordUrl)
+		if err != nil {
+			return nil, "", err
+		}
+		return &models.LocalServerFile{Data: digiFile.Data, ContentType: digiFile.ContentType}, record.RecordName, nil
+	}
+	localFile, err := s.ReadUserLocalServerFile(record)
+	if err != nil {
+		return nil, "", err
+	}
+	return localFile, record.RecordName, nil
+}
+
+func (s *tblMedicalRecordServiceImpl) ReadSignedRecordThumbnail(recordID, userID uint64, expiresAt int64, signature string) (*models.LocalServerFile, error) {
+	record, err := s.getSignedRecord(recordID, userID, expiresAt, signature)
+	if err != nil {
+		return nil, err
+	}
+	if record.ThumbnailUrl == "" {
+		return nil, errors.New("thumbnail is not available")
+	}
+	data, err := s.fileStore.ReadRecordDerivative(context.Background(), record, record.ThumbnailUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &models.LocalServerFile{Data: data, ContentType: "image/jpeg"}, nil
+}
+
+// SearchMedicalRecords runs a ranked full text search over the records of userID and of the
+// patients that granted it view access, or only patientID's records when given.
+func (s *tblMedicalRecordServiceImpl) SearchMedicalRecords(userID uint64, patientID *uint64, query string, limit, offset int) ([]models.RecordSearchResult, int64, error) {
+	patientIds, err := s.patientService.GetAccessiblePatientIds(userID, constant.PermissionViewHealth)
+	if err != nil {
+		return nil, 0, err
+	}
+	if patientID != nil {
+		if !slices.Contains(patientIds, *patientID) {
+			return nil, 0, errors.New(string(constant.PermissionViewMedicalRecord))
+		}
+		patientIds = []uint64{*patientID}
+	}
+	results, total, err := s.tblMedicalRecordRepo.SearchMedicalRecords(patientIds, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range results {
+		results[i].RecordURL = s.BuildRecordDownloadURL(results[i].RecordID, userID)
+	}
+	return results, total, nil
+}
+
+// getSignedRecord checks a signed record link and that its user can still access the record.
+func (s *tblMedicalRecordServiceImpl) getSignedRecord(recordID, userID uint64, expiresAt int64, signature string) (*models.TblMedicalRecord, error) {
+	if !utils.VerifyRecordDownloadSignature(recordID, userID, expiresAt, signature, config.PropConfig.FileStore.DownloadSecret) {
+		return nil, errors.New("download link is invalid or expired")
+	}
+	isAccessible, err := s.IsRecordAccessibleToUser(userID, recordID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAccessible {
+		return nil, errors.New("you do not have access to view report")
+	}
+	return s.GetMedicalRecordByRecordId(recordID)
+}
+
+// MigrateLegacyRecordUrls converts record urls written while files were served from the
+// public /uploads route into store references. Safe to run more than once.
+func (s *tblMedicalRecordServiceImpl) MigrateLegacyRecordUrls() (int64, error) {
+	return s.tblMedicalRecordRepo.MigrateLegacyLocalRecordUrls(LocalRecordURLPrefix)
+}
+
+// RewrapRecordDataKeys re-wraps the data key of every record and record version still on an
+// older master key version, so the old key can be retired once it is done. It runs in the
+// background and reports progress through the process status log.
+func (s *tblMedicalRecordServiceImpl) RewrapRecordDataKeys(userId uint64) (uuid.UUID, error) {
+	if !s.encryption.Enabled() {
+		return uuid.Nil, errors.New("record encryption is not configured")
+	}
+	step := string(constant.ProcessRewrapDataKeys)
+	processID, _ := s.processStatusService.StartProcessInRedis(userId, string(constant.RecordKeyRewrap), strconv.FormatUint(userId, 10),
+		string(constant.MedicalRecordEntity), step)
+	go func() {
+		currentVersion := s.encryption.CurrentKeyVersion()
+		var lastRecordID uint64
+		successCount, failedCount := 0, 0
+		for {
+			records, err := s.tblMedicalRecordRepo.GetRecordsForKeyRewrap(currentVersion, lastRecordID, 100)
+			if err != nil {
+				s.processStatusService.LogStepAndFail(processID, step, constant.Failure, string(constant.RewrapDataKeysFailed), err.Error(), nil, nil, nil)
+				return
+			}
+			if len(records) == 0 {
+				break
+			}
+			for _, record := range records {
+				lastRecordID = record.RecordId
+				dataKey, keyVersion, err := s.encryption.RewrapDataKey(record.DataKey, record.KeyVersion)
+				if err == nil {
+					err = s.tblMedicalRecordRepo.UpdateRecordDataKey(record.RecordId, dataKey, keyVersion)
+				}
+				if err != nil {
+					log.Printf("@RewrapRecordDataKeys record %d: %v", record.RecordId, err)
+					failedCount++
+					continue
+				}
+				successCount++
+			}
+			s.processStatusService.LogStep(processID, step, constant.Running, string(constant.RewrapDataKeysMsg), "", nil, nil, nil, &successCount, &failedCount, nil)
+		}
+		var lastVersionID uint64
+		for {
+			versions, err := s.tblMedicalRecordRepo.GetRecordVersionsForKeyRewrap(currentVersion, lastVersionID, 100)
+			if err != nil {
+				s.processStatusService.LogStepAndFail(processID, step, constant.Failure, string(constant.RewrapDataKeysFailed), err.Error(), nil, nil, nil)
+				return
+			}
+			if len(versions) == 0 {
+				break
+			}
+			for _, version := range versions {
+				lastVersionID = version.VersionId
+				dataKey, keyVersion, err := s.encryption.RewrapDataKey(version.DataKey, version.KeyVersion)
+				if err == nil {
+					err = s.tblMedicalRecordRepo.UpdateRecordVersionDataKey(version.VersionId, dataKey, keyVersion)
+				}
+				if err != nil {
+					log.Printf("@RewrapRecordDataKeys version %d of record %d: %v", version.VersionId, version.RecordId, err)
+					failedCount++
+					continue
+				}
+				successCount++
+			}
+			s.processStatusService.LogStep(processID, step, constant.Running, string(constant.RewrapDataKeysMsg), "", nil, nil, nil, &successCount, &failedCount, nil)
+		}
+		s.processStatusService.LogStep(processID, step, constant.Success, string(constant.RewrapDataKeysSuccess), "", nil, nil, nil, &successCount, &failedCount, nil)
+		s.processStatusService.UpdateProcessStatusInRedis(processID, constant.Success, string(constant.RewrapDataKeysSuccess), step, true, nil)
+	}()
+	return processID, nil
+}
+
 func (s *tblMedicalRecordServiceImpl) ReadMedicalRecord(ResourceId uint64, userId, reqUserId uint64) (interface{}, error) {
 	isAccessible, err := s.IsRecordAccessibleToUser(reqUserId, ResourceId)
 	if err != nil {
@@ -757,7 +1470,7 @@ func (s *tblMedicalRecordServiceImpl) ReadMedicalRecord(ResourceId uint64, userI
 		HMAC        string `json:"hmac,omitempty"`
 	}
 	switch record.UploadDestination {
-	case "DigiLocker":
+	case constant.UploadDestinationDigiLocker:
 		digiFile, err := s.ReadUserDigiLockerFile(reqUserId, record.RecordUrl)
 		if err != nil {
 			return nil, err
@@ -765,8 +1478,8 @@ func (s *tblMedicalRecordServiceImpl) ReadMedicalRecord(ResourceId uint64, userI
 		response.ContentType = digiFile.ContentType
 		response.Data = digiFile.Data
 		response.HMAC = digiFile.HMAC
-	case "LocalServer":
-		localFile, err := s.ReadUserLocalServerFile(record.RecordUrl)
+	case constant.UploadDestinationLocal, constant.UploadDestinationS3:
+		localFile, err := s.ReadUserLocalServerFile(record)
 		if err != nil {
 			return nil, err
 		}
@@ -897,6 +1610,7 @@ func (s *tblMedicalRecordServiceImpl) ReadMedicalRecord(ResourceId uint64, userI
 
 func (s *tblMedicalRecordServiceImpl) GetPrecription(
 	userID uint64,
+	reqUserID uint64,
 	category string,
 	tag string,
 	limit int,
@@ -934,7 +1648,10 @@ func (s *tblMedicalRecordServiceImpl) GetPrecription(
 				RecordDescription:    rec.Description,
 				UploadSource:         rec.UploadSource,
 				SourceAccount:        rec.SourceAccount,
-				RecordURL:            rec.RecordUrl,
+				RecordURL:            s.BuildRecordDownloadURL(rec.RecordId, reqUserID),
+				ThumbnailURL:         s.BuildRecordThumbnailURL(&rec, reqUserID),
+				PreviewStatus:        rec.PreviewStatus,
+				PageCount:            rec.PageCount,
 				RecordSize:           rec.RecordSize,
 				FileType:             rec.FileType,
 				DigitizeFlag:         rec.DigitizeFlag,
@@ -952,7 +1669,7 @@ func (s *tblMedicalRecordServiceImpl) GetPrecription(
 	return allRecords, total, categoryCount, nil
 }
 
-func (s *tblMedicalRecordServiceImpl) GetMedicalRecords(userID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error) {
+func (s *tblMedicalRecordServiceImpl) GetMedicalRecords(userID, reqUserID uint64, category, tag string, limit, offset, isDeleted int) ([]models.MedicalRecordResponseRes, int64, map[string]int64, error) {
 
 	reportMap, tCount, categoryCount, err := s.tblMedicalRecordRepo.GetReportRecordMapping(userID, category, tag, limit, offset, isDeleted)
 	if err != nil {
@@ -1052,7 +1769,10 @@ func (s *tblMedicalRecordServiceImpl) GetMedicalRecords(userID uint64, category,
 						RecordDescription: rec.Description,
 						UploadSource:      rec.UploadSource,
 						SourceAccount:     rec.SourceAccount,
-						RecordURL:         rec.RecordUrl,
+						RecordURL:         s.BuildRecordDownloadURL(rec.RecordId, reqUserID),
+						ThumbnailURL:      s.BuildRecordThumbnailURL(&rec, reqUserID),
+						PreviewStatus:     rec.PreviewStatus,
+						PageCount:         rec.PageCount,
 						RecordSize:        rec.RecordSize,
 						FileType:          rec.FileType,
 						DigitizeFlag:      rec.DigitizeFlag,
@@ -1072,7 +1792,10 @@ func (s *tblMedicalRecordServiceImpl) GetMedicalRecords(userID uint64, category,
 					RecordDescription:         rec.Description,
 					UploadSource:              rec.UploadSource,
 					SourceAccount:             rec.SourceAccount,
-					RecordURL:                 rec.RecordUrl,
+					RecordURL:                 s.BuildRecordDownloadURL(rec.RecordId, reqUserID),
+					ThumbnailURL:              s.BuildRecordThumbnailURL(&rec, reqUserID),
+					PreviewStatus:             rec.PreviewStatus,
+					PageCount:                 rec.PageCount,
 					RecordSize:                rec.RecordSize,
 					FileType:                  rec.FileType,
 					DigitizeFlag:              rec.DigitizeFlag,
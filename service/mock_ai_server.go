@@ -0,0 +1,223 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/models"
+	"biostat/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Fixture groups of the mock AI server, one directory per ApiService call. Everything the
+// server does not know, such as the notification server behind MakeRESTRequest, falls in the
+// rest group.
+const (
+	mockDigitizeReport       = "digitize_report"
+	mockClassifyDocument     = "classify_document"
+	mockDigitizePrescription = "digitize_prescription"
+	mockDocType              = "doc_type"
+	mockPDFProtection        = "pdf_protection"
+	mockPDFPassword          = "pdf_password"
+	mockReportSummary        = "report_summary"
+	mockHistorySummary       = "history_summary"
+	mockPrescriptionAnalysis = "prescription_analysis"
+	mockPharmacokinetics     = "pharmacokinetics"
+	mockAsk                  = "ask"
+	mockPatientDocInfo       = "patient_doc_info"
+	mockTranscription        = "transcription"
+	mockMailCow              = "mailcow"
+	mockRest                 = "rest"
+)
+
+// mockAIRoutes maps the paths the config URLs are pointed at to their fixture group. Groups
+// with an uploaded file are looked up by the file, the others by the request body.
+var mockAIRoutes = map[string]struct {
+	group     string
+	multipart bool
+}{
+	"/digitize/report":          {mockDigitizeReport, true},
+	"/extract/doc-detail":       {mockClassifyDocument, true},
+	"/digitize/prescription":    {mockDigitizePrescription, true},
+	"/doc-type":                 {mockDocType, true},
+	"/pdf/protection":           {mockPDFProtection, true},
+	"/transcribe":               {mockTranscription, true},
+	"/pdf/password":             {mockPDFPassword, false},
+	"/summary/report":           {mockReportSummary, false},
+	"/summary/history":          {mockHistorySummary, false},
+	"/analyze/prescription":     {mockPrescriptionAnalysis, false},
+	"/analyze/pharmacokinetics": {mockPharmacokinetics, false},
+	"/ask":                      {mockAsk, false},
+	"/patient-doc-info":         {mockPatientDocInfo, false},
+	"/mailcow/add/mailbox":      {mockMailCow, false},
+}
+
+// uploadSuffix is the timestamp and id appended to stored file names, stripped so a fixture
+// can be named after the file as it was uploaded.
+var uploadSuffix = regexp.MustCompile(`_\d{14}-[0-9a-f]{8}(\.[^.]*)?$`)
+
+// MockAIServer stands in for the AI service with fixtures, so uploads can be classified and
+// digitized offline. A fixture is the response body as the AI service would send it, stored
+// as <group>/<key>.json under the fixture dir. The keys tried are the sha256 of the uploaded
+// file (or of the body for JSON calls), the file name, the file name without its upload
+// suffix, and finally default.
+type MockAIServer struct {
+	fixtureDir string
+}
+
+func NewMockAIServer(fixtureDir string) *MockAIServer {
+	if fixtureDir == "" {
+		fixtureDir = filepath.Join("fixtures", "ai")
+	}
+	return &MockAIServer{fixtureDir: fixtureDir}
+}
+
+// StartMockAIServer serves a MockAIServer on AI_MOCK_ADDR and points every AI URL of the
+// config, the health check and the notification server at it. It has to run before the
+// services are built, since they read the URLs once.
+func StartMockAIServer() error {
+	cfg := config.PropConfig
+	addr := cfg.AIMock.Addr
+	if addr == "" {
+		addr = "127.0.0.1:8089"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("mock AI server: %w", err)
+	}
+	base := "http://" + listener.Addr().String()
+	cfg.ApiURL.ReportDigitizationURL = base + "/digitize/report"
+	cfg.ApiURL.ExtractDocDetail = base + "/extract/doc-detail"
+	cfg.ApiURL.PrescriptionDigitizationURL = base + "/digitize/prescription"
+	cfg.ApiURL.DocTypeAPI = base + "/doc-type"
+	cfg.ApiURL.CheckPDFProtectionAPI = base + "/pdf/protection"
+	cfg.ApiURL.PDFPasswordAPI = base + "/pdf/password"
+	cfg.ApiURL.ReportSummaryURL = base + "/summary/report"
+	cfg.ApiURL.SummaryHistoryURL = base + "/summary/history"
+	cfg.ApiURL.PrescriptionURL = base + "/analyze/prescription"
+	cfg.ApiURL.PharmacokineticsURL = base + "/analyze/pharmacokinetics"
+	cfg.ApiURL.AskChatBotURL = base + "/ask"
+	cfg.ApiURL.FetchNameAPI = base + "/patient-doc-info"
+	cfg.ApiURL.SpeechToTextAPI = base + "/transcribe"
+	cfg.ApiURL.MailServerBase = base + "/mailcow"
+	cfg.ApiURL.NotifyServerURL = base + "/notify"
+	cfg.ApiURL.NotificationSendURL = base + "/notify/send"
+	cfg.HealthCheck.URL = base + "/health"
+
+	server := NewMockAIServer(cfg.AIMock.FixtureDir)
+	go func() {
+		if err := http.Serve(listener, server); err != nil {
+			log.Printf("@StartMockAIServer: mock AI server stopped: %v", err)
+		}
+	}()
+	log.Printf("Mock AI server listening on %s with fixtures from %s", base, server.fixtureDir)
+	return nil
+}
+
+func (m *MockAIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		writeMockJSON(w, http.StatusOK, []byte(`{"status":"up"}`))
+		return
+	}
+	route, ok := mockAIRoutes[r.URL.Path]
+	if !ok {
+		route.group = mockRest
+	}
+	keys, body, err := m.fixtureKeys(r, route.multipart)
+	if err != nil {
+		writeMockError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if route.group == mockRest {
+		keys = append(keys, strings.ReplaceAll(strings.Trim(r.URL.Path, "/"), "/", "_"))
+	}
+	keys = append(keys, "default")
+	fixture, err := m.loadFixture(route.group, keys)
+	if errors.Is(err, os.ErrNotExist) && route.group == mockPatientDocInfo {
+		fixture, err = mockPatientDocMatch(body)
+	}
+	if err != nil {
+		log.Printf("@MockAIServer %s: %v", r.URL.Path, err)
+		writeMockError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeMockJSON(w, http.StatusOK, fixture)
+}
+
+// fixtureKeys reads the request and returns the fixture keys it can be found by, along with
+// the body of JSON calls.
+func (m *MockAIServer) fixtureKeys(r *http.Request, multipart bool) ([]string, []byte, error) {
+	if !multipart {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{utils.ComputeContentHash(body)}, body, nil
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing file: %w", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := filepath.Base(header.Filename)
+	keys := []string{utils.ComputeContentHash(data), name}
+	if original := uploadSuffix.ReplaceAllString(name, "$1"); original != name {
+		keys = append(keys, original)
+	}
+	return keys, nil, nil
+}
+
+func (m *MockAIServer) loadFixture(group string, keys []string) ([]byte, error) {
+	for _, key := range keys {
+		if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+			continue
+		}
+		fixture, err := os.ReadFile(filepath.Join(m.fixtureDir, group, key+".json"))
+		if err == nil {
+			return fixture, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no %s fixture for keys %v: %w", group, keys, os.ErrNotExist)
+}
+
+// mockPatientDocMatch answers a patient doc info call without a fixture by assigning the
+// document to the requesting patient, since a fixed answer cannot know the user id.
+func mockPatientDocMatch(body []byte) ([]byte, error) {
+	var req models.PatientDocRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return json.Marshal(models.PatientDocResponse{
+		UserID:           req.UserID,
+		FinalPatientName: req.PatientName,
+		MatchedWith:      "patient",
+		MatchedUserID:    req.UserID,
+		IsFallback:       true,
+	})
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeMockError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	writeMockJSON(w, status, body)
+}
@@ -30,6 +30,9 @@ type NotificationService interface {
 	UpdateReminder(userID uint64, reminder models.UpdateReminderRequest) error
 	SendSOS(recipientId, familyMember, patientName, location, dateTime, deviceId string) error
 	GetUserReminders(userId uint64) ([]models.UserReminder, error)
+	SendDataExportReadyMail(systemUser *models.SystemUser_, exportId string, downloadURL string, expiresAt time.Time) error
+	SendCriticalResultAlert(recipient *models.SystemUser_, patient *models.SystemUser_, alert *models.CriticalResultAlert, attempt int) error
+	SendTrendDriftAlert(patient *models.SystemUser_, componentName, unit string, analytics *models.TrendAnalytics, notice *models.TrendDriftNotice) error
 
 	RegisterUserInNotify(fcmToken, phone *string, email string) (uuid.UUID, error)
 	UpadateUserInNotify(recipientId string, fcmToken, email, phone *string) error
@@ -224,7 +227,7 @@ func (s *NotificationServiceImpl) GetUserReminders(userId uint64) ([]models.User
 	header := map[string]string{
 		"X-API-Key": config.PropConfig.ApiURL.NotifyAPIKey,
 	}
-	_, response, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, os.Getenv("NOTIFY_SERVER_URL")+"/api/v1/notifications/info", sendBody, header)
+	_, response, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotifyServerURL+"/api/v1/notifications/info", sendBody, header)
 	if sendErr != nil {
 		return nil, sendErr
 	}
@@ -270,7 +273,7 @@ func (s *NotificationServiceImpl) RegisterUserInNotify(fcmToken, phone *string,
 	if phone != nil && strings.TrimSpace(*phone) != "" {
 		requestBody["phone"] = *phone
 	}
-	_, response, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, os.Getenv("NOTIFY_SERVER_URL")+"/api/v1/recipient/register", requestBody, header)
+	_, response, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotifyServerURL+"/api/v1/recipient/register", requestBody, header)
 	if sendErr != nil {
 		return uuid.Nil, sendErr
 	}
@@ -298,7 +301,7 @@ func (s *NotificationServiceImpl) UpadateUserInNotify(recipientId string, fcmTok
 	if phone != nil && strings.TrimSpace(*phone) != "" {
 		requestBody["phone"] = *phone
 	}
-	_, _, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, os.Getenv("NOTIFY_SERVER_URL")+"/api/v1/recipient/update", requestBody, header)
+	_, _, sendErr := s.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotifyServerURL+"/api/v1/recipient/update", requestBody, header)
 	if sendErr != nil {
 		return sendErr
 	}
@@ -563,7 +566,7 @@ func (e *NotificationServiceImpl) SendAppointmentMail(appointment models.Appoint
 		},
 	}
 
-	scheduleStatus, scheduleData, scheduleErr := e.apiService.MakeRESTRequest(http.MethodPost, os.Getenv("NOTIFY_SERVER_URL")+"/api/v1/notifications/schedule", scheduleBody, header)
+	scheduleStatus, scheduleData, scheduleErr := e.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotifyServerURL+"/api/v1/notifications/schedule", scheduleBody, header)
 	var errs []string
 	if sendErr != nil {
 		errs = append(errs, fmt.Sprintf("send failed: %v (status: %d, data: %v)", sendErr, sendStatus, sendData))
@@ -652,6 +655,135 @@ func (e *NotificationServiceImpl) SendReportResultsEmail(patientInfo *models.Sys
 	return nil
 }
 
+func (e *NotificationServiceImpl) SendDataExportReadyMail(systemUser *models.SystemUser_, exportId string, downloadURL string, expiresAt time.Time) error {
+	sendBody := map[string]interface{}{
+		"target_type":   "recipient_id",
+		"target_value":  systemUser.NotifyId,
+		"template_code": 13,
+		"channels":      []string{"email"},
+		"data": map[string]interface{}{
+			"fullName":    systemUser.FirstName + " " + systemUser.LastName,
+			"downloadURL": downloadURL,
+			"expiresAt":   expiresAt.Format("02 Jan 2006 15:04 MST"),
+		},
+	}
+	header := map[string]string{
+		"X-API-Key": config.PropConfig.ApiURL.NotifyAPIKey,
+	}
+	_, sendData, sendErr := e.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotificationSendURL, sendBody, header)
+	if sendErr != nil {
+		return sendErr
+	}
+	notifId, err := utils.ExtractNotificationID(sendData)
+	if err == nil {
+		err := e.notificationRepo.CreateNotificationMapping(models.UserNotificationMapping{
+			UserID:           systemUser.UserId,
+			NotificationID:   notifId,
+			Title:            "Your data export is ready",
+			Message:          "Your health data export is ready to download.",
+			Tags:             "data export",
+			SourceType:       "tbl_patient_data_export",
+			SourceID:         exportId,
+			NotificationType: "one-time",
+		})
+		if err != nil {
+			log.Println("@SendDataExportReadyMail: failed to save mapping")
+		}
+	}
+	return nil
+}
+
+func (e *NotificationServiceImpl) SendCriticalResultAlert(recipient *models.SystemUser_, patient *models.SystemUser_, alert *models.CriticalResultAlert, attempt int) error {
+	patientName := patient.FirstName + " " + patient.LastName
+	sendBody := map[string]interface{}{
+		"target_type":   "recipient_id",
+		"target_value":  recipient.NotifyId,
+		"template_code": 14,
+		"channels":      []string{"push", "sms", "email"},
+		"data": map[string]interface{}{
+			"fullName":          recipient.FirstName + " " + recipient.LastName,
+			"patientFullName":   patientName,
+			"testComponentName": alert.TestComponentName,
+			"resultValue":       alert.ResultValue,
+			"resultUnit":        alert.ResultUnit,
+			"resultDate":        alert.ResultDate.Format("02 Jan 2006"),
+			"breach":            alert.Breach,
+			"thresholdValue":    alert.ThresholdValue,
+			"alertId":           alert.AlertId.String(),
+			"attempt":           attempt,
+		},
+	}
+	header := map[string]string{
+		"X-API-Key": config.PropConfig.ApiURL.NotifyAPIKey,
+	}
+	_, sendData, sendErr := e.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotificationSendURL, sendBody, header)
+	if sendErr != nil {
+		return sendErr
+	}
+	notifId, err := utils.ExtractNotificationID(sendData)
+	if err == nil {
+		err := e.notificationRepo.CreateNotificationMapping(models.UserNotificationMapping{
+			UserID:           recipient.UserId,
+			NotificationID:   notifId,
+			Title:            "Critical test result",
+			Message:          fmt.Sprintf("%s for %s is critically %s and needs attention.", alert.TestComponentName, patientName, alert.Breach),
+			Tags:             "critical alert",
+			SourceType:       "tbl_critical_result_alert",
+			SourceID:         alert.AlertId.String(),
+			NotificationType: "one-time",
+		})
+		if err != nil {
+			log.Println("@SendCriticalResultAlert: failed to save mapping")
+		}
+	}
+	return nil
+}
+
+func (e *NotificationServiceImpl) SendTrendDriftAlert(patient *models.SystemUser_, componentName, unit string, analytics *models.TrendAnalytics, notice *models.TrendDriftNotice) error {
+	drift := analytics.Drift
+	sendBody := map[string]interface{}{
+		"target_type":   "recipient_id",
+		"target_value":  patient.NotifyId,
+		"template_code": 15,
+		"channels":      []string{"push", "email"},
+		"data": map[string]interface{}{
+			"fullName":          patient.FirstName + " " + patient.LastName,
+			"testComponentName": componentName,
+			"resultValue":       analytics.LatestValue,
+			"resultUnit":        unit,
+			"resultDate":        analytics.LatestDate.Format("02 Jan 2006"),
+			"direction":         drift.Direction,
+			"bound":             drift.Bound,
+			"points":            drift.Points,
+			"reason":            drift.Reason,
+		},
+	}
+	header := map[string]string{
+		"X-API-Key": config.PropConfig.ApiURL.NotifyAPIKey,
+	}
+	_, sendData, sendErr := e.apiService.MakeRESTRequest(http.MethodPost, config.PropConfig.ApiURL.NotificationSendURL, sendBody, header)
+	if sendErr != nil {
+		return sendErr
+	}
+	notifId, err := utils.ExtractNotificationID(sendData)
+	if err == nil {
+		err := e.notificationRepo.CreateNotificationMapping(models.UserNotificationMapping{
+			UserID:           patient.UserId,
+			NotificationID:   notifId,
+			Title:            "Test result trend",
+			Message:          fmt.Sprintf("%s is still in range but has been moving steadily toward abnormal: %s.", componentName, drift.Reason),
+			Tags:             "trend drift",
+			SourceType:       "tbl_trend_drift_notice",
+			SourceID:         fmt.Sprint(notice.NoticeId),
+			NotificationType: "one-time",
+		})
+		if err != nil {
+			log.Println("@SendTrendDriftAlert: failed to save mapping")
+		}
+	}
+	return nil
+}
+
 func (e *NotificationServiceImpl) ShareReportEmail(recipientEmail []string, userDetails *models.SystemUser_, shortURL string) error {
 	var errs []string
 	header := map[string]string{
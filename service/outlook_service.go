@@ -38,10 +38,11 @@ type OutLookServiceImpl struct {
 	processStatusService ProcessStatusService
 	gmailSyncService     GmailSyncService
 	diagnosticRepo       repository.DiagnosticRepository
+	fileStore            FileStoreService
 }
 
-func NewOutLookService(userService UserService, apiService ApiService, processStatusService ProcessStatusService, gmailSyncService GmailSyncService, diagnosticRepo repository.DiagnosticRepository) OutLookService {
-	return &OutLookServiceImpl{userService: userService, apiService: apiService, processStatusService: processStatusService, gmailSyncService: gmailSyncService, diagnosticRepo: diagnosticRepo}
+func NewOutLookService(userService UserService, apiService ApiService, processStatusService ProcessStatusService, gmailSyncService GmailSyncService, diagnosticRepo repository.DiagnosticRepository, fileStore FileStoreService) OutLookService {
+	return &OutLookServiceImpl{userService: userService, apiService: apiService, processStatusService: processStatusService, gmailSyncService: gmailSyncService, diagnosticRepo: diagnosticRepo, fileStore: fileStore}
 }
 
 func (ols *OutLookServiceImpl) GetOutLookAuthURL(userID uint64) (string, error) {
@@ -389,13 +390,6 @@ func (s *OutLookServiceImpl) saveAttachment(att models.OutlookAttachment, msg mo
 	safeName := re.ReplaceAllString(nameOnly, "_")
 	uniqueSuffix := time.Now().Format("20060102150405") + "-" + uuid.New().String()[:8]
 	safeFileName := fmt.Sprintf("%s_%s%s", safeName, uniqueSuffix, extension)
-	destPath := filepath.Join("uploads", safeFileName)
-
-	if err := os.WriteFile(destPath, data, 0644); err != nil {
-		return nil, fmt.Errorf("save file error: %w", err)
-	}
-
-	recordURL := fmt.Sprintf("%s/uploads/%s", os.Getenv("SHORT_URL_BASE"), safeFileName)
 
 	metadata := map[string]interface{}{
 		"attachment_id": att.ID,
@@ -403,21 +397,23 @@ func (s *OutLookServiceImpl) saveAttachment(att models.OutlookAttachment, msg mo
 	}
 	metadataJSON, _ := json.Marshal(metadata)
 
-	return &models.TblMedicalRecord{
-		RecordName:        safeFileName,
-		RecordSize:        int64(len(data)),
-		FileType:          att.ContentType,
-		UploadSource:      "Outlook",
-		UploadDestination: "LocalServer",
-		SourceAccount:     msg.From.EmailAddress.Address,
-		RecordCategory:    string(constant.OTHER),
-		Description:       fmt.Sprintf("Subject: %s | BodyPreview: %s", msg.Subject, msg.BodyPreview),
-		UDF1:              msg.Subject,
-		UDF2:              msg.Received,
-		RecordUrl:         recordURL,
-		FetchedAt:         time.Now(),
-		UploadedBy:        userId,
-		Status:            constant.StatusProcessing,
-		Metadata:          metadataJSON,
-	}, nil
+	record := &models.TblMedicalRecord{
+		RecordName:     safeFileName,
+		RecordSize:     int64(len(data)),
+		FileType:       att.ContentType,
+		UploadSource:   "Outlook",
+		SourceAccount:  msg.From.EmailAddress.Address,
+		RecordCategory: string(constant.OTHER),
+		Description:    fmt.Sprintf("Subject: %s | BodyPreview: %s", msg.Subject, msg.BodyPreview),
+		UDF1:           msg.Subject,
+		UDF2:           msg.Received,
+		FetchedAt:      time.Now(),
+		UploadedBy:     userId,
+		Status:         constant.StatusProcessing,
+		Metadata:       metadataJSON,
+	}
+	if err := s.fileStore.SaveRecordFile(context.Background(), record, safeFileName, data); err != nil {
+		return nil, fmt.Errorf("save file error: %w", err)
+	}
+	return record, nil
 }
@@ -0,0 +1,481 @@
+package service
+
+import (
+	"archive/zip"
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"biostat/repository"
+	"biostat/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+// PatientExportService builds the "download my data" archive of a patient: the original
+// record files, a JSON bundle of everything held for the patient and the diagnostic
+// summaries in PDF and Excel form.
+type PatientExportService interface {
+	StartPatientDataExport(patientId, requestedBy uint64) (*models.PatientDataExport, error)
+	BuildPatientDataExport(exportId uuid.UUID) error
+	GetPatientDataExport(exportId uuid.UUID, userId uint64) (*models.PatientDataExport, error)
+	OpenSignedPatientDataExport(exportId uuid.UUID, userId uint64, expiresAt int64, signature string) (io.ReadCloser, int64, error)
+	PurgeExpiredExports() (int, error)
+}
+
+type patientExportServiceImpl struct {
+	recordRepo           repository.TblMedicalRecordRepository
+	patientService       PatientService
+	allergyService       AllergyService
+	notificationService  NotificationService
+	processStatusService ProcessStatusService
+	fileStore            FileStoreService
+	encryption           RecordEncryptionService
+	taskQueue            *asynq.Client
+}
+
+func NewPatientExportService(recordRepo repository.TblMedicalRecordRepository, patientService PatientService, allergyService AllergyService,
+	notificationService NotificationService, processStatusService ProcessStatusService, fileStore FileStoreService,
+	encryption RecordEncryptionService, taskQueue *asynq.Client) PatientExportService {
+	return &patientExportServiceImpl{recordRepo: recordRepo, patientService: patientService, allergyService: allergyService,
+		notificationService: notificationService, processStatusService: processStatusService, fileStore: fileStore, encryption: encryption,
+		taskQueue: taskQueue}
+}
+
+// exportBuildTimeout bounds one build of an export archive; a build that is cut off, or whose
+// worker dies, is picked up again by asynq.
+const exportBuildTimeout = 2 * time.Hour
+
+// StartPatientDataExport registers the export and queues it to be built by the worker.
+// Progress is reported on the returned export's process id, and requestedBy is notified once
+// the archive can be downloaded.
+func (s *patientExportServiceImpl) StartPatientDataExport(patientId, requestedBy uint64) (*models.PatientDataExport, error) {
+	step := string(constant.CollectExportData)
+	processID, _ := s.processStatusService.StartProcessInRedis(patientId, string(constant.PatientDataExport), strconv.FormatUint(patientId, 10),
+		string(constant.PatientDataExportEntity), step)
+	if processID == uuid.Nil {
+		return nil, errors.New("failed to start the export process")
+	}
+	export := &models.PatientDataExport{
+		ExportId:    processID,
+		UserID:      patientId,
+		RequestedBy: requestedBy,
+		Status:      constant.Running,
+	}
+	if err := s.recordRepo.CreatePatientDataExport(export); err != nil {
+		s.processStatusService.LogStepAndFail(processID, step, constant.Failure, string(constant.DataExportFailed), err.Error(), nil, nil, nil)
+		return nil, err
+	}
+	payloadBytes, err := json.Marshal(models.PatientDataExportPayload{ExportId: processID})
+	if err == nil {
+		task := asynq.NewTask(constant.TaskBuildDataExport, payloadBytes)
+		_, err = s.taskQueue.Enqueue(task, asynq.Queue(constant.QueueDefault), asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts),
+			asynq.Timeout(exportBuildTimeout), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention)))
+	}
+	if err != nil {
+		s.processStatusService.LogStepAndFail(processID, step, constant.Failure, string(constant.DataExportFailed), err.Error(), nil, nil, nil)
+		if updateErr := s.recordRepo.UpdatePatientDataExport(processID, map[string]interface{}{"status": constant.Failure}); updateErr != nil {
+			log.Println("@StartPatientDataExport->UpdatePatientDataExport:", updateErr)
+		}
+		return nil, err
+	}
+	return export, nil
+}
+
+// BuildPatientDataExport builds a queued export. An export that is no longer running, built
+// by an earlier attempt or failed, is left alone.
+func (s *patientExportServiceImpl) BuildPatientDataExport(exportId uuid.UUID) error {
+	export, err := s.recordRepo.GetPatientDataExport(exportId)
+	if err != nil {
+		return err
+	}
+	if export.Status != constant.Running {
+		log.Printf("Export %s is %s, not building it again", exportId, export.Status)
+		return nil
+	}
+	return s.buildPatientDataExport(*export)
+}
+
+// PurgeExpiredExports deletes the archives of exports whose download link has expired and
+// returns how many were removed.
+func (s *patientExportServiceImpl) PurgeExpiredExports() (int, error) {
+	exports, err := s.recordRepo.GetExpiredPatientDataExports(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, export := range exports {
+		if err := s.fileStore.DeleteFile(context.Background(), export.UploadDestination, export.FileUrl); err != nil {
+			log.Printf("@PurgeExpiredExports: failed to delete archive of export %s: %v", export.ExportId, err)
+			continue
+		}
+		if err := s.recordRepo.UpdatePatientDataExport(export.ExportId, map[string]interface{}{"status": constant.Expired, "file_url": ""}); err != nil {
+			log.Printf("@PurgeExpiredExports->UpdatePatientDataExport %s: %v", export.ExportId, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (s *patientExportServiceImpl) GetPatientDataExport(exportId uuid.UUID, userId uint64) (*models.PatientDataExport, error) {
+	export, err := s.getOwnedExport(exportId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if export.Status == constant.Success && export.ExpiresAt != nil && time.Now().Before(*export.ExpiresAt) {
+		export.DownloadURL = s.buildDownloadURL(export, userId)
+	}
+	return export, nil
+}
+
+// OpenSignedPatientDataExport streams the decrypted archive of an export along with its size.
+// The caller must close the reader, also when it stops reading early.
+func (s *patientExportServiceImpl) OpenSignedPatientDataExport(exportId uuid.UUID, userId uint64, expiresAt int64, signature string) (io.ReadCloser, int64, error) {
+	if !utils.VerifyExportDownloadSignature(exportId.String(), userId, expiresAt, signature, config.PropConfig.FileStore.DownloadSecret) {
+		return nil, 0, errors.New("download link is invalid or expired")
+	}
+	export, err := s.getOwnedExport(exportId, userId)
+	if err != nil {
+		return nil, 0, err
+	}
+	if export.Status == constant.Expired || (export.ExpiresAt != nil && time.Now().After(*export.ExpiresAt)) {
+		return nil, 0, errors.New("export has expired, please request a new one")
+	}
+	if export.Status != constant.Success || export.FileUrl == "" {
+		return nil, 0, errors.New("export is not ready")
+	}
+	blob, err := s.fileStore.OpenFile(context.Background(), export.UploadDestination, export.FileUrl)
+	if err != nil {
+		return nil, 0, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := s.encryption.DecryptRecordStream(exportKeyHolder(export), pw, blob)
+		blob.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, export.FileSize, nil
+}
+
+func (s *patientExportServiceImpl) getOwnedExport(exportId uuid.UUID, userId uint64) (*models.PatientDataExport, error) {
+	export, err := s.recordRepo.GetPatientDataExport(exportId)
+	if err != nil {
+		return nil, err
+	}
+	if export.UserID != userId && export.RequestedBy != userId {
+		return nil, errors.New("export not found")
+	}
+	return export, nil
+}
+
+// exportKeyHolder carries the export's data key in the shape the record encryption
+// service works with, so exports share the records' envelope encryption.
+func exportKeyHolder(export *models.PatientDataExport) *models.TblMedicalRecord {
+	return &models.TblMedicalRecord{DataKey: export.DataKey, KeyVersion: export.KeyVersion}
+}
+
+func (s *patientExportServiceImpl) buildDownloadURL(export *models.PatientDataExport, userId uint64) string {
+	expiresAt := export.ExpiresAt.Unix()
+	exportId := export.ExportId.String()
+	query := url.Values{}
+	query.Set("uid", strconv.FormatUint(userId, 10))
+	query.Set("exp", strconv.FormatInt(expiresAt, 10))
+	query.Set("sig", utils.GenerateExportDownloadSignature(exportId, userId, expiresAt, config.PropConfig.FileStore.DownloadSecret))
+	downloadPath := strings.Replace(constant.DataExportDownload, ":export_id", exportId, 1)
+	return fmt.Sprintf("%s%s/public%s?%s", config.PropConfig.ApiURL.ShortBaseURL, os.Getenv("ApiVersion"), downloadPath, query.Encode())
+}
+
+// buildPatientDataExport collects the patient's data and streams the archive, encrypted, to
+// the file store. A failed build marks the export failed and is not retried.
+func (s *patientExportServiceImpl) buildPatientDataExport(export models.PatientDataExport) error {
+	processID := export.ExportId
+	step := string(constant.CollectExportData)
+	fail := func(err error) error {
+		log.Printf("@buildPatientDataExport %s: %v", processID, err)
+		s.processStatusService.LogStepAndFail(processID, step, constant.Failure, string(constant.DataExportFailed), err.Error(), nil, nil, nil)
+		if err := s.recordRepo.UpdatePatientDataExport(processID, map[string]interface{}{"status": constant.Failure}); err != nil {
+			log.Println("@buildPatientDataExport->UpdatePatientDataExport:", err)
+		}
+		return fmt.Errorf("%w: %w", asynq.SkipRetry, err)
+	}
+
+	s.processStatusService.LogStep(processID, step, constant.Running, string(constant.CollectExportDataMsg), "", nil, nil, nil, nil, nil, nil)
+	profile, err := s.patientService.GetUserProfileByUserId(export.UserID)
+	if err != nil {
+		return fail(err)
+	}
+	bundle, err := s.collectPatientData(profile)
+	if err != nil {
+		return fail(err)
+	}
+	records, err := s.recordRepo.GetRecordsForExport(export.UserID)
+	if err != nil {
+		return fail(err)
+	}
+	grid, _, err := s.patientService.GetPatientDiagnosticReportResult(export.UserID, export.UserID, models.DiagnosticReportFilter{}, 1000, 0)
+	if err != nil {
+		return fail(err)
+	}
+	s.processStatusService.LogStep(processID, step, constant.Success, string(constant.CollectExportDataMsg), "", nil, nil, nil, nil, nil, nil)
+
+	step = string(constant.BuildExportArchive)
+	total := len(records)
+	s.processStatusService.LogStep(processID, step, constant.Running, string(constant.BuildExportArchiveMsg), "", nil, nil, &total, nil, nil, nil)
+	keyHolder := &models.TblMedicalRecord{}
+	objectKey := fmt.Sprintf("patient_export_%s.zip", processID)
+	archive := &countingWriter{}
+	var exported, failed int
+	pr, pw := io.Pipe()
+	built := make(chan error, 1)
+	go func() {
+		encrypter, err := s.encryption.NewRecordEncryptWriter(keyHolder, pw)
+		if err == nil {
+			archive.w = encrypter
+			exported, failed, err = s.writeExportArchive(archive, bundle, records, grid, profile)
+			if closeErr := encrypter.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+		built <- err
+	}()
+	destination, fileURL, err := s.fileStore.SaveFileStream(context.Background(), objectKey, pr, "application/zip")
+	pr.CloseWithError(err)
+	if buildErr := <-built; buildErr != nil {
+		return fail(buildErr)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(config.PropConfig.DataExport.LinkExpiryHours) * time.Hour)
+	err = s.recordRepo.UpdatePatientDataExport(processID, map[string]interface{}{
+		"status":             constant.Success,
+		"file_url":           fileURL,
+		"upload_destination": destination,
+		"data_key":           keyHolder.DataKey,
+		"key_version":        keyHolder.KeyVersion,
+		"file_size":          archive.n,
+		"expires_at":         expiresAt,
+		"completed_at":       now,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	msg := fmt.Sprintf("%s: %d files exported, %d failed", constant.DataExportReady, exported, failed)
+	s.processStatusService.LogStep(processID, step, constant.Success, msg, "", nil, nil, &total, &exported, &failed, nil)
+	s.processStatusService.UpdateProcessStatusInRedis(processID, constant.Success, msg, step, true, nil)
+
+	export.ExpiresAt = &expiresAt
+	s.notifyExportReady(&export)
+	return nil
+}
+
+func (s *patientExportServiceImpl) notifyExportReady(export *models.PatientDataExport) {
+	recipient, err := s.patientService.GetUserProfileByUserId(export.RequestedBy)
+	if err != nil {
+		log.Println("@notifyExportReady->GetUserProfileByUserId:", err)
+		return
+	}
+	downloadURL := s.buildDownloadURL(export, export.RequestedBy)
+	if err := s.notificationService.SendDataExportReadyMail(recipient, export.ExportId.String(), downloadURL, *export.ExpiresAt); err != nil {
+		log.Println("@notifyExportReady->SendDataExportReadyMail:", err)
+	}
+}
+
+func (s *patientExportServiceImpl) collectPatientData(profile *models.SystemUser_) (*models.PatientDataBundle, error) {
+	patientId := profile.UserId
+	prescriptions, _, err := s.patientService.GetPrescriptionByPatientId(patientId, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range prescriptions {
+		// The attachment itself is exported under records/, don't inline its stored bytes.
+		prescriptions[i].MedicalRecord.FileData = nil
+	}
+	reports, err := s.patientService.FetchPatientDiagnosticReports(patientId, models.DiagnosticReportFilter{})
+	if err != nil {
+		return nil, err
+	}
+	allergies, err := s.allergyService.GetPatientAllergyRestriction(patientId)
+	if err != nil {
+		return nil, err
+	}
+	diseaseProfiles, err := s.patientService.GetPatientDiseaseProfiles(patientId)
+	if err != nil {
+		return nil, err
+	}
+	reminders, err := s.notificationService.GetUserReminders(patientId)
+	if err != nil {
+		// Reminders live in the notify server, an outage there should not block the export.
+		log.Println("@collectPatientData->GetUserReminders:", err)
+	}
+	exportedProfile := *profile
+	exportedProfile.Password = ""
+	return &models.PatientDataBundle{
+		ExportedAt:        time.Now(),
+		Profile:           &exportedProfile,
+		Prescriptions:     prescriptions,
+		DiagnosticReports: reports,
+		Allergies:         allergies,
+		DiseaseProfiles:   diseaseProfiles,
+		Reminders:         reminders,
+	}, nil
+}
+
+// writeExportArchive zips the record files, the diagnostic summaries and the JSON bundle into
+// w, one record at a time. A record file that cannot be read is listed in the bundle with its
+// error instead of failing the whole export.
+func (s *patientExportServiceImpl) writeExportArchive(w io.Writer, bundle *models.PatientDataBundle, records []models.TblMedicalRecord,
+	grid map[string]interface{}, profile *models.SystemUser_) (int, int, error) {
+	zw := zip.NewWriter(w)
+	exported, failed := 0, 0
+	for i := range records {
+		record := &records[i]
+		entry := models.ExportedRecord{
+			RecordId:          record.RecordId,
+			RecordName:        record.RecordName,
+			RecordCategory:    record.RecordCategory,
+			RecordSubCategory: record.RecordSubCategory,
+			FileType:          record.FileType,
+			UploadSource:      record.UploadSource,
+			ContentHash:       record.ContentHash,
+			CreatedAt:         record.CreatedAt,
+		}
+		data, err := s.readExportRecord(record)
+		if err == nil {
+			entry.FilePath = fmt.Sprintf("records/%d_%s", record.RecordId, utils.SanitizeFileName(record.RecordName))
+			err = writeZipFile(zw, entry.FilePath, data)
+		}
+		if err != nil {
+			log.Printf("@writeExportArchive record %d: %v", record.RecordId, err)
+			entry.FilePath = ""
+			entry.Error = err.Error()
+			failed++
+		} else {
+			exported++
+		}
+		bundle.Records = append(bundle.Records, entry)
+	}
+
+	if rows, ok := grid["rows"].([]map[string]interface{}); ok && len(rows) > 0 {
+		dates, _ := grid["dates"].([]string)
+		sort.Strings(dates)
+		excel, err := s.patientService.GenerateExcelFile(grid)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := writeZipFile(zw, "diagnostic_summary.xlsx", excel); err != nil {
+			return 0, 0, err
+		}
+		analytics, err := s.patientService.GetTrendAnalytics(profile.UserId)
+		if err != nil {
+			return 0, 0, err
+		}
+		pdf, err := s.patientService.GeneratePDF(buildReportData(profile, rows, dates, analytics))
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := writeZipFile(zw, "diagnostic_summary.pdf", pdf); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	bundleJSON, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := writeZipFile(zw, "patient_data.json", bundleJSON); err != nil {
+		return 0, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, 0, err
+	}
+	return exported, failed, nil
+}
+
+func (s *patientExportServiceImpl) readExportRecord(record *models.TblMedicalRecord) ([]byte, error) {
+	if record.UploadDestination == constant.UploadDestinationDigiLocker {
+		return nil, errors.New("DigiLocker documents are not stored by us, download them from DigiLocker")
+	}
+	if len(record.FileData) == 0 && record.RecordUrl == "" {
+		return nil, errors.New("record has no stored file")
+	}
+	return s.fileStore.ReadRecordFile(context.Background(), record)
+}
+
+// countingWriter counts the bytes of the archive on their way to the encrypter.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// buildReportData converts the diagnostic result grid and the trend analytics of each
+// component into the input of GeneratePDF.
+func buildReportData(profile *models.SystemUser_, rows []map[string]interface{}, dates []string, analytics map[uint64]*models.TrendAnalytics) models.ReportData {
+	dob := ""
+	if profile.DateOfBirth != nil {
+		dob = profile.DateOfBirth.Format("02-01-2006")
+	}
+	data := models.ReportData{
+		Patient: models.PatientInfoData{
+			Name:       strings.Join(strings.Fields(profile.FirstName+" "+profile.MiddleName+" "+profile.LastName), " "),
+			Phone:      profile.MobileNo,
+			ReportDate: time.Now().Format("02-01-2006"),
+			DOB:        dob,
+		},
+		Dates: dates,
+	}
+	for _, row := range rows {
+		result := models.TestResult{
+			TestComponentName: fmt.Sprint(row["test_component_name"]),
+			LoincCode:         fmt.Sprint(row["loinc_code"]),
+			Unit:              fmt.Sprint(row["ref_unit"]),
+			RefRange:          fmt.Sprint(row["ref_range"]),
+		}
+		if componentId, ok := rowUint64(row["diagnostic_test_component_id"]); ok {
+			result.Analytics = analytics[componentId]
+		}
+		cells, _ := row["trend_values"].([]models.CellData)
+		for _, cell := range cells {
+			result.TrendValues = append(result.TrendValues, models.Cell{
+				ResultDate: cell.ResultDate,
+				Value:      cell.Value,
+				IsNormal:   cell.ColourClass == "text-green-500",
+			})
+		}
+		data.TestResults = append(data.TestResults, result)
+	}
+	sort.Slice(data.TestResults, func(i, j int) bool {
+		return data.TestResults[i].TestComponentName < data.TestResults[j].TestComponentName
+	})
+	return data
+}
@@ -10,7 +10,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -64,8 +66,12 @@ type PatientService interface {
 	GetNursesList(patientId *uint64, limit int, offset int) ([]models.SystemUser_, int64, error)
 	GetPharmacistList(patientId *uint64, limit int, offset int) ([]models.SystemUser_, int64, error)
 	GetPatientDiagnosticTrendValue(input models.DiagnosticResultRequest) ([]map[string]interface{}, error)
+	GetTrendAnalytics(patientId uint64) (map[uint64]*models.TrendAnalytics, error)
+	NotifyTrendDrift(patientId, reportId uint64) (int, error)
+	CompareReports(patientId uint64, input models.ReportComparisonRequest) (*models.ReportComparison, error)
+	ExportReportComparison(patientId uint64, input models.ReportComparisonRequest, format string) ([]byte, error)
 	FetchPatientDiagnosticReports(patientID uint64, filter models.DiagnosticReportFilter) ([]map[string]interface{}, error)
-	GetPatientDiagnosticReportResult(patientID uint64, filter models.DiagnosticReportFilter, limit, offset int) (map[string]interface{}, int64, error)
+	GetPatientDiagnosticReportResult(patientID, reqUserID uint64, filter models.DiagnosticReportFilter, limit, offset int) (map[string]interface{}, int64, error)
 	GenerateExcelFile(data map[string]interface{}) ([]byte, error)
 	GeneratePDF(data models.ReportData) ([]byte, error)
 	SaveUserHealthProfile(tx *gorm.DB, input *models.TblPatientHealthProfile) (*models.TblPatientHealthProfile, error)
@@ -78,6 +84,7 @@ type PatientService interface {
 	GetPatientGroups(patientID uint64) ([]models.PatientGroupResponse, error)
 
 	CanContinue(patientID, userID uint64, permission string) error
+	GetAccessiblePatientIds(userID uint64, permission string) ([]uint64, error)
 	CanAccessAPI(userID uint64, roles []string) bool
 	CheckPatientRelativeMapping(relativeId, patientId uint64, relation string) error
 	StartConversation(message string, userInfo models.SystemUser_) (*models.AskAPIResponse, error)
@@ -93,15 +100,17 @@ type PatientServiceImpl struct {
 	notificationService NotificationService
 	permissionRepo      repository.PermissionRepository
 	userRepo            repository.UserRepository
+	diagnosticRepo      repository.DiagnosticRepository
 }
 
 // Ensure patientRepo is properly initialized
 func NewPatientService(repo repository.PatientRepository, apiService ApiService, allergyService AllergyService,
 	medicalRecordRepo repository.TblMedicalRecordRepository, roleRepo repository.RoleRepository,
-	notificationService NotificationService, permissionRepo repository.PermissionRepository, userRepo repository.UserRepository) PatientService {
+	notificationService NotificationService, permissionRepo repository.PermissionRepository, userRepo repository.UserRepository,
+	diagnosticRepo repository.DiagnosticRepository) PatientService {
 	return &PatientServiceImpl{patientRepo: repo, apiService: apiService, allergyService: allergyService,
 		medicalRecordRepo: medicalRecordRepo, roleRepo: roleRepo, notificationService: notificationService,
-		permissionRepo: permissionRepo, userRepo: userRepo}
+		permissionRepo: permissionRepo, userRepo: userRepo, diagnosticRepo: diagnosticRepo}
 }
 
 // GetAllRelation implements PatientService.
@@ -636,7 +645,135 @@ func (ps *PatientServiceImpl) GetPatientDiagnosticTrendValue(input models.Diagno
 	if err != nil {
 		return nil, err
 	}
-	return ps.patientRepo.ParseDiagnosticTrendData(data)
+	if input.DisplayUnit != nil && *input.DisplayUnit != "" {
+		if err := ps.convertTrendRows(data, *input.DisplayUnit); err != nil {
+			return nil, err
+		}
+	}
+	groups, err := ps.patientRepo.ParseDiagnosticTrendData(data)
+	if err != nil {
+		return nil, err
+	}
+	attachTrendAnalytics(groups, data, newTrendOptions(input.TrendWindowDays))
+	return groups, nil
+}
+
+// convertTrendRows rewrites result values and reference ranges into displayUnit for the
+// components that have it registered. Other rows keep their stored unit.
+func (ps *PatientServiceImpl) convertTrendRows(rows []map[string]interface{}, displayUnit string) error {
+	units, err := ps.diagnosticRepo.GetComponentUnits(nil)
+	if err != nil {
+		return err
+	}
+	registry := NewUnitRegistry(units)
+	for _, row := range rows {
+		componentId, ok := rowUint64(row["diagnostic_test_component_id"])
+		if !ok {
+			continue
+		}
+		refUnit, _ := row["units"].(string)
+		valueUnit, _ := row["result_unit"].(string)
+		if valueUnit == "" {
+			valueUnit = refUnit
+		}
+		if value, ok := rowFloat64(row["result_value"]); ok && value != 0 {
+			if converted, ok := registry.Convert(componentId, value, valueUnit, displayUnit); ok {
+				row["result_value"] = roundUnitValue(converted)
+				row["result_unit"] = displayUnit
+			}
+		}
+		normalMin, minOk := rowFloat64(row["normal_min"])
+		normalMax, maxOk := rowFloat64(row["normal_max"])
+		if !minOk || !maxOk {
+			continue
+		}
+		convertedMin, minOk := registry.Convert(componentId, normalMin, refUnit, displayUnit)
+		convertedMax, maxOk := registry.Convert(componentId, normalMax, refUnit, displayUnit)
+		if minOk && maxOk {
+			row["normal_min"] = roundUnitValue(convertedMin)
+			row["normal_max"] = roundUnitValue(convertedMax)
+			row["units"] = displayUnit
+		}
+	}
+	return nil
+}
+
+// convertReportRows is convertTrendRows for the report grid, whose values arrive as text.
+func (ps *PatientServiceImpl) convertReportRows(rows []models.ReportRow, displayUnit string) error {
+	units, err := ps.diagnosticRepo.GetComponentUnits(nil)
+	if err != nil {
+		return err
+	}
+	registry := NewUnitRegistry(units)
+	for i := range rows {
+		row := &rows[i]
+		refUnit := row.RefUnits
+		if refUnit == "" {
+			refUnit = row.ComponentUnit
+		}
+		valueUnit := row.ResultUnit
+		if valueUnit == "" {
+			valueUnit = refUnit
+		}
+		if value, err := strconv.ParseFloat(row.ResultValue, 64); err == nil && value != 0 {
+			converted, ok := registry.Convert(row.DiagnosticTestComponentID, value, valueUnit, displayUnit)
+			if !ok {
+				continue
+			}
+			row.ResultValue = strconv.FormatFloat(roundUnitValue(converted), 'f', -1, 64)
+			row.ResultUnit = displayUnit
+			row.ComponentUnit = displayUnit
+		}
+		normalMin, minErr := strconv.ParseFloat(row.NormalMin, 64)
+		normalMax, maxErr := strconv.ParseFloat(row.NormalMax, 64)
+		if minErr != nil || maxErr != nil {
+			continue
+		}
+		convertedMin, minOk := registry.Convert(row.DiagnosticTestComponentID, normalMin, refUnit, displayUnit)
+		convertedMax, maxOk := registry.Convert(row.DiagnosticTestComponentID, normalMax, refUnit, displayUnit)
+		if minOk && maxOk {
+			row.NormalMin = strconv.FormatFloat(roundUnitValue(convertedMin), 'f', -1, 64)
+			row.NormalMax = strconv.FormatFloat(roundUnitValue(convertedMax), 'f', -1, 64)
+			row.RefUnits = displayUnit
+		}
+	}
+	return nil
+}
+
+func roundUnitValue(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
+
+func rowFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func rowUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return uint64(v), true
+	case int32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case string:
+		u, err := strconv.ParseUint(v, 10, 64)
+		return u, err == nil
+	}
+	return 0, false
 }
 
 func (ps *PatientServiceImpl) SaveUserHealthProfile(tx *gorm.DB, input *models.TblPatientHealthProfile) (*models.TblPatientHealthProfile, error) {
@@ -800,7 +937,9 @@ func (ps *PatientServiceImpl) FetchPatientDiagnosticReports(patientId uint64, fi
 	return nestedResults, nil
 }
 
-func (ps *PatientServiceImpl) GetPatientDiagnosticReportResult(patientId uint64, filter models.DiagnosticReportFilter, limit, offset int) (map[string]interface{}, int64, error) {
+// GetPatientDiagnosticReportResult returns the result grid of the patient. The record links of
+// its cells are signed for reqUserID, the user viewing the grid.
+func (ps *PatientServiceImpl) GetPatientDiagnosticReportResult(patientId, reqUserID uint64, filter models.DiagnosticReportFilter, limit, offset int) (map[string]interface{}, int64, error) {
 	var totalReports int64
 	var err error
 	var data []models.ReportRow
@@ -819,6 +958,16 @@ func (ps *PatientServiceImpl) GetPatientDiagnosticReportResult(patientId uint64,
 			return nil, 0, err
 		}
 	}
+	if filter.DisplayUnit != nil && *filter.DisplayUnit != "" {
+		if err := ps.convertReportRows(data, *filter.DisplayUnit); err != nil {
+			return nil, 0, err
+		}
+	}
+	for i := range data {
+		if data[i].RecordId != 0 {
+			data[i].RecordUrl = RecordDownloadURL(data[i].RecordId, reqUserID)
+		}
+	}
 	response := ps.patientRepo.ProcessReportGridData(data, userInfo)
 	return response, totalReports, nil
 }
@@ -904,7 +1053,7 @@ func (ps *PatientServiceImpl) GenerateExcelFile(data map[string]interface{}) ([]
 	sheet := "Report"
 	f.SetSheetName("Sheet1", sheet)
 
-	headers := []string{"Test Component Name", "Unit", "Ref. Range"}
+	headers := []string{"Test Component Name", "LOINC Code", "Unit", "Ref. Range"}
 
 	dates, ok := data["dates"].([]string)
 	if !ok || len(dates) == 0 {
@@ -924,8 +1073,9 @@ func (ps *PatientServiceImpl) GenerateExcelFile(data map[string]interface{}) ([]
 	for rowIndex, row := range rows {
 		r := rowIndex + 2
 		f.SetCellValue(sheet, fmt.Sprintf("A%d", r), row["test_component_name"])
-		f.SetCellValue(sheet, fmt.Sprintf("B%d", r), row["ref_unit"])
-		f.SetCellValue(sheet, fmt.Sprintf("C%d", r), row["ref_range"])
+		f.SetCellValue(sheet, fmt.Sprintf("B%d", r), row["loinc_code"])
+		f.SetCellValue(sheet, fmt.Sprintf("C%d", r), row["ref_unit"])
+		f.SetCellValue(sheet, fmt.Sprintf("D%d", r), row["ref_range"])
 
 		rawTrendValues := row["trend_values"]
 
@@ -947,7 +1097,7 @@ func (ps *PatientServiceImpl) GenerateExcelFile(data map[string]interface{}) ([]
 				styleID = applyColorStyle(f, cellData.ColourClass)
 			}
 
-			cell, _ := excelize.CoordinatesToCellName(colIndex+4, r)
+			cell, _ := excelize.CoordinatesToCellName(colIndex+5, r)
 			f.SetCellValue(sheet, cell, val)
 			if styleID != 0 {
 				f.SetCellStyle(sheet, cell, cell, styleID)
@@ -1212,7 +1362,11 @@ func (g *PatientServiceImpl) GeneratePDF(data models.ReportData) ([]byte, error)
 	addBioStackLogo(pdf)
 
 	// Add Report Title
-	addReportTitle(pdf, "Patient Diagnostic Report")
+	title := data.Title
+	if title == "" {
+		title = "Patient Diagnostic Report"
+	}
+	addReportTitle(pdf, title)
 
 	// Add Patient Information
 	addPatientInfo(pdf, data.Patient)
@@ -1223,6 +1377,9 @@ func (g *PatientServiceImpl) GeneratePDF(data models.ReportData) ([]byte, error)
 	// Add Test Results Table
 	addTestResultsTable(pdf, data.TestResults, data.Dates)
 
+	// Add Trend Analysis
+	addTrendAnalysisTable(pdf, data.TestResults)
+
 	// Output
 	var buf bytes.Buffer
 	if err := pdf.Output(&buf); err != nil {
@@ -1290,16 +1447,12 @@ func addTestResultsTable(pdf *gofpdf.Fpdf, results []models.TestResult, dates []
 	pdf.SetFont("Arial", "B", 10)
 	pdf.SetFillColor(240, 240, 240) // Light grey for header background
 
-	headers := []string{"Test Component Name", "Unit", "Ref. Range"}
+	headers := []string{"Test Component Name", "LOINC", "Unit", "Ref. Range"}
 	headers = append(headers, dates...)
 
-	colWidths := make([]float64, len(headers))
-	for i := range headers {
-		if i < 3 {
-			colWidths[i] = 45
-		} else {
-			colWidths[i] = 25
-		}
+	colWidths := []float64{45, 20, 45, 45}
+	for range dates {
+		colWidths = append(colWidths, 25)
 	}
 
 	// Table Header
@@ -1313,8 +1466,9 @@ func addTestResultsTable(pdf *gofpdf.Fpdf, results []models.TestResult, dates []
 
 	for _, row := range results {
 		pdf.CellFormat(colWidths[0], 8, row.TestComponentName, "1", 0, "", false, 0, "")
-		pdf.CellFormat(colWidths[1], 8, row.Unit, "1", 0, "", false, 0, "")
-		pdf.CellFormat(colWidths[2], 8, row.RefRange, "1", 0, "", false, 0, "")
+		pdf.CellFormat(colWidths[1], 8, row.LoincCode, "1", 0, "", false, 0, "")
+		pdf.CellFormat(colWidths[2], 8, row.Unit, "1", 0, "", false, 0, "")
+		pdf.CellFormat(colWidths[3], 8, row.RefRange, "1", 0, "", false, 0, "")
 
 		dateToValue := make(map[string]models.Cell)
 		for _, tv := range row.TrendValues {
@@ -1336,13 +1490,92 @@ func addTestResultsTable(pdf *gofpdf.Fpdf, results []models.TestResult, dates []
 				}
 			}
 			pdf.SetTextColor(colorR, colorG, colorB)
-			pdf.CellFormat(colWidths[3], 8, val, "1", 0, "C", false, 0, "")
+			pdf.CellFormat(colWidths[4], 8, val, "1", 0, "C", false, 0, "")
 			pdf.SetTextColor(0, 0, 0) // Reset color to black for next cell
 		}
 		pdf.Ln(-1)
 	}
 }
 
+// addTrendAnalysisTable adds the trend analytics of the components that have them to the PDF
+func addTrendAnalysisTable(pdf *gofpdf.Fpdf, results []models.TestResult) {
+	var analysed []models.TestResult
+	for _, row := range results {
+		if row.Analytics != nil && row.Analytics.Points > 1 {
+			analysed = append(analysed, row)
+		}
+	}
+	if len(analysed) == 0 {
+		return
+	}
+	pdf.Ln(5)
+	pdf.SetFont("Arial", "B", 12)
+	pdf.CellFormat(0, 10, "Trend Analysis", "", 1, "L", false, 0, "")
+
+	headers := []string{"Test Component Name", "Points", "Latest", "Change %", "Rate/Day"}
+	for _, window := range analysed[0].Analytics.Windows {
+		headers = append(headers, fmt.Sprintf("Slope/Day %dd", window.Days))
+	}
+	headers = append(headers, "Moving Avg", "Drift")
+	colWidths := make([]float64, len(headers))
+	for i := range headers {
+		switch {
+		case i == 0:
+			colWidths[i] = 45
+		case i == len(headers)-1:
+			colWidths[i] = 50
+		default:
+			colWidths[i] = 22
+		}
+	}
+
+	pdf.SetFont("Arial", "B", 9)
+	pdf.SetFillColor(240, 240, 240)
+	for i, header := range headers {
+		pdf.CellFormat(colWidths[i], 8, header, "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Arial", "", 9)
+	optional := func(value *float64) string {
+		if value == nil {
+			return "-"
+		}
+		return formatTrendValue(*value)
+	}
+	for _, row := range analysed {
+		a := row.Analytics
+		cells := []string{row.TestComponentName, strconv.Itoa(a.Points), formatTrendValue(a.LatestValue), optional(a.PercentChange), optional(a.RateOfChangePerDay)}
+		for _, window := range a.Windows {
+			cells = append(cells, optional(window.SlopePerDay))
+		}
+		movingAverage := "-"
+		if len(a.MovingAverage) > 0 {
+			movingAverage = formatTrendValue(a.MovingAverage[len(a.MovingAverage)-1].Value)
+		}
+		drift := "-"
+		if a.Drift != nil {
+			drift = strings.ReplaceAll(a.Drift.Direction, "_", " ")
+			if a.Drift.InRange {
+				drift += " (in range)"
+			}
+		}
+		cells = append(cells, movingAverage, drift)
+		for i := range headers {
+			value := "-"
+			if i < len(cells) {
+				value = cells[i]
+			}
+			if i == len(headers)-1 && a.Drift != nil {
+				pdf.SetTextColor(217, 119, 6)
+			}
+			pdf.CellFormat(colWidths[i], 8, value, "1", 0, "C", false, 0, "")
+			pdf.SetTextColor(0, 0, 0)
+		}
+		pdf.Ln(-1)
+	}
+}
+
 func (s *PatientServiceImpl) GetUserShares(patientID uint64) ([]models.UserShare, error) {
 	return s.patientRepo.GetUserShares(patientID)
 }
@@ -1370,6 +1603,16 @@ func (s *PatientServiceImpl) CanContinue(patientID, userID uint64, permission st
 	return nil
 }
 
+// GetAccessiblePatientIds returns userID itself followed by every patient that granted it
+// the permission.
+func (s *PatientServiceImpl) GetAccessiblePatientIds(userID uint64, permission string) ([]uint64, error) {
+	patientIds, err := s.patientRepo.GetPatientIdsWithPermission(userID, permission)
+	if err != nil {
+		return nil, err
+	}
+	return append([]uint64{userID}, patientIds...), nil
+}
+
 func (s *PatientServiceImpl) ArchivePatientPrescription(patientId uint64, prescriptionID uint64) error {
 	return s.patientRepo.UpdatePrescriptionArchiveState(patientId, prescriptionID, 1)
 }
@@ -25,6 +25,7 @@ type ProcessStatusService interface {
 	AddOrUpdateStepLogInRedis(processID uuid.UUID, newLog models.ProcessStepLog, attachmentId *string) error
 	LogStep(processID uuid.UUID, step, status, message, errorMsg string, recordId *uint64, recordIndexCount *int, totalrecord *int, successCount *int, failedCount *int, attachmentId *string)
 	LogStepAndFail(processID uuid.UUID, step, status, message, errorMsg string, recordIndexCount *int, recordId *uint64, attachmentId *string)
+	GetProcessStatusFromRedis(processID uuid.UUID) (*models.ProcessStatus, error)
 }
 
 type ProcessStatusServiceImpl struct {
@@ -488,6 +489,21 @@ func (s *ProcessStatusServiceImpl) GetUserActivityLog(userID uint64, limit, offs
 // 	return s.redisClient.Set(ctx, key, updated, 0).Err()
 // }
 
+// GetProcessStatusFromRedis returns a process with its step logs as last written by LogStep.
+func (s *ProcessStatusServiceImpl) GetProcessStatusFromRedis(processID uuid.UUID) (*models.ProcessStatus, error) {
+	raw, err := s.redisClient.Get(context.Background(), "process_status:"+processID.String()).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("process status not found in Redis for ID %s", processID)
+	} else if err != nil {
+		return nil, err
+	}
+	var processStatus models.ProcessStatus
+	if err := json.Unmarshal(raw, &processStatus); err != nil {
+		return nil, err
+	}
+	return &processStatus, nil
+}
+
 func (s *ProcessStatusServiceImpl) UpdateProcessStatusInRedis(
 	processID uuid.UUID,
 	status string,
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/models"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RecordEncryptionService implements envelope encryption for record blobs. Each record
+// gets its own AES-256 data key, which is stored wrapped by the configured master key
+// together with the master key version used to wrap it.
+type RecordEncryptionService interface {
+	Enabled() bool
+	CurrentKeyVersion() int
+	EncryptRecordData(record *models.TblMedicalRecord, plain []byte) ([]byte, error)
+	DecryptRecordData(record *models.TblMedicalRecord, data []byte) ([]byte, error)
+	RewrapDataKey(wrappedKey string, keyVersion int) (string, int, error)
+	SealRecordSecret(record *models.TblMedicalRecord, secret string) (string, error)
+	OpenRecordSecret(record *models.TblMedicalRecord, sealed string) (string, error)
+	NewRecordEncryptWriter(record *models.TblMedicalRecord, dst io.Writer) (io.WriteCloser, error)
+	DecryptRecordStream(record *models.TblMedicalRecord, dst io.Writer, src io.Reader) error
+}
+
+type recordEncryptionServiceImpl struct {
+	currentVersion int
+	masterKeys     map[int][]byte
+}
+
+// NewRecordEncryptionService loads the current master key and any previous versions still
+// needed to unwrap older data keys. With no master key configured records are stored as is.
+func NewRecordEncryptionService() RecordEncryptionService {
+	cfg := config.PropConfig.Encryption
+	masterKeys := map[int][]byte{}
+	for _, entry := range strings.Split(cfg.PreviousMasterKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("@NewRecordEncryptionService previous master key must be <version>:<key>, got %q", entry)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 {
+			log.Fatalf("@NewRecordEncryptionService invalid previous master key version: %q", parts[0])
+		}
+		key, err := decodeMasterKey(parts[1])
+		if err != nil {
+			log.Fatalf("@NewRecordEncryptionService previous master key v%d: %v", version, err)
+		}
+		masterKeys[version] = key
+	}
+	// Encryption is off only when no master key is configured; a configured key that cannot
+	// be used stops startup rather than letting new uploads be stored in plaintext.
+	currentVersion := 0
+	if cfg.MasterKey != "" {
+		key, err := decodeMasterKey(cfg.MasterKey)
+		if err != nil {
+			log.Fatalf("@NewRecordEncryptionService invalid RECORD_MASTER_KEY: %v", err)
+		}
+		if cfg.MasterKeyVersion <= 0 {
+			log.Fatalf("@NewRecordEncryptionService RECORD_MASTER_KEY_VERSION must be positive, got %d", cfg.MasterKeyVersion)
+		}
+		currentVersion = cfg.MasterKeyVersion
+		masterKeys[currentVersion] = key
+	}
+	return &recordEncryptionServiceImpl{currentVersion: currentVersion, masterKeys: masterKeys}
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	return key, nil
+}
+
+func (s *recordEncryptionServiceImpl) Enabled() bool {
+	return s.currentVersion > 0
+}
+
+func (s *recordEncryptionServiceImpl) CurrentKeyVersion() int {
+	return s.currentVersion
+}
+
+// EncryptRecordData encrypts plain with the record's data key, creating and wrapping a new
+// key on the record when it has none yet.
+func (s *recordEncryptionServiceImpl) EncryptRecordData(record *models.TblMedicalRecord, plain []byte) ([]byte, error) {
+	dataKey, err := s.recordDataKey(record)
+	if err != nil || dataKey == nil {
+		return plain, err
+	}
+	return sealAESGCM(dataKey, plain)
+}
+
+// recordDataKey returns the record's data key, creating and wrapping one when it has none.
+// It returns no key while encryption is not configured.
+func (s *recordEncryptionServiceImpl) recordDataKey(record *models.TblMedicalRecord) ([]byte, error) {
+	if record.DataKey != "" {
+		return s.unwrapDataKey(record.DataKey, record.KeyVersion)
+	}
+	if !s.Enabled() {
+		return nil, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := sealAESGCM(s.masterKeys[s.currentVersion], dataKey)
+	if err != nil {
+		return nil, err
+	}
+	record.DataKey = base64.StdEncoding.EncodeToString(wrapped)
+	record.KeyVersion = s.currentVersion
+	return dataKey, nil
+}
+
+func (s *recordEncryptionServiceImpl) DecryptRecordData(record *models.TblMedicalRecord, data []byte) ([]byte, error) {
+	if record.DataKey == "" {
+		return data, nil
+	}
+	dataKey, err := s.unwrapDataKey(record.DataKey, record.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(dataKey, data)
+}
+
+// RewrapDataKey re-encrypts a wrapped data key under the current master key.
+func (s *recordEncryptionServiceImpl) RewrapDataKey(wrappedKey string, keyVersion int) (string, int, error) {
+	if !s.Enabled() {
+		return "", 0, errors.New("record encryption is not configured")
+	}
+	dataKey, err := s.unwrapDataKey(wrappedKey, keyVersion)
+	if err != nil {
+		return "", 0, err
+	}
+	wrapped, err := sealAESGCM(s.masterKeys[s.currentVersion], dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), s.currentVersion, nil
+}
+
+// SealRecordSecret encrypts a secret that belongs to the record, such as the password of a
+// protected PDF, with the record's data key. A record stored without a data key cannot hold
+// secrets.
+func (s *recordEncryptionServiceImpl) SealRecordSecret(record *models.TblMedicalRecord, secret string) (string, error) {
+	if record.DataKey == "" {
+		return "", fmt.Errorf("record %d has no data key", record.RecordId)
+	}
+	sealed, err := s.EncryptRecordData(record, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *recordEncryptionServiceImpl) OpenRecordSecret(record *models.TblMedicalRecord, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if record.DataKey == "" {
+		return "", fmt.Errorf("record %d has no data key", record.RecordId)
+	}
+	secret, err := s.DecryptRecordData(record, data)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// streamSegmentSize is the plain size of one sealed segment of a streamed blob.
+const streamSegmentSize = 1 << 20
+
+// NewRecordEncryptWriter encrypts what is written to it with the record's data key, for blobs
+// too large to hold in memory. The stream is cut into segments, each written as a 4 byte
+// length, a byte marking the last segment and the sealed segment; the segment's position and
+// mark are authenticated so segments cannot be reordered or dropped. Close writes the last
+// segment.
+func (s *recordEncryptionServiceImpl) NewRecordEncryptWriter(record *models.TblMedicalRecord, dst io.Writer) (io.WriteCloser, error) {
+	dataKey, err := s.recordDataKey(record)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return nopWriteCloser{dst}, nil
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{gcm: gcm, dst: dst, buf: make([]byte, 0, streamSegmentSize)}, nil
+}
+
+// DecryptRecordStream decrypts a blob written by NewRecordEncryptWriter into dst. Each segment
+// is checked before it is written, and a stream that ends before its last segment fails.
+func (s *recordEncryptionServiceImpl) DecryptRecordStream(record *models.TblMedicalRecord, dst io.Writer, src io.Reader) error {
+	if record.DataKey == "" {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	dataKey, err := s.unwrapDataKey(record.DataKey, record.KeyVersion)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	var header [5]byte
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return fmt.Errorf("encrypted stream ends before its last segment: %w", err)
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size < uint32(gcm.NonceSize()+gcm.Overhead()) || size > uint32(streamSegmentSize+gcm.NonceSize()+gcm.Overhead()) {
+			return fmt.Errorf("encrypted stream segment %d has an invalid size", index)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return fmt.Errorf("encrypted stream segment %d is truncated: %w", index, err)
+		}
+		last := header[4] == 1
+		nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+		plain, err := gcm.Open(nil, nonce, ciphertext, segmentAAD(index, last))
+		if err != nil {
+			return fmt.Errorf("encrypted stream segment %d: %w", index, err)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+type segmentWriter struct {
+	gcm   cipher.AEAD
+	dst   io.Writer
+	buf   []byte
+	index uint64
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data follows, so the last one can be marked.
+		if len(w.buf) == streamSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):streamSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *segmentWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *segmentWriter) seal(last bool) error {
+	nonce := make([]byte, w.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := w.gcm.Seal(nonce, nonce, w.buf, segmentAAD(w.index, last))
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(sealed)))
+	if last {
+		header[4] = 1
+	}
+	if _, err := w.dst.Write(append(header, sealed...)); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+func segmentAAD(index uint64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad[:8], index)
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (s *recordEncryptionServiceImpl) unwrapDataKey(wrappedKey string, keyVersion int) ([]byte, error) {
+	masterKey, ok := s.masterKeys[keyVersion]
+	if !ok {
+		return nil, fmt.Errorf("master key version %d is not configured", keyVersion)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(masterKey, wrapped)
+}
+
+// sealAESGCM returns nonce || AES-GCM ciphertext.
+func sealAESGCM(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func openAESGCM(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"biostat/repository"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"path/filepath"
+	"strings"
+
+	pdfcpuapi "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// ThumbnailMaxSize is the longest edge, in pixels, of generated record thumbnails.
+const ThumbnailMaxSize = 320
+
+// ErrPreviewUnsupported is returned when no preview can be built for a record, e.g. an
+// unknown file type, a DigiLocker reference or a PDF pdfcpu cannot parse.
+var ErrPreviewUnsupported = errors.New("preview is not supported for this record")
+
+// RecordPreviewService builds the thumbnail and page count shown in the records list.
+type RecordPreviewService interface {
+	GenerateRecordPreview(ctx context.Context, record *models.TblMedicalRecord) error
+}
+
+type recordPreviewServiceImpl struct {
+	recordRepo repository.TblMedicalRecordRepository
+	fileStore  FileStoreService
+}
+
+func NewRecordPreviewService(recordRepo repository.TblMedicalRecordRepository, fileStore FileStoreService) RecordPreviewService {
+	return &recordPreviewServiceImpl{recordRepo: recordRepo, fileStore: fileStore}
+}
+
+// GenerateRecordPreview renders a JPEG thumbnail of the record (the largest image on the
+// first page for PDFs, a downscaled copy for images), stores it next to the record file and
+// saves its reference, preview status and the page count on the record. pdfcpu does not
+// rasterize text, so text-only PDFs get a placeholder page in the shape of their first page.
+func (s *recordPreviewServiceImpl) GenerateRecordPreview(ctx context.Context, record *models.TblMedicalRecord) error {
+	if record.UploadDestination == constant.UploadDestinationDigiLocker {
+		return ErrPreviewUnsupported
+	}
+	data, err := s.readRecordData(ctx, record)
+	if err != nil {
+		return err
+	}
+	var source image.Image
+	pageCount := 1
+	previewStatus := constant.PreviewRendered
+	switch {
+	case isPDFRecord(record, data):
+		source, pageCount, err = firstPageImage(data)
+		if err == nil && source == nil {
+			log.Printf("@GenerateRecordPreview record %d: no raster image on first page, using a placeholder", record.RecordId)
+			source, previewStatus = pdfPlaceholder(data), constant.PreviewPlaceholder
+		}
+	case strings.HasPrefix(record.FileType, "image/") || isImageExt(record.RecordName):
+		source, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrPreviewUnsupported, err)
+		}
+	default:
+		err = ErrPreviewUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	thumbnail, err := encodeThumbnail(source)
+	if err != nil {
+		return err
+	}
+	objectKey := fmt.Sprintf("thumbnail_%d.jpg", record.RecordId)
+	thumbnailURL, err := s.fileStore.SaveRecordDerivative(ctx, record, objectKey, thumbnail, "image/jpeg")
+	if err != nil {
+		return err
+	}
+	return s.recordRepo.UpdateRecordPreview(record.RecordId, thumbnailURL, previewStatus, pageCount)
+}
+
+func (s *recordPreviewServiceImpl) readRecordData(ctx context.Context, record *models.TblMedicalRecord) ([]byte, error) {
+	if len(record.FileData) == 0 && record.RecordUrl == "" {
+		return nil, ErrPreviewUnsupported
+	}
+	return s.fileStore.ReadRecordFile(ctx, record)
+}
+
+func isPDFRecord(record *models.TblMedicalRecord, data []byte) bool {
+	return record.FileType == "application/pdf" || strings.EqualFold(filepath.Ext(record.RecordName), ".pdf") || bytes.HasPrefix(data, []byte("%PDF"))
+}
+
+func isImageExt(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// firstPageImage returns the page count and the largest decodable image on page 1, or a
+// nil image when the page has none.
+func firstPageImage(data []byte) (image.Image, int, error) {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	pageCount, err := pdfcpuapi.PageCount(bytes.NewReader(data), conf)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrPreviewUnsupported, err)
+	}
+	pages, err := pdfcpuapi.ExtractImagesRaw(bytes.NewReader(data), []string{"1"}, conf)
+	if err != nil {
+		log.Println("@firstPageImage->ExtractImagesRaw:", err)
+		return nil, pageCount, nil
+	}
+	var best image.Image
+	bestArea := 0
+	for _, images := range pages {
+		for _, img := range images {
+			if img.IsImgMask || img.Width*img.Height <= bestArea {
+				continue
+			}
+			decoded, _, err := image.Decode(img)
+			if err != nil {
+				continue
+			}
+			best, bestArea = decoded, img.Width*img.Height
+		}
+	}
+	return best, pageCount, nil
+}
+
+// pdfPlaceholder draws a blank page with grey bars for lines of text, in the aspect ratio of
+// the first page of the PDF (A4 when it cannot be read).
+func pdfPlaceholder(data []byte) image.Image {
+	width, height := 210.0, 297.0
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	if dims, err := pdfcpuapi.PageDims(bytes.NewReader(data), conf); err == nil && len(dims) > 0 && dims[0].Width > 0 && dims[0].Height > 0 {
+		width, height = dims[0].Width, dims[0].Height
+	}
+	page := image.Rect(0, 0, ThumbnailMaxSize, ThumbnailMaxSize)
+	if width >= height {
+		page.Max.Y = max(1, int(float64(ThumbnailMaxSize)*height/width))
+	} else {
+		page.Max.X = max(1, int(float64(ThumbnailMaxSize)*width/height))
+	}
+	dst := image.NewRGBA(page)
+	draw.Draw(dst, page, image.NewUniform(color.White), image.Point{}, draw.Src)
+	margin := page.Dx() / 10
+	line := color.RGBA{R: 0xd0, G: 0xd0, B: 0xd0, A: 0xff}
+	for i, y := 0, margin; y+4 < page.Dy()-margin; i, y = i+1, y+12 {
+		right := page.Dx() - margin
+		if i%5 == 4 {
+			// Shorter last line of each paragraph.
+			right = margin + (right-margin)*3/5
+		}
+		draw.Draw(dst, image.Rect(margin, y, right, y+4), image.NewUniform(line), image.Point{}, draw.Src)
+	}
+	return dst
+}
+
+// encodeThumbnail scales src to fit ThumbnailMaxSize on a white background and encodes it as JPEG.
+func encodeThumbnail(src image.Image) ([]byte, error) {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, ErrPreviewUnsupported
+	}
+	if width > ThumbnailMaxSize || height > ThumbnailMaxSize {
+		if width >= height {
+			height = max(1, height*ThumbnailMaxSize/width)
+			width = ThumbnailMaxSize
+		} else {
+			width = max(1, width*ThumbnailMaxSize/height)
+			height = ThumbnailMaxSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
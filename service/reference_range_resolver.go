@@ -0,0 +1,267 @@
+package service
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PatientRangeResolver picks the reference range that applies to one patient's result.
+//
+// Precedence:
+//  1. a patient-specific override for the test and component;
+//  2. the master range of the component whose gender and age band match the patient at the
+//     result date, preferring ranges that constrain both gender and age, then age only, then
+//     gender only, then neither; among those the narrowest age band, then a range defined for
+//     the same test, then the most recently updated;
+//  3. no range, the result is left unflagged.
+type PatientRangeResolver struct {
+	DateOfBirth *time.Time
+	Gender      string
+	ranges      map[uint64][]models.DiagnosticTestReferenceRange
+	overrides   map[[2]uint64]models.PatientTestReferenceRange
+	units       UnitRegistry
+}
+
+// ResolvedRange is the range applied to a result and why it was chosen.
+type ResolvedRange struct {
+	Source  string
+	RangeId *uint64
+	Min     *float64
+	Max     *float64
+	Units   string
+	Reason  string
+}
+
+func NewPatientRangeResolver(patient *models.SystemUser_, ranges []models.DiagnosticTestReferenceRange,
+	overrides []models.PatientTestReferenceRange, units UnitRegistry) *PatientRangeResolver {
+	resolver := &PatientRangeResolver{
+		ranges:    map[uint64][]models.DiagnosticTestReferenceRange{},
+		overrides: map[[2]uint64]models.PatientTestReferenceRange{},
+		units:     units,
+	}
+	if patient != nil {
+		resolver.DateOfBirth = patient.DateOfBirth
+		resolver.Gender = patient.Gender
+	}
+	for _, r := range ranges {
+		resolver.ranges[r.DiagnosticTestComponentId] = append(resolver.ranges[r.DiagnosticTestComponentId], r)
+	}
+	for _, override := range overrides {
+		resolver.AddOverride(override)
+	}
+	return resolver
+}
+
+// AddRange makes a master range created after the resolver was built, such as one taken from
+// the report being digitized, available to the results that follow.
+func (r *PatientRangeResolver) AddRange(referenceRange models.DiagnosticTestReferenceRange) {
+	r.ranges[referenceRange.DiagnosticTestComponentId] = append(r.ranges[referenceRange.DiagnosticTestComponentId], referenceRange)
+}
+
+func (r *PatientRangeResolver) AddOverride(override models.PatientTestReferenceRange) {
+	if override.IsDeleted != 0 {
+		return
+	}
+	r.overrides[[2]uint64{override.DiagnosticTestID, override.DiagnosticTestComponentId}] = override
+}
+
+func (r *PatientRangeResolver) Resolve(testId, componentId uint64, resultDate time.Time) ResolvedRange {
+	if override, ok := r.overrides[[2]uint64{testId, componentId}]; ok {
+		min, max := override.NormalMin, override.NormalMax
+		return ResolvedRange{
+			Source: constant.RangeSourcePatientOverride,
+			Min:    &min,
+			Max:    &max,
+			Units:  override.Units,
+			Reason: "patient-specific reference range",
+		}
+	}
+
+	age, ageKnown := ageAt(r.DateOfBirth, resultDate)
+	gender := normalizeGender(r.Gender)
+	var best *models.DiagnosticTestReferenceRange
+	var bestRank [4]float64
+	for i := range r.ranges[componentId] {
+		candidate := &r.ranges[componentId][i]
+		if candidate.IsDeleted != 0 {
+			continue
+		}
+		rangeGender := normalizeGender(candidate.Gender)
+		if rangeGender != "" && rangeGender != gender {
+			continue
+		}
+		low, high, hasAge := rangeAgeBand(candidate)
+		if hasAge && (!ageKnown || age < low || age > high) {
+			continue
+		}
+		rank := [4]float64{0, -math.MaxFloat64, 0, float64(candidate.UpdatedAt.Unix())}
+		if hasAge {
+			rank[0] += 2
+			rank[1] = -(high - low)
+		}
+		if rangeGender != "" {
+			rank[0]++
+		}
+		if candidate.DiagnosticTestId == testId {
+			rank[2] = 1
+		}
+		if best == nil || rankAbove(rank, bestRank) {
+			best, bestRank = candidate, rank
+		}
+	}
+	if best == nil {
+		reason := "no reference range matches"
+		if !ageKnown {
+			reason += "; patient age unknown"
+		}
+		return ResolvedRange{Source: constant.RangeSourceNone, Reason: reason}
+	}
+
+	min, max := best.NormalMin, best.NormalMax
+	id := best.TestReferenceRangeId
+	var matched []string
+	if g := normalizeGender(best.Gender); g != "" {
+		matched = append(matched, "gender "+g)
+	}
+	if low, high, hasAge := rangeAgeBand(best); hasAge {
+		matched = append(matched, fmt.Sprintf("age %s-%s at %.1f", formatAge(low), formatAge(high), age))
+	}
+	if len(matched) == 0 {
+		matched = append(matched, "general range")
+	}
+	return ResolvedRange{
+		Source:  constant.RangeSourceMaster,
+		RangeId: &id,
+		Min:     &min,
+		Max:     &max,
+		Units:   best.Units,
+		Reason:  fmt.Sprintf("reference range %d: %s", id, strings.Join(matched, ", ")),
+	}
+}
+
+// Apply resolves the range of result and stores it on the result together with the flag.
+// It reports whether any stored field changed.
+func (r *PatientRangeResolver) Apply(result *models.PatientDiagnosticTestResultValue) bool {
+	resolved := r.Resolve(result.DiagnosticTestId, result.DiagnosticTestComponentId, result.ResultDate)
+	min, max, units := resolved.Min, resolved.Max, resolved.Units
+	if min != nil && max != nil && units != "" && result.ResultUnit != "" {
+		convertedMin, minOk := r.units.Convert(result.DiagnosticTestComponentId, *min, units, result.ResultUnit)
+		convertedMax, maxOk := r.units.Convert(result.DiagnosticTestComponentId, *max, units, result.ResultUnit)
+		if minOk && maxOk {
+			min, max, units = &convertedMin, &convertedMax, result.ResultUnit
+		}
+	}
+	flag := rangeFlag(result.ResultValue, min, max)
+
+	changed := result.AppliedRangeSource != resolved.Source ||
+		!sameUint64(result.AppliedRangeId, resolved.RangeId) ||
+		!sameFloat64(result.AppliedNormalMin, min) ||
+		!sameFloat64(result.AppliedNormalMax, max) ||
+		result.AppliedRangeUnits != units ||
+		result.AppliedRangeReason != resolved.Reason ||
+		result.RangeFlag != flag
+	result.AppliedRangeSource = resolved.Source
+	result.AppliedRangeId = resolved.RangeId
+	result.AppliedNormalMin = min
+	result.AppliedNormalMax = max
+	result.AppliedRangeUnits = units
+	result.AppliedRangeReason = resolved.Reason
+	result.RangeFlag = flag
+	return changed
+}
+
+func rangeFlag(value float64, min, max *float64) string {
+	switch {
+	case value == 0 || min == nil || max == nil:
+		return ""
+	case value < *min:
+		return constant.RangeFlagLow
+	case value > *max:
+		return constant.RangeFlagHigh
+	default:
+		return constant.RangeFlagNormal
+	}
+}
+
+func rankAbove(a, b [4]float64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// ageAt returns the age in years on date.
+func ageAt(dob *time.Time, date time.Time) (float64, bool) {
+	if dob == nil || dob.IsZero() || date.Before(*dob) {
+		return 0, false
+	}
+	return date.Sub(*dob).Hours() / 24 / 365.25, true
+}
+
+func normalizeGender(gender string) string {
+	switch strings.ToLower(strings.TrimSpace(gender)) {
+	case "m", "male":
+		return "male"
+	case "f", "female":
+		return "female"
+	}
+	return ""
+}
+
+// rangeAgeBand reads the age band of a range in years. AgeGroup takes "18-60", "60+", ">=18",
+// "<12" or one of the named groups; otherwise a non-zero Age is the lower bound.
+func rangeAgeBand(r *models.DiagnosticTestReferenceRange) (float64, float64, bool) {
+	group := strings.ToLower(strings.ReplaceAll(r.AgeGroup, " ", ""))
+	group = strings.TrimSuffix(strings.TrimSuffix(group, "years"), "yrs")
+	switch group {
+	case "newborn", "infant":
+		return 0, 1, true
+	case "child", "children", "pediatric", "paediatric":
+		return 0, 18, true
+	case "adult":
+		return 18, 150, true
+	case "senior", "elderly", "geriatric":
+		return 60, 150, true
+	}
+	if low, high, found := strings.Cut(group, "-"); found {
+		l, errLow := strconv.ParseFloat(low, 64)
+		h, errHigh := strconv.ParseFloat(high, 64)
+		if errLow == nil && errHigh == nil && l <= h {
+			return l, h, true
+		}
+	}
+	for _, prefix := range []string{">=", "<=", ">", "<"} {
+		if value, err := strconv.ParseFloat(strings.TrimPrefix(group, prefix), 64); err == nil && strings.HasPrefix(group, prefix) {
+			if strings.HasPrefix(prefix, ">") {
+				return value, 150, true
+			}
+			return 0, value, true
+		}
+	}
+	if value, err := strconv.ParseFloat(strings.TrimSuffix(group, "+"), 64); err == nil && strings.HasSuffix(group, "+") {
+		return value, 150, true
+	}
+	if r.Age > 0 {
+		return float64(r.Age), 150, true
+	}
+	return 0, 0, false
+}
+
+func formatAge(age float64) string {
+	return strconv.FormatFloat(age, 'f', -1, 64)
+}
+
+func sameUint64(a, b *uint64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func sameFloat64(a, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"biostat/constant"
+	"biostat/models"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CompareReports aligns the components of two reports, or of the reports of two dates, and
+// tells what changed between them. The older side is always reported as before.
+func (ps *PatientServiceImpl) CompareReports(patientId uint64, input models.ReportComparisonRequest) (*models.ReportComparison, error) {
+	byId := input.ReportIdA != nil && input.ReportIdB != nil
+	byDate := input.DateA != nil && input.DateB != nil
+	if byId == byDate {
+		return nil, errors.New("provide either two report ids or two report dates")
+	}
+	before, err := ps.comparisonSide(patientId, input.ReportIdA, input.DateA)
+	if err != nil {
+		return nil, err
+	}
+	after, err := ps.comparisonSide(patientId, input.ReportIdB, input.DateB)
+	if err != nil {
+		return nil, err
+	}
+	if after.ReportDate.Before(before.ReportDate) {
+		before, after = after, before
+	}
+	for _, id := range before.ReportIds {
+		for _, other := range after.ReportIds {
+			if id == other {
+				return nil, errors.New("both sides of the comparison are the same report")
+			}
+		}
+	}
+	if before.Label == after.Label {
+		before.Label = fmt.Sprintf("%s (%d)", before.Label, before.ReportIds[0])
+		after.Label = fmt.Sprintf("%s (%d)", after.Label, after.ReportIds[0])
+	}
+
+	rows, err := ps.patientRepo.GetComparisonResults(patientId, append(append([]uint64{}, before.ReportIds...), after.ReportIds...))
+	if err != nil {
+		return nil, err
+	}
+	beforeIds := map[uint64]bool{}
+	for _, id := range before.ReportIds {
+		beforeIds[id] = true
+	}
+	beforeRows, afterRows := map[uint64]models.ComparisonResultRow{}, map[uint64]models.ComparisonResultRow{}
+	beforeTests, afterTests := map[string]bool{}, map[string]bool{}
+	var componentIds []uint64
+	for _, row := range rows {
+		// Rows come oldest first, so a component measured twice on one side keeps its latest result.
+		if beforeIds[row.ReportId] {
+			beforeRows[row.DiagnosticTestComponentId] = row
+			beforeTests[row.TestName] = true
+		} else {
+			afterRows[row.DiagnosticTestComponentId] = row
+			afterTests[row.TestName] = true
+		}
+		componentIds = append(componentIds, row.DiagnosticTestComponentId)
+	}
+	var unitRegistry UnitRegistry
+	if len(componentIds) > 0 {
+		units, err := ps.diagnosticRepo.GetComponentUnits(componentIds)
+		if err != nil {
+			return nil, err
+		}
+		unitRegistry = NewUnitRegistry(units)
+	}
+
+	comparison := &models.ReportComparison{
+		Before:       *before,
+		After:        *after,
+		Components:   []models.ComponentComparison{},
+		NewTests:     testsOnlyIn(afterTests, beforeTests),
+		MissingTests: testsOnlyIn(beforeTests, afterTests),
+		Summary:      map[string]int{},
+	}
+	seen := map[uint64]bool{}
+	for _, side := range []map[uint64]models.ComparisonResultRow{afterRows, beforeRows} {
+		for componentId := range side {
+			if seen[componentId] {
+				continue
+			}
+			seen[componentId] = true
+			entry := compareComponent(beforeRows, afterRows, componentId, unitRegistry)
+			comparison.Components = append(comparison.Components, entry)
+			comparison.Summary[entry.Change]++
+			if entry.Transition != "" {
+				comparison.Summary["transitions"]++
+			}
+		}
+	}
+	sort.SliceStable(comparison.Components, func(i, j int) bool {
+		a, b := comparison.Components[i], comparison.Components[j]
+		if a.TestName != b.TestName {
+			return a.TestName < b.TestName
+		}
+		return a.TestComponentName < b.TestComponentName
+	})
+	return comparison, nil
+}
+
+func (ps *PatientServiceImpl) comparisonSide(patientId uint64, reportId *uint64, reportDate *time.Time) (*models.ReportComparisonSide, error) {
+	reports, err := ps.patientRepo.GetComparisonReports(patientId, reportId, reportDate)
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		if reportId != nil {
+			return nil, fmt.Errorf("report %d not found", *reportId)
+		}
+		return nil, fmt.Errorf("no reports on %s", reportDate.Format("2006-01-02"))
+	}
+	side := &models.ReportComparisonSide{ReportDate: reports[0].ReportDate}
+	var names []string
+	for _, report := range reports {
+		side.ReportIds = append(side.ReportIds, report.PatientDiagnosticReportId)
+		if report.ReportName != "" {
+			names = append(names, report.ReportName)
+		}
+	}
+	side.ReportName = strings.Join(names, ", ")
+	side.Label = side.ReportDate.Format("02-01-2006")
+	return side, nil
+}
+
+func compareComponent(beforeRows, afterRows map[uint64]models.ComparisonResultRow, componentId uint64, unitRegistry UnitRegistry) models.ComponentComparison {
+	entry := models.ComponentComparison{DiagnosticTestComponentId: componentId}
+	beforeRow, hasBefore := beforeRows[componentId]
+	afterRow, hasAfter := afterRows[componentId]
+	if hasBefore {
+		entry.Before = comparedValue(beforeRow)
+		entry.TestComponentName, entry.TestName, entry.LoincCode = beforeRow.TestComponentName, beforeRow.TestName, beforeRow.LoincCode
+	}
+	if hasAfter {
+		entry.After = comparedValue(afterRow)
+		entry.TestComponentName, entry.TestName, entry.LoincCode = afterRow.TestComponentName, afterRow.TestName, afterRow.LoincCode
+	}
+	switch {
+	case !hasBefore:
+		entry.Change = constant.ComparisonNew
+		return entry
+	case !hasAfter:
+		entry.Change = constant.ComparisonMissing
+		return entry
+	}
+
+	entry.Change = constant.ComparisonUnchanged
+	if entry.Before.Numeric != nil && entry.After.Numeric != nil {
+		previous, ok := unitRegistry.Convert(componentId, *entry.Before.Numeric, entry.Before.Unit, entry.After.Unit)
+		if ok {
+			delta := roundUnitValue(*entry.After.Numeric - previous)
+			entry.Delta = &delta
+			if previous != 0 {
+				percent := roundUnitValue(delta / math.Abs(previous) * 100)
+				entry.PercentChange = &percent
+			}
+			if delta != 0 {
+				entry.Change = constant.ComparisonChanged
+			}
+		} else {
+			entry.Change = constant.ComparisonChanged
+		}
+	} else if !strings.EqualFold(entry.Before.Value, entry.After.Value) {
+		entry.Change = constant.ComparisonChanged
+	}
+	if entry.Before.Status != "" && entry.After.Status != "" && entry.Before.Status != entry.After.Status {
+		entry.Transition = entry.Before.Status + "_to_" + entry.After.Status
+	}
+	return entry
+}
+
+// comparedValue reads a result the way the report grid shows it: a zero value is a
+// qualitative result whose text is in the status, flagged normal or abnormal from that text.
+func comparedValue(row models.ComparisonResultRow) *models.ComparedValue {
+	value := &models.ComparedValue{
+		ReportId:   row.ReportId,
+		Unit:       row.ResultUnit,
+		NormalMin:  row.NormalMin,
+		NormalMax:  row.NormalMax,
+		ResultDate: row.ResultDate,
+	}
+	if row.ResultValue == 0 {
+		value.Value = row.ResultStatus
+		if value.Value == "" {
+			value.Value = "-"
+		}
+		value.Status = row.RangeFlag
+		if value.Status == "" {
+			value.Status = qualitativeFlag(row.ResultStatus)
+		}
+		return value
+	}
+	numeric := row.ResultValue
+	value.Numeric = &numeric
+	value.Value = formatTrendValue(numeric)
+	value.Status = row.RangeFlag
+	if value.Status == "" {
+		value.Status = rangeFlag(numeric, row.NormalMin, row.NormalMax)
+	}
+	return value
+}
+
+// qualitativeFindings map the text of a qualitative result to its flag, first match wins:
+// "abnormal" contains "normal", and "non-reactive" and "not detected" contain their positive
+// counterparts.
+var qualitativeFindings = []struct {
+	words []string
+	flag  string
+}{
+	{[]string{"abnormal"}, constant.RangeFlagAbnormal},
+	{[]string{"negative", "non-reactive", "non reactive", "nonreactive", "not detected", "absent", "nil", "normal"}, constant.RangeFlagNormal},
+	{[]string{"positive", "reactive", "detected", "present", "trace", "+"}, constant.RangeFlagAbnormal},
+}
+
+// qualitativeFlag returns the flag of a qualitative result, or an empty string for text that
+// is not a known finding.
+func qualitativeFlag(text string) string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" {
+		return ""
+	}
+	for _, finding := range qualitativeFindings {
+		for _, word := range finding.words {
+			if strings.Contains(text, word) {
+				return finding.flag
+			}
+		}
+	}
+	return ""
+}
+
+func testsOnlyIn(tests, others map[string]bool) []string {
+	only := []string{}
+	for name := range tests {
+		if name != "" && !others[name] {
+			only = append(only, name)
+		}
+	}
+	sort.Strings(only)
+	return only
+}
+
+// ExportReportComparison renders the comparison with the Excel or PDF generator of the result
+// grid, one column per side followed by the change.
+func (ps *PatientServiceImpl) ExportReportComparison(patientId uint64, input models.ReportComparisonRequest, format string) ([]byte, error) {
+	comparison, err := ps.CompareReports(patientId, input)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{comparison.Before.Label, comparison.After.Label, "Change"}
+	switch format {
+	case "excel":
+		rows := make([]map[string]interface{}, 0, len(comparison.Components))
+		for _, entry := range comparison.Components {
+			var cells []models.CellData
+			for i, cell := range comparisonCells(entry) {
+				cells = append(cells, models.CellData{Value: cell.Value, ColourClass: cell.ColourClass, ResultDate: columns[i]})
+			}
+			rows = append(rows, map[string]interface{}{
+				"test_component_name": entry.TestComponentName,
+				"loinc_code":          entry.LoincCode,
+				"ref_unit":            comparisonUnit(entry),
+				"ref_range":           comparisonRange(entry),
+				"trend_values":        cells,
+			})
+		}
+		return ps.GenerateExcelFile(map[string]interface{}{"dates": columns, "rows": rows})
+	case "pdf":
+		profile, err := ps.userRepo.GetSystemUserInfo(patientId)
+		if err != nil {
+			return nil, err
+		}
+		data := buildReportData(&profile, nil, columns, nil)
+		data.Title = "Lab Report Comparison"
+		for _, entry := range comparison.Components {
+			result := models.TestResult{
+				TestComponentName: entry.TestComponentName,
+				LoincCode:         entry.LoincCode,
+				Unit:              comparisonUnit(entry),
+				RefRange:          comparisonRange(entry),
+			}
+			for i, cell := range comparisonCells(entry) {
+				result.TrendValues = append(result.TrendValues, models.Cell{
+					ResultDate: columns[i],
+					Value:      cell.Value,
+					IsNormal:   cell.ColourClass != "text-red-500" && cell.ColourClass != "text-blue-500",
+				})
+			}
+			data.TestResults = append(data.TestResults, result)
+		}
+		return ps.GeneratePDF(data)
+	default:
+		return nil, fmt.Errorf("unsupported export format %q, expected pdf or excel", format)
+	}
+}
+
+// comparisonCells returns the before, after and change cells of a component.
+func comparisonCells(entry models.ComponentComparison) []models.CellData {
+	cells := make([]models.CellData, 3)
+	for i, value := range []*models.ComparedValue{entry.Before, entry.After} {
+		cells[i] = models.CellData{Value: "-"}
+		if value != nil {
+			cells[i] = models.CellData{Value: value.Value, ColourClass: rangeFlagColourClass(value.Status)}
+		}
+	}
+	change := entry.Change
+	if entry.Delta != nil {
+		change = formatTrendValue(*entry.Delta)
+		if *entry.Delta > 0 {
+			change = "+" + change
+		}
+	}
+	if entry.Transition != "" {
+		change += " (" + strings.ReplaceAll(entry.Transition, "_", " ") + ")"
+	}
+	cells[2] = models.CellData{Value: change}
+	if entry.After != nil {
+		cells[2].ColourClass = rangeFlagColourClass(entry.After.Status)
+	}
+	return cells
+}
+
+func rangeFlagColourClass(flag string) string {
+	switch flag {
+	case constant.RangeFlagLow:
+		return "text-blue-500"
+	case constant.RangeFlagHigh, constant.RangeFlagAbnormal:
+		return "text-red-500"
+	case constant.RangeFlagNormal:
+		return "text-green-500"
+	}
+	return ""
+}
+
+func comparisonUnit(entry models.ComponentComparison) string {
+	if entry.After != nil && entry.After.Unit != "" {
+		return entry.After.Unit
+	}
+	if entry.Before != nil {
+		return entry.Before.Unit
+	}
+	return ""
+}
+
+func comparisonRange(entry models.ComponentComparison) string {
+	value := entry.After
+	if value == nil {
+		value = entry.Before
+	}
+	if value == nil || value.NormalMin == nil || value.NormalMax == nil {
+		return "-"
+	}
+	return formatTrendValue(*value.NormalMin) + " - " + formatTrendValue(*value.NormalMax)
+}
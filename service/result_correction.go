@@ -0,0 +1,339 @@
+package service
+
+import (
+	"biostat/constant"
+	"biostat/database"
+	"biostat/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var manualResultSources = map[string]bool{
+	constant.ResultSourceManual: true,
+	constant.ResultSourceDevice: true,
+	constant.ResultSourceABDM:   true,
+}
+
+// AddResultValue adds a result to a report of the patient by hand. The value goes through the
+// same unit conversion and range flagging as a digitized one.
+func (s *DiagnosticServiceImpl) AddResultValue(reportId, userId uint64, input models.ManualResultRequest) (*models.PatientDiagnosticTestResultValue, error) {
+	report, err := s.medicalRecordsRepo.GetDiagnosticReport(reportId, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.canChangeResults(report.PatientId, userId); err != nil {
+		return nil, err
+	}
+	source, err := manualResultSource(input.Source)
+	if err != nil {
+		return nil, err
+	}
+	if input.DiagnosticTestComponentId == 0 {
+		return nil, errors.New("diagnostic_test_component_id is required")
+	}
+	testId := input.DiagnosticTestId
+	if testId == 0 {
+		if testId, err = s.diagnosticRepo.GetComponentTestId(input.DiagnosticTestComponentId); err != nil {
+			return nil, fmt.Errorf("component %d is not mapped to a test: %w", input.DiagnosticTestComponentId, err)
+		}
+	}
+	resultDate := report.ReportDate
+	if input.ResultDate != nil {
+		resultDate = *input.ResultDate
+	}
+	now := time.Now()
+	result := &models.PatientDiagnosticTestResultValue{
+		PatientDiagnosticReportId: reportId,
+		DiagnosticTestId:          testId,
+		PatientId:                 report.PatientId,
+		DiagnosticTestComponentId: input.DiagnosticTestComponentId,
+		ResultValue:               *input.ResultValue,
+		ResultUnit:                input.ResultUnit,
+		ResultDate:                resultDate,
+		ResultComment:             input.ResultComment,
+		UDF1:                      input.Qualifier,
+		Source:                    source,
+		VerifiedBy:                &userId,
+		VerifiedAt:                &now,
+	}
+	if err := s.normalizeManualResult(result); err != nil {
+		return nil, err
+	}
+
+	tx := database.DB.Begin()
+	testRecord := models.PatientDiagnosticTest{PatientDiagnosticReportId: reportId, DiagnosticTestId: testId, TestDate: resultDate}
+	if err := s.diagnosticRepo.EnsurePatientDiagnosticTest(tx, &testRecord); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := s.diagnosticRepo.SavePatientReportResultValue(tx, result); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	audit := resultAudit(result, constant.CREATE, userId, input.Reason)
+	audit.NewValue, audit.NewUnit, audit.NewSource = &result.ResultValue, result.ResultUnit, result.Source
+	if err := s.diagnosticRepo.SaveResultAudit(tx, audit); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	s.refreshReportResults(report.PatientId, reportId)
+	return result, nil
+}
+
+// UpdateResultValue corrects the value of a stored result. The result becomes a manual one
+// verified by userId, and the audit keeps the value the AI first extracted.
+func (s *DiagnosticServiceImpl) UpdateResultValue(resultId int, userId uint64, input models.ManualResultRequest) (*models.PatientDiagnosticTestResultValue, error) {
+	result, err := s.diagnosticRepo.GetResultValue(resultId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.canChangeResults(result.PatientId, userId); err != nil {
+		return nil, err
+	}
+	if result.IsDerived {
+		return nil, errors.New("derived results are calculated from other results, correct those instead")
+	}
+	if input.DiagnosticTestComponentId != 0 && input.DiagnosticTestComponentId != result.DiagnosticTestComponentId {
+		return nil, errors.New("the component of a result cannot be changed, delete the result and add a new one")
+	}
+	source, err := manualResultSource(input.Source)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := s.resultChangeAudit(result, constant.UPDATE, userId, input.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result.ResultValue = *input.ResultValue
+	if input.ResultUnit != "" {
+		result.ResultUnit = input.ResultUnit
+	}
+	if input.ResultDate != nil {
+		result.ResultDate = *input.ResultDate
+	}
+	if input.ResultComment != "" {
+		result.ResultComment = input.ResultComment
+	}
+	if input.Qualifier != "" {
+		result.UDF1 = input.Qualifier
+	}
+	result.Source = source
+	result.VerifiedBy = &userId
+	result.VerifiedAt = &now
+	if err := s.normalizeManualResult(result); err != nil {
+		return nil, err
+	}
+	audit.NewValue, audit.NewUnit, audit.NewSource = &result.ResultValue, result.ResultUnit, result.Source
+
+	tx := database.DB.Begin()
+	if err := s.diagnosticRepo.UpdateResultValue(tx, result); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := s.diagnosticRepo.SaveResultAudit(tx, audit); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := s.resolveResultAlert(tx, audit); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	s.refreshReportResults(result.PatientId, result.PatientDiagnosticReportId)
+	return result, nil
+}
+
+// DeleteResultValue removes a stored result, keeping its last value in the audit.
+func (s *DiagnosticServiceImpl) DeleteResultValue(resultId int, userId uint64, reason string) error {
+	result, err := s.diagnosticRepo.GetResultValue(resultId)
+	if err != nil {
+		return err
+	}
+	if err := s.canChangeResults(result.PatientId, userId); err != nil {
+		return err
+	}
+	if result.IsDerived {
+		return errors.New("derived results are calculated from other results, delete those instead")
+	}
+	audit, err := s.resultChangeAudit(result, constant.DELETE, userId, reason)
+	if err != nil {
+		return err
+	}
+
+	tx := database.DB.Begin()
+	if err := s.diagnosticRepo.DeleteResultValue(tx, resultId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := s.diagnosticRepo.SaveResultAudit(tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := s.resolveResultAlert(tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	s.refreshReportResults(result.PatientId, result.PatientDiagnosticReportId)
+	return nil
+}
+
+// GetResultValueAudit returns the changes made to a result, oldest first. It is still available
+// after the result was deleted.
+func (s *DiagnosticServiceImpl) GetResultValueAudit(resultId int, userId uint64) ([]models.PatientDiagnosticResultAudit, error) {
+	audits, err := s.diagnosticRepo.GetResultAudits(resultId)
+	if err != nil {
+		return nil, err
+	}
+	var patientId uint64
+	if len(audits) > 0 {
+		patientId = audits[0].PatientId
+	} else {
+		result, err := s.diagnosticRepo.GetResultValue(resultId)
+		if err != nil {
+			return nil, err
+		}
+		patientId = result.PatientId
+		audits = []models.PatientDiagnosticResultAudit{}
+	}
+	if patientId != userId {
+		if err := s.patientService.CanContinue(patientId, userId, constant.PermissionViewHealth); err != nil {
+			return nil, err
+		}
+	}
+	return audits, nil
+}
+
+// resolveResultAlert closes the critical alert of a result that is corrected or deleted, noting
+// the change on the alert.
+func (s *DiagnosticServiceImpl) resolveResultAlert(tx *gorm.DB, audit *models.PatientDiagnosticResultAudit) error {
+	if s.criticalAlertService == nil {
+		return nil
+	}
+	note := "Result deleted"
+	if audit.OperationType == constant.UPDATE {
+		note = fmt.Sprintf("Result corrected to %g %s", *audit.NewValue, audit.NewUnit)
+	}
+	if audit.Reason != "" {
+		note += ": " + audit.Reason
+	}
+	return s.criticalAlertService.ResolveResultAlert(tx, audit.TestResultValueId, audit.ChangedBy, note)
+}
+
+func (s *DiagnosticServiceImpl) canChangeResults(patientId, userId uint64) error {
+	if patientId == userId {
+		return nil
+	}
+	return s.patientService.CanContinue(patientId, userId, constant.PermissionUploadReport)
+}
+
+func manualResultSource(source string) (string, error) {
+	if source == "" {
+		return constant.ResultSourceManual, nil
+	}
+	if !manualResultSources[source] {
+		return "", fmt.Errorf("invalid source %q, expected manual, device or abdm", source)
+	}
+	return source, nil
+}
+
+// normalizeManualResult converts and flags the value with the unit registry and reference
+// ranges of its component.
+func (s *DiagnosticServiceImpl) normalizeManualResult(result *models.PatientDiagnosticTestResultValue) error {
+	componentIds := []uint64{result.DiagnosticTestComponentId}
+	units, err := s.diagnosticRepo.GetComponentUnits(componentIds)
+	if err != nil {
+		return err
+	}
+	unitRegistry := NewUnitRegistry(units)
+	var rangeResolver *PatientRangeResolver
+	if ranges, err := s.diagnosticRepo.GetReferenceRanges(componentIds); err != nil {
+		log.Println("@normalizeManualResult->GetReferenceRanges:", err)
+	} else if rangeResolver, err = s.newPatientRangeResolver(result.PatientId, unitRegistry, ranges); err != nil {
+		log.Println("@normalizeManualResult->newPatientRangeResolver:", err)
+	}
+	normalizeResultValue(result, unitRegistry, rangeResolver)
+	return nil
+}
+
+func resultAudit(result *models.PatientDiagnosticTestResultValue, operation string, userId uint64, reason string) *models.PatientDiagnosticResultAudit {
+	return &models.PatientDiagnosticResultAudit{
+		TestResultValueId:         result.TestResultValueId,
+		PatientDiagnosticReportId: result.PatientDiagnosticReportId,
+		PatientId:                 result.PatientId,
+		DiagnosticTestComponentId: result.DiagnosticTestComponentId,
+		OperationType:             operation,
+		Reason:                    reason,
+		ChangedBy:                 userId,
+	}
+}
+
+// resultChangeAudit starts the audit of a change to a stored result. The AI value is the result
+// itself while it is still the AI's, and is carried over from earlier audits once corrected.
+func (s *DiagnosticServiceImpl) resultChangeAudit(result *models.PatientDiagnosticTestResultValue, operation string, userId uint64, reason string) (*models.PatientDiagnosticResultAudit, error) {
+	audit := resultAudit(result, operation, userId, reason)
+	previous := result.ResultValue
+	audit.PreviousValue, audit.PreviousUnit, audit.PreviousSource = &previous, result.ResultUnit, result.Source
+	if result.Source == "" || result.Source == constant.ResultSourceAI {
+		aiValue, aiUnit := result.ResultValue, result.ResultUnit
+		if result.OriginalValue != nil {
+			aiValue, aiUnit = *result.OriginalValue, result.OriginalUnit
+		}
+		audit.AiResultValue, audit.AiResultUnit = &aiValue, aiUnit
+		return audit, nil
+	}
+	audits, err := s.diagnosticRepo.GetResultAudits(result.TestResultValueId)
+	if err != nil {
+		return nil, err
+	}
+	for _, earlier := range audits {
+		if earlier.AiResultValue != nil {
+			audit.AiResultValue, audit.AiResultUnit = earlier.AiResultValue, earlier.AiResultUnit
+			break
+		}
+	}
+	return audit, nil
+}
+
+// refreshReportResults recalculates the derived results of the report and checks it for
+// critical values and drifts, as after digitization.
+func (s *DiagnosticServiceImpl) refreshReportResults(patientId, reportId uint64) {
+	go func() {
+		testNameCache, componentNameCache := s.diagnosticRepo.LoadDiagnosticTestMasterData()
+		if testNameCache != nil && componentNameCache != nil {
+			units, err := s.diagnosticRepo.GetComponentUnits(nil)
+			if err != nil {
+				log.Println("@refreshReportResults->GetComponentUnits:", err)
+			}
+			unitRegistry := NewUnitRegistry(units)
+			var rangeResolver *PatientRangeResolver
+			if ranges, err := s.diagnosticRepo.GetReferenceRanges(nil); err == nil {
+				rangeResolver, _ = s.newPatientRangeResolver(patientId, unitRegistry, ranges)
+			}
+			if _, err := s.deriveReportMetrics(patientId, reportId, testNameCache, componentNameCache, unitRegistry, rangeResolver); err != nil {
+				log.Printf("@refreshReportResults->deriveReportMetrics %d: %v", reportId, err)
+			}
+		}
+		if s.criticalAlertService != nil {
+			if _, err := s.criticalAlertService.EvaluateReport(patientId, reportId); err != nil {
+				log.Printf("@refreshReportResults->EvaluateReport %d: %v", reportId, err)
+			}
+		}
+		if _, err := s.patientService.NotifyTrendDrift(patientId, reportId); err != nil {
+			log.Printf("@refreshReportResults->NotifyTrendDrift %d: %v", reportId, err)
+		}
+	}()
+}
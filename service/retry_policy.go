@@ -0,0 +1,175 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// RetryPolicy decides how long a failed task waits before asynq runs it again.
+type RetryPolicy struct {
+	Strategy      string
+	InitialDelay  time.Duration
+	MaxDelay      time.Duration
+	JitterPercent int
+	DeferDelay    time.Duration
+	ThrottleDelay time.Duration
+}
+
+// NewRetryPolicy reads the policy from the Retry config. An unknown strategy falls back to
+// exponential backoff.
+func NewRetryPolicy() RetryPolicy {
+	cfg := config.PropConfig.Retry
+	policy := RetryPolicy{
+		Strategy:      strings.ToLower(strings.TrimSpace(cfg.Strategy)),
+		InitialDelay:  time.Duration(cfg.InitialDelay) * time.Second,
+		MaxDelay:      time.Duration(cfg.MaxDelay) * time.Second,
+		JitterPercent: cfg.JitterPercent,
+		DeferDelay:    time.Duration(config.PropConfig.HealthCheck.RetryDelay) * time.Second,
+		ThrottleDelay: time.Duration(config.PropConfig.TaskQueue.Delay) * time.Second,
+	}
+	switch policy.Strategy {
+	case constant.RetryExponential, constant.RetryLinear, constant.RetryFixed:
+	default:
+		policy.Strategy = constant.RetryExponential
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = 5 * time.Second
+	}
+	if policy.MaxDelay < policy.InitialDelay {
+		policy.MaxDelay = policy.InitialDelay
+	}
+	if policy.DeferDelay <= 0 {
+		policy.DeferDelay = policy.InitialDelay
+	}
+	if policy.ThrottleDelay <= 0 {
+		policy.ThrottleDelay = policy.InitialDelay
+	}
+	if policy.JitterPercent < 0 {
+		policy.JitterPercent = 0
+	} else if policy.JitterPercent > 100 {
+		policy.JitterPercent = 100
+	}
+	return policy
+}
+
+// Delay returns the wait after a task has failed retried times before, jittered and capped at
+// MaxDelay. The jitter is derived from the task and the retry number rather than drawn at
+// random, so the worker can record the same retry time asynq schedules.
+func (p RetryPolicy) Delay(retried int, t *asynq.Task) time.Duration {
+	if retried < 0 {
+		retried = 0
+	}
+	delay := p.InitialDelay
+	switch p.Strategy {
+	case constant.RetryLinear:
+		delay = p.InitialDelay * time.Duration(retried+1)
+	case constant.RetryExponential:
+		if retried >= 32 {
+			delay = p.MaxDelay
+		} else {
+			delay = p.InitialDelay << uint(retried)
+		}
+	}
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if p.JitterPercent > 0 && t != nil {
+		spread := float64(delay) * float64(p.JitterPercent) / 100
+		delay += time.Duration(spread * jitterFraction(t, retried))
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// RetryDelayFunc is the policy as asynq's RetryDelayFunc. A task deferred because the AI
+// service is down waits DeferDelay and one held back by its user's concurrency cap waits
+// ThrottleDelay, however often it was retried.
+func (p RetryPolicy) RetryDelayFunc(retried int, err error, t *asynq.Task) time.Duration {
+	if errors.Is(err, ErrAIServiceUnavailable) {
+		return p.DeferDelay
+	}
+	if errors.Is(err, ErrUserConcurrencyLimit) {
+		return p.ThrottleDelay
+	}
+	return p.Delay(retried, t)
+}
+
+// jitterFraction maps a task and retry number to a fraction in [-1, 1).
+func jitterFraction(t *asynq.Task, retried int) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(t.Type()))
+	hash.Write(t.Payload())
+	var counter [8]byte
+	binary.LittleEndian.PutUint64(counter[:], uint64(retried))
+	hash.Write(counter[:])
+	return float64(hash.Sum64()%2000)/1000 - 1
+}
+
+// APIStatusError is a non-200 answer of the AI service.
+type APIStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIStatusError) Error() string {
+	return fmt.Sprintf("service returned error: %s, body: %s", e.Status, e.Body)
+}
+
+// Errors that come back the same on every attempt of a task.
+var (
+	// ErrPDFPassword is a protected PDF whose password is wrong or was not kept.
+	ErrPDFPassword = errors.New("pdf password is wrong or missing")
+	// ErrUnsupportedFile is a file that cannot be read as the type it claims to be, such as a
+	// corrupt PDF or an entry of an unknown type.
+	ErrUnsupportedFile = errors.New("file is corrupt or of an unsupported type")
+)
+
+// ClassifyTaskError tells whether a failed task may succeed when retried. Timeouts, refused
+// connections and 5xx, 408 and 429 answers of the AI service are transient; other 4xx
+// answers, missing or unreadable files and wrong passwords are permanent. Errors that match
+// neither are treated as transient so they still get their retries.
+func ClassifyTaskError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, asynq.SkipRetry) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, ErrPDFPassword) || errors.Is(err, ErrUnsupportedFile) {
+		return constant.ErrorClassPermanent
+	}
+	var apiErr *APIStatusError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusRequestTimeout, apiErr.StatusCode == http.StatusTooManyRequests, apiErr.StatusCode >= 500:
+			return constant.ErrorClassTransient
+		case apiErr.StatusCode >= 400:
+			return constant.ErrorClassPermanent
+		}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return constant.ErrorClassTransient
+	}
+	return constant.ErrorClassTransient
+}
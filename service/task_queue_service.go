@@ -0,0 +1,138 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"errors"
+	"log"
+	"net/mail"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrAIServiceUnavailable defers a task while the AI service is down. Asynq does not count it
+// as a failed attempt.
+var ErrAIServiceUnavailable = errors.New("AI service unavailable")
+
+// IsTaskFailure is asynq's IsFailure: deferrals do not use up retries.
+func IsTaskFailure(err error) bool {
+	return !errors.Is(err, ErrAIServiceUnavailable) && !errors.Is(err, ErrUserConcurrencyLimit)
+}
+
+type TaskQueueService interface {
+	GetQueueStatus() (*models.TaskQueueOverview, error)
+	SetDigitizationPaused(paused bool) error
+}
+
+type TaskQueueServiceImpl struct {
+	inspector     *asynq.Inspector
+	healthMonitor *HealthMonitorService
+}
+
+func NewTaskQueueService(inspector *asynq.Inspector, healthMonitor *HealthMonitorService) TaskQueueService {
+	return &TaskQueueServiceImpl{inspector: inspector, healthMonitor: healthMonitor}
+}
+
+// GetQueueStatus reports the depth and backlog age of every queue along with the AI service
+// status that pauses digitization.
+func (s *TaskQueueServiceImpl) GetQueueStatus() (*models.TaskQueueOverview, error) {
+	queues, err := s.inspector.Queues()
+	if err != nil {
+		return nil, err
+	}
+	overview := &models.TaskQueueOverview{
+		AIServiceUp: s.healthMonitor.IsServiceUp(),
+		Queues:      []models.TaskQueueStatus{},
+		CheckedAt:   time.Now(),
+	}
+	for _, queue := range queues {
+		info, err := s.inspector.GetQueueInfo(queue)
+		if err != nil {
+			log.Printf("@GetQueueStatus->GetQueueInfo %s: %v", queue, err)
+			continue
+		}
+		overview.Queues = append(overview.Queues, models.TaskQueueStatus{
+			Queue:             info.Queue,
+			Paused:            info.Paused,
+			Size:              info.Size,
+			Pending:           info.Pending,
+			Active:            info.Active,
+			Scheduled:         info.Scheduled,
+			Retry:             info.Retry,
+			Archived:          info.Archived,
+			Completed:         info.Completed,
+			ProcessedToday:    info.Processed,
+			FailedToday:       info.Failed,
+			BacklogAgeSeconds: info.Latency.Seconds(),
+		})
+	}
+	sort.Slice(overview.Queues, func(i, j int) bool {
+		return overview.Queues[i].Queue < overview.Queues[j].Queue
+	})
+	return overview, nil
+}
+
+// SetDigitizationPaused pauses or resumes the digitization queues. Every worker replica calls it
+// on health changes, so a queue already in the wanted state is left alone.
+func (s *TaskQueueServiceImpl) SetDigitizationPaused(paused bool) error {
+	for _, queue := range DigitizationQueues() {
+		info, err := s.inspector.GetQueueInfo(queue)
+		if err != nil && !paused {
+			// A queue that never held a task cannot be paused either.
+			continue
+		}
+		if err == nil && info.Paused == paused {
+			continue
+		}
+		if paused {
+			err = s.inspector.PauseQueue(queue)
+		} else {
+			err = s.inspector.UnpauseQueue(queue)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DigitizationQueues are the queues holding tasks that need the AI service.
+func DigitizationQueues() []string {
+	return []string{constant.QueueDigitizationHigh, constant.QueueDigitizationMedium, constant.QueueDigitizationLow}
+}
+
+// DigitizationQueue is the queue of a digitization priority. Tasks enqueued before priorities
+// existed carry none and go to the medium queue.
+func DigitizationQueue(priority string) string {
+	switch priority {
+	case constant.PriorityHigh:
+		return constant.QueueDigitizationHigh
+	case constant.PriorityLow:
+		return constant.QueueDigitizationLow
+	default:
+		return constant.QueueDigitizationMedium
+	}
+}
+
+// SyncedRecordPriority is the priority of a record fetched by a mail sync: medium, or low for
+// historical backfill when the mail is older than TASK_BACKFILL_AFTER_DAYS. Mail with a date
+// that cannot be read stays medium.
+func SyncedRecordPriority(receivedAt string) string {
+	days := config.PropConfig.TaskQueue.BackfillAfterDays
+	if days <= 0 {
+		return constant.PriorityMedium
+	}
+	received, err := mail.ParseDate(receivedAt)
+	if err != nil {
+		if received, err = time.Parse(time.RFC3339, receivedAt); err != nil {
+			return constant.PriorityMedium
+		}
+	}
+	if time.Since(received) > time.Duration(days)*24*time.Hour {
+		return constant.PriorityLow
+	}
+	return constant.PriorityMedium
+}
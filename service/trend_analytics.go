@@ -0,0 +1,321 @@
+package service
+
+import (
+	"biostat/config"
+	"biostat/constant"
+	"biostat/models"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trendOptions tune the trend analytics. Windows are counted back from the latest result,
+// so a component last measured a year ago still gets its slopes.
+type trendOptions struct {
+	windows        []int
+	movingAverage  int
+	driftMinPoints int
+	driftMinShift  float64
+}
+
+func newTrendOptions(windows []int) trendOptions {
+	if len(windows) == 0 {
+		windows = parseWindowDays(config.PropConfig.TrendAnalytics.WindowDays)
+	}
+	opts := trendOptions{
+		windows:        windows,
+		movingAverage:  config.PropConfig.TrendAnalytics.MovingAveragePoints,
+		driftMinPoints: config.PropConfig.TrendAnalytics.DriftMinPoints,
+		driftMinShift:  float64(config.PropConfig.TrendAnalytics.DriftMinShiftPercent),
+	}
+	if opts.movingAverage < 2 {
+		opts.movingAverage = 3
+	}
+	if opts.driftMinPoints < 3 {
+		opts.driftMinPoints = 3
+	}
+	return opts
+}
+
+// parseWindowDays reads a comma separated list of days, "90,180,365" when empty.
+func parseWindowDays(value string) []int {
+	if strings.TrimSpace(value) == "" {
+		value = "90,180,365"
+	}
+	var windows []int
+	for _, part := range strings.Split(value, ",") {
+		if days, err := strconv.Atoi(strings.TrimSpace(part)); err == nil && days > 0 {
+			windows = append(windows, days)
+		}
+	}
+	return windows
+}
+
+// componentTrend is the history of one component as read from the trend rows.
+type componentTrend struct {
+	componentId uint64
+	name        string
+	unit        string
+	points      []models.TrendAnalyticsPoint
+}
+
+// groupTrendRows collects the numeric results of each component, oldest first. Rows repeated
+// by the reference range join are counted once.
+func groupTrendRows(rows []map[string]interface{}) map[uint64]*componentTrend {
+	trends := map[uint64]*componentTrend{}
+	seen := map[int]bool{}
+	for _, row := range rows {
+		componentId, ok := rowUint64(row["diagnostic_test_component_id"])
+		if !ok {
+			continue
+		}
+		resultId, _ := rowUint64(row["test_result_value_id"])
+		if seen[int(resultId)] {
+			continue
+		}
+		seen[int(resultId)] = true
+		value, ok := rowFloat64(row["result_value"])
+		resultAt, hasDate := row["result_at"].(time.Time)
+		if !ok || value == 0 || !hasDate {
+			continue
+		}
+		trend, exists := trends[componentId]
+		if !exists {
+			trend = &componentTrend{componentId: componentId, name: fmt.Sprint(row["test_component_name"])}
+			trends[componentId] = trend
+		}
+		if unit, ok := row["result_unit"].(string); ok && unit != "" {
+			trend.unit = unit
+		}
+		point := models.TrendAnalyticsPoint{TestResultValueId: int(resultId), ResultDate: resultAt, Value: value}
+		point.ReportId, _ = rowUint64(row["patient_diagnostic_report_id"])
+		if min, ok := rowFloat64(row["normal_min"]); ok {
+			point.NormalMin = &min
+		}
+		if max, ok := rowFloat64(row["normal_max"]); ok {
+			point.NormalMax = &max
+		}
+		trend.points = append(trend.points, point)
+	}
+	for _, trend := range trends {
+		sort.SliceStable(trend.points, func(i, j int) bool {
+			return trend.points[i].ResultDate.Before(trend.points[j].ResultDate)
+		})
+	}
+	return trends
+}
+
+// analyzeTrend computes the analytics of results sorted oldest first.
+func analyzeTrend(points []models.TrendAnalyticsPoint, opts trendOptions) *models.TrendAnalytics {
+	if len(points) == 0 {
+		return nil
+	}
+	latest := points[len(points)-1]
+	analytics := &models.TrendAnalytics{
+		Points:              len(points),
+		LatestValue:         latest.Value,
+		LatestDate:          latest.ResultDate,
+		MovingAverageWindow: opts.movingAverage,
+		Windows:             []models.TrendWindow{},
+	}
+	if len(points) > 1 {
+		previous := points[len(points)-2]
+		analytics.PreviousValue = &previous.Value
+		if previous.Value != 0 {
+			percent := roundUnitValue((latest.Value - previous.Value) / math.Abs(previous.Value) * 100)
+			analytics.PercentChange = &percent
+		}
+		if days := latest.ResultDate.Sub(previous.ResultDate).Hours() / 24; days > 0 {
+			rate := roundUnitValue((latest.Value - previous.Value) / days)
+			analytics.RateOfChangePerDay = &rate
+		}
+	}
+
+	for _, days := range opts.windows {
+		from := latest.ResultDate.AddDate(0, 0, -days)
+		var window []models.TrendAnalyticsPoint
+		for _, point := range points {
+			if !point.ResultDate.Before(from) {
+				window = append(window, point)
+			}
+		}
+		entry := models.TrendWindow{Days: days, Points: len(window)}
+		if slope, ok := leastSquaresSlope(window); ok {
+			slope = roundUnitValue(slope)
+			change := roundUnitValue(window[len(window)-1].Value - window[0].Value)
+			entry.SlopePerDay, entry.Change = &slope, &change
+		}
+		analytics.Windows = append(analytics.Windows, entry)
+	}
+
+	for i := opts.movingAverage - 1; i < len(points); i++ {
+		sum := 0.0
+		for _, point := range points[i-opts.movingAverage+1 : i+1] {
+			sum += point.Value
+		}
+		analytics.MovingAverage = append(analytics.MovingAverage, models.TrendAveragePoint{
+			ResultDate: points[i].ResultDate,
+			Value:      roundUnitValue(sum / float64(opts.movingAverage)),
+		})
+	}
+
+	analytics.Drift = detectDrift(points, opts)
+	return analytics
+}
+
+// leastSquaresSlope fits value against days and returns the slope per day.
+func leastSquaresSlope(points []models.TrendAnalyticsPoint) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	origin := points[0].ResultDate
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := point.ResultDate.Sub(origin).Hours() / 24
+		sumX += x
+		sumY += point.Value
+		sumXY += x * point.Value
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// detectDrift flags a sustained move toward one bound of the reference range: at least
+// driftMinPoints consecutive results, ending with the latest, each moving the same way,
+// starting inside the range and covering driftMinShift percent of its width. The latest result
+// may still be in range.
+func detectDrift(points []models.TrendAnalyticsPoint, opts trendOptions) *models.TrendDrift {
+	latest := points[len(points)-1]
+	if len(points) < opts.driftMinPoints || latest.NormalMin == nil || latest.NormalMax == nil || *latest.NormalMax <= *latest.NormalMin {
+		return nil
+	}
+	rising := latest.Value > points[len(points)-2].Value
+	start := len(points) - 1
+	for start > 0 {
+		step := points[start].Value - points[start-1].Value
+		if step == 0 || (step > 0) != rising {
+			break
+		}
+		start--
+	}
+	run := len(points) - start
+	if run < opts.driftMinPoints {
+		return nil
+	}
+	min, max := *latest.NormalMin, *latest.NormalMax
+	first := points[start].Value
+	if first < min || first > max {
+		return nil
+	}
+	shift := math.Abs(latest.Value-first) / (max - min) * 100
+	if shift < opts.driftMinShift {
+		return nil
+	}
+	drift := &models.TrendDrift{
+		Points:       run,
+		ShiftPercent: roundUnitValue(shift),
+		InRange:      latest.Value >= min && latest.Value <= max,
+	}
+	if rising {
+		drift.Direction, drift.Bound = constant.TrendDriftTowardHigh, max
+	} else {
+		drift.Direction, drift.Bound = constant.TrendDriftTowardLow, min
+	}
+	verb, limit := "rising", "upper"
+	if !rising {
+		verb, limit = "falling", "lower"
+	}
+	drift.Reason = fmt.Sprintf("%d consecutive results %s from %s to %s, %.0f%% of the reference range toward the %s limit %s",
+		run, verb, formatTrendValue(first), formatTrendValue(latest.Value), shift, limit, formatTrendValue(drift.Bound))
+	return drift
+}
+
+func formatTrendValue(value float64) string {
+	return strconv.FormatFloat(roundUnitValue(value), 'f', -1, 64)
+}
+
+// attachTrendAnalytics adds the analytics of each component to the parsed trend groups.
+func attachTrendAnalytics(groups []map[string]interface{}, rows []map[string]interface{}, opts trendOptions) {
+	trends := groupTrendRows(rows)
+	for _, group := range groups {
+		componentId, ok := rowUint64(group["diagnostic_test_component_id"])
+		if !ok {
+			continue
+		}
+		if trend, ok := trends[componentId]; ok {
+			group["analytics"] = analyzeTrend(trend.points, opts)
+		}
+	}
+}
+
+// GetTrendAnalytics returns the analytics of every component the patient has results for.
+func (ps *PatientServiceImpl) GetTrendAnalytics(patientId uint64) (map[uint64]*models.TrendAnalytics, error) {
+	rows, err := ps.patientRepo.FetchPatientDiagnosticTrendValue(models.DiagnosticResultRequest{PatientId: patientId})
+	if err != nil {
+		return nil, err
+	}
+	opts := newTrendOptions(nil)
+	analytics := map[uint64]*models.TrendAnalytics{}
+	for componentId, trend := range groupTrendRows(rows) {
+		analytics[componentId] = analyzeTrend(trend.points, opts)
+	}
+	return analytics, nil
+}
+
+// NotifyTrendDrift tells the patient about components of the report whose latest result
+// continues a sustained drift toward abnormal while still in range. Each drift is announced
+// once per result; it returns how many notifications were sent.
+func (ps *PatientServiceImpl) NotifyTrendDrift(patientId, reportId uint64) (int, error) {
+	rows, err := ps.patientRepo.FetchPatientDiagnosticTrendValue(models.DiagnosticResultRequest{PatientId: patientId})
+	if err != nil {
+		return 0, err
+	}
+	var patient *models.SystemUser_
+	opts := newTrendOptions(nil)
+	sent := 0
+	for componentId, trend := range groupTrendRows(rows) {
+		latest := trend.points[len(trend.points)-1]
+		if latest.ReportId != reportId {
+			continue
+		}
+		analytics := analyzeTrend(trend.points, opts)
+		if analytics.Drift == nil || !analytics.Drift.InRange {
+			continue
+		}
+		notice := &models.TrendDriftNotice{
+			PatientId:                 patientId,
+			DiagnosticTestComponentId: componentId,
+			TestResultValueId:         latest.TestResultValueId,
+			Direction:                 analytics.Drift.Direction,
+		}
+		created, err := ps.patientRepo.CreateTrendDriftNotice(notice)
+		if err != nil || !created {
+			if err != nil {
+				log.Printf("@NotifyTrendDrift->CreateTrendDriftNotice component %d: %v", componentId, err)
+			}
+			continue
+		}
+		if patient == nil {
+			info, err := ps.userRepo.GetSystemUserInfo(patientId)
+			if err != nil {
+				return sent, err
+			}
+			patient = &info
+		}
+		if err := ps.notificationService.SendTrendDriftAlert(patient, trend.name, trend.unit, analytics, notice); err != nil {
+			log.Printf("@NotifyTrendDrift->SendTrendDriftAlert component %d: %v", componentId, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"biostat/models"
+	"strings"
+)
+
+// UnitRegistry holds the registered units of each diagnostic test component, keyed by
+// component id and normalized unit.
+type UnitRegistry map[uint64]map[string]models.DiagnosticTestComponentUnit
+
+func NewUnitRegistry(units []models.DiagnosticTestComponentUnit) UnitRegistry {
+	registry := UnitRegistry{}
+	for _, unit := range units {
+		if registry[unit.DiagnosticTestComponentId] == nil {
+			registry[unit.DiagnosticTestComponentId] = map[string]models.DiagnosticTestComponentUnit{}
+		}
+		registry[unit.DiagnosticTestComponentId][NormalizeUnit(unit.Unit)] = unit
+	}
+	return registry
+}
+
+// NormalizeUnit folds the spellings labs use for the same unit ("mg/dL", "mg / dl", "µmol/L",
+// "umol/l") onto one key.
+func NormalizeUnit(unit string) string {
+	unit = strings.ToLower(strings.TrimSpace(unit))
+	unit = strings.NewReplacer(" ", "", "µ", "u", "μ", "u", "mcg", "ug").Replace(unit)
+	return unit
+}
+
+// Canonical returns the canonical unit of a component, if one is registered.
+func (r UnitRegistry) Canonical(componentId uint64) (models.DiagnosticTestComponentUnit, bool) {
+	for _, unit := range r[componentId] {
+		if unit.IsCanonical {
+			return unit, true
+		}
+	}
+	return models.DiagnosticTestComponentUnit{}, false
+}
+
+// ToCanonical converts value from unit into the component's canonical unit. It reports false,
+// leaving the value untouched, when the component has no canonical unit or does not know unit.
+func (r UnitRegistry) ToCanonical(componentId uint64, value float64, unit string) (float64, string, bool) {
+	canonical, ok := r.Canonical(componentId)
+	if !ok {
+		return value, unit, false
+	}
+	from, ok := r[componentId][NormalizeUnit(unit)]
+	if !ok {
+		return value, unit, false
+	}
+	return value*from.Factor + from.Offset, canonical.Unit, true
+}
+
+// Convert converts value between two registered units of a component.
+func (r UnitRegistry) Convert(componentId uint64, value float64, fromUnit, toUnit string) (float64, bool) {
+	if NormalizeUnit(fromUnit) == NormalizeUnit(toUnit) {
+		return value, true
+	}
+	from, ok := r[componentId][NormalizeUnit(fromUnit)]
+	if !ok {
+		return value, false
+	}
+	to, ok := r[componentId][NormalizeUnit(toUnit)]
+	if !ok || to.Factor == 0 {
+		return value, false
+	}
+	return (value*from.Factor + from.Offset - to.Offset) / to.Factor, true
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUserConcurrencyLimit defers a task of a user who already has as many tasks running as the
+// cap allows. Like ErrAIServiceUnavailable it does not count as a failed attempt.
+var ErrUserConcurrencyLimit = errors.New("user concurrency limit reached")
+
+// userSlotStaleAfter drops slots of tasks that never released them, e.g. after a worker crash.
+// It matches asynq's default task timeout.
+const userSlotStaleAfter = 30 * time.Minute
+
+// acquireUserSlot takes a slot unless the user is at the cap. A task that already holds a slot
+// keeps it, and a forced acquire always succeeds so it still counts against later tasks.
+var acquireUserSlot = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if ARGV[5] ~= '1' and not redis.call('ZSCORE', KEYS[1], ARGV[4]) and redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+redis.call('EXPIRE', KEYS[1], ARGV[6])
+return 1
+`)
+
+// UserConcurrencyLimiter caps the digitization tasks running at once for one user across all
+// worker replicas, so a large sync cannot take every worker.
+type UserConcurrencyLimiter struct {
+	redisClient *redis.Client
+	limit       int
+}
+
+func NewUserConcurrencyLimiter(redisClient *redis.Client, limit int) *UserConcurrencyLimiter {
+	return &UserConcurrencyLimiter{redisClient: redisClient, limit: limit}
+}
+
+func userSlotsKey(userId uint64) string {
+	return fmt.Sprintf("digitization_active:%d", userId)
+}
+
+// Acquire takes a slot for the task. Forced tasks, manual uploads, are never held back. A limit
+// of zero or less turns the cap off.
+func (l *UserConcurrencyLimiter) Acquire(ctx context.Context, userId uint64, taskId string, force bool) (bool, error) {
+	if l.limit <= 0 {
+		return true, nil
+	}
+	now := time.Now()
+	forced := "0"
+	if force {
+		forced = "1"
+	}
+	acquired, err := acquireUserSlot.Run(ctx, l.redisClient, []string{userSlotsKey(userId)},
+		now.UnixMilli(), now.Add(-userSlotStaleAfter).UnixMilli(), l.limit, taskId, forced, int(userSlotStaleAfter.Seconds())).Int()
+	if err != nil {
+		return false, err
+	}
+	return acquired == 1, nil
+}
+
+// Release frees the slot of a finished task.
+func (l *UserConcurrencyLimiter) Release(ctx context.Context, userId uint64, taskId string) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	return l.redisClient.ZRem(ctx, userSlotsKey(userId), taskId).Err()
+}
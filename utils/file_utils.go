@@ -4,12 +4,15 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"biostat/models"
 
@@ -58,6 +61,37 @@ func GenerateHMAC(fileData []byte, clientSecret string) string {
 	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
+// ComputeContentHash returns the hex SHA-256 of a file's plaintext content, used to
+// detect the same document arriving through different sources.
+func ComputeContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func GenerateRecordDownloadSignature(recordID, userID uint64, expiresAt int64, secret string) string {
+	return GenerateHMAC([]byte(fmt.Sprintf("%d:%d:%d", recordID, userID, expiresAt)), secret)
+}
+
+func VerifyRecordDownloadSignature(recordID, userID uint64, expiresAt int64, signature string, secret string) bool {
+	if secret == "" || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := GenerateRecordDownloadSignature(recordID, userID, expiresAt, secret)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func GenerateExportDownloadSignature(exportID string, userID uint64, expiresAt int64, secret string) string {
+	return GenerateHMAC([]byte(fmt.Sprintf("export:%s:%d:%d", exportID, userID, expiresAt)), secret)
+}
+
+func VerifyExportDownloadSignature(exportID string, userID uint64, expiresAt int64, signature string, secret string) bool {
+	if secret == "" || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := GenerateExportDownloadSignature(exportID, userID, expiresAt, secret)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
 func SanitizeFileName(name string) string {
 	decodedName, err := url.QueryUnescape(name)
 	if err != nil {
@@ -568,6 +568,15 @@ func derefFloat(ptr *float64) float64 {
 	return 0.0
 }
 
+func HasRole(ctx *gin.Context, role string) bool {
+	roles, exists := ctx.Get("userRoles")
+	if !exists {
+		return false
+	}
+	userRoles, ok := roles.([]string)
+	return ok && StringInSlice(role, userRoles)
+}
+
 func StringInSlice(str string, list []string) bool {
 	for _, v := range list {
 		if v == str {
@@ -1528,6 +1537,28 @@ func MatchLabInBody(nBody, nLab string) (bool, MatchDetail) {
 	}
 }
 
+// ComponentNameSimilarity scores how alike two test component names are, from 0 to 1. It takes
+// the best of the Jaro-Winkler similarity of the names and their token match in either
+// direction; finding one name inside a much longer one counts for less.
+func ComponentNameSimilarity(a, b string) float64 {
+	na, nb := NormalizeText(a), NormalizeText(b)
+	if na == "" || nb == "" {
+		return 0
+	}
+	if na == nb {
+		return 1
+	}
+	best := jaroWinkler(joinNoSpace(tokens(na)), joinNoSpace(tokens(nb)))
+	for _, pair := range [][2]string{{na, nb}, {nb, na}} {
+		_, detail := MatchLabInBody(pair[0], pair[1])
+		score := detail.Score * math.Min(1, float64(len(tokens(pair[1])))/float64(len(tokens(pair[0]))))
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
 func safeSnippet(s string, start, end int) string {
 	if start < 0 {
 		start = 0
@@ -1544,3 +1575,26 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+var reLoincCode = regexp.MustCompile(`^(\d{1,7})-(\d)$`)
+
+// IsValidLoincCode checks the format of a LOINC code and its mod 10 check digit.
+func IsValidLoincCode(code string) bool {
+	parts := reLoincCode.FindStringSubmatch(strings.TrimSpace(code))
+	if parts == nil {
+		return false
+	}
+	number := parts[1]
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		digit := int(number[len(number)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return (10-sum%10)%10 == int(parts[2][0]-'0')
+}
@@ -10,13 +10,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
@@ -43,6 +43,72 @@ func processAppointments(s service.AppointmentService) {
 	}
 }
 
+func StartRecordPurgeScheduler(service service.TblMedicalRecordService) {
+	log.Println("Record purge scheduler running")
+
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			purged, err := service.PurgeExpiredRecords()
+			if err != nil {
+				log.Println("Error @ PurgeExpiredRecords", err)
+			} else if purged > 0 {
+				log.Println("Purged deleted medical records past retention:", purged)
+			}
+		}
+	}()
+}
+
+func StartErasureScheduler(service service.ErasureService) {
+	log.Println("Erasure scheduler running")
+
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			completed, err := service.ExecuteDueErasures()
+			if err != nil {
+				log.Println("Error @ ExecuteDueErasures", err)
+			} else if completed > 0 {
+				log.Println("Executed right-to-erasure requests past grace period:", completed)
+			}
+		}
+	}()
+}
+
+func StartCriticalAlertScheduler(service service.CriticalAlertService) {
+	log.Println("Critical alert scheduler running")
+
+	ticker := time.NewTicker(1 * time.Minute)
+	go func() {
+		for range ticker.C {
+			escalated, err := service.ReescalateDueAlerts()
+			if err != nil {
+				log.Println("Error @ ReescalateDueAlerts", err)
+			} else if escalated > 0 {
+				log.Println("Re-escalated unacknowledged critical alerts:", escalated)
+			}
+		}
+	}()
+}
+
+// StartDataExportSweeper deletes the archives of patient data exports once their download
+// link has expired.
+func StartDataExportSweeper(service service.PatientExportService) {
+	log.Println("Data export sweeper running")
+
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			purged, err := service.PurgeExpiredExports()
+			if err != nil {
+				log.Println("Error @ PurgeExpiredExports", err)
+			} else if purged > 0 {
+				log.Println("Deleted expired patient data exports:", purged)
+			}
+		}
+	}()
+}
+
 type DigitizationWorker struct {
 	redisClient          *redis.Client
 	taskQueue            *asynq.Client
@@ -54,6 +120,14 @@ type DigitizationWorker struct {
 	healthMonitor        *service.HealthMonitorService
 	processStatusService service.ProcessStatusService
 	gmailService         service.GmailSyncService
+	fileStore            service.FileStoreService
+	encryption           service.RecordEncryptionService
+	previewService       service.RecordPreviewService
+	patientExportService service.PatientExportService
+	deadLetterService    service.DeadLetterService
+	taskQueueService     service.TaskQueueService
+	userLimiter          *service.UserConcurrencyLimiter
+	retryPolicy          service.RetryPolicy
 }
 
 func NewDigitizationWorker(db *gorm.DB) *DigitizationWorker {
@@ -63,6 +137,15 @@ func NewDigitizationWorker(db *gorm.DB) *DigitizationWorker {
 	return &DigitizationWorker{db: db}
 }
 
+// taskQueueWeights share the workers between queues while all of them hold work: about half
+// pick up manual uploads, so a large sync or backfill never keeps them waiting for long.
+var taskQueueWeights = map[string]int{
+	constant.QueueDigitizationHigh:   5,
+	constant.QueueDefault:            2,
+	constant.QueueDigitizationMedium: 2,
+	constant.QueueDigitizationLow:    1,
+}
+
 func InitAsynqWorker(
 	apiService service.ApiService,
 	patientService service.PatientService,
@@ -71,7 +154,11 @@ func InitAsynqWorker(
 	db *gorm.DB,
 	processStatusService service.ProcessStatusService,
 	gmailService service.GmailSyncService,
-
+	fileStore service.FileStoreService,
+	encryption service.RecordEncryptionService,
+	deadLetterService service.DeadLetterService,
+	taskQueueService service.TaskQueueService,
+	patientExportService service.PatientExportService,
 ) {
 	client := asynq.NewClient(asynq.RedisClientOpt{Addr: config.PropConfig.ApiURL.RedisURL})
 	healthMonitor := service.NewHealthMonitorService(config.RedisClient, config.PropConfig.HealthCheck.URL, time.Duration(config.PropConfig.HealthCheck.IntervalSeconds)*time.Second, time.Duration(config.PropConfig.HealthCheck.TimeoutSeconds)*time.Second)
@@ -87,24 +174,92 @@ func InitAsynqWorker(
 		healthMonitor:        healthMonitor,
 		processStatusService: processStatusService,
 		gmailService:         gmailService,
+		fileStore:            fileStore,
+		encryption:           encryption,
+		previewService:       service.NewRecordPreviewService(recordRepo, fileStore),
+		patientExportService: patientExportService,
+		deadLetterService:    deadLetterService,
+		taskQueueService:     taskQueueService,
+		userLimiter:          service.NewUserConcurrencyLimiter(config.RedisClient, config.PropConfig.TaskQueue.UserConcurrency),
+		retryPolicy:          service.NewRetryPolicy(),
 	}
+	go worker.watchAIServiceHealth(time.Duration(config.PropConfig.HealthCheck.IntervalSeconds) * time.Second)
 
 	srv := asynq.NewServer(
 		asynq.RedisClientOpt{Addr: config.PropConfig.ApiURL.RedisURL},
-		asynq.Config{Concurrency: config.PropConfig.TaskQueue.ConcurrentTaskRun, RetryDelayFunc: func(n int, err error, t *asynq.Task) time.Duration {
-			return time.Duration(config.PropConfig.Retry.MaxDelay)
-		}},
+		asynq.Config{
+			Concurrency:    config.PropConfig.TaskQueue.ConcurrentTaskRun,
+			Queues:         taskQueueWeights,
+			RetryDelayFunc: worker.retryPolicy.RetryDelayFunc,
+			IsFailure:      service.IsTaskFailure,
+		},
 	)
 
 	mux := asynq.NewServeMux()
-	mux.HandleFunc("digitize:record", worker.HandleDigitizationTask)
-	mux.HandleFunc("check:doctype", worker.HandleDocTypeCheckTask)
+	mux.HandleFunc(constant.TaskDigitizeRecord, worker.HandleDigitizationTask)
+	mux.HandleFunc(constant.TaskCheckDocType, worker.HandleDocTypeCheckTask)
+	mux.HandleFunc("preview:record", worker.HandleRecordPreviewTask)
+	mux.HandleFunc(constant.TaskBuildDataExport, worker.HandleDataExportTask)
 
 	if err := srv.Run(mux); err != nil {
 		log.Fatalf("Could not run Asynq server: %v", err)
 	}
 }
 
+// watchAIServiceHealth pauses the digitization queues while the AI service is down and resumes
+// them once it is back, so tasks wait in the queue instead of using up their retries.
+func (w *DigitizationWorker) watchAIServiceHealth(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var wasUp *bool
+	for range ticker.C {
+		up := w.healthMonitor.IsServiceUp()
+		if wasUp != nil && *wasUp == up {
+			continue
+		}
+		if err := w.taskQueueService.SetDigitizationPaused(!up); err != nil {
+			log.Printf("@watchAIServiceHealth: failed to update digitization queues (service up=%t): %v", up, err)
+			continue
+		}
+		if up {
+			log.Println("AI service is up, digitization resumed.")
+		} else {
+			log.Println("AI service is down, digitization paused.")
+		}
+		wasUp = &up
+	}
+}
+
+func (w *DigitizationWorker) HandleRecordPreviewTask(ctx context.Context, t *asynq.Task) error {
+	var p models.RecordPreviewPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return err
+	}
+	record, err := w.recordRepo.GetMedicalRecordByRecordId(p.RecordID)
+	if err != nil {
+		return err
+	}
+	if err := w.previewService.GenerateRecordPreview(ctx, record); err != nil {
+		if errors.Is(err, service.ErrPreviewUnsupported) {
+			log.Printf("No preview for record %d: %v", p.RecordID, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (w *DigitizationWorker) HandleDataExportTask(ctx context.Context, t *asynq.Task) error {
+	var p models.PatientDataExportPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("%w: %w", asynq.SkipRetry, err)
+	}
+	return w.patientExportService.BuildPatientDataExport(p.ExportId)
+}
+
 func (w *DigitizationWorker) HandleDigitizationTask(ctx context.Context, t *asynq.Task) error {
 	var p models.DigitizationPayload
 	if err := json.Unmarshal(t.Payload(), &p); err != nil {
@@ -124,24 +279,29 @@ func (w *DigitizationWorker) HandleDigitizationTask(ctx context.Context, t *asyn
 		status = constant.StatusRetrying
 	}
 	if !w.healthMonitor.IsServiceUp() {
-		log.Println("AI service is down, retrying later.")
-		_ = w.logAndUpdateStatus(ctx, p.RecordID, queueName, constant.StatusQueued, 0, &constant.ServiceError, retryCount)
-		newTask := asynq.NewTask("digitize:record", t.Payload())
-		_, err := w.taskQueue.Enqueue(newTask, asynq.ProcessIn(time.Duration(config.PropConfig.TaskQueue.Delay)))
-		if err != nil {
-			log.Printf("Failed to reschedule task for record %d: %v", p.RecordID, err)
-			return err
-		}
-		return nil
+		return w.deferTask(ctx, t, p, queueName, retryCount, service.ErrAIServiceUnavailable)
+	}
+	taskId, _ := asynq.GetTaskID(ctx)
+	acquired, err := w.userLimiter.Acquire(ctx, p.UserID, taskId, p.Priority == constant.PriorityHigh)
+	if err != nil {
+		log.Printf("@HandleDigitizationTask: concurrency cap of user %d not checked: %v", p.UserID, err)
+	} else if !acquired {
+		return w.deferTask(ctx, t, p, queueName, retryCount, service.ErrUserConcurrencyLimit)
+	} else {
+		defer func() {
+			if err := w.userLimiter.Release(context.Background(), p.UserID, taskId); err != nil {
+				log.Printf("@HandleDigitizationTask: failed to release slot of user %d: %v", p.UserID, err)
+			}
+		}()
 	}
 
 	log.Printf("Digitization started: recordId=%d queue Name := %s : retrying count := %d : record status := %s", p.RecordID, queueName, retryCount, status)
 
 	_ = w.logAndUpdateStatus(ctx, p.RecordID, queueName, status, 0, nil, retryCount)
 
-	fileBytes, err := os.ReadFile(p.FilePath)
+	fileBytes, err := w.readPayloadFile(ctx, p)
 	if err != nil {
-		return w.failTask(ctx, queueName, p.ProcessID, p.RecordID, "Failed to read file", retryCount)
+		return w.failTask(ctx, t, p, queueName, fmt.Errorf("failed to read file: %w", err), retryCount)
 	}
 
 	fileBuf := bytes.NewBuffer(fileBytes)
@@ -151,17 +311,17 @@ func (w *DigitizationWorker) HandleDigitizationTask(ctx context.Context, t *asyn
 		switch p.Category {
 		case string(constant.TESTREPORT):
 			if err := w.handleTestReport(fileBuf, p); err != nil {
-				return w.failTask(ctx, queueName, p.ProcessID, p.RecordID, err.Error(), retryCount)
+				return w.failTask(ctx, t, p, queueName, err, retryCount)
 			}
 		case string(constant.MEDICATION):
 			if err := w.handlePrescription(fileBuf, p); err != nil {
-				return w.failTask(ctx, queueName, p.ProcessID, p.RecordID, err.Error(), retryCount)
+				return w.failTask(ctx, t, p, queueName, err, retryCount)
 			}
 		}
 	} else {
 		log.Println("GEMINI call flag else : ", flag)
 		if err := w.ClassifyDoc(fileBuf, p); err != nil {
-			return w.failTask(ctx, queueName, p.ProcessID, p.RecordID, err.Error(), retryCount)
+			return w.failTask(ctx, t, p, queueName, err, retryCount)
 		}
 	}
 	if err := w.logAndUpdateStatus(ctx, p.RecordID, queueName, constant.StatusSuccess, 1, nil, retryCount); err != nil {
@@ -169,6 +329,7 @@ func (w *DigitizationWorker) HandleDigitizationTask(ctx context.Context, t *asyn
 	}
 
 	w.processStatusService.LogStep(p.ProcessID, step, constant.Success, msg, errorMsg, &p.RecordID, nil, nil, nil, nil, nil)
+	w.deadLetterService.ResolveTask(constant.TaskDigitizeRecord, strconv.FormatUint(p.RecordID, 10))
 	log.Printf("Digitization success: recordId=%d queue Name := %s : retrying count := %d : record status := %s", p.RecordID, queueName, retryCount, constant.StatusSuccess)
 	_ = os.Remove(p.FilePath)
 	return nil
@@ -197,16 +358,17 @@ func (w *DigitizationWorker) logAndUpdateStatus(ctx context.Context, recordID ui
 		}
 	}
 
-	if status == constant.StatusFailed {
-		update.NextRetryAt = ptrTime(now.Add(5 * time.Minute))
-	}
-
 	if errMsg != nil {
 		update.ErrorMessage = *errMsg
 	}
 	if _, err := w.recordRepo.UpdateTblMedicalRecord(update); err != nil {
 		return err
 	}
+	if status == constant.StatusSuccess {
+		if err := w.recordRepo.SetRecordNextRetryAt(recordID, nil); err != nil {
+			log.Printf("Failed to clear next retry of record %d: %v", recordID, err)
+		}
+	}
 
 	w.redisClient.Set(ctx, fmt.Sprintf("record_status:%d", recordID), status, 0)
 	w.redisClient.Set(ctx, fmt.Sprintf("record_queue:%d", recordID), queue, 0)
@@ -214,18 +376,119 @@ func (w *DigitizationWorker) logAndUpdateStatus(ctx context.Context, recordID ui
 	return nil
 }
 
+// readPayloadFile prefers the temp copy written by the enqueuing replica and falls back
+// to the shared file store when the task is picked up on another host.
+func (w *DigitizationWorker) readPayloadFile(ctx context.Context, p models.DigitizationPayload) ([]byte, error) {
+	fileBytes, err := os.ReadFile(p.FilePath)
+	if err == nil {
+		return fileBytes, nil
+	}
+	if p.RecordURL == "" {
+		return nil, err
+	}
+	log.Printf("Temp file missing for record %d, reading from %s store", p.RecordID, p.UploadDestination)
+	record, err := w.recordRepo.GetMedicalRecordByRecordId(p.RecordID)
+	if err != nil {
+		return nil, err
+	}
+	fileBytes, err = w.fileStore.ReadRecordFile(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsPasswordProtected == nil || !*p.IsPasswordProtected {
+		return fileBytes, nil
+	}
+	if record.SealedPDFPassword == "" {
+		return nil, fmt.Errorf("password of protected record %d was not kept: %w", p.RecordID, service.ErrPDFPassword)
+	}
+	password, err := w.encryption.OpenRecordSecret(record, record.SealedPDFPassword)
+	if err != nil {
+		return nil, err
+	}
+	return service.DecryptPDFIfProtected(fileBytes, password)
+}
+
+// deferTask puts a task back while the AI service is down or its user is at the concurrency
+// cap. The deferral is returned to asynq as the cause, which does not count as a failure and
+// waits as the retry policy says; only on the last attempt, which asynq would archive instead,
+// is a fresh task enqueued on the same queue.
+func (w *DigitizationWorker) deferTask(ctx context.Context, t *asynq.Task, p models.DigitizationPayload, queueName string, retryCount int, cause error) error {
+	delay := w.retryPolicy.RetryDelayFunc(retryCount, cause, t)
+	if errors.Is(cause, service.ErrAIServiceUnavailable) {
+		log.Printf("AI service is down, deferring record %d by %s.", p.RecordID, delay)
+		_ = w.logAndUpdateStatus(ctx, p.RecordID, queueName, constant.StatusQueued, 0, &constant.ServiceError, retryCount)
+		if err := w.recordRepo.SetRecordNextRetryAt(p.RecordID, ptrTime(time.Now().Add(delay))); err != nil {
+			log.Printf("@deferTask: failed to set next retry of record %d: %v", p.RecordID, err)
+		}
+	}
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	if retryCount < maxRetry {
+		return fmt.Errorf("%w: deferring record %d", cause, p.RecordID)
+	}
+	queue, ok := asynq.GetQueueName(ctx)
+	if !ok {
+		queue = service.DigitizationQueue(p.Priority)
+	}
+	newTask := asynq.NewTask(constant.TaskDigitizeRecord, t.Payload())
+	if _, err := w.taskQueue.Enqueue(newTask, asynq.Queue(queue), asynq.ProcessIn(delay),
+		asynq.MaxRetry(config.PropConfig.Retry.MaxAttempts), asynq.Retention(time.Duration(config.PropConfig.TaskQueue.Retention))); err != nil {
+		log.Printf("Failed to reschedule task for record %d: %v", p.RecordID, err)
+		return err
+	}
+	return nil
+}
+
 func ptrTime(t time.Time) *time.Time {
 	return &t
 }
 
-func (w *DigitizationWorker) failTask(ctx context.Context, queueName string, processID uuid.UUID, recordID uint64, msg string, retryCount int) error {
-	log.Printf("Digitization failed: recordId=%d queue Name := %s : retrying count := %d : record status := %s : error=%s", recordID, queueName, retryCount, constant.StatusFailed, msg)
-	_ = w.logAndUpdateStatus(ctx, recordID, queueName, constant.StatusFailed, 0, &msg, retryCount)
+// failTask marks the record failed and tells asynq whether to retry. Permanent errors, and all
+// errors when retries are disabled, skip the remaining retries; otherwise NextRetryAt is set to
+// when the retry policy will run the task again.
+func (w *DigitizationWorker) failTask(ctx context.Context, t *asynq.Task, p models.DigitizationPayload, queueName string, cause error, retryCount int) error {
+	msg := cause.Error()
+	errorClass := service.ClassifyTaskError(cause)
+	log.Printf("Digitization failed: recordId=%d queue Name := %s : retrying count := %d : record status := %s : error class := %s : error=%s", p.RecordID, queueName, retryCount, constant.StatusFailed, errorClass, msg)
+	_ = w.logAndUpdateStatus(ctx, p.RecordID, queueName, constant.StatusFailed, 0, &msg, retryCount)
 	err := fmt.Errorf("digitization failed: %s queue Name := %s", msg, queueName)
-	w.processStatusService.LogStepAndFail(processID, string(constant.DocsDigitization), constant.Failure, string(constant.DigitizationFailed), err.Error(), nil, &recordID, nil)
+	w.processStatusService.LogStepAndFail(p.ProcessID, string(constant.DocsDigitization), constant.Failure, string(constant.DigitizationFailed), err.Error(), nil, &p.RecordID, nil)
+
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	skipRetry := errorClass == constant.ErrorClassPermanent || !config.PropConfig.Retry.Enabled
+	exhausted := skipRetry || retryCount >= maxRetry
+	var nextRetryAt *time.Time
+	if !exhausted {
+		nextRetryAt = ptrTime(time.Now().Add(w.retryPolicy.Delay(retryCount, t)))
+	}
+	if updateErr := w.recordRepo.SetRecordNextRetryAt(p.RecordID, nextRetryAt); updateErr != nil {
+		log.Printf("Failed to set next retry of record %d: %v", p.RecordID, updateErr)
+	}
+
+	recordID, patientID := p.RecordID, p.UserID
+	w.recordDeadLetter(models.DigitizationDeadLetter{
+		TaskType:     constant.TaskDigitizeRecord,
+		TaskKey:      strconv.FormatUint(p.RecordID, 10),
+		QueueName:    queueName,
+		RecordId:     &recordID,
+		PatientId:    &patientID,
+		ProcessId:    p.ProcessID.String(),
+		Payload:      t.Payload(),
+		ErrorMessage: msg,
+	}, []models.DeadLetterAttempt{{Attempt: retryCount + 1, Error: msg, Class: errorClass, FailedAt: time.Now()}}, exhausted)
+	if skipRetry {
+		return fmt.Errorf("%w: %w", asynq.SkipRetry, err)
+	}
 	return err
 }
 
+// recordDeadLetter keeps a failed task in the dead-letter store. Failing to store it must not
+// change the outcome of the task, so the error is only logged.
+func (w *DigitizationWorker) recordDeadLetter(failure models.DigitizationDeadLetter, attempts []models.DeadLetterAttempt, exhausted bool) {
+	if err := w.deadLetterService.RecordFailure(failure, attempts, exhausted); err != nil {
+		log.Printf("Failed to dead-letter %s task %s: %v", failure.TaskType, failure.TaskKey, err)
+	}
+}
+
 func (w *DigitizationWorker) handleTestReport(fileBuf *bytes.Buffer, p models.DigitizationPayload) error {
 	step := string(constant.CallAIService)
 	errorMsg := ""
@@ -529,14 +792,32 @@ func (w *DigitizationWorker) HandleDocTypeCheckTask(ctx context.Context, t *asyn
 	}
 	var docTypeResp *models.DocTypeAPIResponse
 	var err error
+	var attempts []models.DeadLetterAttempt
 	for attempt := 1; attempt <= 3; attempt++ {
 		docTypeResp, err = w.apiService.CallDocumentTypeAPI(bytes.NewReader(payload.FileBytes), payload.FileName)
 		if err == nil {
 			break
 		}
 		log.Printf("[Attempt %d] Doc type API failed for record %s: %v : %v", attempt, payload.AttachmentID, err, docTypeResp)
+		errorClass := service.ClassifyTaskError(err)
+		attempts = append(attempts, models.DeadLetterAttempt{Attempt: attempt, Error: err.Error(), Class: errorClass, FailedAt: time.Now()})
+		if errorClass == constant.ErrorClassPermanent {
+			break
+		}
 		time.Sleep(5 * time.Second)
 	}
+	// The check gives up after its own attempts, asynq does not retry it.
+	if err != nil {
+		w.recordDeadLetter(models.DigitizationDeadLetter{
+			TaskType:     constant.TaskCheckDocType,
+			TaskKey:      payload.AttachmentID,
+			ProcessId:    payload.ProcessID.String(),
+			Payload:      t.Payload(),
+			ErrorMessage: err.Error(),
+		}, attempts, true)
+	} else {
+		w.deadLetterService.ResolveTask(constant.TaskCheckDocType, payload.AttachmentID)
+	}
 
 	// log.Printf("Doc type API response for record %s: %+v", payload.AttachmentID, docTypeResp)
 	SendDocTypeResult(payload.AttachmentID, docTypeResp)